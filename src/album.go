@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// albumMetadataFileName is the file Takeout writes into every album folder. Unlike the
+// per-photo sidecars it describes the album itself.
+const albumMetadataFileName = "metadata.json"
+
+// yearFolderPattern matches the "Photos from 2020" folders, which are not albums.
+var yearFolderPattern = regexp.MustCompile(`^Photos from \d{4}$`)
+
+var (
+	organizeBy      string
+	albumAlsoByDate bool
+	albumDuplicates string
+	albumDirs       = make(map[string]string)
+	// flatFolder is the FLAT_FOLDER every file goes into with ORGANIZE_BY=none, "" for the
+	// remote base path itself.
+	flatFolder string
+
+	// albumStrategy is how album photos get into their albums: upload-both uploads them into
+	// the album folder, copy-remote uploads them into their date folder and copies them into
+	// the album folder on the server, and tag-only tags the date folder copy with the album.
+	albumStrategy = "upload-both"
+)
+
+// AlbumMetadata represents the album-level metadata.json in a Takeout album folder.
+type AlbumMetadata struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// addAlbumMetadataFile records the folder of an album metadata.json as an album.
+func addAlbumMetadataFile(metadataFile string) error {
+	albumDir := filepath.Dir(metadataFile)
+	if yearFolderPattern.MatchString(filepath.Base(albumDir)) {
+		return nil
+	}
+
+	byteValue, err := readMediaFile(metadataFile)
+	if err != nil {
+		return fmt.Errorf("failed to read album metadata %s: %v", metadataFile, err)
+	}
+
+	var album AlbumMetadata
+	if err := json.Unmarshal(byteValue, &album); err != nil {
+		return fmt.Errorf("failed to parse album metadata %s: %v", metadataFile, err)
+	}
+
+	title := album.Title
+	if title == "" {
+		title = filepath.Base(albumDir)
+	}
+	albumDirs[albumDir] = norm.NFC.String(title)
+	return nil
+}
+
+// albumFolders returns the remote folders of every album mediaPath belongs to: the album
+// folder it sits in and the albums of copies removed by deduplication.
+func albumFolders(index *MediaIndex, mediaPath string) []string {
+	var folders []string
+	for _, title := range albumTitles(index, mediaPath) {
+		folders = append(folders, "Albums/"+remoteFolderName(title))
+	}
+	return folders
+}
+
+// albumTitles returns the sorted titles of every album mediaPath belongs to.
+func albumTitles(index *MediaIndex, mediaPath string) []string {
+	var titles []string
+	if title, ok := albumDirs[filepath.Dir(mediaPath)]; ok {
+		titles = append(titles, title)
+	}
+	titles = append(titles, index.Albums(mediaPath)...)
+	sort.Strings(titles)
+	return slices.Compact(titles)
+}
+
+// planUploads turns index into upload jobs according to ORGANIZE_BY. In album mode photos
+// inside an album folder go to Albums/{AlbumName}, and also to their date folder when
+// ALBUM_ALSO_BY_DATE is set. Everything else keeps its date folder. With none every file
+// goes into FLAT_FOLDER.
+//
+// Takeout stores a separate copy of a photo in every album it belongs to. With
+// ALBUM_DUPLICATES=copy each album gets its copy; with first only the album that sorts
+// first keeps it. Copies are recognized by file name and size.
+func planUploads(index *MediaIndex) []MediaFile {
+	paths := index.Paths()
+
+	// Date folders are laid out by FOLDER_TEMPLATE. Files from an included Trash or Archive
+	// folder keep their date folder below Trash/ or Archive/, and ROUTE_RULES put that below
+	// the prefix of the file's type
+	dateFolder := func(photoPath string) string {
+		folder, _ := index.Get(photoPath)
+		return routeFolder(photoPath, specialDirPrefix(photoPath)+applyFolderTemplate(folder))
+	}
+
+	var jobs []MediaFile
+	if organizeBy == "none" {
+		for _, photoPath := range paths {
+			folder := routeFolder(photoPath, strings.TrimSuffix(specialDirPrefix(photoPath)+flatFolder, "/"))
+			jobs = append(jobs, MediaFile{photoPath, folder, index.Size(photoPath)})
+		}
+		return jobs
+	}
+	if organizeBy != "album" {
+		for _, photoPath := range paths {
+			jobs = append(jobs, MediaFile{photoPath, dateFolder(photoPath), index.Size(photoPath)})
+		}
+		return jobs
+	}
+
+	type albumCopy struct {
+		name string
+		size int64
+	}
+	seenInAlbum := make(map[albumCopy]bool)
+
+	for _, photoPath := range paths {
+		folders := albumFolders(index, photoPath)
+		if len(folders) == 0 {
+			jobs = append(jobs, MediaFile{photoPath, dateFolder(photoPath), index.Size(photoPath)})
+			continue
+		}
+
+		if albumDuplicates == "first" {
+			key := albumCopy{name: filepath.Base(photoPath)}
+			if info, err := statMedia(photoPath); err == nil {
+				key.size = info.Size()
+			}
+			if seenInAlbum[key] {
+				continue
+			}
+			seenInAlbum[key] = true
+			folders = folders[:1]
+		}
+
+		// Both strategies upload the photo once, into its date folder
+		switch albumStrategy {
+		case "copy-remote":
+			jobs = append(jobs, MediaFile{photoPath, dateFolder(photoPath), index.Size(photoPath)})
+			index.SetAlbumCopies(photoPath, folders)
+			continue
+		case "tag-only":
+			jobs = append(jobs, MediaFile{photoPath, dateFolder(photoPath), index.Size(photoPath)})
+			index.SetAlbumTags(photoPath, albumTitles(index, photoPath)[:len(folders)])
+			continue
+		}
+
+		for _, folder := range folders {
+			jobs = append(jobs, MediaFile{photoPath, folder, index.Size(photoPath)})
+		}
+		if albumAlsoByDate {
+			jobs = append(jobs, MediaFile{photoPath, dateFolder(photoPath), index.Size(photoPath)})
+		}
+	}
+
+	return jobs
+}
+
+// placeInAlbums copies or tags the file uploaded from media to remotePath into the albums
+// recorded in index by planUploads. Nothing is done for the upload-both strategy.
+func placeInAlbums(ctx context.Context, backend UploadBackend, index *MediaIndex, media MediaFile, remotePath string) error {
+	for _, folder := range index.AlbumCopies(media.Path) {
+		copier, ok := backend.(remoteCopier)
+		if !ok {
+			return fmt.Errorf("the upload backend can't copy files")
+		}
+		target := destinationPath(folder, path.Base(remotePath))
+		if err := copier.Copy(ctx, remotePath, target); err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %w", remotePath, target, err)
+		}
+		slog.Debug("Copied file into album", "file", remotePath, "album", folder)
+	}
+
+	for _, title := range index.AlbumTags(media.Path) {
+		tagger, ok := backend.(fileTagger)
+		if !ok {
+			return fmt.Errorf("the upload backend can't tag files")
+		}
+		if err := tagger.Tag(ctx, remotePath, title); err != nil {
+			return fmt.Errorf("failed to tag %s with %q: %w", remotePath, title, err)
+		}
+		slog.Debug("Tagged file with album", "file", remotePath, "album", title)
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveEntry is a file inside a PHOTOS_ARCHIVE archive.
+type archiveEntry interface {
+	Open() (io.ReadCloser, error)
+	FileInfo() fs.FileInfo
+}
+
+// archiveEntries maps the virtual path of every file in the PHOTOS_ARCHIVE archives to its
+// entry. The archives are merged into one tree below the archive path, because Takeout
+// splits an export across several archives and a sidecar may be in a different archive
+// than its media file.
+var archiveEntries = make(map[string]archiveEntry)
+
+// archiveFormat returns the format of the archive at path by its extension: zip, tar or
+// tar.gz, or "" for anything else.
+func archiveFormat(path string) string {
+	name := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tgz"), strings.HasSuffix(name, ".tar.gz"):
+		return "tar.gz"
+	default:
+		return ""
+	}
+}
+
+// openArchives indexes the archive at path, or every archive directly in the directory at
+// path, and returns the virtual root their entries are placed below and a function closing
+// the archives.
+func openArchives(path string) (string, func(), error) {
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return "", nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", nil, err
+	}
+
+	archives := []string{root}
+	if info.IsDir() {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return "", nil, err
+		}
+		archives = nil
+		for _, entry := range entries {
+			if !entry.IsDir() && archiveFormat(entry.Name()) != "" {
+				archives = append(archives, filepath.Join(root, entry.Name()))
+			}
+		}
+		if len(archives) == 0 {
+			return "", nil, fmt.Errorf("no .zip, .tgz or .tar archives found in %s", root)
+		}
+	} else if archiveFormat(root) == "" {
+		return "", nil, fmt.Errorf("unsupported archive %s, only .zip, .tgz and .tar archives can be read without extracting", root)
+	}
+
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	for _, archive := range archives {
+		var closer io.Closer
+		var count int
+		if archiveFormat(archive) == "zip" {
+			closer, count, err = openZipArchive(root, archive)
+		} else {
+			closer, count, err = openTarArchive(root, archive)
+		}
+		if err != nil {
+			closeAll()
+			return "", nil, fmt.Errorf("failed to open archive %s: %v", archive, err)
+		}
+		closers = append(closers, closer)
+		slog.Info("Opened archive", "archive", archive, "entries", count)
+	}
+
+	return root, closeAll, nil
+}
+
+// openZipArchive adds the files in the zip archive to archiveEntries below root, and
+// returns the open zip and its number of entries.
+func openZipArchive(root, archive string) (io.Closer, int, error) {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, entry := range r.File {
+		if !entry.FileInfo().IsDir() {
+			addArchiveEntry(root, archive, entry.Name, entry)
+		}
+	}
+	return r, len(r.File), nil
+}
+
+// openTarArchive adds the files in the tar archive, compressed with gzip if it is a .tgz,
+// to archiveEntries below root, and returns the open archive and its number of files.
+// Entries are read at their position in the archive, so a compressed archive is
+// decompressed into a temporary file first, as gzip can only be read from the start.
+func openTarArchive(root, archive string) (io.Closer, int, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, 0, err
+	}
+	var closer io.Closer = file
+	if archiveFormat(archive) == "tar.gz" {
+		slog.Info("Decompressing archive into a temporary file", "archive", archive, "dir", os.TempDir())
+		decompressed, err := decompressArchive(file)
+		file.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		file, closer = decompressed, tempArchive{decompressed}
+	}
+
+	count := 0
+	r := tar.NewReader(file)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			closer.Close()
+			return nil, 0, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// The reader stops right before the entry's data
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			closer.Close()
+			return nil, 0, err
+		}
+		addArchiveEntry(root, archive, header.Name, tarEntry{archive: file, offset: offset, header: header})
+		count++
+	}
+	return closer, count, nil
+}
+
+// decompressArchive writes the gzip stream of archive into a temporary file and returns it.
+func decompressArchive(archive *os.File) (*os.File, error) {
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tmp, err := os.CreateTemp("", "media2nextcloud-archive-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	// Where open files can be removed this leaves nothing behind when the run exits early,
+	// elsewhere tempArchive removes it on close
+	_ = os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, gz); err != nil {
+		tempArchive{tmp}.Close()
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tempArchive{tmp}.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// tempArchive is a decompressed archive that is removed once it is closed.
+type tempArchive struct {
+	*os.File
+}
+
+func (a tempArchive) Close() error {
+	err := a.File.Close()
+	os.Remove(a.Name())
+	return err
+}
+
+// tarEntry is a file inside an uncompressed tar archive, read from its position in it.
+type tarEntry struct {
+	archive *os.File
+	offset  int64
+	header  *tar.Header
+}
+
+func (e tarEntry) Open() (io.ReadCloser, error) {
+	return io.NopCloser(io.NewSectionReader(e.archive, e.offset, e.header.Size)), nil
+}
+
+func (e tarEntry) FileInfo() fs.FileInfo {
+	return e.header.FileInfo()
+}
+
+// addArchiveEntry adds the entry called name in archive to archiveEntries below root. An
+// absolute name or one with ".." parts would end up outside of root, so it is skipped.
+func addArchiveEntry(root, archive, name string, entry archiveEntry) {
+	if !isLocalArchiveName(name) {
+		slog.Warn("Skipping archive entry with a path outside the archive", "file", name, "archive", archive)
+		return
+	}
+	virtualPath := filepath.Join(root, filepath.FromSlash(name))
+	if _, exists := archiveEntries[virtualPath]; exists {
+		slog.Debug("File is in several archives, using the last one", "file", name, "archive", archive)
+	}
+	archiveEntries[virtualPath] = entry
+}
+
+// isLocalArchiveName reports whether the entry name stays below the archive root: it is
+// relative and none of its parts, separated by slashes or backslashes, is "..".
+func isLocalArchiveName(name string) bool {
+	native := filepath.FromSlash(name)
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) || filepath.IsAbs(native) || filepath.VolumeName(native) != "" {
+		return false
+	}
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// archiveDirInfo describes a directory that only exists implied by the paths of archive entries.
+type archiveDirInfo string
+
+func (d archiveDirInfo) Name() string       { return filepath.Base(string(d)) }
+func (d archiveDirInfo) Size() int64        { return 0 }
+func (d archiveDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o755 }
+func (d archiveDirInfo) ModTime() time.Time { return time.Time{} }
+func (d archiveDirInfo) IsDir() bool        { return true }
+func (d archiveDirInfo) Sys() any           { return nil }
+
+// walkArchive calls fn for every archive entry below root and the directories they imply,
+// parents before their contents, like filepath.Walk does for a directory.
+func walkArchive(root string, fn filepath.WalkFunc) error {
+	paths := make([]string, 0, len(archiveEntries))
+	for path := range archiveEntries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	visited := map[string]bool{root: true}
+	var skipped []string
+	if err := fn(root, archiveDirInfo(root), nil); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if isBelowAny(path, skipped) {
+			continue
+		}
+
+		// Visit the directories leading to path that haven't been seen yet, outermost first
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		dir := root
+		skip := false
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			if part == "." {
+				continue
+			}
+			dir = filepath.Join(dir, part)
+			if visited[dir] {
+				continue
+			}
+			visited[dir] = true
+			if err := fn(dir, archiveDirInfo(dir), nil); err == filepath.SkipDir {
+				skipped = append(skipped, dir)
+				skip = true
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		if skip {
+			continue
+		}
+
+		if err := fn(path, archiveEntries[path].FileInfo(), nil); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+// isBelowAny reports whether path is inside one of dirs.
+func isBelowAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isArchiveEntry reports whether path is a file inside a PHOTOS_ARCHIVE archive.
+func isArchiveEntry(path string) bool {
+	_, ok := archiveEntries[path]
+	return ok
+}
+
+// openMedia opens a local file or a file inside a PHOTOS_ARCHIVE archive for reading.
+func openMedia(path string) (io.ReadCloser, error) {
+	if entry, ok := archiveEntries[path]; ok {
+		return entry.Open()
+	}
+	return os.Open(path)
+}
+
+// statMedia returns the file info of a local file or a file inside a PHOTOS_ARCHIVE archive.
+func statMedia(path string) (fs.FileInfo, error) {
+	if entry, ok := archiveEntries[path]; ok {
+		return entry.FileInfo(), nil
+	}
+	return os.Stat(path)
+}
+
+// readMediaFile reads a local file or a file inside a PHOTOS_ARCHIVE archive.
+func readMediaFile(path string) ([]byte, error) {
+	if _, ok := archiveEntries[path]; !ok {
+		return os.ReadFile(path)
+	}
+	r, err := openMedia(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// archiveFiles are the entries of the test archives: a sidecar, its photo and entries
+// trying to escape the archive root.
+var archiveFiles = []struct{ name, content string }{
+	{"Takeout/Google Photos/2022/IMG_0001.jpg.json", `{"title": "IMG_0001.jpg"}`},
+	{"Takeout/Google Photos/2022/IMG_0001.jpg", "jpeg data"},
+	{"../outside.jpg", "escaped"},
+	{"Takeout/../../outside.jpg", "escaped"},
+	{"/etc/outside.jpg", "escaped"},
+	{`..\outside.jpg`, "escaped"},
+}
+
+func writeZipArchive(t *testing.T, path string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, f := range archiveFiles {
+		entry, err := w.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := entry.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, buf.String())
+}
+
+func writeTarArchive(t *testing.T, path string, gzipped bool) {
+	t.Helper()
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	var gz *gzip.Writer
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		out = gz
+	}
+	w := tar.NewWriter(out)
+	if err := w.WriteHeader(&tar.Header{Name: "Takeout/Google Photos/2022/", Typeflag: tar.TypeDir, Mode: 0o755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range archiveFiles {
+		if err := w.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(f.content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, path, buf.String())
+}
+
+func TestOpenArchives(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		write func(t *testing.T, path string)
+	}{
+		{"takeout.zip", writeZipArchive},
+		{"takeout.tgz", func(t *testing.T, path string) { writeTarArchive(t, path, true) }},
+		{"takeout.tar.gz", func(t *testing.T, path string) { writeTarArchive(t, path, true) }},
+		{"takeout.tar", func(t *testing.T, path string) { writeTarArchive(t, path, false) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			archiveEntries = make(map[string]archiveEntry)
+			t.Cleanup(func() { archiveEntries = make(map[string]archiveEntry) })
+
+			archive := filepath.Join(t.TempDir(), tt.name)
+			tt.write(t, archive)
+			root, closeArchives, err := openArchives(archive)
+			if err != nil {
+				t.Fatalf("openArchives() error = %v", err)
+			}
+			defer closeArchives()
+
+			if len(archiveEntries) != 2 {
+				t.Errorf("openArchives() indexed %d entries, want the 2 inside the archive: %v", len(archiveEntries), archiveEntries)
+			}
+			for virtualPath := range archiveEntries {
+				if !isBelowAny(virtualPath, []string{root}) {
+					t.Errorf("entry %s is outside of the archive root %s", virtualPath, root)
+				}
+			}
+
+			photo := filepath.Join(root, "Takeout", "Google Photos", "2022", "IMG_0001.jpg")
+			data, err := readMediaFile(photo)
+			if err != nil || string(data) != "jpeg data" {
+				t.Errorf("readMediaFile() = %q, %v, want the photo", data, err)
+			}
+			if info, err := statMedia(photo); err != nil || info.Size() != int64(len("jpeg data")) || info.Name() != "IMG_0001.jpg" {
+				t.Errorf("statMedia() = %v, %v, want the photo's info", info, err)
+			}
+		})
+	}
+}
+
+func TestIsLocalArchiveName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"Takeout/Google Photos/IMG_0001.jpg": true,
+		"./Takeout/IMG_0001.jpg":             true,
+		"Takeout/..photo.jpg":                true,
+		"":                                   false,
+		"/Takeout/IMG_0001.jpg":              false,
+		`\Takeout\IMG_0001.jpg`:              false,
+		"../IMG_0001.jpg":                    false,
+		"Takeout/../IMG_0001.jpg":            false,
+		`Takeout\..\..\IMG_0001.jpg`:         false,
+	} {
+		if got := isLocalArchiveName(name); got != want {
+			t.Errorf("isLocalArchiveName(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
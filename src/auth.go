@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Authenticator adds credentials to every request sent to Nextcloud.
+type Authenticator interface {
+	Authenticate(req *http.Request)
+}
+
+// basicAuth authenticates with a username and password (or app password).
+type basicAuth struct {
+	username, password string
+}
+
+func (a basicAuth) Authenticate(req *http.Request) {
+	req.SetBasicAuth(a.username, a.password)
+}
+
+// bearerAuth authenticates with an OIDC/OAuth bearer token.
+type bearerAuth struct {
+	token string
+}
+
+func (a bearerAuth) Authenticate(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+}
+
+// newAuthenticator builds the Authenticator selected by NEXTCLOUD_AUTH_MODE.
+func newAuthenticator(mode, username, password, token string) (Authenticator, error) {
+	switch strings.ToLower(mode) {
+	case "", "basic":
+		if username == "" || password == "" {
+			return nil, fmt.Errorf("basic auth requires NEXTCLOUD_USER and NEXTCLOUD_PASSWORD")
+		}
+		return basicAuth{username: username, password: password}, nil
+	case "bearer":
+		if token == "" {
+			return nil, fmt.Errorf("bearer auth requires NEXTCLOUD_TOKEN")
+		}
+		return bearerAuth{token: token}, nil
+	default:
+		return nil, fmt.Errorf("invalid NEXTCLOUD_AUTH_MODE %q: must be basic or bearer", mode)
+	}
+}
+
+// readPassword returns the password read from stdin when fromStdin is set, else the one in
+// file if that is set, else value, the plain NEXTCLOUD_PASSWORD.
+func readPassword(fromStdin bool, file, value string) (string, error) {
+	var password string
+	switch {
+	case fromStdin && file != "":
+		return "", errors.New("NEXTCLOUD_PASSWORD_STDIN and NEXTCLOUD_PASSWORD_FILE can't both be set")
+	case fromStdin:
+		line, err := stdinReader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("failed to read password from stdin: %v", err)
+		}
+		password = line
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file: %v", err)
+		}
+		// Only the first line, so files written by echo or an editor work as well
+		password, _, _ = strings.Cut(string(data), "\n")
+	default:
+		return value, nil
+	}
+
+	password = strings.TrimSuffix(strings.TrimSuffix(password, "\n"), "\r")
+	if password == "" {
+		return "", errors.New("password read is empty")
+	}
+	return password, nil
+}
+
+// stripURLCredentials removes a user and password embedded in rawURL, so they are not
+// logged with every URL derived from it, and returns them separately.
+func stripURLCredentials(rawURL string) (string, *url.Userinfo) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL, nil
+	}
+	user := u.User
+	u.User = nil
+	return u.String(), user
+}
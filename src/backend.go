@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadBackend is the destination media files are uploaded to. Paths are relative to the
+// backend's root and separated by forward slashes.
+type UploadBackend interface {
+	// EnsureDir creates dir, and any missing parents, unless it already exists.
+	EnsureDir(ctx context.Context, dir string) error
+	// Upload stores the content of r at path, replacing any existing file.
+	Upload(ctx context.Context, path string, r io.Reader, opts UploadOptions) error
+	// Exists reports whether a file or directory exists at path.
+	Exists(ctx context.Context, path string) (bool, error)
+	// Size returns the size of the file at path.
+	Size(ctx context.Context, path string) (int64, error)
+}
+
+// remoteCopier is implemented by backends that can copy a file without uploading it again.
+type remoteCopier interface {
+	// Copy copies the file at src to dst, both relative to the backend's root.
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// partialUploader is implemented by backends that can append to a partially uploaded file.
+type partialUploader interface {
+	// PartialSize returns how many bytes of a size-byte upload to path already arrived, or 0
+	// if the upload has to start over.
+	PartialSize(ctx context.Context, path string, size int64) int64
+}
+
+// dirPruner is implemented by backends that can delete the directories they created.
+type dirPruner interface {
+	// PruneEmptyDirs deletes the directories EnsureDir created in this run that are still
+	// empty and returns how many it deleted.
+	PruneEmptyDirs(ctx context.Context) (int, error)
+}
+
+// dirLister is implemented by backends that can list a directory in a single request.
+type dirLister interface {
+	// ListDir returns the size of every file in dir by name.
+	ListDir(ctx context.Context, dir string) (map[string]int64, error)
+}
+
+// fileTagger is implemented by backends that can attach a named tag to a file.
+type fileTagger interface {
+	Tag(ctx context.Context, path, tag string) error
+}
+
+// modTimeSetter is implemented by backends that can read and change the modification time
+// of a stored file.
+type modTimeSetter interface {
+	// ModTime returns the modification time of the file at path, and false if there is none.
+	ModTime(ctx context.Context, path string) (time.Time, bool, error)
+	// SetModTime changes the modification time of the file at path.
+	SetModTime(ctx context.Context, path string, modTime time.Time) error
+}
+
+// UploadOptions describes the local file passed to UploadBackend.Upload.
+type UploadOptions struct {
+	Size    int64
+	ModTime time.Time
+	// Source is the path of the local file, which identifies resumable uploads.
+	Source string
+	// Offset is the number of bytes the server already has. The reader starts after them
+	// and the rest is sent as a Content-Range PUT.
+	Offset int64
+	// Taken is the sidecar timestamp the file was dated by, zero if it wasn't.
+	Taken time.Time
+	// Checksum is the hex SHA-256 of the file computed while indexing, empty if it wasn't.
+	Checksum string
+}
+
+// uploadStatusError is returned by a backend whose server rejected an upload.
+type uploadStatusError struct {
+	Code   int
+	Status string
+}
+
+// errChecksumMismatch is returned when Nextcloud stored different bytes than the
+// OC-Checksum header announced, i.e. the upload got corrupted on the way.
+var errChecksumMismatch = errors.New("server reported a checksum mismatch")
+
+// sabreError is the body of an error response from Sabre, the WebDAV server Nextcloud is
+// built on.
+type sabreError struct {
+	Exception string `xml:"http://sabredav.org/ns exception"`
+	Message   string `xml:"http://sabredav.org/ns message"`
+}
+
+// isChecksumError reports whether body is a Sabre error about the uploaded bytes not
+// matching the OC-Checksum header.
+func isChecksumError(body io.Reader) bool {
+	var sabre sabreError
+	if err := xml.NewDecoder(io.LimitReader(body, 64<<10)).Decode(&sabre); err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(sabre.Message), "checksum")
+}
+
+func (e *uploadStatusError) Error() string {
+	return fmt.Sprintf("server returned %s", e.Status)
+}
+
+// newUploadBackend returns the backend selected by BACKEND, rooted at basePath below its
+// destination. basePath is created if it is missing.
+func newUploadBackend(ctx context.Context, name, nextcloudURL string, auth Authenticator, localDir, basePath string) (UploadBackend, error) {
+	switch name {
+	case "nextcloud", "webdav":
+		nextcloud := name == "nextcloud"
+		if basePath != "" {
+			if err := newWebDAVBackend(nextcloudURL, auth, nextcloud).EnsureDir(ctx, basePath); err != nil {
+				return nil, err
+			}
+		}
+		backend := newWebDAVBackend(remoteURL(nextcloudURL, basePath), auth, nextcloud)
+		if nextcloud {
+			backend.davRoot, _ = nextcloudDAVRoot(nextcloudURL)
+		}
+		if nextcloud && bulkUpload && backend.davRoot != "" {
+			backend.bulkURL = remoteURL(backend.davRoot, "bulk")
+			backend.homePath = nextcloudHomePath(backend.baseURL)
+		}
+		if nextcloud && chunkSize > 0 {
+			if backend.uploadsURL = uploadsURLFor(nextcloudURL); backend.uploadsURL == "" {
+				slog.Warn("Chunked uploads need a NEXTCLOUD_URL ending in /remote.php/dav/files/<username>, uploading without chunks")
+			} else {
+				backend.cleanupUploadSessions(ctx)
+			}
+		}
+		return backend, nil
+	case "immich":
+		// Immich has no folders to put basePath into
+		return newImmichBackend(immichURL, immichAPIKey), nil
+	case "local":
+		root := filepath.Join(localDir, filepath.FromSlash(basePath))
+		if err := os.MkdirAll(root, 0o755); err != nil {
+			return nil, err
+		}
+		return localBackend{root: root}, nil
+	default:
+		return nil, fmt.Errorf("unknown BACKEND %q, must be nextcloud, webdav, immich or local", name)
+	}
+}
+
+// disableCompression is DISABLE_COMPRESSION: no response is asked for compressed, and
+// uploads tell the server and proxies in between to leave their body as is. Photos and
+// videos are compressed already, so compressing them again only costs CPU, and proxies that
+// compress or decompress request bodies on the way have corrupted uploads.
+var disableCompression = true
+
+// setIdentityEncoding marks the body of the upload req as not to be compressed, unless
+// DISABLE_COMPRESSION is off.
+func setIdentityEncoding(req *http.Request) {
+	if disableCompression {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+}
+
+// httpProxy is the NEXTCLOUD_PROXY URL. When nil, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables are used.
+var httpProxy *url.URL
+
+// insecureSkipVerify is INSECURE_SKIP_VERIFY: the server's certificate is accepted without
+// verifying it, for servers with a self-signed certificate.
+var insecureSkipVerify bool
+
+// newHTTPTransport returns the transport used for every request to the server.
+func newHTTPTransport() *http.Transport {
+	proxy := http.ProxyFromEnvironment
+	if httpProxy != nil {
+		proxy = http.ProxyURL(httpProxy)
+	}
+	return &http.Transport{
+		Proxy:              proxy,
+		TLSClientConfig:    &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+		DisableCompression: disableCompression,
+	}
+}
+
+// defaultWebDAVPath is the default WEBDAV_PATH, Nextcloud's WebDAV endpoint of a user's files.
+const defaultWebDAVPath = "/remote.php/dav/files/{user}/"
+
+// webUIPathMarkers start the path of pages of Nextcloud's web interface, whose URL is often
+// given instead of the WebDAV endpoint.
+var webUIPathMarkers = []string{"/index.php/", "/apps/"}
+
+// nextcloudEndpoint returns the WebDAV endpoint for a NEXTCLOUD_URL. A URL containing
+// "/remote.php/" is an endpoint already and returned as is. Any other URL is the address
+// Nextcloud is reached at, e.g. "https://cloud.example.com" or "https://example.com/nextcloud",
+// and pathTemplate, the WEBDAV_PATH, is appended with {user} replaced by user. A URL of the
+// web interface is cut down to that address with a warning.
+func nextcloudEndpoint(rawURL, pathTemplate, user string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute URL", rawURL)
+	}
+	if strings.Contains(u.Path, "/remote.php/") {
+		return rawURL, nil
+	}
+
+	for _, marker := range webUIPathMarkers {
+		if i := strings.Index(u.Path+"/", marker); i >= 0 {
+			slog.Warn("NEXTCLOUD_URL looks like a page of the web interface, using the WebDAV endpoint of the server instead", "url", rawURL)
+			u.Path = u.Path[:i]
+			break
+		}
+	}
+
+	if strings.Contains(pathTemplate, "{user}") {
+		if user == "" {
+			return "", errors.New("WEBDAV_PATH contains {user} but NEXTCLOUD_USER is not set")
+		}
+		if strings.ContainsAny(user, "/\\") {
+			return "", fmt.Errorf("invalid user %q", user)
+		}
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + strings.Trim(strings.ReplaceAll(pathTemplate, "{user}", user), "/")
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+// nextcloudDAVRoot splits a NEXTCLOUD_URL of the form ".../remote.php/dav/files/<username>"
+// into the ".../remote.php/dav" URL and the user name. It returns empty strings for URLs of
+// another form, such as the legacy ".../remote.php/webdav".
+func nextcloudDAVRoot(nextcloudURL string) (string, string) {
+	u, err := url.Parse(nextcloudURL)
+	if err != nil {
+		return "", ""
+	}
+	const filesSegment = "/remote.php/dav/files/"
+	i := strings.Index(u.Path, filesSegment)
+	if i < 0 {
+		return "", ""
+	}
+	user, _, _ := strings.Cut(u.Path[i+len(filesSegment):], "/")
+	if user == "" {
+		return "", ""
+	}
+	u.Path = u.Path[:i] + "/remote.php/dav"
+	u.RawPath = ""
+	return u.String(), user
+}
+
+// parseProxyURL parses a NEXTCLOUD_PROXY value such as "http://proxy.example.com:3128".
+func parseProxyURL(value string) (*url.URL, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		// The error repeats the value, which may hold the proxy's password
+		return nil, errors.New("proxy is not a valid URL")
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("proxy %q must be a URL like http://host:port", u.Redacted())
+	}
+	return u, nil
+}
+
+// webdavBackend uploads to a WebDAV folder. With nextcloud set it relies on Nextcloud's
+// extensions, otherwise it only assumes plain WebDAV, for ownCloud or a generic share.
+type webdavBackend struct {
+	baseURL   string
+	auth      Authenticator
+	client    *http.Client
+	nextcloud bool
+	// uploadsURL is Nextcloud's chunked upload endpoint, empty when files larger than
+	// CHUNK_SIZE are uploaded with a single PUT as well.
+	uploadsURL string
+	// davRoot is Nextcloud's ".../remote.php/dav" URL, empty when NEXTCLOUD_URL has another form.
+	davRoot string
+	// bulkURL is Nextcloud's bulk upload endpoint, set with BULK_UPLOAD. homePath is the
+	// backend's root below the user's home, which the endpoint addresses files by.
+	bulkURL  string
+	homePath string
+	tags     tagCache
+	// createdDirs are the directories EnsureDir created in this run, the only ones
+	// PRUNE_EMPTY may delete. knownDirs are all directories known to exist, which EnsureDir
+	// doesn't ask the server about again.
+	dirsMu      sync.Mutex
+	createdDirs []string
+	knownDirs   map[string]bool
+	// checksums are the SHA-256 of the local files uploaded by this backend that weren't
+	// hashed while indexing, so retries don't hash them again.
+	checksumsMu sync.Mutex
+	checksums   map[string]string
+}
+
+func newWebDAVBackend(baseURL string, auth Authenticator, nextcloud bool) *webdavBackend {
+	return &webdavBackend{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		auth:      auth,
+		client:    &http.Client{Transport: newHTTPTransport()},
+		nextcloud: nextcloud,
+		knownDirs: make(map[string]bool),
+		checksums: make(map[string]string),
+	}
+}
+
+func (b *webdavBackend) EnsureDir(ctx context.Context, dir string) error {
+	dir = strings.Trim(dir, "/")
+	b.dirsMu.Lock()
+	known := b.knownDirs[dir]
+	b.dirsMu.Unlock()
+	if known {
+		return nil
+	}
+
+	err := b.ensureDir(ctx, dir)
+	if err == nil {
+		b.dirsMu.Lock()
+		b.knownDirs[dir] = true
+		b.dirsMu.Unlock()
+	}
+	return err
+}
+
+func (b *webdavBackend) ensureDir(ctx context.Context, dir string) error {
+	created, err := createDirectoryIfNotExists(b.client, remoteURL(b.baseURL, dir), b.auth)
+	if created {
+		b.dirsMu.Lock()
+		b.createdDirs = append(b.createdDirs, dir)
+		b.dirsMu.Unlock()
+	}
+	if err == nil || b.nextcloud {
+		return err
+	}
+
+	// Servers differ in what MKCOL answers for an existing collection, so ask directly
+	if exists, existsErr := b.Exists(ctx, dir); existsErr == nil && exists {
+		return nil
+	}
+	return err
+}
+
+func (b *webdavBackend) Upload(ctx context.Context, path string, r io.Reader, opts UploadOptions) error {
+	if b.chunked(opts.Size) && opts.Source != "" {
+		return b.uploadChunked(ctx, path, r, opts)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", remoteURL(b.baseURL, path), r)
+	if err != nil {
+		return err
+	}
+	// Set explicitly since the length can't be inferred from a wrapped reader
+	req.ContentLength = opts.Size - opts.Offset
+	b.auth.Authenticate(req)
+	setIdentityEncoding(req)
+	if opts.Offset > 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", opts.Offset, opts.Size-1, opts.Size))
+	}
+	// Nextcloud keeps the local modification time instead of the upload time
+	if b.nextcloud && !opts.ModTime.IsZero() {
+		req.Header.Set("X-OC-Mtime", strconv.FormatInt(opts.ModTime.Unix(), 10))
+	}
+	// and verifies the stored file against a checksum of the whole file
+	checksummed := false
+	if b.nextcloud && opts.Source != "" && opts.Offset == 0 {
+		if sum, err := b.checksum(opts); err != nil {
+			slog.Debug("Failed to compute checksum, uploading without it", "file", opts.Source, "error", err)
+		} else {
+			req.Header.Set("OC-Checksum", "SHA256:"+sum)
+			checksummed = true
+		}
+	}
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusOK, http.StatusNoContent:
+		if fileID := resp.Header.Get("OC-FileId"); fileID != "" {
+			b.recordFileID(path, fileID)
+		}
+		return nil
+	case http.StatusBadRequest:
+		if checksummed && isChecksumError(resp.Body) {
+			return fmt.Errorf("%w for %s", errChecksumMismatch, path)
+		}
+		return &uploadStatusError{Code: resp.StatusCode, Status: resp.Status}
+	default:
+		return &uploadStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+}
+
+// checksum returns the hex SHA-256 of the file uploaded with opts: the one computed while
+// indexing, or else one this backend computed for an earlier attempt.
+func (b *webdavBackend) checksum(opts UploadOptions) (string, error) {
+	if opts.Checksum != "" {
+		return opts.Checksum, nil
+	}
+	b.checksumsMu.Lock()
+	sum, ok := b.checksums[opts.Source]
+	b.checksumsMu.Unlock()
+	if ok {
+		return sum, nil
+	}
+
+	sum, err := fileSHA256(opts.Source)
+	if err != nil {
+		return "", err
+	}
+	b.checksumsMu.Lock()
+	b.checksums[opts.Source] = sum
+	b.checksumsMu.Unlock()
+	return sum, nil
+}
+
+// chunked reports whether a file of size bytes is uploaded with Nextcloud's chunked upload.
+func (b *webdavBackend) chunked(size int64) bool {
+	return b.uploadsURL != "" && size > chunkSize
+}
+
+// PartialSize asks the server with HEAD how much of the file at path arrived. Only a server
+// announcing "Accept-Ranges: bytes" is trusted to append with a Content-Range PUT.
+func (b *webdavBackend) PartialSize(ctx context.Context, path string, size int64) int64 {
+	if b.chunked(size) {
+		// Chunked uploads resume on their own
+		return 0
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", remoteURL(b.baseURL, path), nil)
+	if err != nil {
+		return 0
+	}
+	b.auth.Authenticate(req)
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		slog.Debug("Failed to check partial upload", "path", path, "error", err)
+		return 0
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return 0
+	}
+	if resp.ContentLength <= 0 || resp.ContentLength >= size {
+		return 0
+	}
+	return resp.ContentLength
+}
+
+func (b *webdavBackend) Copy(ctx context.Context, src, dst string) error {
+	req, err := http.NewRequestWithContext(ctx, "COPY", remoteURL(b.baseURL, src), nil)
+	if err != nil {
+		return err
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Destination", remoteURL(b.baseURL, dst))
+	if onConflict != "overwrite" {
+		req.Header.Set("Overwrite", "F")
+	}
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent:
+		return nil
+	case http.StatusPreconditionFailed:
+		slog.Debug("Album copy exists, keeping it", "path", dst)
+		return nil
+	default:
+		return &uploadStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+}
+
+func (b *webdavBackend) Exists(ctx context.Context, path string) (bool, error) {
+	return remoteExists(ctx, b.client, remoteURL(b.baseURL, path), b.auth)
+}
+
+func (b *webdavBackend) Size(ctx context.Context, path string) (int64, error) {
+	return remoteFileSize(b.client, remoteURL(b.baseURL, path), b.auth)
+}
+
+// localBackend copies media files into a local directory, which is handy to try out a
+// configuration without a server.
+type localBackend struct {
+	root string
+}
+
+func (b localBackend) localPath(path string) string {
+	return filepath.Join(b.root, filepath.FromSlash(path))
+}
+
+func (b localBackend) EnsureDir(ctx context.Context, dir string) error {
+	return os.MkdirAll(b.localPath(dir), 0o755)
+}
+
+func (b localBackend) Upload(ctx context.Context, path string, r io.Reader, opts UploadOptions) error {
+	target := b.localPath(path)
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if !opts.ModTime.IsZero() {
+		return os.Chtimes(target, opts.ModTime, opts.ModTime)
+	}
+	return nil
+}
+
+// Copy hard links dst to src where the file system allows it, so the album copy takes no
+// extra space, and copies the file otherwise.
+func (b localBackend) Copy(ctx context.Context, src, dst string) error {
+	target := b.localPath(dst)
+	if _, err := os.Stat(target); err == nil {
+		if onConflict != "overwrite" {
+			return nil
+		}
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	if err := os.Link(b.localPath(src), target); err == nil {
+		return nil
+	}
+
+	source, err := os.Open(b.localPath(src))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	return b.Upload(ctx, dst, source, UploadOptions{Size: info.Size(), ModTime: info.ModTime()})
+}
+
+func (b localBackend) Exists(ctx context.Context, path string) (bool, error) {
+	_, err := os.Stat(b.localPath(path))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b localBackend) Size(ctx context.Context, path string) (int64, error) {
+	info, err := os.Stat(b.localPath(path))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+// errServerDown stops the run once MAX_CONSECUTIVE_FAILURES uploads failed in a row.
+var errServerDown = errors.New("server appears down")
+
+// failureBreaker aborts the run when too many uploads fail in a row, which means the
+// server is unreachable or broken rather than that some files are bad, so the remaining
+// files would only burn their retries. A nil *failureBreaker never trips.
+type failureBreaker struct {
+	mu          sync.Mutex
+	max         int
+	consecutive int
+	abort       context.CancelCauseFunc
+}
+
+var (
+	breaker *failureBreaker
+	// maxConsecutiveFailures is MAX_CONSECUTIVE_FAILURES, 0 disables the breaker.
+	maxConsecutiveFailures int
+)
+
+// newFailureBreaker returns a breaker calling abort after max consecutive failures, or nil
+// if max is 0.
+func newFailureBreaker(max int, abort context.CancelCauseFunc) *failureBreaker {
+	if max <= 0 {
+		return nil
+	}
+	return &failureBreaker{max: max, abort: abort}
+}
+
+// Success resets the count of consecutive failures.
+func (b *failureBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutive = 0
+}
+
+// Failure counts a failed upload and aborts the run once the limit is reached.
+func (b *failureBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutive++
+	if b.consecutive == b.max {
+		slog.Error("Uploads keep failing, the server appears down. Stopping the run, files uploaded so far are kept", "consecutiveFailures", b.consecutive)
+		b.abort(errServerDown)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// bulkBundleMaxFiles and bulkBundleMaxBytes bound a single bulk upload request.
+	bulkBundleMaxFiles = 100
+	bulkBundleMaxBytes = 50 << 20
+)
+
+var (
+	// bulkUpload is BULK_UPLOAD: send files up to bulkUploadMaxSize bytes in bundles through
+	// Nextcloud's bulk upload endpoint.
+	bulkUpload        bool
+	bulkUploadMaxSize int64
+
+	// bulkUploaded holds the result of every local file uploaded in a bundle, so
+	// uploadMediaFile doesn't upload it again.
+	bulkUploaded   = make(map[string]UploadResult)
+	bulkUploadedMu sync.Mutex
+)
+
+// errBulkUnsupported is returned by UploadBulk when the server has no bulk upload endpoint.
+var errBulkUnsupported = errors.New("server does not support bulk upload")
+
+// bulkFile is one file of a bulk upload.
+type bulkFile struct {
+	Media MediaFile
+	// Path is the remote path relative to the backend's root.
+	Path string
+}
+
+// bulkUploader is implemented by backends that can upload several small files in one request.
+type bulkUploader interface {
+	// UploadBulk uploads files together and returns the error of every file that failed,
+	// keyed by its path. It returns errBulkUnsupported if the server can't do bulk uploads.
+	UploadBulk(ctx context.Context, files []bulkFile) (map[string]error, error)
+}
+
+// nextcloudHomePath returns the path of the WebDAV files URL davURL below the user's home,
+// e.g. "/Photos" for ".../remote.php/dav/files/alice/Photos", which is how the bulk upload
+// endpoint addresses files.
+func nextcloudHomePath(davURL string) string {
+	u, err := url.Parse(davURL)
+	if err != nil {
+		return ""
+	}
+	const filesSegment = "/remote.php/dav/files/"
+	i := strings.Index(u.Path, filesSegment)
+	if i < 0 {
+		return ""
+	}
+	_, home, _ := strings.Cut(u.Path[i+len(filesSegment):], "/")
+	return "/" + strings.Trim(home, "/")
+}
+
+// bulkEligible reports whether media can be uploaded in a bundle: it is small and uploaded
+// as is, to a path decided without asking the server.
+func bulkEligible(media MediaFile) bool {
+	if media.Size <= 0 || media.Size > bulkUploadMaxSize || onConflict != "overwrite" || stripGeodata {
+		return false
+	}
+	converted := convertHEIC && heicConverter != nil && isHEIC(media.Path) && !isArchiveEntry(media.Path)
+	return !converted
+}
+
+// uploadBundles uploads the small files among mediaFiles in bundles of the same folder
+// before the regular upload. Files a bundle couldn't upload are left to the regular upload.
+func uploadBundles(ctx context.Context, parallel int, backend UploadBackend, mediaFiles []MediaFile, manifest *resumeManifest) {
+	uploader, ok := backend.(bulkUploader)
+	if !ok {
+		return
+	}
+
+	var bundles [][]bulkFile
+	open := make(map[string]int) // folder -> index of its bundle being filled
+	bundleBytes := make(map[int]int64)
+	for _, media := range mediaFiles {
+		if !bulkEligible(media) || manifest.Done(media) {
+			continue
+		}
+		i, found := open[media.Ts]
+		if !found || len(bundles[i]) >= bulkBundleMaxFiles || bundleBytes[i]+media.Size > bulkBundleMaxBytes {
+			i = len(bundles)
+			bundles = append(bundles, nil)
+			open[media.Ts] = i
+		}
+		bundles[i] = append(bundles[i], bulkFile{Media: media, Path: destinationPath(media.Ts, filepath.Base(media.Path))})
+		bundleBytes[i] += media.Size
+	}
+	if len(bundles) == 0 {
+		return
+	}
+	slog.Info("Uploading small files in bundles", "bundles", len(bundles))
+
+	jobs := make(chan []bulkFile, len(bundles))
+	for _, bundle := range bundles {
+		jobs <- bundle
+	}
+	close(jobs)
+
+	var unsupported sync.Once
+	var stop bool
+	var stopMu sync.Mutex
+	var wg sync.WaitGroup
+	for range parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for bundle := range jobs {
+				stopMu.Lock()
+				stopped := stop
+				stopMu.Unlock()
+				if stopped || ctx.Err() != nil {
+					continue
+				}
+
+				start := time.Now()
+				failed, err := uploader.UploadBulk(ctx, bundle)
+				if errors.Is(err, errBulkUnsupported) {
+					unsupported.Do(func() {
+						slog.Warn("The server doesn't support bulk uploads, uploading files one by one")
+					})
+					stopMu.Lock()
+					stop = true
+					stopMu.Unlock()
+					continue
+				}
+				if err != nil {
+					slog.Warn("Bulk upload failed, uploading its files one by one", "files", len(bundle), "error", err)
+					continue
+				}
+				recordBundle(bundle, failed, time.Since(start))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// recordBundle remembers the files of bundle that were uploaded, sharing the time the
+// request took between them.
+func recordBundle(bundle []bulkFile, failed map[string]error, elapsed time.Duration) {
+	bulkUploadedMu.Lock()
+	defer bulkUploadedMu.Unlock()
+	for _, file := range bundle {
+		if err, isFailed := failed[file.Path]; isFailed {
+			slog.Debug("File of bulk upload failed, uploading it alone", "file", file.Media.Path, "error", err)
+			continue
+		}
+		bulkUploaded[file.Media.Path] = UploadResult{
+			TargetPath: file.Path,
+			StatusCode: http.StatusOK,
+			Bytes:      file.Media.Size,
+			Attempts:   1,
+			Elapsed:    elapsed / time.Duration(len(bundle)),
+		}
+	}
+}
+
+// bulkUploadResult returns the result of localPath if it was uploaded in a bundle.
+func bulkUploadResult(localPath string) (UploadResult, bool) {
+	bulkUploadedMu.Lock()
+	defer bulkUploadedMu.Unlock()
+	result, found := bulkUploaded[localPath]
+	return result, found
+}
+
+// bulkResponse is the per-file outcome Nextcloud's bulk upload endpoint answers with, keyed
+// by the X-File-Path of each file.
+type bulkResponse map[string]struct {
+	Error   bool   `json:"error"`
+	Message string `json:"message"`
+}
+
+func (b *webdavBackend) UploadBulk(ctx context.Context, files []bulkFile) (map[string]error, error) {
+	if b.bulkURL == "" {
+		return nil, errBulkUnsupported
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	homePaths := make(map[string]string, len(files))
+	for _, file := range files {
+		data, err := readMediaFile(file.Media.Path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := statMedia(file.Media.Path)
+		if err != nil {
+			return nil, err
+		}
+		sum := md5.Sum(data)
+		homePath := path.Join(b.homePath, file.Path)
+		homePaths[homePath] = file.Path
+
+		header := textproto.MIMEHeader{}
+		header.Set("X-File-Path", homePath)
+		header.Set("X-File-MD5", hex.EncodeToString(sum[:]))
+		header.Set("X-File-Mtime", strconv.FormatInt(info.ModTime().Unix(), 10))
+		header.Set("Content-Length", strconv.Itoa(len(data)))
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader = &body
+	if uploadLimiter != nil {
+		reader = &throttledReader{ctx: ctx, r: reader, limiter: uploadLimiter}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", b.bulkURL, metrics.countBytes(reader))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(body.Len())
+	b.auth.Authenticate(req)
+	setIdentityEncoding(req)
+	req.Header.Set("Content-Type", "multipart/related; boundary="+writer.Boundary())
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusNotImplemented, http.StatusMethodNotAllowed:
+		return nil, errBulkUnsupported
+	default:
+		return nil, &uploadStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	var outcome bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&outcome); err != nil {
+		return nil, fmt.Errorf("failed to decode bulk upload response: %v", err)
+	}
+
+	// A file missing from the response counts as failed
+	failed := make(map[string]error)
+	for homePath, filePath := range homePaths {
+		result, found := outcome[homePath]
+		switch {
+		case !found:
+			failed[filePath] = errors.New("not in bulk upload response")
+		case result.Error:
+			failed[filePath] = errors.New(result.Message)
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newBulkTestBackend returns a WebDAV backend for server whose bulk upload endpoint is
+// answered by bulk, with BULK_UPLOAD on for the rest of the test.
+func newBulkTestBackend(t *testing.T, server *davServer, bulk func(w http.ResponseWriter, paths []string)) *webdavBackend {
+	t.Helper()
+	oldBulk, oldMaxSize := bulkUpload, bulkUploadMaxSize
+	bulkUpload, bulkUploadMaxSize = true, 1<<20
+	t.Cleanup(func() {
+		bulkUpload, bulkUploadMaxSize = oldBulk, oldMaxSize
+		bulkUploadedMu.Lock()
+		clear(bulkUploaded)
+		bulkUploadedMu.Unlock()
+	})
+
+	server.dirs["/2022"], server.dirs["/2022/03"], server.dirs["/2022/04"] = true, true, true
+	server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/bulk" {
+			return false
+		}
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			t.Errorf("bulk upload Content-Type: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return true
+		}
+		var paths []string
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("bulk upload body: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return true
+			}
+			paths = append(paths, part.Header.Get("X-File-Path"))
+		}
+		bulk(w, paths)
+		return true
+	}
+
+	backend := newTestWebDAVBackend(server)
+	backend.bulkURL = server.URL + "/bulk"
+	return backend
+}
+
+// bulkTestMediaFiles creates three small photos to upload into 2022/03.
+func bulkTestMediaFiles(t *testing.T) []MediaFile {
+	t.Helper()
+	dir := t.TempDir()
+	var mediaFiles []MediaFile
+	for _, name := range []string{"IMG_0001.jpg", "IMG_0002.jpg", "IMG_0003.jpg"} {
+		writeFile(t, filepath.Join(dir, name), "jpeg data")
+		mediaFiles = append(mediaFiles, MediaFile{Path: filepath.Join(dir, name), Ts: "2022/03", Size: 9})
+	}
+	return mediaFiles
+}
+
+// TestUploadBundlesPartialFailure checks that only the files the bulk upload response
+// reports as stored are taken as uploaded: a file with "error": true and one missing from
+// the response are uploaded again one by one.
+func TestUploadBundlesPartialFailure(t *testing.T) {
+	fastRetries(t)
+	server := newDAVServer(t)
+	backend := newBulkTestBackend(t, server, func(w http.ResponseWriter, paths []string) {
+		// IMG_0001.jpg is stored, IMG_0002.jpg failed and IMG_0003.jpg is left out
+		outcome := make(map[string]any)
+		for _, filePath := range paths {
+			switch path.Base(filePath) {
+			case "IMG_0001.jpg":
+				outcome[filePath] = map[string]any{"error": false, "etag": "abc"}
+			case "IMG_0002.jpg":
+				outcome[filePath] = map[string]any{"error": true, "message": "quota exceeded"}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(outcome)
+	})
+	mediaFiles := bulkTestMediaFiles(t)
+
+	uploadedBefore, failedBefore := successfullCounter.Load(), failedCounter.Load()
+	report := newRunReport(filepath.Join(t.TempDir(), "report.csv"))
+	if processed := uploadMediaFilesToNextcloud(context.Background(), 1, 1, backend, newMediaIndex(), nil, mediaFiles, nil, report); processed != 3 {
+		t.Errorf("uploadMediaFilesToNextcloud() processed %d files, want 3", processed)
+	}
+
+	if _, bundled := bulkUploadResult(mediaFiles[0].Path); !bundled {
+		t.Errorf("%s, stored by the bulk upload, isn't recorded as bundled", mediaFiles[0].Path)
+	}
+	for _, media := range mediaFiles[1:] {
+		if _, bundled := bulkUploadResult(media.Path); bundled {
+			t.Errorf("%s, failed in the bulk upload, is recorded as bundled", media.Path)
+		}
+	}
+	var puts []string
+	server.mu.Lock()
+	for _, request := range server.requests {
+		if putPath, ok := strings.CutPrefix(request, "PUT "); ok {
+			puts = append(puts, putPath)
+		}
+	}
+	server.mu.Unlock()
+	slices.Sort(puts)
+	if want := []string{"/2022/03/IMG_0002.jpg", "/2022/03/IMG_0003.jpg"}; !slices.Equal(puts, want) {
+		t.Errorf("PUT %q, want only the files the bulk upload didn't store %q", puts, want)
+	}
+	if uploaded := successfullCounter.Load() - uploadedBefore; uploaded != 3 {
+		t.Errorf("uploaded counter grew by %d, want 3", uploaded)
+	}
+	if failed := failedCounter.Load() - failedBefore; failed != 0 {
+		t.Errorf("failed counter grew by %d, want 0", failed)
+	}
+}
+
+// TestUploadBundlesUnsupported checks every file is uploaded one by one when the server has
+// no bulk upload endpoint, without trying the bundles of other folders.
+func TestUploadBundlesUnsupported(t *testing.T) {
+	fastRetries(t)
+	for _, status := range []int{http.StatusNotFound, http.StatusNotImplemented} {
+		server := newDAVServer(t)
+		backend := newBulkTestBackend(t, server, func(w http.ResponseWriter, paths []string) {
+			w.WriteHeader(status)
+		})
+		mediaFiles := bulkTestMediaFiles(t)
+		mediaFiles[2].Ts = "2022/04"
+
+		report := newRunReport(filepath.Join(t.TempDir(), "report.csv"))
+		if processed := uploadMediaFilesToNextcloud(context.Background(), 1, 1, backend, newMediaIndex(), nil, mediaFiles, nil, report); processed != 3 {
+			t.Errorf("%d: uploadMediaFilesToNextcloud() processed %d files, want 3", status, processed)
+		}
+		if n := server.requestCount("POST"); n != 1 {
+			t.Errorf("%d: %d bulk upload requests, want 1", status, n)
+		}
+		for _, media := range mediaFiles {
+			if _, bundled := bulkUploadResult(media.Path); bundled {
+				t.Errorf("%d: %s is recorded as bundled", status, media.Path)
+			}
+			if _, ok := server.file("/" + media.Ts + "/" + filepath.Base(media.Path)); !ok {
+				t.Errorf("%d: %s wasn't uploaded one by one", status, media.Path)
+			}
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const propfindLastModifiedBody = `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:getlastmodified/>
+  </d:prop>
+</d:propfind>`
+
+// uploadSessionPrefix starts the name of every chunked upload session this tool creates, so
+// stale ones can be told apart from the sessions of other clients.
+const uploadSessionPrefix = "media2nextcloud-"
+
+// maxUploadChunks is the most chunks Nextcloud accepts for one upload.
+const maxUploadChunks = 10000
+
+var (
+	// chunkSize is the CHUNK_SIZE in bytes. Larger files are uploaded in chunks of this size,
+	// 0 uploads every file with a single PUT.
+	chunkSize int64
+	// chunkSessionMaxAge is how old an unfinished upload session may get before it is deleted.
+	chunkSessionMaxAge time.Duration
+)
+
+// uploadSession is an unfinished chunked upload recorded in STATE_FILE, so a later run can
+// continue it.
+type uploadSession struct {
+	ID      string    `json:"id"`
+	Target  string    `json:"target"`
+	Created time.Time `json:"created"`
+}
+
+// uploadSessionKey identifies the session of a local file by its path, content hash and chunk
+// size, so a file that changed since, or one uploaded with another CHUNK_SIZE, whose stored
+// chunks would be cut at other offsets, is uploaded from scratch.
+func uploadSessionKey(localPath, hash string, chunkSize int64) string {
+	return localPath + "|" + hash + "|" + strconv.FormatInt(chunkSize, 10)
+}
+
+// uploadsURLFor returns the Nextcloud chunked upload endpoint belonging to the WebDAV files
+// URL nextcloudURL, e.g. ".../remote.php/dav/uploads/alice" for
+// ".../remote.php/dav/files/alice". It returns "" for URLs of another form.
+func uploadsURLFor(nextcloudURL string) string {
+	davRoot, user := nextcloudDAVRoot(nextcloudURL)
+	if davRoot == "" {
+		return ""
+	}
+	return remoteURL(davRoot, "uploads/"+user)
+}
+
+// newUploadSessionID returns a random session name starting with uploadSessionPrefix.
+func newUploadSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return uploadSessionPrefix + hex.EncodeToString(b), nil
+}
+
+// uploadChunked uploads r to path in chunks through Nextcloud's chunked upload API. The
+// session is recorded in the state file, and chunks a previous attempt already stored are
+// skipped, so an interrupted upload continues where it stopped.
+func (b *webdavBackend) uploadChunked(ctx context.Context, path string, r io.Reader, opts UploadOptions) error {
+	size := chunkSize
+	if minSize := (opts.Size + maxUploadChunks - 1) / maxUploadChunks; size < minSize {
+		size = minSize
+	}
+	destination := remoteURL(b.baseURL, path)
+
+	hash, err := contentHash(opts.Source)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s for chunked upload: %v", opts.Source, err)
+	}
+	key := uploadSessionKey(opts.Source, hash, size)
+
+	session, stored, err := b.resumeUploadSession(ctx, key, destination)
+	if err != nil {
+		return err
+	}
+	sessionURL := remoteURL(b.uploadsURL, session.ID)
+
+	chunks := int((opts.Size + size - 1) / size)
+	for n := 1; n <= chunks; n++ {
+		length := min(size, opts.Size-int64(n-1)*size)
+		if stored[n] == length {
+			if err := skipBytes(r, length); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := b.putChunk(ctx, sessionURL, n, destination, io.LimitReader(r, length), length); err != nil {
+			return fmt.Errorf("failed to upload chunk %d of %d: %w", n, chunks, err)
+		}
+	}
+	if len(stored) > 0 {
+		slog.Debug("Resumed chunked upload", "path", path, "session", session.ID, "storedChunks", len(stored), "chunks", chunks)
+	}
+
+	if err := b.assembleChunks(ctx, sessionURL, destination, opts); err != nil {
+		return err
+	}
+
+	state.mu.Lock()
+	delete(state.UploadSessions, key)
+	state.mu.Unlock()
+	return saveState(statePath)
+}
+
+// resumeUploadSession returns the session recorded for key together with the size of every
+// chunk already stored in it, or creates a new session if there is none or it is gone.
+func (b *webdavBackend) resumeUploadSession(ctx context.Context, key, destination string) (uploadSession, map[int]int64, error) {
+	state.mu.Lock()
+	session, found := state.UploadSessions[key]
+	state.mu.Unlock()
+
+	if found && session.Target == destination {
+		stored, err := b.storedChunks(ctx, remoteURL(b.uploadsURL, session.ID))
+		if err == nil {
+			return session, stored, nil
+		}
+		slog.Debug("Upload session can't be resumed, starting a new one", "session", session.ID, "error", err)
+	}
+
+	id, err := newUploadSessionID()
+	if err != nil {
+		return uploadSession{}, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "MKCOL", remoteURL(b.uploadsURL, id), nil)
+	if err != nil {
+		return uploadSession{}, nil, err
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Destination", destination)
+	if err := b.do(req, http.StatusCreated); err != nil {
+		return uploadSession{}, nil, fmt.Errorf("failed to create upload session: %v", err)
+	}
+
+	session = uploadSession{ID: id, Target: destination, Created: time.Now()}
+	state.mu.Lock()
+	state.UploadSessions[key] = session
+	state.mu.Unlock()
+	if err := saveState(statePath); err != nil {
+		slog.Warn("Failed to record upload session in state file", "error", err)
+	}
+	return session, map[int]int64{}, nil
+}
+
+// storedChunks lists the chunks of the upload session at sessionURL by number and size.
+func (b *webdavBackend) storedChunks(ctx context.Context, sessionURL string) (map[int]int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", sessionURL, strings.NewReader(propfindContentLengthBody))
+	if err != nil {
+		return nil, err
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND %s returned %s", sessionURL, resp.Status)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("failed to decode PROPFIND response for %s: %v", sessionURL, err)
+	}
+
+	stored := make(map[int]int64)
+	for _, r := range ms.Responses {
+		n, err := strconv.Atoi(path.Base(strings.TrimRight(r.Href, "/")))
+		if err != nil {
+			// The session collection itself
+			continue
+		}
+		for _, ps := range r.Propstat {
+			if size, err := strconv.ParseInt(ps.Prop.ContentLength, 10, 64); err == nil {
+				stored[n] = size
+			}
+		}
+	}
+	return stored, nil
+}
+
+// putChunk uploads chunk number n of length bytes read from r into the session.
+func (b *webdavBackend) putChunk(ctx context.Context, sessionURL string, n int, destination string, r io.Reader, length int64) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", remoteURL(sessionURL, strconv.Itoa(n)), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+	b.auth.Authenticate(req)
+	setIdentityEncoding(req)
+	req.Header.Set("Destination", destination)
+	return b.do(req, http.StatusCreated, http.StatusNoContent)
+}
+
+// assembleChunks asks Nextcloud to join the chunks of the session into the destination file,
+// which also removes the session.
+func (b *webdavBackend) assembleChunks(ctx context.Context, sessionURL, destination string, opts UploadOptions) error {
+	req, err := http.NewRequestWithContext(ctx, "MOVE", remoteURL(sessionURL, ".file"), nil)
+	if err != nil {
+		return err
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Destination", destination)
+	req.Header.Set("OC-Total-Length", strconv.FormatInt(opts.Size, 10))
+	if !opts.ModTime.IsZero() {
+		req.Header.Set("X-OC-Mtime", strconv.FormatInt(opts.ModTime.Unix(), 10))
+	}
+	return b.do(req, http.StatusCreated, http.StatusNoContent)
+}
+
+// do sends req and returns an *uploadStatusError unless the response has one of the
+// expected status codes.
+func (b *webdavBackend) do(req *http.Request, expected ...int) error {
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	return &uploadStatusError{Code: resp.StatusCode, Status: resp.Status}
+}
+
+// skipBytes discards the next n bytes of r, which were uploaded by an earlier attempt. The
+// bandwidth limit and the metrics only apply to bytes actually sent, so their readers are
+// bypassed.
+func skipBytes(r io.Reader, n int64) error {
+	if counting, ok := r.(*countingReader); ok {
+		r = counting.r
+	}
+	if throttled, ok := r.(*throttledReader); ok {
+		r = throttled.r
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
+
+// cleanupUploadSessions deletes this tool's upload sessions older than CHUNK_SESSION_MAX_AGE
+// from the server and forgets them in the state file. Nextcloud keeps the chunks of an
+// abandoned session, and they count towards the user's quota.
+func (b *webdavBackend) cleanupUploadSessions(ctx context.Context) {
+	cutoff := time.Now().Add(-chunkSessionMaxAge)
+
+	state.mu.Lock()
+	for key, session := range state.UploadSessions {
+		if session.Created.Before(cutoff) {
+			delete(state.UploadSessions, key)
+		}
+	}
+	state.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", b.uploadsURL, strings.NewReader(propfindLastModifiedBody))
+	if err != nil {
+		return
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		slog.Warn("Failed to list upload sessions", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		slog.Debug("Failed to list upload sessions", "status", resp.Status)
+		return
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		slog.Warn("Failed to decode upload session list", "error", err)
+		return
+	}
+
+	for _, r := range ms.Responses {
+		id := path.Base(strings.TrimRight(r.Href, "/"))
+		if !strings.HasPrefix(id, uploadSessionPrefix) {
+			continue
+		}
+		for _, ps := range r.Propstat {
+			modified, err := http.ParseTime(ps.Prop.LastModified)
+			if err != nil || !modified.Before(cutoff) {
+				continue
+			}
+			req, err := http.NewRequestWithContext(ctx, "DELETE", remoteURL(b.uploadsURL, id), nil)
+			if err != nil {
+				continue
+			}
+			b.auth.Authenticate(req)
+			if err := b.do(req, http.StatusNoContent, http.StatusOK); err != nil {
+				slog.Warn("Failed to delete stale upload session", "session", id, "error", err)
+				continue
+			}
+			slog.Info("Deleted stale upload session", "session", id, "lastModified", modified)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUploadSessionKey(t *testing.T) {
+	key := uploadSessionKey("/photos/VID_0001.mp4", "abc", 4<<20)
+	for _, other := range []string{
+		uploadSessionKey("/photos/VID_0002.mp4", "abc", 4<<20),
+		uploadSessionKey("/photos/VID_0001.mp4", "abd", 4<<20),
+		uploadSessionKey("/photos/VID_0001.mp4", "abc", 8<<20),
+	} {
+		if other == key {
+			t.Errorf("uploadSessionKey() = %q for another file, content or chunk size", other)
+		}
+	}
+	if again := uploadSessionKey("/photos/VID_0001.mp4", "abc", 4<<20); again != key {
+		t.Errorf("uploadSessionKey() = %q, then %q", key, again)
+	}
+}
+
+// newChunkedDAVServer returns a davServer with Nextcloud's files and uploads collections of
+// alice, which assembles the chunks of a session on MOVE, failing the first failMoves.
+func newChunkedDAVServer(t *testing.T, failMoves int32) *davServer {
+	server := newDAVServer(t)
+	for _, dir := range []string{"/remote.php", "/remote.php/dav", "/remote.php/dav/files", "/remote.php/dav/files/alice", "/remote.php/dav/uploads", "/remote.php/dav/uploads/alice"} {
+		server.dirs[dir] = true
+	}
+	var moves atomic.Int32
+	server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != "MOVE" {
+			return false
+		}
+		if moves.Add(1) <= failMoves {
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+		destination, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return true
+		}
+		session := path.Dir(r.URL.Path)
+
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		var chunks []int
+		for p := range server.files {
+			if path.Dir(p) == session {
+				n, _ := strconv.Atoi(path.Base(p))
+				chunks = append(chunks, n)
+			}
+		}
+		slices.Sort(chunks)
+		var assembled []byte
+		for _, n := range chunks {
+			p := session + "/" + strconv.Itoa(n)
+			assembled = append(assembled, server.files[p]...)
+			delete(server.files, p)
+		}
+		delete(server.dirs, session)
+		server.files[destination.Path] = assembled
+		w.WriteHeader(http.StatusCreated)
+		return true
+	}
+	return server
+}
+
+// chunkPUTs returns the number of chunks uploaded to server.
+func chunkPUTs(server *davServer) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	n := 0
+	for _, req := range server.requests {
+		if strings.HasPrefix(req, "PUT /remote.php/dav/uploads/") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestUploadChunkedResume(t *testing.T) {
+	fastRetries(t)
+	oldChunkSize, oldStatePath := chunkSize, statePath
+	statePath = filepath.Join(t.TempDir(), "state.json")
+	t.Cleanup(func() { chunkSize, statePath = oldChunkSize, oldStatePath })
+
+	content := []byte("0123456789ab")
+	local := filepath.Join(t.TempDir(), "VID_0001.mp4")
+	if err := os.WriteFile(local, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opts := UploadOptions{Size: int64(len(content)), Source: local}
+
+	tests := []struct {
+		name          string
+		first, second int64
+		// wantPUTs is the number of chunks the second attempt sends
+		wantPUTs int
+	}{
+		// The stored chunks are all reused
+		{name: "same chunk size", first: 4, second: 4, wantPUTs: 0},
+		// The chunks of 4 bytes can't be reused, the third would be appended to those of 6
+		{name: "other chunk size", first: 4, second: 6, wantPUTs: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newChunkedDAVServer(t, 1)
+			backend := newWebDAVBackend(server.URL+"/remote.php/dav/files/alice", basicAuth{username: "alice", password: "secret"}, true)
+			backend.uploadsURL = uploadsURLFor(backend.baseURL)
+
+			chunkSize = tt.first
+			if err := backend.uploadChunked(context.Background(), "VID_0001.mp4", bytes.NewReader(content), opts); err == nil {
+				t.Fatal("first uploadChunked() succeeded although assembling failed")
+			}
+			if n := chunkPUTs(server); n != 3 {
+				t.Fatalf("first attempt sent %d chunks, want 3", n)
+			}
+
+			chunkSize = tt.second
+			if err := backend.uploadChunked(context.Background(), "VID_0001.mp4", bytes.NewReader(content), opts); err != nil {
+				t.Fatalf("second uploadChunked() error = %v", err)
+			}
+			if n := chunkPUTs(server) - 3; n != tt.wantPUTs {
+				t.Errorf("second attempt sent %d chunks, want %d", n, tt.wantPUTs)
+			}
+			if got, _ := server.file("/remote.php/dav/files/alice/VID_0001.mp4"); !bytes.Equal(got, content) {
+				t.Errorf("assembled file = %q, want %q", got, content)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Setting describes a configuration option that can be given as a command line flag,
+// an environment variable or an entry in the config file.
+type Setting struct {
+	Flag    string
+	Env     string
+	Default string
+	Usage   string
+	Bool    bool
+	// List settings can be given several times on the command line, the values are joined
+	// with commas as in the environment variable.
+	List bool
+}
+
+// settings lists every supported option. Add new options here so they automatically get a
+// flag, an environment variable, a config file key and an entry in --help.
+var settings = []Setting{
+	{Flag: "config", Env: "CONFIG_FILE", Usage: "path to a YAML config file"},
+	{Flag: "nextcloud-url", Env: "NEXTCLOUD_URL", Usage: "Nextcloud server, e.g. https://nextcloud.example.com, or its WebDAV endpoint, e.g. https://nextcloud.example.com/remote.php/dav/files/username (required)"},
+	{Flag: "webdav-path", Env: "WEBDAV_PATH", Default: defaultWebDAVPath, Usage: "path of the WebDAV endpoint appended to a nextcloud-url without /remote.php/, {user} stands for the user name"},
+	{Flag: "user", Env: "NEXTCLOUD_USER", Usage: "Nextcloud username"},
+	{Flag: "password", Env: "NEXTCLOUD_PASSWORD", Usage: "Nextcloud password or app password"},
+	{Flag: "password-file", Env: "NEXTCLOUD_PASSWORD_FILE", Usage: "file to read the Nextcloud password from instead of NEXTCLOUD_PASSWORD, e.g. a Docker secret"},
+	{Flag: "password-stdin", Env: "NEXTCLOUD_PASSWORD_STDIN", Default: "false", Bool: true, Usage: "read the Nextcloud password from the first line of stdin instead of NEXTCLOUD_PASSWORD"},
+	{Flag: "user-map", Env: "USER_MAP", Usage: "YAML file mapping folders below photos-dir to other Nextcloud users' accounts, each with its own URL and credentials"},
+	{Flag: "auth-mode", Env: "NEXTCLOUD_AUTH_MODE", Default: "basic", Usage: "authentication mode: basic or bearer"},
+	{Flag: "token", Env: "NEXTCLOUD_TOKEN", Usage: "bearer token used when auth-mode is bearer"},
+	{Flag: "photos-dir", Env: "PHOTOS_DIR", Usage: "path to the Google Photos Takeout directory, or several separated by commas (required unless photos-archive is set)"},
+	{Flag: "photos-archive", Env: "PHOTOS_ARCHIVE", Usage: "Takeout .zip or .tgz file, or directory of them, to read instead of PHOTOS_DIR without extracting it"},
+	{Flag: "backend", Env: "BACKEND", Default: "nextcloud", Usage: "where to upload to: nextcloud, webdav for other WebDAV servers, immich, or local to copy into local-dir"},
+	{Flag: "immich-url", Env: "IMMICH_URL", Usage: "Immich server URL, e.g. https://immich.example.com, used with backend immich"},
+	{Flag: "immich-api-key", Env: "IMMICH_API_KEY", Usage: "Immich API key used with backend immich"},
+	{Flag: "local-dir", Env: "LOCAL_DIR", Usage: "directory the local backend copies media files into"},
+	{Flag: "proxy", Env: "NEXTCLOUD_PROXY", Usage: "proxy URL for requests to the server, overriding HTTP_PROXY/HTTPS_PROXY"},
+	{Flag: "insecure-skip-verify", Env: "INSECURE_SKIP_VERIFY", Default: "false", Bool: true, Usage: "accept the server's TLS certificate without verifying it, e.g. a self-signed one"},
+	{Flag: "disable-compression", Env: "DISABLE_COMPRESSION", Default: "true", Bool: true, Usage: "send uploads with Accept-Encoding: identity and don't ask for compressed responses, as media is compressed already"},
+	{Flag: "remote-base-path", Env: "REMOTE_BASE_PATH", Usage: "folder below the WebDAV endpoint to upload into"},
+	{Flag: "date-source", Env: "DATE_SOURCE", Default: "taken,creation,exif,filename", Usage: "date sources tried in order to pick the year/month folder: taken, creation, modified, exif and filename"},
+	{Flag: "date-discrepancy-days", Env: "DATE_DISCREPANCY_DAYS", Default: "0", Usage: "warn about media files whose sidecar taken time and EXIF date are more than this many days apart, 0 disables the check"},
+	{Flag: "fallback-year", Env: "FALLBACK_YEAR", Default: "Unknown", Usage: "folder for media files none of the date sources yields a date for: a year such as 2000 for its January folder, or a folder name"},
+	{Flag: "on-unknown-date", Env: "ON_UNKNOWN_DATE", Default: "fallback", Usage: "what to do with media files without a date: fallback uploads them into the FALLBACK_YEAR folder, skip leaves them out, prompt asks once for all of them"},
+	{Flag: "timezone", Env: "TIMEZONE", Default: "UTC", Usage: "time zone sidecar timestamps and EXIF dates with a zone are converted to before picking their year/month folder, an IANA name such as Europe/Berlin or local"},
+	{Flag: "timestamp-layouts", Env: "TIMESTAMP_LAYOUTS", Default: defaultTimestampLayouts, Usage: "semicolon-separated Go time layouts tried in order for sidecar timestamps that aren't epochs; dates without a zone are in timezone"},
+	{Flag: "filename-date-patterns", Env: "FILENAME_DATE_PATTERNS", Default: defaultFilenameDatePatterns, Usage: "whitespace separated regular expressions with named groups year and month used by the filename date source"},
+	{Flag: "date-since", Env: "DATE_SINCE", Usage: "only upload media dated in or after this month, YYYY-MM or RFC3339"},
+	{Flag: "date-until", Env: "DATE_UNTIL", Usage: "only upload media dated in or before this month, YYYY-MM or RFC3339"},
+	{Flag: "organize-by", Env: "ORGANIZE_BY", Default: "date", Usage: "date uploads into year/month folders, album uploads album photos into Albums/{AlbumName}, none uploads everything into flat-folder"},
+	{Flag: "folder-template", Env: "FOLDER_TEMPLATE", Default: defaultFolderTemplate, Usage: "layout of the date folders with organize-by date or album, {year} and {month} stand for the file's year and month, e.g. {year}/{year}-{month}"},
+	{Flag: "flat-folder", Env: "FLAT_FOLDER", Usage: "folder below the remote base path every file is uploaded into with organize-by none, empty for the base path itself"},
+	{Flag: "route-rules", Env: "ROUTE_RULES", List: true, Usage: "comma-separated group=folder rules putting date and flat folders below a folder per file type, e.g. videos=Videos,images=Photos; groups are videos, images, other or extensions joined by +"},
+	{Flag: "album-also-by-date", Env: "ALBUM_ALSO_BY_DATE", Default: "false", Bool: true, Usage: "with organize-by album, also upload album photos into their date folder"},
+	{Flag: "album-duplicates", Env: "ALBUM_DUPLICATES", Default: "copy", Usage: "photos found in several albums: copy uploads into every album, first only into the first album"},
+	{Flag: "album-strategy", Env: "ALBUM_STRATEGY", Default: "upload-both", Usage: "with organize-by album, upload-both uploads album photos into the album folder, copy-remote uploads them into their date folder and copies them into the album on the server, tag-only tags them with the album instead"},
+	{Flag: "apply-tags", Env: "APPLY_TAGS", List: true, Usage: "comma-separated collaborative tags attached to every uploaded file, {album} and {people} stand for the file's album and people names"},
+	{Flag: "dedup", Env: "DEDUP", Default: "false", Bool: true, Usage: "upload byte-identical copies of a photo (e.g. in an album and in Photos from YYYY) only once"},
+	{Flag: "hash-algorithm", Env: "HASH_ALGORITHM", Default: "sha256", Usage: "content hash used to detect duplicates"},
+	{Flag: "repair-mtime", Env: "REPAIR_MTIME", Default: "false", Bool: true, Usage: "instead of uploading, set the modification time of already uploaded files to that of their local file"},
+	{Flag: "list-only", Env: "LIST_ONLY", Default: "false", Bool: true, Usage: "list every media file with its resolved date folder and date source and exit without uploading"},
+	{Flag: "list-file", Env: "LIST_FILE", Usage: "with list-only, write the list to this file instead of stdout"},
+	{Flag: "report-duplicates", Env: "REPORT_DUPLICATES", Default: "false", Bool: true, Usage: "list groups of duplicate files and exit without uploading"},
+	{Flag: "index-cache", Env: "INDEX_CACHE", Usage: "file caching the dates resolved from sidecars and EXIF data, reused while no photo or date setting changed"},
+	{Flag: "state-file", Env: "STATE_FILE", Usage: "file caching content hashes and unfinished chunked uploads between runs, and when the last completed run started"},
+	{Flag: "only-new", Env: "ONLY_NEW", Default: "false", Bool: true, Usage: "skip media files from before the last completed run recorded in state-file"},
+	{Flag: "only-new-by", Env: "ONLY_NEW_BY", Default: "mtime", Usage: "what only-new compares with the last run: mtime, the file's modification time, or date, its resolved photo date"},
+	{Flag: "include-trash", Env: "INCLUDE_TRASH", Default: "false", Bool: true, Usage: "upload Takeout's Trash folder into a separate Trash/ folder instead of skipping it"},
+	{Flag: "include-archive", Env: "INCLUDE_ARCHIVE", Default: "false", Bool: true, Usage: "upload Takeout's Archive folder into a separate Archive/ folder instead of skipping it"},
+	{Flag: "include-ext", Env: "INCLUDE_EXT", Default: defaultIncludeExt, Usage: "comma-separated extensions or globs of media files to upload"},
+	{Flag: "exclude-dir", Env: "EXCLUDE_DIR", List: true, Usage: "directory to skip, relative to photos-dir, as a .gitignore pattern such as \"Memes\" or \"Takeout/Old screenshots\"; repeatable, comma-separated in the environment"},
+	{Flag: "follow-symlinks", Env: "FOLLOW_SYMLINKS", Default: "false", Bool: true, Usage: "also walk symlinked directories below the photos directory, skipping symlink cycles"},
+	{Flag: "exclude-ext", Env: "EXCLUDE_EXT", Default: defaultExcludeExt, Usage: "comma-separated extensions or globs of files to skip, checked before include-ext"},
+	{Flag: "parallel-uploads", Env: "PARALLEL_UPLOADS", Usage: "number of concurrent uploads (default twice the CPU cores, at most 8)"},
+	{Flag: "parallel-dirs", Env: "PARALLEL_DIRS", Default: "4", Usage: "number of concurrent directory creations"},
+	{Flag: "convert-heic", Env: "CONVERT_HEIC", Default: "false", Bool: true, Usage: "convert HEIC/HEIF photos to JPEG before uploading, using heif-convert or ImageMagick"},
+	{Flag: "heic-keep-original", Env: "HEIC_KEEP_ORIGINAL", Default: "false", Bool: true, Usage: "with convert-heic, upload the original HEIC next to the JPEG"},
+	{Flag: "extract-motion", Env: "EXTRACT_MOTION", Default: "false", Bool: true, Usage: "also upload the video embedded in Google and Samsung motion photos as an .mp4 next to the photo"},
+	{Flag: "strip-geodata", Env: "STRIP_GEODATA", Default: "false", Bool: true, Usage: "upload copies of the media files without their GPS metadata, leaving the local originals untouched; formats that can't be edited fail unless allow-unstripped is set"},
+	{Flag: "allow-unstripped", Env: "ALLOW_UNSTRIPPED", Default: "false", Bool: true, Usage: "with strip-geodata, upload files whose GPS metadata can't be removed unchanged instead of failing them"},
+	{Flag: "on-conflict", Env: "ON_CONFLICT", Default: "overwrite", Usage: "what to do when a remote file already exists: overwrite, skip or rename to \"name (1).ext\""},
+	{Flag: "max-file-size", Env: "MAX_FILE_SIZE", Default: "0", Usage: "skip media files larger than this many bytes, e.g. the server's upload limit; 0 uploads files of any size"},
+	{Flag: "upload-sidecars", Env: "UPLOAD_SIDECARS", Default: "false", Bool: true, Usage: "also upload each media file's JSON sidecar next to it on the server as <name>.json"},
+	{Flag: "upload-empty", Env: "UPLOAD_EMPTY", Default: "false", Bool: true, Usage: "also upload 0-byte media files, which are skipped by default"},
+	{Flag: "ignore-quota", Env: "IGNORE_QUOTA", Default: "false", Bool: true, Usage: "upload even when the server reports less free space than the files need"},
+	{Flag: "chunk-size", Env: "CHUNK_SIZE", Default: "0", Usage: "upload files larger than this many bytes to Nextcloud in chunks of this size, so interrupted uploads can be resumed; 0 disables chunking"},
+	{Flag: "max-consecutive-failures", Env: "MAX_CONSECUTIVE_FAILURES", Default: "50", Usage: "stop the run when this many uploads in a row failed, as the server appears down; 0 never stops"},
+	{Flag: "resume-partial", Env: "RESUME_PARTIAL", Default: "false", Bool: true, Usage: "on a retry, append the rest of a partially uploaded file with a Content-Range PUT if the server supports it"},
+	{Flag: "prune-empty", Env: "PRUNE_EMPTY", Default: "false", Bool: true, Usage: "at the end of a run, delete the folders it created that are still empty, e.g. after an interruption"},
+	{Flag: "bulk-upload", Env: "BULK_UPLOAD", Default: "false", Bool: true, Usage: "send small files to Nextcloud in bundles through its bulk upload endpoint, falling back to one PUT per file"},
+	{Flag: "bulk-upload-max-size", Env: "BULK_UPLOAD_MAX_SIZE", Default: "1048576", Usage: "largest file in bytes that BULK_UPLOAD bundles"},
+	{Flag: "chunk-session-max-age", Env: "CHUNK_SESSION_MAX_AGE", Default: "24h", Usage: "age after which unfinished chunked uploads are deleted from the server"},
+	{Flag: "upload-timeout", Env: "UPLOAD_TIMEOUT", Default: "10m", Usage: "maximum duration of a single upload request before it is retried, 0 disables the timeout"},
+	{Flag: "max-upload-bytes-per-sec", Env: "MAX_UPLOAD_BYTES_PER_SEC", Default: "0", Usage: "combined upload bandwidth limit of all workers in bytes per second, 0 means unlimited"},
+	{Flag: "resume-manifest", Env: "RESUME_MANIFEST", Usage: "file recording uploaded files so an interrupted run can be resumed"},
+	{Flag: "run-report", Env: "RUN_REPORT", Usage: "CSV file to write the outcome and date source of every planned upload to"},
+	{Flag: "unresolved-report", Env: "UNRESOLVED_REPORT", Usage: "CSV file to list media files without any usable date in"},
+	{Flag: "verify-all", Env: "VERIFY_ALL", Usage: "CSV file to list planned uploads missing remotely or with a different size in, checked once the run ended"},
+	{Flag: "retry-from", Env: "RETRY_FROM", Usage: "run report of a previous run whose failed uploads are retried without indexing again"},
+	{Flag: "metrics-addr", Env: "METRICS_ADDR", Usage: "address such as :9090 to serve upload metrics on in the Prometheus text format under /metrics"},
+	{Flag: "log-level", Env: "LOG_LEVEL", Default: "info", Usage: "log level: debug, info, warn or error"},
+	{Flag: "yes", Env: "ASSUME_YES", Default: "false", Bool: true, Usage: "start uploading without asking for confirmation, needed when stdin is not a terminal"},
+	{Flag: "quiet", Env: "QUIET", Default: "false", Bool: true, Usage: "only log warnings, errors and the final summary, without progress bars"},
+	{Flag: "verbose", Env: "VERBOSE", Default: "false", Bool: true, Usage: "log everything, including every uploaded file (same as log-level debug)"},
+	{Flag: "log-format", Env: "LOG_FORMAT", Default: "text", Usage: "log format: text or json"},
+	{Flag: "json-logs", Env: "JSON_LOGS", Default: "false", Bool: true, Usage: "write one JSON object per line for every lifecycle event to stdout, without progress bars, for wrappers and GUIs"},
+	{Flag: "json-logs-file", Env: "JSON_LOGS_FILE", Usage: "write the JSON_LOGS events to this file or named pipe instead of stdout"},
+	{Flag: "verify-uploads", Env: "VERIFY_UPLOADS", Default: "false", Bool: true, Usage: "check the remote size of every uploaded file"},
+	{Flag: "delete-after-upload", Env: "DELETE_AFTER_UPLOAD", Default: "false", Bool: true, Usage: "delete local media files once their upload is verified (requires verify-uploads)"},
+	{Flag: "delete-sidecars", Env: "DELETE_SIDECARS", Default: "false", Bool: true, Usage: "also delete the JSON sidecar of deleted media files"},
+}
+
+// listFlag is the flag of a List setting.
+type listFlag struct {
+	values []string
+}
+
+func (l *listFlag) String() string { return strings.Join(l.values, ",") }
+
+func (l *listFlag) Set(value string) error {
+	l.values = append(l.values, value)
+	return nil
+}
+
+// Config resolves settings by checking, in order, command line flags, environment
+// variables, the optional YAML config file and finally the setting's default.
+//
+// Settings are identified by their environment variable name, e.g. NEXTCLOUD_URL. In the
+// config file the same setting is written in lower case, optionally without the
+// NEXTCLOUD_ prefix:
+//
+//	nextcloud_url: https://cloud.example.com/remote.php/dav/files/alice
+//	user: alice
+//	password: app-password
+//	photos_dir: /photos
+//	parallel_uploads: 4
+type Config struct {
+	flags    map[string]string
+	file     map[string]string
+	defaults map[string]string
+}
+
+// registerFlags adds a flag for every setting to flags and installs a usage message that
+// lists them together with their environment variables and defaults.
+func registerFlags(flags *flag.FlagSet) {
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s (env %s)", s.Usage, s.Env)
+		if s.Bool {
+			flags.Bool(s.Flag, s.Default == "true", usage)
+		} else if s.List {
+			flags.Var(&listFlag{}, s.Flag, usage)
+		} else {
+			flags.String(s.Flag, s.Default, usage)
+		}
+	}
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags]\n\n", flags.Name())
+		fmt.Fprintln(flags.Output(), "Uploads a Google Photos Takeout to Nextcloud, organized by year and month.")
+		fmt.Fprintln(flags.Output(), "Every flag can also be set with the environment variable shown, or in the config file.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+}
+
+// loadConfig collects the flags that were explicitly set on the command line and reads the
+// config file given by --config or CONFIG_FILE, if any. Keys of the config file that aren't
+// a setting are an error.
+func loadConfig(flags *flag.FlagSet) (*Config, error) {
+	cfg := &Config{
+		flags:    make(map[string]string),
+		file:     make(map[string]string),
+		defaults: make(map[string]string),
+	}
+
+	envNames := make(map[string]string)
+	for _, s := range settings {
+		envNames[s.Flag] = s.Env
+		cfg.defaults[s.Env] = s.Default
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		if envName, ok := envNames[f.Name]; ok {
+			cfg.flags[envName] = f.Value.String()
+		}
+	})
+
+	path := cfg.Get("CONFIG_FILE")
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	known := make(map[string]bool)
+	for _, s := range settings {
+		known[strings.ToLower(s.Env)] = true
+		known[strings.ToLower(strings.TrimPrefix(s.Env, "NEXTCLOUD_"))] = true
+	}
+	for key, value := range values {
+		// A misspelled key would otherwise be silently ignored
+		if !known[strings.ToLower(key)] {
+			return nil, fmt.Errorf("unknown key %q in config file %s", key, path)
+		}
+		text, err := configFileValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %q in config file %s: %v", key, path, err)
+		}
+		cfg.file[strings.ToLower(key)] = text
+	}
+
+	return cfg, nil
+}
+
+// configFileValue turns a value of the config file into the string the setting would have in
+// the environment. A sequence such as [jpg, png] is joined with commas, as every setting that
+// takes several values separates them by commas.
+func configFileValue(value any) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, len(value))
+		for i, item := range value {
+			switch item.(type) {
+			case nil, []any, map[string]any:
+				return "", fmt.Errorf("list item %d is not a single value", i+1)
+			}
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", fmt.Errorf("must be a single value or a list, not a mapping")
+	}
+	return fmt.Sprint(value), nil
+}
+
+// Get returns the resolved value of the setting key.
+func (c *Config) Get(key string) string {
+	if value, ok := c.flags[key]; ok {
+		return value
+	}
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	if value, ok := c.file[strings.ToLower(key)]; ok {
+		return value
+	}
+	if value, ok := c.file[strings.ToLower(strings.TrimPrefix(key, "NEXTCLOUD_"))]; ok {
+		return value
+	}
+	return c.defaults[key]
+}
+
+// GetBool parses the resolved value of the setting key as a boolean.
+func (c *Config) GetBool(key string) (bool, error) {
+	value := c.Get(key)
+	if value == "" {
+		return false, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean value for %s: %q", key, value)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, "photos_dir: /photos\nuser: alice\nfolder_template: \"{year}/{year}-{month}\"\n"+
+		"apply_tags: [Takeout, \"{album}\"]\ninclude_ext:\n  - jpg\n  - png\ndate_discrepancy_days: 3\nremote_base_path:\n")
+	for _, key := range []string{"PHOTOS_DIR", "NEXTCLOUD_USER", "FOLDER_TEMPLATE", "APPLY_TAGS", "INCLUDE_EXT", "DATE_DISCREPANCY_DAYS", "REMOTE_BASE_PATH"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("CONFIG_FILE", path)
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(flags)
+
+	cfg, err := loadConfig(flags)
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	for key, want := range map[string]string{
+		"PHOTOS_DIR":            "/photos",
+		"NEXTCLOUD_USER":        "alice",
+		"FOLDER_TEMPLATE":       "{year}/{year}-{month}",
+		"APPLY_TAGS":            "Takeout,{album}",
+		"INCLUDE_EXT":           "jpg,png",
+		"DATE_DISCREPANCY_DAYS": "3",
+		"REMOTE_BASE_PATH":      "",
+	} {
+		if got := cfg.Get(key); got != want {
+			t.Errorf("Get(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, "photos_dri: /photos\n")
+	t.Setenv("CONFIG_FILE", path)
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(flags)
+
+	if _, err := loadConfig(flags); err == nil || !strings.Contains(err.Error(), "photos_dri") {
+		t.Errorf("loadConfig() error = %v, want one naming photos_dri", err)
+	}
+}
+
+func TestLoadConfigNonScalarValue(t *testing.T) {
+	for _, content := range []string{
+		"include_ext:\n  jpg: true\n",
+		"include_ext: [jpg, [png, gif]]\n",
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		writeFile(t, path, content)
+		t.Setenv("CONFIG_FILE", path)
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		registerFlags(flags)
+
+		if _, err := loadConfig(flags); err == nil || !strings.Contains(err.Error(), "include_ext") {
+			t.Errorf("loadConfig() of %q error = %v, want one naming include_ext", content, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// assumeYes is ASSUME_YES: start uploading without asking for confirmation.
+var assumeYes bool
+
+// errNotConfirmed is returned by confirmUpload when the user declined the upload.
+var errNotConfirmed = errors.New("upload not confirmed")
+
+// stdinReader reads the answers to every question asked on stdin.
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// confirmUpload shows the upload plan and asks on stdin whether to go ahead.
+func confirmUpload(files, folders int, totalBytes int64) error {
+	confirmed, err := askYesNo(fmt.Sprintf("About to create %d folders and upload %d files (%s). Continue?", folders, files, formatBytes(totalBytes)))
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return errNotConfirmed
+	}
+	return nil
+}
+
+// askYesNo asks question on stdin and reports whether it was answered with yes, which
+// ASSUME_YES answers right away. It fails instead of waiting for an answer when stdin isn't
+// a terminal, since nobody could answer.
+func askYesNo(question string) (bool, error) {
+	if assumeYes {
+		return true, nil
+	}
+
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false, errors.New("stdin is not a terminal, set ASSUME_YES=true to go ahead without confirmation")
+	}
+
+	// The prompt goes to stderr with the logs, stdout may carry JSON_LOGS
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := stdinReader.ReadString('\n')
+	if errors.Is(err, io.EOF) && answer == "" {
+		// e.g. stdin is /dev/null
+		fmt.Fprintln(os.Stderr)
+		return false, errors.New("no answer on stdin, set ASSUME_YES=true to go ahead without confirmation")
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// errRemoteExists is returned by uploadTargetPath when ON_CONFLICT=skip and the target exists.
+var errRemoteExists = errors.New("file already exists remotely")
+
+// maxRenameAttempts bounds the search for a free "name (N).ext" with ON_CONFLICT=rename.
+const maxRenameAttempts = 1000
+
+var (
+	// onConflict is what happens when an upload's target already exists: overwrite, skip or rename.
+	onConflict = "overwrite"
+
+	// claimedPaths holds every remote path picked by this run, so two local files with the
+	// same name in the same folder don't both see it as free while neither has finished.
+	claimedPaths   = make(map[string]bool)
+	claimedPathsMu sync.Mutex
+)
+
+// claimPath reserves the remote path for this run and reports whether it was still free.
+func claimPath(remotePath string) bool {
+	claimedPathsMu.Lock()
+	defer claimedPathsMu.Unlock()
+	if claimedPaths[remotePath] {
+		return false
+	}
+	claimedPaths[remotePath] = true
+	return true
+}
+
+// uploadTargetPath returns the remote path to upload fileName in subFolder to according to
+// ON_CONFLICT. size is the local file's size, -1 if unknown. With skip a listed remote file
+// of another size is uploaded again, as it is most likely an upload that was cut short,
+// while rename keeps it, as it may be another photo with the same name.
+func uploadTargetPath(ctx context.Context, backend UploadBackend, subFolder, fileName string, size int64) (string, error) {
+	if onConflict == "overwrite" {
+		return destinationPath(subFolder, fileName), nil
+	}
+	if onConflict != "skip" {
+		size = -1
+	}
+
+	ext := filepath.Ext(fileName)
+	stem := strings.TrimSuffix(fileName, ext)
+	for n := 0; n < maxRenameAttempts; n++ {
+		name := fileName
+		if n > 0 {
+			name = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+		}
+		targetPath := destinationPath(subFolder, name)
+
+		free := claimPath(targetPath)
+		if free {
+			exists, err := remoteFileExists(ctx, backend, targetPath, size)
+			if err != nil {
+				return "", err
+			}
+			free = !exists
+		}
+
+		if free {
+			return targetPath, nil
+		}
+		if onConflict == "skip" {
+			return "", errRemoteExists
+		}
+	}
+
+	return "", fmt.Errorf("no free name for %s after %d attempts", fileName, maxRenameAttempts)
+}
+
+// remoteExists reports whether a file or directory exists at url using a Depth 0 PROPFIND.
+func remoteExists(ctx context.Context, client *http.Client, url string, auth Authenticator) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", url, strings.NewReader(propfindContentLengthBody))
+	if err != nil {
+		return false, err
+	}
+	auth.Authenticate(req)
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := doRequest(client, req, webdavRetryPolicy)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusMultiStatus:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("PROPFIND %s returned %s", url, resp.Status)
+	}
+}
+
+// findCollisions groups planned uploads by remote path and returns the groups where
+// different local files would be written to the same place, keyed by remote path. Files of
+// equal size and content are taken to be the copies Takeout keeps of one photo and don't
+// collide, so only files of equal size are hashed.
+func findCollisions(mediaFiles []MediaFile) map[string][]string {
+	byTarget := make(map[string][]MediaFile)
+	for _, media := range mediaFiles {
+		target := destinationPath(media.Ts, filepath.Base(media.Path))
+		byTarget[target] = append(byTarget[target], media)
+	}
+
+	collisions := make(map[string][]string)
+	for target, group := range byTarget {
+		if len(group) < 2 || sameContent(group) {
+			continue
+		}
+		for _, media := range group {
+			collisions[target] = append(collisions[target], media.Path)
+		}
+	}
+	return collisions
+}
+
+// sameContent reports whether every file in group has the size and SHA-256 of the first.
+// A file that can't be hashed counts as different.
+func sameContent(group []MediaFile) bool {
+	for _, media := range group[1:] {
+		if media.Size < 0 || media.Size != group[0].Size {
+			return false
+		}
+	}
+
+	first, err := fileSHA256(group[0].Path)
+	if err != nil {
+		slog.Warn("Failed to hash file to compare it with files of the same name", "file", group[0].Path, "error", err)
+		return false
+	}
+	for _, media := range group[1:] {
+		hash, err := fileSHA256(media.Path)
+		if err != nil {
+			slog.Warn("Failed to hash file to compare it with files of the same name", "file", media.Path, "error", err)
+			return false
+		}
+		if hash != first {
+			return false
+		}
+	}
+	return true
+}
+
+// checkCollisions logs every remote path several different local files would be uploaded
+// to. With ON_CONFLICT=overwrite they would silently replace each other, so the run stops.
+func checkCollisions(mediaFiles []MediaFile) {
+	collisions := findCollisions(mediaFiles)
+	if len(collisions) == 0 {
+		return
+	}
+
+	targets := make([]string, 0, len(collisions))
+	for target := range collisions {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		switch onConflict {
+		case "overwrite":
+			slog.Error("Different files would be uploaded to the same remote path", "path", target, "files", collisions[target])
+		case "skip":
+			slog.Warn("Different files map to the same remote path, only one is uploaded", "path", target, "files", collisions[target])
+		case "rename":
+			slog.Info("Different files map to the same remote path, all but one are renamed", "path", target, "files", collisions[target])
+		}
+	}
+
+	if onConflict == "overwrite" {
+		fatal("Refusing to overwrite files with each other, set ON_CONFLICT to rename or skip", "collisions", len(collisions))
+	}
+}
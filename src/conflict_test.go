@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// resetClaimedPaths forgets the remote paths claimed so far, for the rest of the test.
+func resetClaimedPaths(t *testing.T) {
+	claimedPathsMu.Lock()
+	old := claimedPaths
+	claimedPaths = make(map[string]bool)
+	claimedPathsMu.Unlock()
+	t.Cleanup(func() {
+		claimedPathsMu.Lock()
+		claimedPaths = old
+		claimedPathsMu.Unlock()
+	})
+}
+
+func TestFindCollisions(t *testing.T) {
+	src := t.TempDir()
+	for _, f := range []struct{ path, content string }{
+		{"Photos from 2024/image.jpg", "first photo"},
+		{"Trip/image.jpg", "second photo, longer"},
+		{"Photos from 2024/IMG_0001.jpg", "the same photo"},
+		{"Trip/IMG_0001.jpg", "the same photo"},
+		{"Photos from 2024/IMG_0002.jpg", "one photo"},
+		{"Photos from 2024/April/IMG_0002.jpg", "another one"},
+		{"Photos from 2024/IMG_0003.jpg", "same size A"},
+		{"Trip/IMG_0003.jpg", "same size B"},
+	} {
+		writeFile(t, filepath.Join(src, f.path), f.content)
+	}
+	local := func(path string) string { return filepath.Join(src, path) }
+
+	mediaFiles := []MediaFile{
+		// Two different photos from different folders, dated the same month
+		{Path: local("Photos from 2024/image.jpg"), Ts: "2024/03", Size: 11},
+		{Path: local("Trip/image.jpg"), Ts: "2024/03", Size: 20},
+		// Takeout's copies of one photo in its year folder and an album
+		{Path: local("Photos from 2024/IMG_0001.jpg"), Ts: "2024/03", Size: 14},
+		{Path: local("Trip/IMG_0001.jpg"), Ts: "2024/03", Size: 14},
+		// The same name in another month
+		{Path: local("Photos from 2024/IMG_0002.jpg"), Ts: "2024/03", Size: 9},
+		{Path: local("Photos from 2024/April/IMG_0002.jpg"), Ts: "2024/04", Size: 11},
+		// Two different photos that happen to have the same size
+		{Path: local("Photos from 2024/IMG_0003.jpg"), Ts: "2024/03", Size: 11},
+		{Path: local("Trip/IMG_0003.jpg"), Ts: "2024/03", Size: 11},
+		// Unknown sizes can't be told apart
+		{Path: "/takeout/a/clip.mp4", Ts: "2024/05", Size: -1},
+		{Path: "/takeout/b/clip.mp4", Ts: "2024/05", Size: -1},
+	}
+
+	collisions := findCollisions(mediaFiles)
+	want := map[string][]string{
+		"2024/03/image.jpg":    {local("Photos from 2024/image.jpg"), local("Trip/image.jpg")},
+		"2024/03/IMG_0003.jpg": {local("Photos from 2024/IMG_0003.jpg"), local("Trip/IMG_0003.jpg")},
+		"2024/05/clip.mp4":     {"/takeout/a/clip.mp4", "/takeout/b/clip.mp4"},
+	}
+	if len(collisions) != len(want) {
+		t.Errorf("findCollisions() = %v, want %v", collisions, want)
+	}
+	for target, files := range want {
+		if !slices.Equal(collisions[target], files) {
+			t.Errorf("collisions at %s = %v, want %v", target, collisions[target], files)
+		}
+	}
+}
+
+// TestUploadCollidingFiles uploads two different files with the same name into the same
+// month folder of the local backend under each ON_CONFLICT policy that allows it.
+func TestUploadCollidingFiles(t *testing.T) {
+	oldConflict := onConflict
+	t.Cleanup(func() { onConflict = oldConflict })
+
+	src := t.TempDir()
+	first, second := filepath.Join(src, "Photos from 2024", "image.jpg"), filepath.Join(src, "Trip", "image.jpg")
+	writeFile(t, first, "first photo")
+	writeFile(t, second, "second photo")
+
+	tests := []struct {
+		policy string
+		want   map[string]string
+	}{
+		{"rename", map[string]string{"image.jpg": "first photo", "image (1).jpg": "second photo"}},
+		{"skip", map[string]string{"image.jpg": "first photo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			resetClaimedPaths(t)
+			onConflict = tt.policy
+			dest := t.TempDir()
+			backend := localBackend{root: dest}
+			if err := backend.EnsureDir(context.Background(), "2024/03"); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := uploadFile(context.Background(), newMediaIndex(), first, backend, "2024/03"); err != nil {
+				t.Fatalf("uploading the first file: %v", err)
+			}
+			result, err := uploadFile(context.Background(), newMediaIndex(), second, backend, "2024/03")
+			if err != nil {
+				t.Fatalf("uploading the second file: %v", err)
+			}
+			if result.Skipped != (tt.policy == "skip") {
+				t.Errorf("second upload skipped = %t with ON_CONFLICT=%s", result.Skipped, tt.policy)
+			}
+
+			entries, err := os.ReadDir(filepath.Join(dest, "2024", "03"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tt.want) {
+				t.Errorf("uploaded %d files, want %d", len(entries), len(tt.want))
+			}
+			for name, content := range tt.want {
+				data, err := os.ReadFile(filepath.Join(dest, "2024", "03", name))
+				if err != nil || string(data) != content {
+					t.Errorf("%s = %q, %v, want %q", name, data, err, content)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadTargetPathSkipExisting(t *testing.T) {
+	oldConflict := onConflict
+	t.Cleanup(func() { onConflict = oldConflict })
+	resetClaimedPaths(t)
+	onConflict = "skip"
+
+	dest := t.TempDir()
+	writeFile(t, filepath.Join(dest, "2024", "03", "image.jpg"), "from an earlier run")
+	if _, err := uploadTargetPath(context.Background(), localBackend{root: dest}, "2024/03", "image.jpg", -1); !errors.Is(err, errRemoteExists) {
+		t.Errorf("uploadTargetPath() error = %v, want errRemoteExists", err)
+	}
+}
+
+// TestUploadTargetPathListedSize checks that a listed remote file only counts as existing
+// for ON_CONFLICT=skip if it has the local file's size, while rename keeps any file.
+func TestUploadTargetPathListedSize(t *testing.T) {
+	oldConflict, oldListings := onConflict, remoteListings
+	t.Cleanup(func() { onConflict, remoteListings = oldConflict, oldListings })
+	remoteListings = &remoteListing{files: make(map[string]map[string]int64)}
+	remoteListings.set("2024/03", map[string]int64{"image.jpg": 100})
+	// Nothing exists in the backend, so only the listing can report the file
+	backend := localBackend{root: t.TempDir()}
+
+	tests := []struct {
+		policy  string
+		size    int64
+		want    string
+		wantErr error
+	}{
+		{"skip", 100, "", errRemoteExists},
+		{"skip", 42, "2024/03/image.jpg", nil},
+		{"skip", -1, "", errRemoteExists},
+		{"rename", 42, "2024/03/image (1).jpg", nil},
+	}
+	for _, tt := range tests {
+		resetClaimedPaths(t)
+		onConflict = tt.policy
+		got, err := uploadTargetPath(context.Background(), backend, "2024/03", "image.jpg", tt.size)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("%s with size %d: uploadTargetPath() = %q, %v, want %q, %v", tt.policy, tt.size, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// TestUploadTargetPathNormalized checks that the target picked under every ON_CONFLICT
+// policy is the destinationPath of the folder, however it is padded with slashes or "..".
+func TestUploadTargetPathNormalized(t *testing.T) {
+	oldConflict := onConflict
+	t.Cleanup(func() { onConflict = oldConflict })
+
+	for _, policy := range []string{"overwrite", "rename", "skip"} {
+		t.Run(policy, func(t *testing.T) {
+			onConflict = policy
+
+			backend := localBackend{root: t.TempDir()}
+			for _, subFolder := range []string{"2024/03", "/2024/03/", "//2024//03", "../2024/03"} {
+				resetClaimedPaths(t)
+				got, err := uploadTargetPath(context.Background(), backend, subFolder, "image.jpg", -1)
+				if err != nil {
+					t.Fatalf("uploadTargetPath(%q) error = %v", subFolder, err)
+				}
+				if got != "2024/03/image.jpg" {
+					t.Errorf("uploadTargetPath(%q) = %q, want %q", subFolder, got, "2024/03/image.jpg")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	exifmeta "github.com/tajtiattila/metadata"
+
+	"media2nextcloud/metadata"
+)
+
+// fallbackDateSource is recorded for files whose date came from none of the sources.
+const fallbackDateSource = "fallback"
+
+// errNoExifDate is returned by exifDateFolder when the EXIF metadata has no date.
+var errNoExifDate = errors.New("no date in EXIF metadata")
+
+// knownDateSources are the values DATE_SOURCE accepts.
+var knownDateSources = []string{"taken", "creation", "modified", "exif", "filename"}
+
+// defaultFilenameDatePatterns matches dates embedded in names such as IMG-20220314-WA0001.jpg,
+// IMG_20220314_123456.jpg, PXL_20220314_...mp4 and Screenshot_2021-05-02-10-11-12.png.
+const defaultFilenameDatePatterns = `(?:^|[^0-9])(?P<year>(?:19|20)[0-9][0-9])[-_.]?(?P<month>0[1-9]|1[0-2])[-_.]?(?:0[1-9]|[12][0-9]|3[01])(?:[^0-9]|$)`
+
+// defaultTimestampLayouts are the time layouts tried for sidecar timestamps that aren't
+// epochs: RFC 3339 as written by Takeout, optionally without a zone or with a space instead
+// of the T as written by other exporters, and EXIF's "2006:01:02 15:04:05".
+const defaultTimestampLayouts = "2006-01-02T15:04:05Z07:00;2006-01-02T15:04:05;2006-01-02 15:04:05Z07:00;2006-01-02 15:04:05;2006:01:02 15:04:05"
+
+// defaultFolderTemplate is the FOLDER_TEMPLATE media files are indexed by.
+const defaultFolderTemplate = "{year}/{month}"
+
+var (
+	// dateSources is the order in which date sources are tried for every media file.
+	dateSources = knownDateSources
+	// timestampLayouts are the TIMESTAMP_LAYOUTS tried in order for sidecar timestamps.
+	timestampLayouts = strings.Split(defaultTimestampLayouts, ";")
+	// filenameDatePatterns are tried in order by the filename date source.
+	filenameDatePatterns []*regexp.Regexp
+	// fallbackDateFolder is the FALLBACK_YEAR folder media files go to when none of the date
+	// sources yields a date.
+	fallbackDateFolder = "Unknown"
+	// onUnknownDate is ON_UNKNOWN_DATE, what happens to media files without a date:
+	// fallback, skip or prompt.
+	onUnknownDate = "fallback"
+	// dateSince and dateUntil are the inclusive bounds of DATE_SINCE and DATE_UNTIL, zero
+	// when unset.
+	dateSince, dateUntil dateBound
+	// dateLocation is the TIMEZONE sidecar timestamps and EXIF dates are converted to before
+	// picking their year/month folder, so a photo taken late on the last day of a month
+	// stays in that month.
+	dateLocation = time.UTC
+	// folderTemplate is the FOLDER_TEMPLATE "YYYY/MM" date folders are uploaded as.
+	folderTemplate = defaultFolderTemplate
+	// dateDiscrepancyDays is the DATE_DISCREPANCY_DAYS the sidecar and EXIF dates of a media
+	// file may differ by before it is reported, 0 disables the check.
+	dateDiscrepancyDays int
+)
+
+// parseFallbackYear returns the folder for a FALLBACK_YEAR value: "YYYY/01" for a year such
+// as 2000, or any other single folder name such as "Unknown" as is.
+func parseFallbackYear(value string) (string, error) {
+	if year, err := strconv.Atoi(value); err == nil {
+		if year < 1 || year > 9999 {
+			return "", fmt.Errorf("year %d out of range", year)
+		}
+		return fmt.Sprintf("%04d/01", year), nil
+	}
+	if value == "" || value == "." || value == ".." || strings.ContainsAny(value, `/\`) {
+		return "", fmt.Errorf("%q is neither a year nor a folder name", value)
+	}
+	return value, nil
+}
+
+// parseFolderTemplate parses a FOLDER_TEMPLATE value such as "{year}/{year}-{month}". It
+// must contain {year} and stay below the remote base path.
+func parseFolderTemplate(value string) (string, error) {
+	value = strings.Trim(value, "/")
+	if !strings.Contains(value, "{year}") {
+		return "", fmt.Errorf("%q doesn't contain {year}", value)
+	}
+	rest := strings.NewReplacer("{year}", "", "{month}", "").Replace(value)
+	if strings.ContainsAny(rest, `{}\`) {
+		return "", fmt.Errorf("%q contains a placeholder other than {year} and {month}, or a backslash", value)
+	}
+	for _, part := range strings.Split(value, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("%q contains an empty, . or .. folder", value)
+		}
+	}
+	return value, nil
+}
+
+// applyFolderTemplate returns the folder a "YYYY/MM" date folder is uploaded as with
+// FOLDER_TEMPLATE. Other folders, such as a FALLBACK_YEAR folder name, are returned as is.
+func applyFolderTemplate(folder string) string {
+	year, month, ok := strings.Cut(folder, "/")
+	if !ok || len(year) != 4 || len(month) != 2 || strings.Trim(year+month, "0123456789") != "" {
+		return folder
+	}
+	return strings.NewReplacer("{year}", year, "{month}", month).Replace(folderTemplate)
+}
+
+// parseTimezone parses a TIMEZONE value: an IANA name such as "America/New_York", or "local"
+// for the time zone of the machine.
+func parseTimezone(value string) (*time.Location, error) {
+	if strings.EqualFold(value, "local") {
+		return time.Local, nil
+	}
+	return time.LoadLocation(value)
+}
+
+// parseDateSources parses a comma separated DATE_SOURCE list such as "creation,taken,exif".
+func parseDateSources(value string) ([]string, error) {
+	var sources []string
+	for _, source := range strings.Split(value, ",") {
+		source = strings.ToLower(strings.TrimSpace(source))
+		if source == "" {
+			continue
+		}
+		if !slices.Contains(knownDateSources, source) {
+			return nil, fmt.Errorf("unknown date source %q, must be one of %s", source, strings.Join(knownDateSources, ", "))
+		}
+		sources = append(sources, source)
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no date source given")
+	}
+	return sources, nil
+}
+
+// resolveDateFolder returns the "YYYY/MM" folder of mediaPath and the source it came from,
+// trying dateSources in order, and records what it found out in index. sidecar is nil for
+// media files without a JSON sidecar.
+func resolveDateFolder(index *MediaIndex, mediaPath string, sidecar *metadata.PhotoMetadata) (string, string) {
+	// Flattened uploads only need the date to filter by it
+	if organizeBy == "none" && !needsDates() {
+		return "", "none"
+	}
+
+	reason := "no-sidecar"
+	if sidecar != nil {
+		reason = "sidecar-no-date"
+	}
+
+	for _, source := range dateSources {
+		var folder, timestamp string
+		var err error
+		switch source {
+		case "taken", "creation", "modified":
+			if sidecar == nil {
+				continue
+			}
+			timestamp = sidecar.PhotoTakenTime.Timestamp
+			switch source {
+			case "creation":
+				timestamp = sidecar.CreationTime.Timestamp
+			case "modified":
+				timestamp = sidecar.PhotoLastModifiedTime.Timestamp
+			}
+			folder, err = extractDateFolder(timestamp)
+		case "exif":
+			if folder, err = exifDateFolder(mediaPath); errors.Is(err, errNoExifDate) {
+				reason = "zero-time"
+			} else if err != nil {
+				reason = "exif-error"
+			}
+		case "filename":
+			folder, err = filenameDateFolder(mediaPath)
+		}
+		// Year 1 is what a zeroed date turns into, so it is no date at all
+		if err == nil && strings.HasPrefix(folder, "0001/") {
+			err = errors.New("date is in year 1")
+		}
+		if err != nil {
+			slog.Debug("Date source not usable", "file", mediaPath, "source", source, "error", err)
+			continue
+		}
+		checkDateDiscrepancy(index, mediaPath, sidecar, source)
+		if taken, err := parseSidecarTimestamp(timestamp); timestamp != "" && err == nil {
+			index.SetTakenTime(mediaPath, taken)
+		}
+		return folder, source
+	}
+
+	if onUnknownDate == "skip" {
+		slog.Warn("No date found, skipping file", "file", mediaPath, "sources", strings.Join(dateSources, ","), "reason", reason)
+	} else {
+		slog.Warn("No date found, using fallback folder", "file", mediaPath, "folder", fallbackDateFolder, "sources", strings.Join(dateSources, ","), "reason", reason)
+	}
+	index.SetUnresolved(mediaPath, reason)
+	return fallbackDateFolder, fallbackDateSource
+}
+
+// checkDateDiscrepancy warns when the sidecar's photoTakenTime and the EXIF date of
+// mediaPath are more than DATE_DISCREPANCY_DAYS apart, which happens for old scans whose
+// taken time is the upload date, and records the discrepancy in index. source is the date
+// source that was used.
+func checkDateDiscrepancy(index *MediaIndex, mediaPath string, sidecar *metadata.PhotoMetadata, source string) {
+	if dateDiscrepancyDays == 0 || sidecar == nil {
+		return
+	}
+	taken, err := parseSidecarTimestamp(sidecar.PhotoTakenTime.Timestamp)
+	if err != nil || taken.Year() <= 1 {
+		return
+	}
+	exif, err := exifDate(mediaPath)
+	if err != nil || exif.Year() <= 1 {
+		return
+	}
+
+	days := int(taken.Sub(exif).Abs().Hours() / 24)
+	if days <= dateDiscrepancyDays {
+		return
+	}
+	slog.Warn("Sidecar and EXIF dates disagree, set DATE_SOURCE to pick the right one", "file", mediaPath,
+		"taken", taken.Format(time.DateOnly), "exif", exif.Format(time.DateOnly), "days", days, "source", source)
+	index.SetDiscrepancy(mediaPath, fmt.Sprintf("taken %s, exif %s, %d days apart", taken.Format(time.DateOnly), exif.Format(time.DateOnly), days))
+}
+
+// exifDateFolder returns the "YYYY/MM" folder of the EXIF creation date of mediaPath,
+// falling back to the original date.
+func exifDateFolder(mediaPath string) (string, error) {
+	date, err := exifDate(mediaPath)
+	if err != nil {
+		return "", err
+	}
+	return date.Format("2006/01"), nil
+}
+
+// exifDate returns the EXIF creation date of mediaPath, falling back to the original date,
+// in dateLocation like sidecar timestamps.
+func exifDate(mediaPath string) (time.Time, error) {
+	file, err := openMedia(mediaPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	meta, err := exifmeta.Parse(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !meta.DateTimeCreated.IsZero() {
+		return exifTimeIn(meta.DateTimeCreated, dateLocation), nil
+	}
+	if !meta.DateTimeOriginal.IsZero() {
+		return exifTimeIn(meta.DateTimeOriginal, dateLocation), nil
+	}
+	return time.Time{}, errNoExifDate
+}
+
+// exifTimeIn returns the EXIF date t in loc. A date with a zone is converted, one without,
+// as EXIF dates usually are, is the camera's clock and taken to be in loc, the same as a
+// sidecar timestamp without a zone.
+func exifTimeIn(t exifmeta.Time, loc *time.Location) time.Time {
+	if t.HasLoc {
+		return t.Time.In(loc)
+	}
+	year, month, day := t.Date()
+	hour, minute, second := t.Clock()
+	return time.Date(year, month, day, hour, minute, second, t.Nanosecond(), loc)
+}
+
+// parseFilenameDatePatterns compiles whitespace separated regular expressions. Each must have
+// the named groups year and month.
+func parseFilenameDatePatterns(value string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, expr := range strings.Fields(value) {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filename date pattern %q: %v", expr, err)
+		}
+		if pattern.SubexpIndex("year") < 0 || pattern.SubexpIndex("month") < 0 {
+			return nil, fmt.Errorf("filename date pattern %q needs the named groups year and month", expr)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// parseTimestampLayouts parses a TIMESTAMP_LAYOUTS list of Go time layouts separated by
+// semicolons or newlines, such as "2006-01-02T15:04:05Z07:00;Jan 2, 2006 3:04:05 PM".
+// Commas can't separate them, since layouts with month names need them.
+func parseTimestampLayouts(value string) ([]string, error) {
+	var layouts []string
+	for _, layout := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '\n' }) {
+		if layout = strings.TrimSpace(layout); layout != "" {
+			layouts = append(layouts, layout)
+		}
+	}
+	if len(layouts) == 0 {
+		return nil, errors.New("no timestamp layout given")
+	}
+	return layouts, nil
+}
+
+// filenameDateFolder returns the "YYYY/MM" folder of a date embedded in the name of mediaPath.
+func filenameDateFolder(mediaPath string) (string, error) {
+	name := filepath.Base(mediaPath)
+	for _, pattern := range filenameDatePatterns {
+		match := pattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		year, yearErr := strconv.Atoi(match[pattern.SubexpIndex("year")])
+		month, monthErr := strconv.Atoi(match[pattern.SubexpIndex("month")])
+		if yearErr != nil || monthErr != nil || month < 1 || month > 12 || year > time.Now().Year() {
+			continue
+		}
+		return fmt.Sprintf("%04d/%02d", year, month), nil
+	}
+	return "", errors.New("no date in file name")
+}
+
+// dateBound is a DATE_SINCE or DATE_UNTIL bound.
+type dateBound struct {
+	// folder is the "YYYY/MM" folder the bound falls in, empty when unset.
+	folder string
+	// at is the instant of an RFC3339 bound, zero for a "YYYY-MM" one.
+	at time.Time
+}
+
+// set reports whether the bound was given.
+func (b dateBound) set() bool {
+	return b.folder != ""
+}
+
+// compare returns -1, 0 or +1 as a media file in dateFolder, taken at taken if known, is
+// dated before, at or after b. An RFC3339 bound is compared with the sidecar timestamp when
+// the file has one, otherwise, and for a "YYYY-MM" bound, only the months are compared.
+func (b dateBound) compare(dateFolder string, taken time.Time, known bool) int {
+	if known && !b.at.IsZero() {
+		return taken.Compare(b.at)
+	}
+	// "YYYY/MM" folders sort chronologically as strings
+	return strings.Compare(dateFolder, b.folder)
+}
+
+func (b dateBound) String() string {
+	if !b.at.IsZero() {
+		return b.at.Format(time.RFC3339)
+	}
+	return b.folder
+}
+
+// parseDateBound parses a DATE_SINCE or DATE_UNTIL value, either "YYYY-MM" or RFC3339. An
+// RFC3339 value falls in its month in TIMEZONE, so dateLocation must be set before.
+func parseDateBound(value string) (dateBound, error) {
+	if value == "" {
+		return dateBound{}, nil
+	}
+	if t, err := time.Parse("2006-01", value); err == nil {
+		return dateBound{folder: t.Format("2006/01")}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return dateBound{}, fmt.Errorf("invalid date %q, must be YYYY-MM or RFC3339", value)
+	}
+	t = t.In(dateLocation)
+	return dateBound{folder: t.Format("2006/01"), at: t}, nil
+}
+
+// skipUnknownDates removes the media files that got fallbackDateFolder from index as
+// ON_UNKNOWN_DATE asks, and returns how many were removed. With prompt the user decides for
+// all of them at once.
+func skipUnknownDates(index *MediaIndex) (int, error) {
+	if onUnknownDate == "fallback" {
+		return 0, nil
+	}
+
+	var unknown []string
+	index.Range(func(mediaPath, dateFolder string) bool {
+		if index.DateSource(mediaPath) == fallbackDateSource {
+			unknown = append(unknown, mediaPath)
+		}
+		return true
+	})
+	if len(unknown) == 0 {
+		return 0, nil
+	}
+
+	if onUnknownDate == "prompt" {
+		upload, err := askYesNo(fmt.Sprintf("%d files have no date. Upload them into %s anyway?", len(unknown), fallbackDateFolder))
+		if err != nil || upload {
+			return 0, err
+		}
+	}
+	for _, mediaPath := range unknown {
+		slog.Debug("Skipping file without a date", "file", mediaPath)
+		index.Delete(mediaPath)
+	}
+	return len(unknown), nil
+}
+
+// needsDates reports whether media files have to be dated to filter them, by DATE_SINCE,
+// DATE_UNTIL or ONLY_NEW_BY=date, or to list them with LIST_ONLY.
+func needsDates() bool {
+	return listOnly || dateSince.set() || dateUntil.set() || (onlyNew && onlyNewBy == onlyNewByDate)
+}
+
+// filterByDate removes media files dated outside DATE_SINCE and DATE_UNTIL from index and
+// returns how many were removed. Files dated by their sidecar are compared by the sidecar's
+// timestamp with an RFC3339 bound, others by their date folder's month. Files without a
+// known date are removed too.
+func filterByDate(index *MediaIndex) int {
+	if !dateSince.set() && !dateUntil.set() {
+		return 0
+	}
+
+	skipped := 0
+	index.Range(func(mediaPath, dateFolder string) bool {
+		taken, known := index.TakenTime(mediaPath)
+		outside := (dateSince.set() && dateSince.compare(dateFolder, taken, known) < 0) ||
+			(dateUntil.set() && dateUntil.compare(dateFolder, taken, known) > 0)
+		if outside || index.DateSource(mediaPath) == fallbackDateSource {
+			slog.Debug("Skipping file outside date range", "file", mediaPath, "folder", dateFolder)
+			index.Delete(mediaPath)
+			skipped++
+		}
+		return true
+	})
+	return skipped
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tajtiattila/metadata/exif"
+	"github.com/tajtiattila/metadata/exif/exiftag"
+
+	"media2nextcloud/metadata"
+)
+
+// TestResolveDateFolderYearOne checks that a zeroed sidecar date, which turns into year 1,
+// counts as no date rather than a 0001/01 folder.
+func TestResolveDateFolderYearOne(t *testing.T) {
+	mediaPath := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+	writeFile(t, mediaPath, "no EXIF")
+	zero := metadata.TimeData{Timestamp: "0001-01-01T00:00:00Z"}
+
+	tests := []struct {
+		name       string
+		sidecar    metadata.PhotoMetadata
+		wantFolder string
+		wantSource string
+	}{
+		{"falls through to creation", metadata.PhotoMetadata{PhotoTakenTime: zero, CreationTime: metadata.TimeData{Timestamp: "1647253800"}}, "2022/03", "creation"},
+		{"falls back", metadata.PhotoMetadata{PhotoTakenTime: zero, CreationTime: zero}, fallbackDateFolder, fallbackDateSource},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folder, source := resolveDateFolder(newMediaIndex(), mediaPath, &tt.sidecar)
+			if folder != tt.wantFolder || source != tt.wantSource {
+				t.Errorf("resolveDateFolder() = %q, %q, want %q, %q", folder, source, tt.wantFolder, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestParseTimestampLayouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "default", value: defaultTimestampLayouts, want: []string{"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05", "2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05", "2006:01:02 15:04:05"}},
+		{name: "comma inside a layout", value: "Jan 2, 2006 3:04:05 PM;2006-01-02", want: []string{"Jan 2, 2006 3:04:05 PM", "2006-01-02"}},
+		{name: "newlines", value: "Jan 2, 2006 at 3:04 PM\n02.01.2006 15:04\n", want: []string{"Jan 2, 2006 at 3:04 PM", "02.01.2006 15:04"}},
+		{name: "blanks around", value: " 2006-01-02 15:04:05 ; ;2006/01/02 ", want: []string{"2006-01-02 15:04:05", "2006/01/02"}},
+		{name: "empty", value: "", wantErr: true},
+		{name: "separators only", value: " ;\n; ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTimestampLayouts(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimestampLayouts(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseTimestampLayouts(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseSidecarTimestampLayouts parses timestamps with configured layouts, including
+// ones with commas, spaces and zone offsets, in UTC and another TIMEZONE.
+func TestParseSidecarTimestampLayouts(t *testing.T) {
+	oldLayouts, oldLocation := timestampLayouts, dateLocation
+	t.Cleanup(func() { timestampLayouts, dateLocation = oldLayouts, oldLocation })
+	tokyo := time.FixedZone("JST", 9*60*60)
+
+	layouts, err := parseTimestampLayouts("Jan 2, 2006 3:04:05 PM MST;Jan 2, 2006 3:04:05 PM;2006-01-02 15:04:05 -0700;" + defaultTimestampLayouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestampLayouts = layouts
+
+	tests := []struct {
+		timestamp string
+		location  *time.Location
+		want      time.Time
+	}{
+		{"Mar 14, 2022 10:30:00 AM", time.UTC, time.Date(2022, 3, 14, 10, 30, 0, 0, time.UTC)},
+		{"Mar 14, 2022 10:30:00 PM UTC", time.UTC, time.Date(2022, 3, 14, 22, 30, 0, 0, time.UTC)},
+		// A layout without a zone is read in TIMEZONE
+		{"Mar 31, 2022 11:30:00 PM", tokyo, time.Date(2022, 3, 31, 23, 30, 0, 0, tokyo)},
+		{"2022-03-14 10:30:00 +0530", time.UTC, time.Date(2022, 3, 14, 5, 0, 0, 0, time.UTC)},
+		{"2022-03-14 10:30:00 -0800", tokyo, time.Date(2022, 3, 14, 18, 30, 0, 0, time.UTC)},
+		{"2022-03-14T10:30:00+05:30", time.UTC, time.Date(2022, 3, 14, 5, 0, 0, 0, time.UTC)},
+		{"2022-03-14 10:30:00", tokyo, time.Date(2022, 3, 14, 10, 30, 0, 0, tokyo)},
+		{"1647253800", tokyo, time.Unix(1647253800, 0)},
+	}
+	for _, tt := range tests {
+		dateLocation = tt.location
+		got, err := parseSidecarTimestamp(tt.timestamp)
+		if err != nil {
+			t.Errorf("parseSidecarTimestamp(%q) error = %v", tt.timestamp, err)
+			continue
+		}
+		if !got.Equal(tt.want) || got.Location() != tt.location {
+			t.Errorf("parseSidecarTimestamp(%q) = %v, want %v in %v", tt.timestamp, got, tt.want, tt.location)
+		}
+	}
+
+	dateLocation = time.UTC
+	if _, err := parseSidecarTimestamp("14.03.2022 10:30"); err == nil {
+		t.Error("parseSidecarTimestamp() accepted a timestamp no layout matches")
+	}
+}
+
+func TestFilenameDateFolder(t *testing.T) {
+	oldPatterns := filenameDatePatterns
+	t.Cleanup(func() { filenameDatePatterns = oldPatterns })
+	patterns, err := parseFilenameDatePatterns(defaultFilenameDatePatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filenameDatePatterns = patterns
+
+	nextYear := time.Now().Year() + 1
+	tests := []struct {
+		name, want string
+	}{
+		{"IMG-20220314-WA0001.jpg", "2022/03"},
+		{"VID-20191231-WA0042.mp4", "2019/12"},
+		{"IMG_20220314_123456.jpg", "2022/03"},
+		{"IMG_20220314_123456_HDR.jpg", "2022/03"},
+		{"PXL_20230102_081122334.MP.jpg", "2023/01"},
+		{"Screenshot_2021-05-02-10-11-12.png", "2021/05"},
+		{"Screenshot_20210502-101112_Chrome.jpg", "2021/05"},
+		{"20220314_123456.jpg", "2022/03"},
+		{"signal-2022-03-14-123456.jpg", "2022/03"},
+		{"Photo 2018_07_09 (2).jpeg", "2018/07"},
+		{"IMG_1234.jpg", ""},
+		{"DSC01234.JPG", ""},
+		{"IMG-20221314-WA0001.jpg", ""},
+		{"IMG-20220230-WA0001.jpg", "2022/02"},
+		{"IMG-20220300-WA0001.jpg", ""},
+		{"1234202203141234.jpg", ""},
+		{fmt.Sprintf("IMG_%d0101_000000.jpg", nextYear), ""},
+	}
+	for _, tt := range tests {
+		got, err := filenameDateFolder(filepath.Join("/photos", tt.name))
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("filenameDateFolder(%q) = %q, want no date", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("filenameDateFolder(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseFilenameDatePatterns(t *testing.T) {
+	patterns, err := parseFilenameDatePatterns(`^scan_(?P<month>\d{2})-(?P<year>\d{4})  ` + defaultFilenameDatePatterns)
+	if err != nil {
+		t.Fatalf("parseFilenameDatePatterns() error = %v", err)
+	}
+	if len(patterns) != 2 {
+		t.Fatalf("parseFilenameDatePatterns() = %d patterns, want 2", len(patterns))
+	}
+
+	oldPatterns := filenameDatePatterns
+	t.Cleanup(func() { filenameDatePatterns = oldPatterns })
+	filenameDatePatterns = patterns
+	if got, err := filenameDateFolder("scan_07-1998.tif"); err != nil || got != "1998/07" {
+		t.Errorf("filenameDateFolder() with a custom pattern = %q, %v, want 1998/07", got, err)
+	}
+
+	for _, value := range []string{`(?P<year>\d{4})`, `(?P<year>\d{4})(?P<month>\d{2}`, `(\d{4})(\d{2})`} {
+		if _, err := parseFilenameDatePatterns(value); err == nil {
+			t.Errorf("parseFilenameDatePatterns(%q) succeeded", value)
+		}
+	}
+	if patterns, err := parseFilenameDatePatterns(" "); err != nil || len(patterns) != 0 {
+		t.Errorf("parseFilenameDatePatterns(\" \") = %v, %v, want no patterns", patterns, err)
+	}
+}
+
+// TestIndexingUsesFilenameDates indexes media files without sidecar or EXIF, which get
+// their folder from their names before falling back.
+func TestIndexingUsesFilenameDates(t *testing.T) {
+	oldPatterns := filenameDatePatterns
+	t.Cleanup(func() { filenameDatePatterns = oldPatterns })
+	filenameDatePatterns, _ = parseFilenameDatePatterns(defaultFilenameDatePatterns)
+
+	dir := t.TempDir()
+	whatsApp, screenshot, undated := filepath.Join(dir, "IMG-20220314-WA0001.jpg"), filepath.Join(dir, "Screenshot_2021-05-02-10-11-12.png"), filepath.Join(dir, "IMG_1234.jpg")
+	for _, path := range []string{whatsApp, screenshot, undated} {
+		writeFile(t, path, "no metadata")
+	}
+
+	index := newMediaIndex()
+	parseExtractMediaFilesWithoutMedtadataJsonFileAddToMap(index, []string{whatsApp, screenshot, undated})
+	for path, want := range map[string]string{whatsApp: "2022/03", screenshot: "2021/05", undated: fallbackDateFolder} {
+		if got, _ := index.Get(path); got != want {
+			t.Errorf("folder of %s = %q, want %q", filepath.Base(path), got, want)
+		}
+	}
+	if source := index.DateSource(whatsApp); source != "filename" {
+		t.Errorf("date source of %s = %q, want filename", filepath.Base(whatsApp), source)
+	}
+}
+
+// fixtureExifJPEG returns a JPEG whose EXIF DateTimeOriginal is dateTime.
+func fixtureExifJPEG(t *testing.T, dateTime string) []byte {
+	t.Helper()
+	var photo, out bytes.Buffer
+	if err := jpeg.Encode(&photo, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	x := exif.New(16, 16)
+	x.Set(exiftag.DateTimeOriginal, exif.Ascii(dateTime))
+	if err := exif.Copy(&out, &photo, x); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// TestExifDateFolderTimezone dates photos taken shortly after midnight UTC on the first of
+// a month. An EXIF date with a zone is converted to TIMEZONE like a sidecar timestamp, one
+// without is the camera's clock and kept.
+func TestExifDateFolderTimezone(t *testing.T) {
+	old := dateLocation
+	t.Cleanup(func() { dateLocation = old })
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+
+	tests := []struct {
+		dateTime string
+		loc      *time.Location
+		want     string
+	}{
+		{"2022:02:01 03:30:00Z", time.UTC, "2022/02"},
+		{"2022:02:01 03:30:00Z", newYork, "2022/01"},
+		{"2022:02:01 03:30:00", time.UTC, "2022/02"},
+		{"2022:02:01 03:30:00", newYork, "2022/02"},
+	}
+	for _, tt := range tests {
+		photo := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+		writeFile(t, photo, string(fixtureExifJPEG(t, tt.dateTime)))
+		dateLocation = tt.loc
+
+		if got, err := exifDateFolder(photo); err != nil || got != tt.want {
+			t.Errorf("exifDateFolder() of %q in %s = %q, %v, want %q", tt.dateTime, tt.loc, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseTimezone(t *testing.T) {
+	for _, tt := range []struct {
+		value, want string
+		wantErr     bool
+	}{
+		{value: "UTC", want: "UTC"},
+		{value: "America/New_York", want: "America/New_York"},
+		{value: "local", want: "Local"},
+		{value: "LOCAL", want: "Local"},
+		{value: "Mars/Olympus_Mons", wantErr: true},
+	} {
+		loc, err := parseTimezone(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTimezone(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && loc.String() != tt.want {
+			t.Errorf("parseTimezone(%q) = %v, want %s", tt.value, loc, tt.want)
+		}
+	}
+}
+
+func TestParseDateBound(t *testing.T) {
+	old := dateLocation
+	t.Cleanup(func() { dateLocation = old })
+	dateLocation = time.FixedZone("JST", 9*60*60)
+
+	for _, tt := range []struct {
+		value, wantFolder string
+		wantAt            time.Time
+		wantErr           bool
+	}{
+		{value: ""},
+		{value: "2022-03", wantFolder: "2022/03"},
+		// 22:00 UTC on the last day of March is already April in TIMEZONE
+		{value: "2022-03-31T22:00:00Z", wantFolder: "2022/04", wantAt: time.Date(2022, 3, 31, 22, 0, 0, 0, time.UTC)},
+		{value: "2022-03-15", wantErr: true},
+		{value: "2022/03", wantErr: true},
+	} {
+		got, err := parseDateBound(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDateBound(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got.folder != tt.wantFolder || !got.at.Equal(tt.wantAt) {
+			t.Errorf("parseDateBound(%q) = %q at %v, want %q at %v", tt.value, got.folder, got.at, tt.wantFolder, tt.wantAt)
+		}
+	}
+}
+
+// TestFilterByDate checks an RFC3339 bound is compared with the sidecar timestamp of files
+// dated by one and with the month of the others, and a "YYYY-MM" bound always with the month.
+func TestFilterByDate(t *testing.T) {
+	oldSince, oldUntil, oldLocation := dateSince, dateUntil, dateLocation
+	t.Cleanup(func() { dateSince, dateUntil, dateLocation = oldSince, oldUntil, oldLocation })
+	dateLocation = time.UTC
+
+	march := func(day, hour int) time.Time { return time.Date(2022, 3, day, hour, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name         string
+		since, until string
+		want         []string
+	}{
+		{name: "months", since: "2022-03", until: "2022-03", want: []string{"early", "late", "month only"}},
+		{name: "since instant", since: "2022-03-10T00:00:00Z", want: []string{"late", "month only", "next month"}},
+		{name: "until instant", until: "2022-03-10T00:00:00Z", want: []string{"early", "last month", "month only"}},
+		{name: "window", since: "2022-03-05T00:00:00Z", until: "2022-03-25T00:00:00Z", want: []string{"early", "month only"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if dateSince, err = parseDateBound(tt.since); err != nil {
+				t.Fatal(err)
+			}
+			if dateUntil, err = parseDateBound(tt.until); err != nil {
+				t.Fatal(err)
+			}
+			index := newMediaIndex()
+			index.Add("early", "2022/03")
+			index.SetTakenTime("early", march(5, 12))
+			index.Add("late", "2022/03")
+			index.SetTakenTime("late", march(28, 12))
+			index.Add("month only", "2022/03")
+			index.Add("last month", "2022/02")
+			index.Add("next month", "2022/04")
+
+			filterByDate(index)
+			got := index.Paths()
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("filterByDate() kept %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFolderTemplate(t *testing.T) {
+	for _, tt := range []struct {
+		value, want string
+		wantErr     bool
+	}{
+		{value: "{year}/{month}", want: "{year}/{month}"},
+		{value: "/{year}/{year}-{month}/", want: "{year}/{year}-{month}"},
+		{value: "Photos {year}", want: "Photos {year}"},
+		{value: "{month}", wantErr: true},
+		{value: "{year}/{day}", wantErr: true},
+		{value: "{year}//{month}", wantErr: true},
+		{value: "../{year}", wantErr: true},
+		{value: `{year}\{month}`, wantErr: true},
+	} {
+		got, err := parseFolderTemplate(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFolderTemplate(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseFolderTemplate(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestApplyFolderTemplate(t *testing.T) {
+	old := folderTemplate
+	t.Cleanup(func() { folderTemplate = old })
+	folderTemplate = "{year}/{year}-{month}"
+
+	for _, tt := range []struct{ folder, want string }{
+		{"2022/07", "2022/2022-07"},
+		{"Unknown", "Unknown"},
+		{"Trash", "Trash"},
+	} {
+		if got := applyFolderTemplate(tt.folder); got != tt.want {
+			t.Errorf("applyFolderTemplate(%q) = %q, want %q", tt.folder, got, tt.want)
+		}
+	}
+}
+
+func TestParseDateSources(t *testing.T) {
+	sources, err := parseDateSources(" Modified, taken ,,EXIF")
+	if err != nil || !slices.Equal(sources, []string{"modified", "taken", "exif"}) {
+		t.Errorf("parseDateSources() = %v, %v", sources, err)
+	}
+	for _, value := range []string{"", " , ", "taken,uploaded"} {
+		if _, err := parseDateSources(value); err == nil {
+			t.Errorf("parseDateSources(%q) succeeded", value)
+		}
+	}
+}
+
+// TestResolveDateFolderSources dates a sidecar whose taken, creation and modified times are
+// in different months by each DATE_SOURCE order and TIMEZONE.
+func TestResolveDateFolderSources(t *testing.T) {
+	oldSources, oldLocation := dateSources, dateLocation
+	t.Cleanup(func() { dateSources, dateLocation = oldSources, oldLocation })
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+
+	mediaPath := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+	writeFile(t, mediaPath, "no EXIF")
+	sidecar := metadata.PhotoMetadata{
+		// 2022-04-01 02:30 UTC, still March in New York
+		PhotoTakenTime:        metadata.TimeData{Timestamp: "1648780200"},
+		CreationTime:          metadata.TimeData{Timestamp: "1656633600"},
+		PhotoLastModifiedTime: metadata.TimeData{Timestamp: "1669852800"},
+	}
+
+	tests := []struct {
+		sources    string
+		location   *time.Location
+		wantFolder string
+		wantSource string
+	}{
+		{"taken,creation,modified", time.UTC, "2022/04", "taken"},
+		{"taken,creation,modified", newYork, "2022/03", "taken"},
+		{"creation,taken", time.UTC, "2022/07", "creation"},
+		{"modified,taken", time.UTC, "2022/12", "modified"},
+		{"exif,modified", time.UTC, "2022/12", "modified"},
+	}
+	for _, tt := range tests {
+		dateSources, _ = parseDateSources(tt.sources)
+		dateLocation = tt.location
+		folder, source := resolveDateFolder(newMediaIndex(), mediaPath, &sidecar)
+		if folder != tt.wantFolder || source != tt.wantSource {
+			t.Errorf("DATE_SOURCE=%s TIMEZONE=%v: resolveDateFolder() = %q, %q, want %q, %q", tt.sources, tt.location, folder, source, tt.wantFolder, tt.wantSource)
+		}
+	}
+}
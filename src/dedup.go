@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"sort"
+)
+
+var dedup bool
+
+// deduplicateMedia removes copies of the same photo (as decided by HASH_ALGORITHM) from index, which
+// Takeout creates for every album a photo belongs to on top of its "Photos from YYYY"
+// copy. The copy outside of album folders is kept, and the albums of the removed copies
+// are recorded in index, so album organization still sees every album the photo belongs
+// to. It returns the number of duplicates removed.
+func deduplicateMedia(index *MediaIndex) int {
+	paths := index.Paths()
+
+	byHash, hashes := findDuplicateGroups(paths, func(path string, err error) {
+		slog.Warn("Failed to hash file for deduplication", "file", path, "error", err)
+	})
+	// Nextcloud verifies uploads against the SHA-256, which saves hashing them again
+	if contentHasher.Name() == "sha256" {
+		for path, hash := range hashes {
+			index.SetChecksum(path, hash)
+		}
+	}
+
+	duplicates := 0
+	for _, group := range byHash {
+		// Prefer the copy outside of album folders, then the first path
+		sort.SliceStable(group, func(i, j int) bool {
+			_, iInAlbum := albumDirs[filepath.Dir(group[i])]
+			_, jInAlbum := albumDirs[filepath.Dir(group[j])]
+			return !iInAlbum && jInAlbum
+		})
+
+		kept := group[0]
+		for _, duplicate := range group[1:] {
+			if title, inAlbum := albumDirs[filepath.Dir(duplicate)]; inAlbum {
+				index.AddAlbum(kept, title)
+			}
+			index.Delete(duplicate)
+			duplicates++
+			slog.Debug("Skipping duplicate file", "file", duplicate, "duplicateOf", kept)
+		}
+	}
+
+	return duplicates
+}
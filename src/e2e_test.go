@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestTakeoutToLocalBackend runs a fake Takeout export through indexing and uploading to
+// the local backend and checks the files end up in their YYYY/MM folders.
+func TestTakeoutToLocalBackend(t *testing.T) {
+	takeout := filepath.Join(t.TempDir(), "Takeout", "Google Photos")
+	photos := filepath.Join(takeout, "Photos from 2022")
+	album := filepath.Join(takeout, "Holidays")
+	for _, f := range []struct{ path, content string }{
+		{filepath.Join(photos, "IMG_0001.jpg"), "march photo"},
+		{filepath.Join(photos, "IMG_0001.jpg.supplemental-metadata.json"), `{"title": "IMG_0001.jpg", "photoTakenTime": {"timestamp": "1647253800"}}`},
+		// New Year's Eve in UTC, which a local time zone would move to the next month
+		{filepath.Join(photos, "VID_0002.mp4"), "december video"},
+		{filepath.Join(photos, "VID_0002.mp4.supplemental-metadata.json"), `{"title": "VID_0002.mp4", "photoTakenTime": {"timestamp": "1640995199"}}`},
+		{filepath.Join(album, "PXL_0003.jpg"), "album photo"},
+		{filepath.Join(album, "PXL_0003.jpg.supplemental-metadata.json"), `{"title": "PXL_0003.jpg", "photoTakenTime": {"timestamp": "1596240000"}}`},
+		{filepath.Join(album, "metadata.json"), `{"title": "Holidays"}`},
+	} {
+		writeFile(t, f.path, f.content)
+	}
+
+	index, errs := processDirectory([]string{takeout})
+	if errs != 0 {
+		t.Fatalf("processDirectory() failed for %d files", errs)
+	}
+	mediaFiles := planUploads(index)
+	dest := t.TempDir()
+	backend := localBackend{root: dest}
+	report := newRunReport(filepath.Join(t.TempDir(), "report.csv"))
+	processed := uploadMediaFilesToNextcloud(context.Background(), 1, 2, backend, index, getUniqueDirectoryToBecreatedOnNextCloud(mediaFiles), mediaFiles, nil, report)
+	if processed != 3 {
+		t.Errorf("uploadMediaFilesToNextcloud() processed %d files, want 3", processed)
+	}
+
+	var uploaded []string
+	err := filepath.WalkDir(dest, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(dest, path)
+			uploaded = append(uploaded, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(uploaded)
+	want := []string{"2020/08/PXL_0003.jpg", "2021/12/VID_0002.mp4", "2022/03/IMG_0001.jpg"}
+	if !slices.Equal(uploaded, want) {
+		t.Errorf("uploaded files = %v, want %v", uploaded, want)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "2022", "03", "IMG_0001.jpg"))
+	if err != nil || string(data) != "march photo" {
+		t.Errorf("uploaded content = %q, %v, want the local file's", data, err)
+	}
+}
+
+// TestSplitTakeoutIndexing indexes an export split into two parts, with a sidecar in
+// another part than its media file, and checks the media file is dated from it.
+func TestSplitTakeoutIndexing(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "Takeout", "Google Photos")
+	second := filepath.Join(dir, "Takeout 2", "Google Photos")
+	photo := filepath.Join(first, "Photos from 2022", "IMG_0001.jpg")
+	sidecar := filepath.Join(second, "Photos from 2022", "IMG_0001.jpg.supplemental-metadata.json")
+	writeFile(t, photo, "no metadata")
+	writeFile(t, sidecar, `{"title": "IMG_0001.jpg", "photoTakenTime": {"timestamp": "1647253800"}}`)
+	// The second part has media files in the same folder too
+	writeFile(t, filepath.Join(second, "Photos from 2022", "IMG_0002.jpg"), "no metadata")
+	orphanSidecars = nil
+
+	index, errs := processDirectory([]string{first, second})
+	if errs != 0 {
+		t.Fatalf("processDirectory() failed for %d files", errs)
+	}
+	if folder, ok := index.Get(photo); !ok || folder != "2022/03" {
+		t.Errorf("folder of %s = %q, %t, want 2022/03", filepath.Base(photo), folder, ok)
+	}
+	if got, _ := index.Sidecar(photo); got != sidecar {
+		t.Errorf("sidecar of %s = %q, want %q", filepath.Base(photo), got, sidecar)
+	}
+	if len(orphanSidecars) != 0 {
+		t.Errorf("orphan sidecars = %q, want none", orphanSidecars)
+	}
+}
+
+// TestNearbySidecarIndexing indexes sidecars whose media file is in the parent or a
+// subfolder of the sidecar's folder, and one whose media file is nowhere, which must be
+// reported as an orphan.
+func TestNearbySidecarIndexing(t *testing.T) {
+	const sidecarJSON = `{"title": "IMG_0001.jpg", "photoTakenTime": {"timestamp": "1647253800"}}`
+	tests := []struct {
+		name                 string
+		photoDir, sidecarDir string
+		wantOrphan           bool
+	}{
+		{name: "sidecar in a subfolder", photoDir: "Holidays", sidecarDir: "Holidays/sub"},
+		{name: "media in a subfolder", photoDir: "Holidays/sub", sidecarDir: "Holidays"},
+		{name: "no media", sidecarDir: "Holidays", wantOrphan: true},
+	}
+	for _, tt := range tests {
+		takeout := filepath.Join(t.TempDir(), "Takeout", "Google Photos")
+		sidecar := filepath.Join(takeout, filepath.FromSlash(tt.sidecarDir), "IMG_0001.jpg.supplemental-metadata.json")
+		writeFile(t, sidecar, sidecarJSON)
+		var photo string
+		if !tt.wantOrphan {
+			photo = filepath.Join(takeout, filepath.FromSlash(tt.photoDir), "IMG_0001.jpg")
+			writeFile(t, photo, "no metadata")
+		}
+		orphanSidecars = nil
+
+		index, errs := processDirectory([]string{takeout})
+		if errs != 0 {
+			t.Errorf("%s: processDirectory() failed for %d files", tt.name, errs)
+		}
+		if tt.wantOrphan {
+			if index.Len() != 0 {
+				t.Errorf("%s: indexed %v, want nothing", tt.name, index.Paths())
+			}
+			if !slices.Equal(orphanSidecars, []string{sidecar}) {
+				t.Errorf("%s: orphan sidecars = %q, want %q", tt.name, orphanSidecars, sidecar)
+			}
+			continue
+		}
+		if folder, ok := index.Get(photo); !ok || folder != "2022/03" {
+			t.Errorf("%s: folder of the photo = %q, %t, want 2022/03", tt.name, folder, ok)
+		}
+		if got, _ := index.Sidecar(photo); got != sidecar {
+			t.Errorf("%s: sidecar of the photo = %q, want %q", tt.name, got, sidecar)
+		}
+		if len(orphanSidecars) != 0 {
+			t.Errorf("%s: orphan sidecars = %q, want none", tt.name, orphanSidecars)
+		}
+	}
+	orphanSidecars = nil
+}
+
+// TestDeleteAfterUploadSharedPath uploads one local file into an album and its date folder,
+// as ALBUM_STRATEGY=upload-both plans it, with DELETE_AFTER_UPLOAD. The file must only be
+// deleted once both uploads succeeded.
+func TestDeleteAfterUploadSharedPath(t *testing.T) {
+	oldDelete, oldVerify := deleteAfterUpload, verifyUploads
+	deleteAfterUpload, verifyUploads = true, true
+	t.Cleanup(func() { deleteAfterUpload, verifyUploads = oldDelete, oldVerify })
+
+	local := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+	writeFile(t, local, "album photo")
+	mediaFiles := []MediaFile{
+		{Path: local, Ts: "Albums/Holidays", Size: 11},
+		{Path: local, Ts: "2022/03", Size: 11},
+	}
+	dest := t.TempDir()
+	report := newRunReport(filepath.Join(t.TempDir(), "report.csv"))
+
+	failed, deleted := failedCounter.Load(), deletedCounter.Load()
+	processed := uploadMediaFilesToNextcloud(context.Background(), 1, 2, localBackend{root: dest}, newMediaIndex(), getUniqueDirectoryToBecreatedOnNextCloud(mediaFiles), mediaFiles, nil, report)
+	if processed != 2 {
+		t.Errorf("uploadMediaFilesToNextcloud() processed %d files, want 2", processed)
+	}
+	if n := failedCounter.Load() - failed; n != 0 {
+		t.Errorf("%d uploads failed, want none", n)
+	}
+	if n := deletedCounter.Load() - deleted; n != 1 {
+		t.Errorf("deleted %d local files, want 1", n)
+	}
+	for _, folder := range []string{"Albums/Holidays", "2022/03"} {
+		if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(folder), "IMG_0001.jpg")); err != nil {
+			t.Errorf("upload into %s missing: %v", folder, err)
+		}
+	}
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Errorf("local file still exists after both uploads: %v", err)
+	}
+}
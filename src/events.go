@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event names written with JSON_LOGS.
+const (
+	eventIndexingStarted = "indexing_started"
+	eventFileIndexed     = "file_indexed"
+	eventDirCreated      = "dir_created"
+	eventUploadStarted   = "upload_started"
+	eventUploadDone      = "upload_done"
+	eventUploadFailed    = "upload_failed"
+	eventRunFinished     = "run_finished"
+)
+
+// runEvent is one line of the JSON_LOGS stream.
+type runEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Path   string    `json:"path,omitempty"`
+	Folder string    `json:"folder,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Bytes  int64     `json:"bytes,omitempty"`
+	Status string    `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	// Counts are only set on run_finished, where they are always present.
+	Uploaded *int64 `json:"uploaded,omitempty"`
+	Failed   *int64 `json:"failed,omitempty"`
+	Skipped  *int64 `json:"skipped,omitempty"`
+}
+
+// eventStream writes the JSON_LOGS lifecycle events, one JSON object per line, for
+// wrappers that follow a run. A nil *eventStream is valid and writes nothing.
+type eventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	out io.Closer
+}
+
+var events *eventStream
+
+// openEventStream returns a stream writing to path, or to stdout if path is empty. path
+// may be a named pipe, which blocks until a reader opens it.
+func openEventStream(path string) (*eventStream, error) {
+	if path == "" {
+		return &eventStream{enc: json.NewEncoder(os.Stdout)}, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventStream{enc: json.NewEncoder(file), out: file}, nil
+}
+
+func (s *eventStream) emit(event runEvent) {
+	if s == nil {
+		return
+	}
+	event.Time = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A wrapper that went away must not stop the run
+	_ = s.enc.Encode(event)
+}
+
+func (s *eventStream) IndexingStarted(dirs []string) {
+	for _, dir := range dirs {
+		s.emit(runEvent{Event: eventIndexingStarted, Path: dir})
+	}
+}
+
+func (s *eventStream) FileIndexed(path, folder string) {
+	s.emit(runEvent{Event: eventFileIndexed, Path: path, Folder: folder})
+}
+
+func (s *eventStream) DirCreated(dir string) {
+	s.emit(runEvent{Event: eventDirCreated, Path: dir})
+}
+
+func (s *eventStream) UploadStarted(media MediaFile) {
+	s.emit(runEvent{Event: eventUploadStarted, Path: media.Path, Folder: media.Ts, Bytes: max(media.Size, 0)})
+}
+
+// UploadDone reports a media file that was uploaded or found on the server, with status
+// one of the run report's statuses.
+func (s *eventStream) UploadDone(media MediaFile, uploads []UploadResult, status string) {
+	event := runEvent{Event: eventUploadDone, Path: media.Path, Folder: media.Ts, Status: status}
+	for _, upload := range uploads {
+		event.Bytes += upload.Bytes
+		if event.Target == "" {
+			event.Target = upload.TargetPath
+		}
+	}
+	s.emit(event)
+}
+
+func (s *eventStream) UploadFailed(media MediaFile, status string, err error) {
+	event := runEvent{Event: eventUploadFailed, Path: media.Path, Folder: media.Ts, Status: status}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	s.emit(event)
+}
+
+// RunFinished reports the end of the run, with status "interrupted" or "finished".
+func (s *eventStream) RunFinished(status string) {
+	if s == nil {
+		return
+	}
+	uploaded, failed, skipped := successfullCounter.Load(), failedCounter.Load(), skippedByReason.Total()
+	s.emit(runEvent{Event: eventRunFinished, Status: status, Uploaded: &uploaded, Failed: &failed, Skipped: &skipped})
+	if s.out != nil {
+		_ = s.out.Close()
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultIncludeExt = "jpg,jpeg,mp,png,heic,heif,gif,webp,bmp,tif,tiff,dng,mp4,mov,m4v,avi,mkv,3gp,mts,mpg,wmv"
+	defaultExcludeExt = ".DS_Store,._*,Thumbs.db"
+)
+
+var includePatterns, excludePatterns []string
+
+// parsePatterns splits a comma-separated list of globs. Bare extensions such as "jpg" or
+// ".jpg" are turned into "*.jpg". Patterns are lower-cased since matching ignores case.
+func parsePatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			pattern = "*." + strings.TrimPrefix(pattern, ".")
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// matchesAny reports whether the lower-cased name matches one of patterns.
+func matchesAny(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// copyCounterSuffix matches the counter Takeout appends to the name of a copy of a file
+// after its extension, e.g. "IMG_1234.jpg(1)".
+var copyCounterSuffix = regexp.MustCompile(`\(\d+\)$`)
+
+// isMediaFileIncluded applies EXCLUDE_EXT and then INCLUDE_EXT to a file name. A counter
+// after the extension is ignored, so "IMG_1234.jpg(1)" counts as a jpg.
+func isMediaFileIncluded(name string) bool {
+	name = copyCounterSuffix.ReplaceAllString(name, "")
+	if matchesAny(name, excludePatterns) {
+		return false
+	}
+	return len(includePatterns) == 0 || matchesAny(name, includePatterns)
+}
+
+// takeoutSpecialDirs maps the names of Takeout's special folders to the remote folder their
+// files go to when included. "Bin" is the name used by UK English exports.
+var takeoutSpecialDirs = map[string]string{
+	"Trash":   "Trash",
+	"Bin":     "Trash",
+	"Archive": "Archive",
+}
+
+var (
+	includeTrash, includeArchive bool
+	specialDirs                  = make(map[string]string)
+)
+
+// specialDirFolder checks whether dir is Takeout's Trash or Archive folder. Only the top two
+// levels below root are considered, so PHOTOS_DIR may point at either the Takeout folder or
+// the Google Photos folder inside it without user albums of the same name matching.
+func specialDirFolder(root, dir string) (string, bool) {
+	folder, ok := takeoutSpecialDirs[filepath.Base(dir)]
+	if !ok {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." || strings.Count(rel, string(os.PathSeparator)) > 1 {
+		return "", false
+	}
+	return folder, true
+}
+
+// includeSpecialDir reports whether files in a special folder should be uploaded.
+func includeSpecialDir(folder string) bool {
+	if folder == "Trash" {
+		return includeTrash
+	}
+	return includeArchive
+}
+
+// specialDirPrefix returns the remote folder prefix for mediaPath if it lies inside an
+// included Trash or Archive folder.
+func specialDirPrefix(mediaPath string) string {
+	for dir, folder := range specialDirs {
+		if strings.HasPrefix(mediaPath, dir+string(os.PathSeparator)) {
+			return folder + "/"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,800 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// stripGeodata is STRIP_GEODATA: upload copies of the media files without GPS metadata.
+	stripGeodata bool
+	// allowUnstripped is ALLOW_UNSTRIPPED: with STRIP_GEODATA, upload files whose format
+	// can't be stripped unchanged instead of failing them.
+	allowUnstripped bool
+)
+
+// errStripUnsupported is returned by stripGeodataFile for formats it can't edit.
+var errStripUnsupported = errors.New("removing GPS metadata is not supported for this file format")
+
+const (
+	exifGPSIFDTag = 0x8825
+	exifXMPTag    = 0x02BC
+	// maxIFDChain bounds how many IFDs are followed, in case a file's offsets form a loop.
+	maxIFDChain = 8
+	// maxBoxDepth bounds how deep ISO BMFF boxes are descended into.
+	maxBoxDepth = 8
+)
+
+var (
+	jpegSignature = []byte{0xFF, 0xD8}
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+	// xmpUUID is the type of the uuid box MP4 files keep XMP in.
+	xmpUUID = []byte("\xbe\x7a\xcf\xcb\x97\xa9\x42\xe8\x9c\x71\x99\x94\x91\xe3\xaf\xac")
+)
+
+// emptyXMP is an XMP packet without properties, which blankXMP pads with spaces.
+const emptyXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"/>`
+
+// bmffLocationBoxes are the MP4 and QuickTime boxes holding the location a video was
+// recorded at: "©xyz", written by phones and QuickTime, and 3GPP's "loci".
+var bmffLocationBoxes = map[string]bool{"\xa9xyz": true, "loci": true}
+
+// bmffContainerBoxes are the boxes descended into to find location boxes. "meta" is
+// handled on its own, see blankMetaLocation.
+var bmffContainerBoxes = map[string]bool{"moov": true, "trak": true, "udta": true, "ilst": true}
+
+// exifTypeSizes is the size in bytes of one value of each TIFF field type.
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// stripGeodataFiles replaces the files in uploadPaths by copies without GPS metadata in a
+// temporary directory, keeping their names. The local originals aren't touched. Files that
+// can't be stripped fail the upload, unless ALLOW_UNSTRIPPED is set and they are uploaded
+// unchanged. The returned cleanup removes the copies.
+func stripGeodataFiles(uploadPaths []string) ([]string, func(), error) {
+	tmpDir, err := os.MkdirTemp("", "media2nextcloud-strip-")
+	if err != nil {
+		return nil, func() {}, err
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	stripped := make([]string, 0, len(uploadPaths))
+	for i, uploadPath := range uploadPaths {
+		// Separate directories, since a conversion may share its name with another file
+		dir := filepath.Join(tmpDir, fmt.Sprint(i))
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		target := filepath.Join(dir, filepath.Base(uploadPath))
+
+		err := stripGeodataFile(uploadPath, target)
+		if errors.Is(err, errStripUnsupported) && allowUnstripped {
+			slog.Warn("Can't remove GPS metadata from this format, uploading it unchanged", "file", uploadPath)
+			stripped = append(stripped, uploadPath)
+			continue
+		}
+		if err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("failed to remove GPS metadata from %s: %w", uploadPath, err)
+		}
+		stripped = append(stripped, target)
+	}
+	return stripped, cleanup, nil
+}
+
+// stripGeodataFile writes a copy of the media file at src without GPS metadata to dst.
+func stripGeodataFile(src, dst string) error {
+	data, err := readMediaFile(src)
+	if err != nil {
+		return err
+	}
+	stripped, err := stripGeodataBytes(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, stripped, 0o600)
+}
+
+// stripGeodataBytes returns a copy of the media file data without GPS metadata. The format is
+// told by the file's signature rather than its extension. Formats that can't hold a
+// location, such as GIF without XMP, are returned as they are, and errStripUnsupported is
+// returned for all others that aren't known.
+func stripGeodataBytes(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, jpegSignature):
+		return stripJPEGGeodata(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return stripPNGGeodata(data)
+	case isBMFF(data):
+		// MP4, QuickTime, 3GP and HEIF files such as HEIC and AVIF
+		stripped := bytes.Clone(data)
+		return stripped, blankBMFFLocation(stripped)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return stripWebPGeodata(data)
+	case bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")):
+		// TIFF and the raw formats built on it, such as DNG, NEF and ARW
+		stripped := bytes.Clone(data)
+		return stripped, stripTIFFGPS(stripped)
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		// GIF has no EXIF, only XMP in an application extension
+		if bytes.Contains(data, []byte("XMP DataXMP")) && bytes.Contains(data, []byte("GPS")) {
+			return nil, errStripUnsupported
+		}
+		return data, nil
+	default:
+		return nil, errStripUnsupported
+	}
+}
+
+// sidecarGeoFields are the members of a Takeout sidecar that hold the photo's location.
+var sidecarGeoFields = []string{"geoData", "geoDataExif"}
+
+// stripSidecarGeodata writes a copy of the JSON sidecar at src without its location to dst.
+// All other members are kept as they are.
+func stripSidecarGeodata(src, dst string) error {
+	data, err := readMediaFile(src)
+	if err != nil {
+		return err
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+	for _, field := range sidecarGeoFields {
+		delete(members, field)
+	}
+	stripped, err := json.MarshalIndent(members, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, stripped, 0o600)
+}
+
+// stripJPEGGeodata removes the GPS IFD from the EXIF segment of a JPEG and drops XMP
+// segments that mention GPS. Everything else, including the image data, is kept as is,
+// except for data after the end of the image, see stripJPEGTrailer.
+func stripJPEGGeodata(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	for i := 2; i < len(data); {
+		if data[i] != 0xFF || i+1 >= len(data) {
+			return nil, fmt.Errorf("invalid JPEG marker at offset %d", i)
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte before a marker
+			out.WriteByte(0xFF)
+			i++
+			continue
+		case marker == 0xD9:
+			out.Write(data[i : i+2])
+			trailer, err := stripJPEGTrailer(data[i+2:])
+			if err != nil {
+				return nil, err
+			}
+			out.Write(trailer)
+			return out.Bytes(), nil
+		case marker == 0xDA:
+			// The scan header is followed by image data, which holds no metadata, up to the
+			// next marker that isn't a stuffed 0xFF or a restart marker
+			if i+4 > len(data) {
+				return nil, errors.New("truncated JPEG scan header")
+			}
+			j := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+			for ; j+1 < len(data); j++ {
+				if data[j] == 0xFF && data[j+1] != 0x00 && data[j+1] != 0xFF && (data[j+1] < 0xD0 || data[j+1] > 0xD7) {
+					break
+				}
+			}
+			if j+1 >= len(data) {
+				// Truncated without an end of image
+				j = len(data)
+			}
+			out.Write(data[i:j])
+			i = j
+			continue
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD7:
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+
+		if i+4 > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) || end < i+4 {
+			return nil, fmt.Errorf("invalid JPEG segment length at offset %d", i)
+		}
+		segment := bytes.Clone(data[i:end])
+		payload := segment[4:]
+
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			if err := stripTIFFGPS(payload[6:]); err != nil {
+				return nil, fmt.Errorf("invalid EXIF data: %v", err)
+			}
+		} else if marker == 0xE1 && bytes.HasPrefix(payload, []byte("http://ns.adobe.com/")) && bytes.Contains(payload, []byte("GPS")) {
+			// XMP can repeat the coordinates, e.g. as exif:GPSLatitude
+			i = end
+			continue
+		}
+		out.Write(segment)
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+// stripJPEGTrailer returns the data after the end of a JPEG image without a location. The
+// MP4 video of a motion photo keeps its place and length, so the offsets locating it stay
+// valid, with its location boxes blanked. A trailer without a video is dropped.
+func stripJPEGTrailer(trailer []byte) ([]byte, error) {
+	start := bytes.Index(trailer, []byte("ftyp")) - 4
+	if start < 0 || mp4Length(trailer[start:]) == 0 {
+		if len(trailer) > 0 {
+			slog.Debug("Dropping data after the end of the JPEG image", "bytes", len(trailer))
+		}
+		return nil, nil
+	}
+	stripped := bytes.Clone(trailer)
+	if err := blankBMFFLocation(stripped[start : start+mp4Length(trailer[start:])]); err != nil {
+		return nil, fmt.Errorf("invalid motion photo video: %v", err)
+	}
+	return stripped, nil
+}
+
+// stripPNGGeodata removes the GPS IFD from the eXIf chunk of a PNG and drops XMP text chunks
+// that mention GPS, and EXIF ImageMagick stored as text. Anything after the end of the
+// image is dropped.
+func stripPNGGeodata(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	for i := len(pngSignature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("invalid PNG chunk length at offset %d", i)
+		}
+		chunk := data[i:end]
+
+		switch chunkType := string(chunk[4:8]); chunkType {
+		case "eXIf":
+			chunk = bytes.Clone(chunk)
+			if err := stripTIFFGPS(chunk[8 : 8+length]); err != nil {
+				return nil, fmt.Errorf("invalid EXIF data: %v", err)
+			}
+			binary.BigEndian.PutUint32(chunk[8+length:], crc32.ChecksumIEEE(chunk[4:8+length]))
+		case "tEXt", "zTXt", "iTXt":
+			keyword, text, _ := bytes.Cut(chunk[8:8+length], []byte{0})
+			compressed := chunkType == "zTXt" || chunkType == "iTXt" && len(text) > 0 && text[0] != 0
+			switch {
+			case strings.EqualFold(string(keyword), "Raw profile type exif"), strings.EqualFold(string(keyword), "Raw profile type APP1"):
+				i = end
+				continue
+			case string(keyword) == "XML:com.adobe.xmp" && (compressed || bytes.Contains(text, []byte("GPS"))):
+				i = end
+				continue
+			}
+		case "IEND":
+			out.Write(chunk)
+			return out.Bytes(), nil
+		}
+		out.Write(chunk)
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+// stripWebPGeodata removes the GPS IFD from the EXIF chunk of a WebP image and drops its
+// XMP chunk if it mentions GPS.
+func stripWebPGeodata(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	vp8x, xmpDropped := -1, false
+	for i := 12; i+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if size < 0 || i+8+size > len(data) {
+			return nil, fmt.Errorf("invalid WebP chunk size at offset %d", i)
+		}
+		// The padding byte of the last chunk is sometimes missing
+		end = min(end, len(data))
+		chunk := data[i:end]
+
+		switch string(chunk[:4]) {
+		case "EXIF":
+			chunk = bytes.Clone(chunk)
+			if err := stripTIFFGPS(bytes.TrimPrefix(chunk[8:8+size], []byte("Exif\x00\x00"))); err != nil {
+				return nil, fmt.Errorf("invalid EXIF data: %v", err)
+			}
+		case "XMP ":
+			if bytes.Contains(chunk[8:8+size], []byte("GPS")) {
+				xmpDropped = true
+				i = end
+				continue
+			}
+		case "VP8X":
+			vp8x = out.Len()
+		}
+		out.Write(chunk)
+		i = end
+	}
+
+	stripped := out.Bytes()
+	if xmpDropped && vp8x >= 0 && vp8x+8 < len(stripped) {
+		// Clear the flag announcing XMP
+		stripped[vp8x+8] &^= 0x04
+	}
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+// isBMFF reports whether data is an ISO base media file, such as MP4 or HEIC, or a
+// QuickTime movie, which older ones start without an ftyp box.
+func isBMFF(data []byte) bool {
+	if len(data) < 12 {
+		return false
+	}
+	switch string(data[4:8]) {
+	case "ftyp", "moov", "wide", "mdat":
+		return true
+	}
+	return false
+}
+
+// bmffBox is a box of an ISO base media file: its type, where it starts, where its payload
+// starts and where it ends.
+type bmffBox struct {
+	typ                 string
+	start, payload, end int
+}
+
+// bmffBoxes returns the boxes in data[start:end].
+func bmffBoxes(data []byte, start, end int) ([]bmffBox, error) {
+	var boxes []bmffBox
+	for offset := start; offset+8 <= end; {
+		size, header := int(binary.BigEndian.Uint32(data[offset:])), 8
+		switch size {
+		case 0:
+			// The box extends to the end
+			size = end - offset
+		case 1:
+			if offset+16 > end {
+				return nil, errors.New("truncated box header")
+			}
+			size64 := binary.BigEndian.Uint64(data[offset+8:])
+			if size64 > uint64(end-offset) {
+				return nil, fmt.Errorf("invalid box size at offset %d", offset)
+			}
+			size, header = int(size64), 16
+		}
+		if size < header || offset+size > end {
+			return nil, fmt.Errorf("invalid box size at offset %d", offset)
+		}
+		boxes = append(boxes, bmffBox{typ: string(data[offset+4 : offset+8]), start: offset, payload: offset + header, end: offset + size})
+		offset += size
+	}
+	return boxes, nil
+}
+
+// blankBox turns box into a "free" box of the same size, so nothing after it moves.
+func blankBox(data []byte, box bmffBox) {
+	copy(data[box.start+4:], "free")
+	clear(data[box.payload:box.end])
+}
+
+// blankXMP overwrites the XMP packet xmp in place with one without properties, padded with
+// spaces to the same length, for formats it can't be removed from.
+func blankXMP(xmp []byte) error {
+	if len(xmp) < len(emptyXMP) {
+		return errors.New("XMP packet too short to blank")
+	}
+	n := copy(xmp, emptyXMP)
+	for i := n; i < len(xmp); i++ {
+		xmp[i] = ' '
+	}
+	return nil
+}
+
+// blankBMFFLocation removes the location from the ISO base media file data in place, without
+// moving any byte, so the offsets into the file stay valid: location boxes and XMP boxes
+// mentioning GPS become free boxes, and the EXIF and XMP items of HEIF images lose their
+// GPS data.
+func blankBMFFLocation(data []byte) error {
+	if string(data[4:8]) == "ftyp" && len(data) >= 12 && string(data[8:12]) == "crx " {
+		// Canon's CR3 keeps its GPS data in a TIFF structure of its own
+		return errStripUnsupported
+	}
+	return blankBMFFBoxes(data, 0, len(data), 0)
+}
+
+// blankBMFFBoxes blanks the location boxes among the boxes in data[start:end] and below.
+func blankBMFFBoxes(data []byte, start, end, depth int) error {
+	if depth > maxBoxDepth {
+		return errors.New("boxes nested too deeply")
+	}
+	boxes, err := bmffBoxes(data, start, end)
+	if err != nil {
+		return err
+	}
+	for _, box := range boxes {
+		switch {
+		case bmffLocationBoxes[box.typ]:
+			blankBox(data, box)
+		case box.typ == "uuid":
+			payload := data[box.payload:box.end]
+			if bytes.HasPrefix(payload, xmpUUID) && bytes.Contains(payload, []byte("GPS")) {
+				blankBox(data, box)
+			}
+		case box.typ == "meta":
+			if err := blankMetaLocation(data, box, depth); err != nil {
+				return err
+			}
+		case bmffContainerBoxes[box.typ]:
+			if err := blankBMFFBoxes(data, box.payload, box.end, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// blankMetaLocation blanks the location held by the meta box: QuickTime metadata items
+// whose key names a location, such as com.apple.quicktime.location.ISO6709, location
+// boxes, and the GPS data in the EXIF and XMP items of a HEIF image.
+func blankMetaLocation(data []byte, meta bmffBox, depth int) error {
+	// ISO's meta box has a version and flags before its children, QuickTime's hasn't
+	children := meta.payload
+	if meta.payload+8 > meta.end || string(data[meta.payload+4:meta.payload+8]) != "hdlr" {
+		children += 4
+	}
+	boxes, err := bmffBoxes(data, children, meta.end)
+	if err != nil {
+		return err
+	}
+
+	locationKeys := make(map[uint32]bool)
+	var iinf, iloc, idat *bmffBox
+	for i, box := range boxes {
+		switch box.typ {
+		case "keys":
+			locationKeys = quickTimeLocationKeys(data[box.payload:box.end])
+		case "iinf":
+			iinf = &boxes[i]
+		case "iloc":
+			iloc = &boxes[i]
+		case "idat":
+			idat = &boxes[i]
+		}
+	}
+
+	for _, box := range boxes {
+		switch {
+		case bmffLocationBoxes[box.typ]:
+			blankBox(data, box)
+		case box.typ == "ilst":
+			items, err := bmffBoxes(data, box.payload, box.end)
+			if err != nil {
+				return err
+			}
+			for _, item := range items {
+				if bmffLocationBoxes[item.typ] || locationKeys[binary.BigEndian.Uint32([]byte(item.typ))] {
+					blankBox(data, item)
+				}
+			}
+		case bmffContainerBoxes[box.typ]:
+			if err := blankBMFFBoxes(data, box.payload, box.end, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if iinf != nil && iloc != nil {
+		return blankHEIFItems(data, *iinf, *iloc, idat)
+	}
+	return nil
+}
+
+// quickTimeLocationKeys returns the 1-based indices of the keys in the payload of a
+// QuickTime "keys" box that name a location.
+func quickTimeLocationKeys(keys []byte) map[uint32]bool {
+	indices := make(map[uint32]bool)
+	if len(keys) < 8 {
+		return indices
+	}
+	count := binary.BigEndian.Uint32(keys[4:])
+	entries := keys[8:]
+	for i := uint32(1); i <= count && len(entries) >= 8; i++ {
+		size := int(binary.BigEndian.Uint32(entries))
+		if size < 8 || size > len(entries) {
+			break
+		}
+		if bytes.Contains(bytes.ToLower(entries[8:size]), []byte("location")) {
+			indices[i] = true
+		}
+		entries = entries[size:]
+	}
+	return indices
+}
+
+// heifItemTypes returns the item type of every item in the payload of a HEIF "iinf" box by
+// item ID. MIME items are returned as "mime:" followed by their content type.
+func heifItemTypes(data []byte, iinf bmffBox) (map[uint32]string, error) {
+	payload := data[iinf.payload:iinf.end]
+	if len(payload) < 6 {
+		return nil, errors.New("truncated iinf box")
+	}
+	first := iinf.payload + 6
+	if payload[0] != 0 {
+		first += 2
+	}
+	boxes, err := bmffBoxes(data, first, iinf.end)
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[uint32]string)
+	for _, infe := range boxes {
+		entry := data[infe.payload:infe.end]
+		// Versions 0 and 1 have no item type
+		if infe.typ != "infe" || len(entry) < 4 || entry[0] < 2 {
+			continue
+		}
+		var id uint32
+		rest := entry[4:]
+		if entry[0] == 2 && len(rest) >= 2 {
+			id, rest = uint32(binary.BigEndian.Uint16(rest)), rest[2:]
+		} else if len(rest) >= 4 {
+			id, rest = binary.BigEndian.Uint32(rest), rest[4:]
+		}
+		// Skip the protection index
+		if len(rest) < 6 {
+			continue
+		}
+		itemType := string(rest[2:6])
+		if itemType == "mime" {
+			// The item name and content type follow, both null-terminated
+			if fields := bytes.SplitN(rest[6:], []byte{0}, 3); len(fields) >= 2 {
+				itemType += ":" + string(fields[1])
+			}
+		}
+		types[id] = itemType
+	}
+	return types, nil
+}
+
+// heifItemLocation is where the data of a HEIF item is stored: the offset and length of
+// each extent, in the file or, with constructionMethod 1, in the idat box.
+type heifItemLocation struct {
+	constructionMethod int
+	extents            [][2]uint64
+}
+
+// heifItemLocations parses a HEIF "iloc" box and returns the location of every item by ID.
+func heifItemLocations(data []byte, iloc bmffBox) (map[uint32]heifItemLocation, error) {
+	r := &byteReader{data: data[iloc.payload:iloc.end]}
+	version := r.uint(1)
+	r.uint(3)
+	sizes := r.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0x0F)
+	sizes = r.uint(1)
+	baseOffsetSize, indexSize := int(sizes>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0x0F)
+	}
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+
+	locations := make(map[uint32]heifItemLocation)
+	for count := r.uint(idSize); count > 0 && r.err == nil; count-- {
+		id := uint32(r.uint(idSize))
+		var location heifItemLocation
+		if version == 1 || version == 2 {
+			location.constructionMethod = int(r.uint(2) & 0x0F)
+		}
+		r.uint(2)
+		base := r.uint(baseOffsetSize)
+		for extents := r.uint(2); extents > 0 && r.err == nil; extents-- {
+			r.uint(indexSize)
+			offset := r.uint(offsetSize)
+			location.extents = append(location.extents, [2]uint64{base + offset, r.uint(lengthSize)})
+		}
+		locations[id] = location
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid iloc box: %v", r.err)
+	}
+	return locations, nil
+}
+
+// blankHEIFItems removes the GPS IFD from the EXIF items of a HEIF image and blanks its XMP
+// items that mention GPS, in place.
+func blankHEIFItems(data []byte, iinf, iloc bmffBox, idat *bmffBox) error {
+	types, err := heifItemTypes(data, iinf)
+	if err != nil {
+		return err
+	}
+	locations, err := heifItemLocations(data, iloc)
+	if err != nil {
+		return err
+	}
+
+	for id, itemType := range types {
+		if itemType != "Exif" && itemType != "mime:application/rdf+xml" {
+			continue
+		}
+		location, ok := locations[id]
+		if !ok {
+			continue
+		}
+		// Edited in place, an item has to be in one piece
+		if len(location.extents) != 1 || location.constructionMethod > 1 || location.constructionMethod == 1 && idat == nil {
+			return fmt.Errorf("%w: HEIF %s item stored in an unsupported way", errStripUnsupported, itemType)
+		}
+		base, limit := 0, len(data)
+		if location.constructionMethod == 1 {
+			base, limit = idat.payload, idat.end
+		}
+		offset, length := location.extents[0][0], location.extents[0][1]
+		if length == 0 {
+			// The item extends to the end
+			length = uint64(limit-base) - min(offset, uint64(limit-base))
+		}
+		if offset > uint64(limit-base) || length > uint64(limit-base)-offset {
+			return fmt.Errorf("HEIF %s item out of range", itemType)
+		}
+		item := data[base+int(offset) : base+int(offset+length)]
+
+		if itemType == "Exif" {
+			// The TIFF header follows an offset to it
+			if len(item) < 4 || int(binary.BigEndian.Uint32(item)) > len(item)-4 {
+				return errors.New("invalid HEIF EXIF item")
+			}
+			if err := stripTIFFGPS(item[4+int(binary.BigEndian.Uint32(item)):]); err != nil {
+				return fmt.Errorf("invalid EXIF data: %v", err)
+			}
+		} else if bytes.Contains(item, []byte("GPS")) {
+			if err := blankXMP(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// byteReader reads big-endian unsigned integers of 0 to 8 bytes, remembering the first
+// read past the end in err.
+type byteReader struct {
+	data []byte
+	err  error
+}
+
+func (r *byteReader) uint(size int) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if size > len(r.data) || size > 8 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	var v uint64
+	for _, b := range r.data[:size] {
+		v = v<<8 | uint64(b)
+	}
+	r.data = r.data[size:]
+	return v
+}
+
+// stripTIFFGPS removes the GPS IFD pointer from every IFD in the chain of the TIFF structure
+// tiff and zeroes the GPS IFD with its values, in place. Other offsets stay valid since
+// nothing is moved except the entries of the IFD the pointer is removed from. XMP stored in
+// the TIFF structure, as raw formats do, is blanked if it mentions GPS.
+func stripTIFFGPS(tiff []byte) error {
+	if len(tiff) < 8 {
+		return errors.New("truncated TIFF header")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return errors.New("unknown byte order")
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	for range maxIFDChain {
+		if offset == 0 {
+			return nil
+		}
+		count, err := ifdEntryCount(tiff, order, offset)
+		if err != nil {
+			return err
+		}
+		for n := range count {
+			entry := offset + 2 + 12*n
+			if order.Uint16(tiff[entry:]) != exifXMPTag {
+				continue
+			}
+			size := exifTypeSizes[order.Uint16(tiff[entry+2:])] * int(order.Uint32(tiff[entry+4:]))
+			valueOffset := int(order.Uint32(tiff[entry+8:]))
+			if size > 4 && valueOffset >= 8 && valueOffset+size <= len(tiff) && bytes.Contains(tiff[valueOffset:valueOffset+size], []byte("GPS")) {
+				if err := blankXMP(tiff[valueOffset : valueOffset+size]); err != nil {
+					return err
+				}
+			}
+		}
+		for n := range count {
+			entry := offset + 2 + 12*n
+			if order.Uint16(tiff[entry:]) != exifGPSIFDTag {
+				continue
+			}
+			if err := zeroIFD(tiff, order, int(order.Uint32(tiff[entry+8:]))); err != nil {
+				return err
+			}
+			// Shift the following entries and the next IFD offset over the pointer
+			ifdEnd := offset + 2 + 12*count + 4
+			copy(tiff[entry:], tiff[entry+12:ifdEnd])
+			clear(tiff[ifdEnd-12 : ifdEnd])
+			count--
+			order.PutUint16(tiff[offset:], uint16(count))
+			break
+		}
+		offset = int(order.Uint32(tiff[offset+2+12*count:]))
+	}
+	return nil
+}
+
+// ifdEntryCount returns the number of entries of the IFD at offset, checking that the IFD
+// lies within tiff.
+func ifdEntryCount(tiff []byte, order binary.ByteOrder, offset int) (int, error) {
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0, fmt.Errorf("IFD offset %d out of range", offset)
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	if offset+2+12*count+4 > len(tiff) {
+		return 0, fmt.Errorf("IFD at offset %d is truncated", offset)
+	}
+	return count, nil
+}
+
+// zeroIFD overwrites the IFD at offset and the values its entries point to with zeros.
+func zeroIFD(tiff []byte, order binary.ByteOrder, offset int) error {
+	count, err := ifdEntryCount(tiff, order, offset)
+	if err != nil {
+		return err
+	}
+	for n := range count {
+		entry := offset + 2 + 12*n
+		size := exifTypeSizes[order.Uint16(tiff[entry+2:])] * int(order.Uint32(tiff[entry+4:]))
+		if size <= 4 {
+			// Stored inline, cleared with the IFD
+			continue
+		}
+		valueOffset := int(order.Uint32(tiff[entry+8:]))
+		if valueOffset < 8 || valueOffset+size > len(tiff) {
+			return fmt.Errorf("GPS value offset %d out of range", valueOffset)
+		}
+		clear(tiff[valueOffset : valueOffset+size])
+	}
+	clear(tiff[offset : offset+2+12*count+4])
+	return nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sidecarWithLocation = `{
+  "title": "IMG_0001.jpg",
+  "description": "Beach",
+  "photoTakenTime": {"timestamp": "1647253800"},
+  "geoData": {"latitude": 48.8584, "longitude": 2.2945, "altitude": 35.0},
+  "geoDataExif": {"latitude": 48.8584, "longitude": 2.2945, "altitude": 35.0},
+  "people": [{"name": "Alice"}]
+}`
+
+func TestStripSidecarGeodata(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "IMG_0001.jpg.json"), filepath.Join(dir, "stripped.json")
+	writeFile(t, src, sidecarWithLocation)
+
+	if err := stripSidecarGeodata(src, dst); err != nil {
+		t.Fatalf("stripSidecarGeodata() error = %v", err)
+	}
+	data, err := readMediaFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		t.Fatalf("stripped sidecar is no JSON object: %v", err)
+	}
+	for _, field := range []string{"geoData", "geoDataExif"} {
+		if _, ok := members[field]; ok {
+			t.Errorf("stripped sidecar still has %s", field)
+		}
+	}
+	for _, field := range []string{"title", "description", "photoTakenTime", "people"} {
+		if _, ok := members[field]; !ok {
+			t.Errorf("stripped sidecar lost %s", field)
+		}
+	}
+	if strings.Contains(string(data), "48.8584") {
+		t.Errorf("stripped sidecar still contains the latitude: %s", data)
+	}
+
+	if err := stripSidecarGeodata(filepath.Join(dir, "missing.json"), dst); err == nil {
+		t.Error("stripSidecarGeodata() of a missing file succeeded")
+	}
+	writeFile(t, src, "{truncated")
+	if err := stripSidecarGeodata(src, dst); err == nil {
+		t.Error("stripSidecarGeodata() of invalid JSON succeeded")
+	}
+}
+
+func TestUploadSidecarStripsLocation(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		old := stripGeodata
+		stripGeodata = strip
+		t.Cleanup(func() { stripGeodata = old })
+
+		dir := t.TempDir()
+		mediaPath := filepath.Join(dir, "IMG_0001.jpg")
+		sidecarPath := mediaPath + ".supplemental-metadata.json"
+		writeFile(t, mediaPath, "jpeg data")
+		writeFile(t, sidecarPath, sidecarWithLocation)
+		index := newMediaIndex()
+		index.SetSidecar(mediaPath, sidecarPath)
+
+		uploaded := make(map[string]string)
+		backend := stubBackend{upload: func(path string, r io.Reader) error {
+			data, err := io.ReadAll(r)
+			uploaded[path] = string(data)
+			return err
+		}}
+		media := MediaFile{Path: mediaPath, Ts: "2022/03"}
+		uploadSidecar(context.Background(), backend, index, media, map[string]string{mediaPath: "2022/03/IMG_0001.jpg"}, []string{mediaPath})
+
+		content, ok := uploaded["2022/03/IMG_0001.jpg.json"]
+		if !ok {
+			t.Fatalf("STRIP_GEODATA=%t: sidecar not uploaded, got %v", strip, uploaded)
+		}
+		if hasLocation := strings.Contains(content, "geoData"); hasLocation == strip {
+			t.Errorf("STRIP_GEODATA=%t: uploaded sidecar has location %t: %s", strip, hasLocation, content)
+		}
+	}
+}
+
+// The latitude the fixtures were taken at, as an EXIF rational numerator and an ISO 6709
+// string, which must be gone after stripping.
+const (
+	fixtureLatitude = 48858400
+	fixtureISO6709  = "+48.8584+002.2945+035.000/"
+)
+
+// fixtureTIFF returns a little-endian TIFF structure whose IFD0 points to a GPS IFD holding
+// the fixture latitude.
+func fixtureTIFF() []byte {
+	le := binary.LittleEndian
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	// IFD0: Orientation and the GPS IFD pointer, at 8
+	tiff = le.AppendUint16(tiff, 2)
+	tiff = append(tiff, 0x12, 0x01, 3, 0, 1, 0, 0, 0, 1, 0, 0, 0)
+	tiff = append(tiff, 0x25, 0x88, 4, 0, 1, 0, 0, 0, 38, 0, 0, 0)
+	tiff = le.AppendUint32(tiff, 0)
+	// GPS IFD: GPSLatitude, three rationals at 56
+	tiff = le.AppendUint16(tiff, 1)
+	tiff = append(tiff, 0x02, 0x00, 5, 0, 3, 0, 0, 0, 56, 0, 0, 0)
+	tiff = le.AppendUint32(tiff, 0)
+	for _, v := range []uint32{fixtureLatitude, 1000000, 0, 1, 0, 1} {
+		tiff = le.AppendUint32(tiff, v)
+	}
+	return tiff
+}
+
+// fixtureJPEG returns an encoded 16x16 JPEG with the EXIF data of fixtureTIFF.
+func fixtureJPEG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	exif := append([]byte("Exif\x00\x00"), fixtureTIFF()...)
+	segment := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(exif)+2))
+	return append(append(append([]byte{0xFF, 0xD8}, segment...), exif...), buf.Bytes()[2:]...)
+}
+
+// fixtureMotionPhoto returns a Pixel motion photo: fixtureJPEG with fixtureMP4 appended and
+// XMP locating it.
+func fixtureMotionPhoto(t *testing.T) []byte {
+	t.Helper()
+	xmp := fmt.Appendf([]byte("http://ns.adobe.com/xap/1.0/\x00"), `<x:xmpmeta><GCamera:MicroVideoOffset>%d</GCamera:MicroVideoOffset></x:xmpmeta>`, len(fixtureMP4()))
+	segment := binary.BigEndian.AppendUint16([]byte{0xFF, 0xD8, 0xFF, 0xE1}, uint16(len(xmp)+2))
+	photo := append(append(segment, xmp...), fixtureJPEG(t)[2:]...)
+	return append(photo, fixtureMP4()...)
+}
+
+// box returns an ISO BMFF box of type typ holding the concatenated payloads.
+func box(typ string, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(8+len(payload))), append([]byte(typ), payload...)...)
+}
+
+// fixtureMP4 returns an MP4 with the fixture location in a "©xyz" box, as Android writes it,
+// and in QuickTime metadata, as iPhones write it.
+func fixtureMP4() []byte {
+	xyz := box("\xa9xyz", []byte{0, byte(len(fixtureISO6709)), 0x15, 0xc7}, []byte(fixtureISO6709))
+	key := "com.apple.quicktime.location.ISO6709"
+	keys := box("keys", []byte{0, 0, 0, 0, 0, 0, 0, 1}, binary.BigEndian.AppendUint32(nil, uint32(8+len(key))), []byte("mdta"), []byte(key))
+	item := box("\x00\x00\x00\x01", box("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte(fixtureISO6709)))
+	meta := box("meta", box("hdlr", make([]byte, 8), []byte("mdta"), make([]byte, 13)), keys, box("ilst", item))
+	return bytes.Join([][]byte{
+		box("ftyp", []byte("mp42\x00\x00\x00\x00isommp42")),
+		box("moov", box("mvhd", make([]byte, 100)), box("udta", xyz), meta),
+		box("mdat", bytes.Repeat([]byte{0xAB}, 64)),
+	}, nil)
+}
+
+// fixtureHEIC returns a HEIF image whose Exif item, located by iloc, holds fixtureTIFF.
+func fixtureHEIC() []byte {
+	ftyp := box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	hdlr := box("hdlr", make([]byte, 8), []byte("pict"), make([]byte, 13))
+	infe := box("infe", []byte{2, 0, 0, 0, 0, 1, 0, 0}, []byte("Exif\x00"))
+	iinf := box("iinf", []byte{0, 0, 0, 0, 0, 1}, infe)
+	exif := append([]byte{0, 0, 0, 0}, fixtureTIFF()...)
+	// iloc version 0, 4 byte offsets and lengths, one item with one extent
+	ilocSize := 8 + 4 + 2 + 2 + 2 + 2 + 2 + 8
+	meta := box("meta", []byte{0, 0, 0, 0}, hdlr, iinf, make([]byte, ilocSize))
+	offset := len(ftyp) + len(meta) + 8
+	iloc := box("iloc", []byte{0, 0, 0, 0, 0x44, 0x00, 0, 1, 0, 1, 0, 0, 0, 1},
+		binary.BigEndian.AppendUint32(nil, uint32(offset)), binary.BigEndian.AppendUint32(nil, uint32(len(exif))))
+	copy(meta[len(meta)-ilocSize:], iloc)
+	return bytes.Join([][]byte{ftyp, meta, box("mdat", exif)}, nil)
+}
+
+// pngChunk returns a PNG chunk with its CRC.
+func pngChunk(typ string, data []byte) []byte {
+	chunk := append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), append([]byte(typ), data...)...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// fixturePNG returns an encoded 16x16 PNG with the EXIF data of fixtureTIFF and an XMP text
+// chunk with the fixture location.
+func fixturePNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	// The signature and IHDR come first
+	ihdrEnd := 8 + 12 + 13
+	xmp := []byte("XML:com.adobe.xmp\x00<x:xmpmeta><exif:GPSLatitude>48,51.504N</exif:GPSLatitude></x:xmpmeta>")
+	return bytes.Join([][]byte{encoded[:ihdrEnd], pngChunk("eXIf", fixtureTIFF()), pngChunk("iTXt", xmp), encoded[ihdrEnd:]}, nil)
+}
+
+// fixtureWebP returns an extended WebP file with the EXIF data of fixtureTIFF and XMP
+// mentioning GPS.
+func fixtureWebP() []byte {
+	chunk := func(typ string, data []byte) []byte {
+		c := append([]byte(typ), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+		c = append(c, data...)
+		if len(data)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	body := bytes.Join([][]byte{
+		[]byte("WEBP"),
+		chunk("VP8X", []byte{0x0C, 0, 0, 0, 15, 0, 0, 15, 0, 0}),
+		chunk("VP8L", []byte{0x2f, 0x0f, 0xc0, 0x03, 0x00}),
+		chunk("EXIF", fixtureTIFF()),
+		chunk("XMP ", []byte("<x:xmpmeta><exif:GPSLatitude>48,51.504N</exif:GPSLatitude></x:xmpmeta>")),
+	}, nil)
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+// assertNoLocation fails if data still holds the fixture latitude in any form.
+func assertNoLocation(t *testing.T, data []byte) {
+	t.Helper()
+	for _, leak := range [][]byte{
+		binary.LittleEndian.AppendUint32(nil, fixtureLatitude),
+		[]byte(fixtureISO6709),
+		[]byte("GPSLatitude"),
+	} {
+		if i := bytes.Index(data, leak); i >= 0 {
+			t.Errorf("stripped file still holds %q at offset %d", leak, i)
+		}
+	}
+}
+
+func TestStripGeodataBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    func(t *testing.T) []byte
+		keepLen bool
+		check   func(t *testing.T, original, stripped []byte)
+	}{
+		{name: "jpeg", data: fixtureJPEG, check: func(t *testing.T, _, stripped []byte) {
+			if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+				t.Errorf("stripped JPEG doesn't decode: %v", err)
+			}
+		}},
+		{name: "motion photo", data: fixtureMotionPhoto, keepLen: true, check: func(t *testing.T, original, stripped []byte) {
+			video, err := motionVideo(stripped)
+			if err != nil {
+				t.Fatalf("motionVideo() of the stripped photo error = %v", err)
+			}
+			if len(video) != len(fixtureMP4()) {
+				t.Errorf("video length = %d, want %d", len(video), len(fixtureMP4()))
+			}
+		}},
+		{name: "jpeg with other trailer", data: func(t *testing.T) []byte {
+			return append(fixtureJPEG(t), []byte("trailing "+fixtureISO6709)...)
+		}, check: func(t *testing.T, _, stripped []byte) {
+			if !bytes.HasSuffix(stripped, []byte{0xFF, 0xD9}) {
+				t.Error("data after the end of the image was kept")
+			}
+		}},
+		{name: "mp4", data: func(*testing.T) []byte { return fixtureMP4() }, keepLen: true, check: func(t *testing.T, original, stripped []byte) {
+			if mp4Length(stripped) != len(original) {
+				t.Errorf("mp4Length() = %d, want %d", mp4Length(stripped), len(original))
+			}
+			if !bytes.HasSuffix(stripped, bytes.Repeat([]byte{0xAB}, 64)) {
+				t.Error("media data changed")
+			}
+		}},
+		{name: "heic", data: func(*testing.T) []byte { return fixtureHEIC() }, keepLen: true},
+		{name: "png", data: fixturePNG, check: func(t *testing.T, _, stripped []byte) {
+			if _, err := png.Decode(bytes.NewReader(stripped)); err != nil {
+				t.Errorf("stripped PNG doesn't decode: %v", err)
+			}
+		}},
+		{name: "webp", data: func(*testing.T) []byte { return fixtureWebP() }, check: func(t *testing.T, _, stripped []byte) {
+			if size := binary.LittleEndian.Uint32(stripped[4:]); int(size) != len(stripped)-8 {
+				t.Errorf("RIFF size = %d, want %d", size, len(stripped)-8)
+			}
+			if stripped[20]&0x04 != 0 {
+				t.Error("VP8X still announces XMP")
+			}
+		}},
+		{name: "tiff", data: func(*testing.T) []byte { return fixtureTIFF() }, keepLen: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := tt.data(t)
+			input := bytes.Clone(original)
+			stripped, err := stripGeodataBytes(input)
+			if err != nil {
+				t.Fatalf("stripGeodataBytes() error = %v", err)
+			}
+			if !bytes.Equal(input, original) {
+				t.Error("stripGeodataBytes() modified its input")
+			}
+			assertNoLocation(t, stripped)
+			if tt.keepLen && len(stripped) != len(original) {
+				t.Errorf("stripped length = %d, want %d", len(stripped), len(original))
+			}
+			if tt.check != nil {
+				tt.check(t, original, stripped)
+			}
+		})
+	}
+}
+
+func TestStripGeodataBytesUnsupported(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"cr3":     box("ftyp", []byte("crx \x00\x00\x00\x01crx isom")),
+		"unknown": []byte("not a media file at all"),
+		"gif xmp": []byte("GIF89a\x21\xffXMP DataXMP <exif:GPSLatitude/>"),
+	} {
+		if _, err := stripGeodataBytes(data); !errors.Is(err, errStripUnsupported) {
+			t.Errorf("%s: stripGeodataBytes() error = %v, want errStripUnsupported", name, err)
+		}
+	}
+	gif := []byte("GIF89a plain")
+	if stripped, err := stripGeodataBytes(gif); err != nil || !bytes.Equal(stripped, gif) {
+		t.Errorf("GIF without XMP = %q, %v, want it unchanged", stripped, err)
+	}
+}
+
+func TestStripGeodataFilesAllowUnstripped(t *testing.T) {
+	dir := t.TempDir()
+	photo, unknown := filepath.Join(dir, "IMG_0001.jpg"), filepath.Join(dir, "clip.bin")
+	if err := os.WriteFile(photo, fixtureJPEG(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, unknown, "unknown format")
+
+	for _, allow := range []bool{false, true} {
+		old := allowUnstripped
+		allowUnstripped = allow
+		t.Cleanup(func() { allowUnstripped = old })
+
+		paths, cleanup, err := stripGeodataFiles([]string{photo, unknown})
+		if !allow {
+			if !errors.Is(err, errStripUnsupported) {
+				t.Errorf("stripGeodataFiles() error = %v, want errStripUnsupported", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("stripGeodataFiles() error = %v", err)
+		}
+		if paths[0] == photo || paths[1] != unknown {
+			t.Errorf("stripGeodataFiles() = %v, want a stripped copy of the photo and the other file unchanged", paths)
+		}
+		data, err := os.ReadFile(paths[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertNoLocation(t, data)
+		cleanup()
+		if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+			t.Errorf("cleanup left %s behind", paths[0])
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// ContentHasher computes a fingerprint of a media file. Files with the same fingerprint
+// are considered duplicates. Exact hashers only match byte-identical files, which lets
+// callers skip hashing files whose size is unique; perceptual hashers must return false.
+type ContentHasher interface {
+	Name() string
+	Exact() bool
+	Hash(path string) (string, error)
+}
+
+// sha256Hasher matches byte-identical files.
+type sha256Hasher struct{}
+
+func (sha256Hasher) Name() string { return "sha256" }
+
+func (sha256Hasher) Exact() bool { return true }
+
+func (sha256Hasher) Hash(path string) (string, error) {
+	file, err := openMedia(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// contentHashers lists the available HASH_ALGORITHM values. A perceptual hasher that also
+// catches re-encoded copies can be registered here.
+var contentHashers = map[string]ContentHasher{
+	"sha256": sha256Hasher{},
+}
+
+var contentHasher ContentHasher = sha256Hasher{}
+
+// fileSHA256 returns the hex SHA-256 of path, from the content hash cache when
+// HASH_ALGORITHM is sha256.
+func fileSHA256(path string) (string, error) {
+	if contentHasher.Name() == "sha256" {
+		return contentHash(path)
+	}
+	return sha256Hasher{}.Hash(path)
+}
+
+// newContentHasher returns the hasher registered under name.
+func newContentHasher(name string) (ContentHasher, error) {
+	hasher, ok := contentHashers[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown HASH_ALGORITHM %q", name)
+	}
+	return hasher, nil
+}
+
+// contentHash returns the fingerprint of path, reusing the value cached in the state file
+// when the file's size and mtime are unchanged.
+func contentHash(path string) (string, error) {
+	info, err := statMedia(path)
+	if err != nil {
+		return "", err
+	}
+
+	state.mu.Lock()
+	cached, ok := state.Hashes[path]
+	state.mu.Unlock()
+	if ok && cached.Algorithm == contentHasher.Name() && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+		return cached.Hash, nil
+	}
+
+	hash, err := contentHasher.Hash(path)
+	if err != nil {
+		return "", err
+	}
+
+	state.mu.Lock()
+	state.Hashes[path] = hashCacheEntry{
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		Algorithm: contentHasher.Name(),
+		Hash:      hash,
+	}
+	state.mu.Unlock()
+
+	return hash, nil
+}
+
+// findDuplicateGroups groups paths by content hash and returns every group with more than
+// one file, each sorted by path, and the hash of every file it hashed. For exact hashers
+// only files sharing a size are hashed. Files that can't be hashed are passed to onError
+// and left out.
+func findDuplicateGroups(paths []string, onError func(path string, err error)) (map[string][]string, map[string]string) {
+	candidates := paths
+	if contentHasher.Exact() {
+		bySize := make(map[int64][]string)
+		for _, path := range paths {
+			info, err := statMedia(path)
+			if err != nil {
+				onError(path, err)
+				continue
+			}
+			bySize[info.Size()] = append(bySize[info.Size()], path)
+		}
+
+		candidates = nil
+		for _, sameSize := range bySize {
+			if len(sameSize) > 1 {
+				candidates = append(candidates, sameSize...)
+			}
+		}
+	}
+
+	byHash := make(map[string][]string)
+	hashes := make(map[string]string)
+	for _, path := range candidates {
+		hash, err := contentHash(path)
+		if err != nil {
+			onError(path, err)
+			continue
+		}
+		byHash[hash] = append(byHash[hash], path)
+		hashes[path] = hash
+	}
+
+	for hash, group := range byHash {
+		if len(group) < 2 {
+			delete(byHash, hash)
+			continue
+		}
+		sort.Strings(group)
+	}
+	return byHash, hashes
+}
+
+// reportDuplicates writes every group of duplicate files in index to w.
+func reportDuplicates(index *MediaIndex, w io.Writer) int {
+	paths := index.Paths()
+
+	groups, _ := findDuplicateGroups(paths, func(path string, err error) {
+		slog.Warn("Failed to hash file", "file", path, "error", err)
+	})
+
+	hashes := make([]string, 0, len(groups))
+	for hash := range groups {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return groups[hashes[i]][0] < groups[hashes[j]][0] })
+
+	for i, hash := range hashes {
+		fmt.Fprintf(w, "Duplicate group %d (%s:%s, %d files):\n", i+1, contentHasher.Name(), hash, len(groups[hash]))
+		for _, path := range groups[hash] {
+			fmt.Fprintf(w, "  %s\n", path)
+		}
+	}
+	return len(groups)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ImageConverter transcodes an image file into another format. It lets the HEIC to JPEG
+// conversion use whichever codec is installed.
+type ImageConverter interface {
+	Name() string
+	Convert(src, dst string) error
+}
+
+// commandConverter converts by running an external program.
+type commandConverter struct {
+	command string
+	args    func(src, dst string) []string
+}
+
+func (c commandConverter) Name() string { return c.command }
+
+func (c commandConverter) Convert(src, dst string) error {
+	output, err := exec.Command(c.command, c.args(src, dst)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", c.command, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// heicConverters lists the supported converters in order of preference. All of them copy
+// the EXIF data into the JPEG.
+var heicConverters = []commandConverter{
+	{command: "heif-convert", args: func(src, dst string) []string { return []string{"-q", "92", src, dst} }},
+	{command: "magick", args: func(src, dst string) []string { return []string{src, "-quality", "92", dst} }},
+	{command: "convert", args: func(src, dst string) []string { return []string{src, "-quality", "92", dst} }},
+}
+
+var (
+	convertHEIC      bool
+	heicKeepOriginal bool
+	heicConverter    ImageConverter
+)
+
+// findHEICConverter returns the first converter installed on this machine, or nil.
+func findHEICConverter() ImageConverter {
+	for _, converter := range heicConverters {
+		if _, err := exec.LookPath(converter.command); err == nil {
+			return converter
+		}
+	}
+	return nil
+}
+
+// isHEIC reports whether path has a HEIC/HEIF extension.
+func isHEIC(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".heic" || ext == ".heif"
+}
+
+// mediaUploadFiles returns the local files to upload for mediaPath. With CONVERT_HEIC a
+// HEIC file is replaced by a JPEG conversion in a temporary directory (plus the original
+// with HEIC_KEEP_ORIGINAL). If conversion isn't possible the original is uploaded
+// unchanged. The returned cleanup removes any temporary files.
+func mediaUploadFiles(mediaPath string) ([]string, func()) {
+	noop := func() {}
+	// The converters need a real file, so HEIC files inside a PHOTOS_ARCHIVE zip aren't converted
+	if !convertHEIC || heicConverter == nil || !isHEIC(mediaPath) || isArchiveEntry(mediaPath) {
+		return []string{mediaPath}, noop
+	}
+
+	tmpDir, err := os.MkdirTemp("", "media2nextcloud-heic-")
+	if err != nil {
+		slog.Warn("Failed to create temporary directory, uploading HEIC unconverted", "file", mediaPath, "error", err)
+		return []string{mediaPath}, noop
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	name := strings.TrimSuffix(filepath.Base(mediaPath), filepath.Ext(mediaPath)) + ".jpg"
+	jpegPath := filepath.Join(tmpDir, name)
+	if err := heicConverter.Convert(mediaPath, jpegPath); err != nil {
+		slog.Warn("Failed to convert HEIC, uploading it unconverted", "file", mediaPath, "converter", heicConverter.Name(), "error", err)
+		cleanup()
+		return []string{mediaPath}, noop
+	}
+	slog.Debug("Converted HEIC to JPEG", "file", mediaPath, "converter", heicConverter.Name())
+
+	if heicKeepOriginal {
+		return []string{jpegPath, mediaPath}, cleanup
+	}
+	return []string{jpegPath}, cleanup
+}
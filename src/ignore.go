@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// photoIgnoreFileName is the file at the root of a PHOTOS_DIR listing paths to skip.
+const photoIgnoreFileName = ".photoignore"
+
+// excludeDirs are the EXCLUDE_DIR patterns, which apply below every PHOTOS_DIR.
+var excludeDirs []string
+
+// ignorePattern is one line of a .photoignore file.
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// photoIgnore decides which paths below a photos root are skipped, following the rules of
+// .gitignore: a pattern without a slash matches a file or directory name at any depth, one
+// with a slash matches the path relative to the root, a trailing slash only matches
+// directories, "**" spans directories, "!" re-includes a path and the last matching pattern
+// wins. Everything below an ignored directory is ignored as well.
+type photoIgnore struct {
+	patterns []ignorePattern
+}
+
+// loadPhotoIgnore returns the patterns of root's .photoignore file, if any, followed by
+// the EXCLUDE_DIR patterns.
+func loadPhotoIgnore(root string) (*photoIgnore, error) {
+	ignore := &photoIgnore{}
+
+	data, err := readMediaFile(filepath.Join(root, photoIgnoreFileName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := ignore.add(strings.TrimRight(line, " ")); err != nil {
+			return nil, fmt.Errorf("invalid pattern in %s: %v", filepath.Join(root, photoIgnoreFileName), err)
+		}
+	}
+
+	for _, dir := range excludeDirs {
+		if err := ignore.add(strings.TrimSuffix(dir, "/") + "/"); err != nil {
+			return nil, fmt.Errorf("invalid EXCLUDE_DIR: %v", err)
+		}
+	}
+	return ignore, nil
+}
+
+// parseExcludeDirs splits the comma-separated EXCLUDE_DIR value.
+func parseExcludeDirs(value string) []string {
+	var dirs []string
+	for _, dir := range strings.Split(value, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func (p *photoIgnore) add(line string) error {
+	pattern := ignorePattern{}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		// "\!" and "\#" start literal names
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return errors.New("empty pattern")
+	}
+
+	anchored := strings.Contains(line, "/")
+	expr := globToRegexp(strings.TrimPrefix(line, "/"))
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return fmt.Errorf("%q: %v", line, err)
+	}
+	pattern.re = re
+	p.patterns = append(p.patterns, pattern)
+	return nil
+}
+
+// globToRegexp translates a .gitignore glob into a regular expression.
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String()
+}
+
+// Match reports whether the path rel, relative to the photos root and slash-separated, is
+// ignored. Its parents are expected to have been checked already.
+func (p *photoIgnore) Match(rel string, isDir bool) bool {
+	ignored := false
+	for _, pattern := range p.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.re.MatchString(rel) {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// immichURL and immichAPIKey are IMMICH_URL and IMMICH_API_KEY, used with BACKEND=immich.
+var immichURL, immichAPIKey string
+
+// immichDeviceID identifies the assets this tool uploaded in Immich.
+const immichDeviceID = "media2nextcloud"
+
+// immichBackend uploads to an Immich server's asset API. Immich has no folders, so EnsureDir
+// does nothing and a path is only remembered to find its asset again. A path below
+// "Albums/<name>/" puts the asset into the Immich album of that name, which is created if
+// missing.
+type immichBackend struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+
+	mu sync.Mutex
+	// assets maps the paths uploaded in this run to their asset ids. albums maps album names
+	// to ids once the server's albums were listed.
+	assets map[string]string
+	albums map[string]string
+}
+
+func newImmichBackend(baseURL, apiKey string) *immichBackend {
+	return &immichBackend{
+		baseURL: strings.TrimSuffix(strings.TrimRight(baseURL, "/"), "/api"),
+		apiKey:  apiKey,
+		client:  &http.Client{Transport: newHTTPTransport()},
+		assets:  make(map[string]string),
+	}
+}
+
+// immichAssetResponse is the answer to an upload. Newer servers report a duplicate in
+// Status, older ones in Duplicate.
+type immichAssetResponse struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Duplicate bool   `json:"duplicate"`
+}
+
+func (b *immichBackend) EnsureDir(ctx context.Context, dir string) error {
+	return nil
+}
+
+// Upload sends the file as a new asset. Its creation date is the sidecar timestamp the file
+// was dated by, Immich reads EXIF dates itself. A file Immich already has, recognized by its
+// SHA-1 checksum, is reported as a duplicate and not stored again.
+func (b *immichBackend) Upload(ctx context.Context, p string, r io.Reader, opts UploadOptions) error {
+	createdAt := opts.ModTime
+	if !opts.Taken.IsZero() {
+		createdAt = opts.Taken
+	}
+
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		fields := map[string]string{
+			"deviceAssetId":  fmt.Sprintf("%s-%d", path.Base(p), opts.Size),
+			"deviceId":       immichDeviceID,
+			"fileCreatedAt":  createdAt.UTC().Format(time.RFC3339),
+			"fileModifiedAt": opts.ModTime.UTC().Format(time.RFC3339),
+		}
+		for name, value := range fields {
+			if err := form.WriteField(name, value); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		part, err := form.CreateFormFile("assetData", path.Base(p))
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", b.baseURL+"/api/assets", body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("x-api-key", b.apiKey)
+	setIdentityEncoding(req)
+	if opts.Source != "" {
+		if sum, err := fileSHA1(opts.Source); err == nil {
+			req.Header.Set("x-immich-checksum", sum)
+		}
+	}
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return &uploadStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	var asset immichAssetResponse
+	if err := json.NewDecoder(resp.Body).Decode(&asset); err != nil {
+		return fmt.Errorf("failed to decode Immich upload response: %v", err)
+	}
+	if asset.ID == "" {
+		return errors.New("Immich did not return the id of the uploaded asset")
+	}
+
+	if asset.Status == "duplicate" || asset.Duplicate {
+		slog.Debug("Immich already has the asset", "path", p, "id", asset.ID)
+	}
+
+	b.mu.Lock()
+	b.assets[p] = asset.ID
+	b.mu.Unlock()
+	return b.addToAlbum(ctx, p, asset.ID)
+}
+
+// Exists reports whether path was uploaded in this run. Immich itself skips assets it
+// already has, whatever path they were uploaded from.
+func (b *immichBackend) Exists(ctx context.Context, p string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.assets[p]
+	return ok, nil
+}
+
+// Size returns the size Immich recorded for the asset uploaded to path.
+func (b *immichBackend) Size(ctx context.Context, p string) (int64, error) {
+	b.mu.Lock()
+	id, ok := b.assets[p]
+	b.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("no asset was uploaded to %s", p)
+	}
+
+	var asset struct {
+		ExifInfo struct {
+			FileSizeInByte int64 `json:"fileSizeInByte"`
+		} `json:"exifInfo"`
+	}
+	if err := b.call(ctx, "GET", "/api/assets/"+id, nil, &asset); err != nil {
+		return 0, err
+	}
+	return asset.ExifInfo.FileSizeInByte, nil
+}
+
+// Copy adds the asset uploaded to src to the album dst is in, as Immich keeps a single copy.
+func (b *immichBackend) Copy(ctx context.Context, src, dst string) error {
+	b.mu.Lock()
+	id, ok := b.assets[src]
+	b.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no asset was uploaded to %s", src)
+	}
+	if _, ok := immichAlbum(dst); !ok {
+		return fmt.Errorf("%s is not in an album", dst)
+	}
+	return b.addToAlbum(ctx, dst, id)
+}
+
+// immichAlbum returns the album name of a path below "Albums/<name>/".
+func immichAlbum(p string) (string, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimPrefix(p, "/"), "Albums/")
+	if !ok {
+		return "", false
+	}
+	name, _, ok := strings.Cut(rest, "/")
+	return name, ok && name != ""
+}
+
+// addToAlbum adds the asset id to the album of p, if p is in one.
+func (b *immichBackend) addToAlbum(ctx context.Context, p, id string) error {
+	name, ok := immichAlbum(p)
+	if !ok {
+		return nil
+	}
+	albumID, err := b.albumID(ctx, name)
+	if err != nil {
+		return err
+	}
+	// Adding an asset that is already in the album is not an error
+	return b.call(ctx, "PUT", "/api/albums/"+albumID+"/assets", map[string]any{"ids": []string{id}}, nil)
+}
+
+// albumID returns the id of the album named name, creating the album if needed. The lock
+// is held while creating, so workers uploading into the same new album create it once.
+func (b *immichBackend) albumID(ctx context.Context, name string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.albums == nil {
+		var albums []struct {
+			ID   string `json:"id"`
+			Name string `json:"albumName"`
+		}
+		if err := b.call(ctx, "GET", "/api/albums", nil, &albums); err != nil {
+			return "", err
+		}
+		b.albums = make(map[string]string)
+		for _, album := range albums {
+			b.albums[album.Name] = album.ID
+		}
+	}
+	if id, ok := b.albums[name]; ok {
+		return id, nil
+	}
+
+	var album struct {
+		ID string `json:"id"`
+	}
+	if err := b.call(ctx, "POST", "/api/albums", map[string]any{"albumName": name}, &album); err != nil {
+		return "", fmt.Errorf("failed to create album %q: %w", name, err)
+	}
+	b.albums[name] = album.ID
+	return album.ID, nil
+}
+
+// call sends a JSON API request with the body in, if not nil, and decodes the response into
+// out, if not nil.
+func (b *immichBackend) call(ctx context.Context, method, endpoint string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = strings.NewReader(string(data))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.baseURL+endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("x-api-key", b.apiKey)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s", method, endpoint, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %v", method, endpoint, err)
+	}
+	return nil
+}
+
+// fileSHA1 returns the hex SHA-1 of path, the checksum Immich recognizes duplicates by.
+func fileSHA1(path string) (string, error) {
+	file, err := openMedia(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// immichPing checks IMMICH_URL and IMMICH_API_KEY before indexing starts.
+func immichPing(baseURL, apiKey string) error {
+	b := newImmichBackend(baseURL, apiKey)
+	return b.call(context.Background(), "GET", "/api/users/me", nil, nil)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+// indexCacheVersion changes whenever the cached data or the way dates are resolved does,
+// so caches written by older versions are not used.
+const indexCacheVersion = 1
+
+// indexCachePath is INDEX_CACHE, the file the resolved index is cached in between runs.
+var indexCachePath string
+
+// indexCache is the outcome of parsing the sidecars and EXIF data of an export. It is only
+// valid for the Key it was written with, which covers the size and modification time of
+// every sidecar and media file and the settings that affect date resolution.
+type indexCache struct {
+	Key            string               `json:"key"`
+	Folders        map[string]string    `json:"folders"`
+	DateSources    map[string]string    `json:"dateSources"`
+	Sidecars       map[string]string    `json:"sidecars,omitempty"`
+	Unresolved     map[string]string    `json:"unresolved,omitempty"`
+	TakenTimes     map[string]time.Time `json:"takenTimes,omitempty"`
+	People         map[string][]string  `json:"people,omitempty"`
+	Discrepancies  map[string]string    `json:"discrepancies,omitempty"`
+	OrphanSidecars []string             `json:"orphanSidecars,omitempty"`
+}
+
+// indexCacheKey fingerprints the sidecars and media files found by the walk and the date
+// settings. A file that is added, removed or modified changes the key. Without INDEX_CACHE
+// the files aren't stat'ed and the key is empty.
+func indexCacheKey(jsonFiles, mediaFiles []string) string {
+	if indexCachePath == "" {
+		return ""
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "v%d\x00%q\x00%s\x00%q\x00%s\x00%q\x00%t\x00%s\x00%s\x00%d\n",
+		indexCacheVersion, dateSources, dateLocation, timestampLayouts, fallbackDateFolder, filenameDatePatterns,
+		organizeBy == "none" && !needsDates(), dateSince, dateUntil, dateDiscrepancyDays)
+
+	files := append(append([]string{}, jsonFiles...), mediaFiles...)
+	sort.Strings(files)
+	for _, file := range files {
+		info, err := statMedia(file)
+		if err != nil {
+			fmt.Fprintf(hash, "%s\x00missing\n", file)
+			continue
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// loadIndexCache fills index from INDEX_CACHE, and reports whether the cache was valid for
+// key. A missing or stale cache is not an error.
+func loadIndexCache(key string, index *MediaIndex) bool {
+	if indexCachePath == "" {
+		return false
+	}
+	data, err := os.ReadFile(indexCachePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Failed to read index cache, indexing anew", "file", indexCachePath, "error", err)
+		}
+		return false
+	}
+	var cache indexCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		slog.Warn("Failed to parse index cache, indexing anew", "file", indexCachePath, "error", err)
+		return false
+	}
+	if cache.Key != key {
+		slog.Info("Photos or date settings changed since the index was cached, indexing anew", "file", indexCachePath)
+		return false
+	}
+
+	for path, folder := range cache.Folders {
+		index.Add(path, folder)
+	}
+	for path, source := range cache.DateSources {
+		index.SetDateSource(path, source)
+	}
+	for path, sidecar := range cache.Sidecars {
+		index.SetSidecar(path, sidecar)
+	}
+	for path, reason := range cache.Unresolved {
+		index.SetUnresolved(path, reason)
+	}
+	for path, taken := range cache.TakenTimes {
+		index.SetTakenTime(path, taken)
+	}
+	for path, people := range cache.People {
+		index.AddPeople(path, people...)
+	}
+	for path, discrepancy := range cache.Discrepancies {
+		index.SetDiscrepancy(path, discrepancy)
+	}
+	orphanSidecars = cache.OrphanSidecars
+	return true
+}
+
+// saveIndexCache writes index to INDEX_CACHE under key, replacing the file atomically.
+func saveIndexCache(key string, index *MediaIndex) error {
+	if indexCachePath == "" {
+		return nil
+	}
+	cache := indexCache{
+		Key:            key,
+		Folders:        make(map[string]string),
+		OrphanSidecars: orphanSidecars,
+	}
+	index.Range(func(path, folder string) bool {
+		cache.Folders[path] = folder
+		return true
+	})
+
+	index.mu.RLock()
+	cache.DateSources = index.dateSources
+	cache.Sidecars = index.sidecars
+	cache.Unresolved = index.unresolved
+	cache.TakenTimes = index.takenTimes
+	cache.People = index.people
+	cache.Discrepancies = index.discrepancies
+	data, err := json.Marshal(cache)
+	index.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmpPath := indexCachePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write index cache %s: %v", indexCachePath, err)
+	}
+	return os.Rename(tmpPath, indexCachePath)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// remoteListing holds the files of the remote folders listed before the upload, so the
+// existence checks of ON_CONFLICT=skip and rename don't need a request per file.
+type remoteListing struct {
+	mu    sync.Mutex
+	files map[string]map[string]int64
+}
+
+var remoteListings = &remoteListing{files: make(map[string]map[string]int64)}
+
+func (l *remoteListing) set(dir string, files map[string]int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.files[dir] = files
+}
+
+// lookup reports whether the file at remotePath exists according to the listing of its
+// folder, and false for found if the folder wasn't listed. Unless size is negative, a file
+// of another size, such as one whose upload was cut short, doesn't count as existing.
+func (l *remoteListing) lookup(remotePath string, size int64) (exists, found bool) {
+	dir := path.Dir(remotePath)
+	if dir == "." {
+		dir = ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	files, found := l.files[dir]
+	if !found {
+		return false, false
+	}
+	listedSize, exists := files[path.Base(remotePath)]
+	if exists && size >= 0 && listedSize != size {
+		slog.Debug("Remote file has another size than the local one", "path", remotePath, "remoteSize", listedSize, "localSize", size)
+		return false, true
+	}
+	return exists, true
+}
+
+// remoteFileExists reports whether a file exists at remotePath, from the folder listings
+// if its folder was listed and by asking backend otherwise. With a size that isn't
+// negative, a listed file of another size doesn't count as existing.
+func remoteFileExists(ctx context.Context, backend UploadBackend, remotePath string, size int64) (bool, error) {
+	if exists, found := remoteListings.lookup(remotePath, size); found {
+		return exists, nil
+	}
+	return backend.Exists(ctx, remotePath)
+}
+
+// listRemoteFolders lists the folders mediaFiles are uploaded to with one request each,
+// using parallel workers. A folder that can't be listed is checked file by file instead.
+func listRemoteFolders(ctx context.Context, parallel int, backend UploadBackend, mediaFiles []MediaFile, manifest *resumeManifest) {
+	lister, ok := backend.(dirLister)
+	if !ok {
+		return
+	}
+
+	seen := make(map[string]bool)
+	var folders []string
+	for _, media := range mediaFiles {
+		if manifest.Done(media) || seen[media.Ts] {
+			continue
+		}
+		seen[media.Ts] = true
+		folders = append(folders, media.Ts)
+	}
+	slog.Info("Listing remote folders to find existing files", "count", len(folders))
+
+	jobs := make(chan string, len(folders))
+	for _, folder := range folders {
+		jobs <- folder
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for range parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for folder := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				files, err := lister.ListDir(ctx, folder)
+				if err != nil {
+					slog.Debug("Failed to list remote folder, checking its files one by one", "folder", folder, "error", err)
+					continue
+				}
+				remoteListings.set(strings.Trim(folder, "/"), files)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (b *webdavBackend) ListDir(ctx context.Context, dir string) (map[string]int64, error) {
+	dirURL := remoteURL(b.baseURL, dir) + "/"
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", dirURL, strings.NewReader(propfindContentLengthBody))
+	if err != nil {
+		return nil, err
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND %s returned %s", dirURL, resp.Status)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("failed to decode PROPFIND response for %s: %v", dirURL, err)
+	}
+
+	files := make(map[string]int64)
+	// The collection itself is always the first response
+	for _, r := range ms.Responses[min(1, len(ms.Responses)):] {
+		href, err := url.PathUnescape(strings.TrimRight(r.Href, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid href %q in PROPFIND response for %s: %v", r.Href, dirURL, err)
+		}
+		size := int64(-1)
+		for _, ps := range r.Propstat {
+			if n, err := strconv.ParseInt(ps.Prop.ContentLength, 10, 64); err == nil {
+				size = n
+			}
+		}
+		files[path.Base(href)] = size
+	}
+	return files, nil
+}
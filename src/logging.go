@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// summaryLogger logs the end-of-run summary, which is shown even with QUIET.
+var summaryLogger = slog.Default()
+
+// setupLogger configures the default slog logger from LOG_LEVEL (debug, info, warn, error)
+// and LOG_FORMAT (text, json). Logs go to stderr so they never interleave with the
+// progress bars, which render on stdout.
+func setupLogger(level, format string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL %q: %v", level, err)
+	}
+
+	newHandler := func(level slog.Level) slog.Handler {
+		opts := &slog.HandlerOptions{Level: level}
+		if strings.ToLower(format) == "json" {
+			return slog.NewJSONHandler(os.Stderr, opts)
+		}
+		return slog.NewTextHandler(os.Stderr, opts)
+	}
+	if f := strings.ToLower(format); f != "text" && f != "json" {
+		return fmt.Errorf("invalid LOG_FORMAT %q: must be text or json", format)
+	}
+
+	slog.SetDefault(slog.New(newHandler(logLevel)))
+	summaryLogger = slog.New(newHandler(min(logLevel, slog.LevelInfo)))
+	return nil
+}
+
+// fatal logs msg at ERROR level and exits with a non-zero status.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -1,493 +1,2097 @@
 package main
 
 import (
-	"crypto/tls"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/schollz/progressbar/v3"
-	"github.com/tajtiattila/metadata"
-)
 
-// PhotoMetadata represents the structure of the JSON metadata file accompanying each photo.
-type PhotoMetadata struct {
-	Title          string   `json:"title"`
-	Description    string   `json:"description"`
-	ImageViews     string   `json:"imageViews"`
-	CreationTime   TimeData `json:"creationTime"`
-	PhotoTakenTime TimeData `json:"photoTakenTime"`
-	GeoData        GeoData  `json:"geoData"`
-	People         []Person `json:"people"`
-	URL            string   `json:"url"`
-	Origin         Origin   `json:"googlePhotosOrigin"`
-}
+	"media2nextcloud/metadata"
+)
 
-type TimeData struct {
-	Timestamp string `json:"timestamp"`
-	Formatted string `json:"formatted"`
-}
+var (
+	nextcloudURL, username, password, photosDir, parallel string
+	remoteBasePath                                        string
+	dateFilteredCounter                                   = 0
+	unresolvedReportPath                                  string
+	uploadEmpty                                           bool
+	maxFileSize                                           int64
+	quiet                                                 bool
+	emptyMediaFiles                                       []string
+	oversizedMediaFiles                                   []string
+	orphanSidecars                                        []string
+
+	uploadTimeout                                    time.Duration
+	resumePartial                                    bool
+	verifyUploads, deleteAfterUpload, deleteSidecars bool
+	uploadSidecars                                   bool
+	deletedCounter, freedBytes                       atomic.Int64
+	skippedExistingCounter                           atomic.Int64
+	failedCounter, successfullCounter                atomic.Int64
+)
 
-type GeoData struct {
-	Latitude      float64 `json:"latitude"`
-	Longitude     float64 `json:"longitude"`
-	Altitude      float64 `json:"altitude"`
-	LatitudeSpan  float64 `json:"latitudeSpan"`
-	LongitudeSpan float64 `json:"longitudeSpan"`
+// maxDefaultParallelUploads caps the default number of upload workers so that many-core
+// machines don't flood a small Nextcloud server.
+const maxDefaultParallelUploads = 8
+
+// extractDateFolder returns the "YYYY/MM" folder for a sidecar timestamp, as seen in
+// dateLocation. Accepted inputs:
+//
+//   - A date in one of timestampLayouts, tried in order, e.g. "2020-02-06T10:40:00Z",
+//     "2022-03-14T10:30:00+05:30" or "2022-03-14 10:30:00". Dates without a zone are
+//     taken to be in dateLocation
+//   - Unix epoch seconds, e.g. "1580985600", optionally fractional, e.g. "1580985600.5"
+//   - Unix epoch milliseconds, e.g. "1580985600000", which some exports use. Any epoch of
+//     1e12 or more is taken as milliseconds, since seconds only get there in the year 33658
+//
+// An empty string or anything else is an error.
+func extractDateFolder(timestamp string) (string, error) {
+	parsedTime, err := parseSidecarTimestamp(timestamp)
+	if err != nil {
+		return "", err
+	}
+	return parsedTime.Format("2006/01"), nil
 }
 
-type Person struct {
-	Name string `json:"name"`
-}
+// parseSidecarTimestamp parses a sidecar timestamp in one of the formats extractDateFolder
+// accepts and returns it in dateLocation.
+func parseSidecarTimestamp(timestamp string) (time.Time, error) {
+	if timestamp == "" {
+		return time.Time{}, fmt.Errorf("empty timestamp")
+	}
 
-type Origin struct {
-	MobileUpload MobileUpload `json:"mobileUpload"`
-}
+	for _, layout := range timestampLayouts {
+		if parsedTime, err := time.ParseInLocation(layout, timestamp, dateLocation); err == nil {
+			return parsedTime.In(dateLocation), nil
+		}
+	}
 
-type MobileUpload struct {
-	DeviceFolder DeviceFolder `json:"deviceFolder"`
-	DeviceType   string       `json:"deviceType"`
-}
+	// If no layout matches, try to parse as epoch time, which may be fractional
+	epoch, err := strconv.ParseFloat(timestamp, 64)
+	if err != nil || math.IsNaN(epoch) || math.IsInf(epoch, 0) {
+		return time.Time{}, fmt.Errorf("invalid timestamp format: %s", timestamp)
+	}
 
-type DeviceFolder struct {
-	LocalFolderName string `json:"localFolderName"`
+	if math.Abs(epoch) >= 1e12 {
+		epoch /= 1000
+	}
+	seconds, fraction := math.Modf(epoch)
+	parsedTime := time.Unix(int64(seconds), int64(fraction*1e9))
+	return parsedTime.In(dateLocation), nil
 }
 
-var (
-	nextcloudURL, username, password, photosDir, parallel string
-	myMap                                                 = make(map[string]string)
-	failedCounter                                         = 0
-	successfullCounter                                    = 0
-)
-
-func extractDateFolder(timestamp string) (string, error) {
-	// Try to parse as ISO 8601 first
-	parsedTime, err := time.Parse("2006-01-02T15:04:05Z", timestamp)
-	if err == nil {
-		return parsedTime.Format("2006/01"), nil
+// getMediaFileList returns the sidecars, media files and album metadata files below
+// directory, and the number of files and directories that could not be read. Unreadable
+// entries are logged and skipped so the rest of the directory is still indexed. Ignored
+// paths are recorded in index.
+func getMediaFileList(index *MediaIndex, directory string) ([]string, []string, []string, int) {
+	var localJsonFileList []string
+	var localMediaFileList []string
+	var localAlbumMetadataFileList []string
+	walkErrors := 0
+
+	walk := filepath.Walk
+	if len(archiveEntries) > 0 {
+		walk = walkArchive
+	} else if followSymlinks {
+		walk = walkFollowingSymlinks
 	}
 
-	// If ISO 8601 fails, try to parse as epoch time
-	epoch, err := strconv.ParseInt(timestamp, 10, 64)
+	ignore, err := loadPhotoIgnore(directory)
 	if err != nil {
-		return "", fmt.Errorf("invalid timestamp format: %s", timestamp)
+		slog.Error("Failed to read ignore file, skipping directory", "dir", directory, "error", err)
+		return nil, nil, nil, 1
 	}
-	parsedTime = time.Unix(epoch, 0)
-	return parsedTime.Format("2006/01"), nil
-}
 
-func getMediaFileList(directory string) ([]string, []string) {
-	var localJsonFileList []string
-	var localMediaFileList []string
+	// Skipped directories are still walked to count the media files in them
+	var skippedDirs []string
+	skipReasons := make(map[string]string)
 
 	// recursive search directory for files
-	filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+	err = walk(directory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return err
+			// The root itself failing is reported by walk's own return value
+			if path == directory {
+				return err
+			}
+			slog.Warn("Failed to read, skipping", "path", path, "error", err)
+			walkErrors++
+			return nil
+		}
+
+		if isBelowAny(path, skippedDirs) {
+			if !info.IsDir() && filepath.Ext(info.Name()) != ".json" && isMediaFileIncluded(info.Name()) {
+				for dir, reason := range skipReasons {
+					if isBelowAny(path, []string{dir}) {
+						skippedByReason.Add(reason, 1)
+						break
+					}
+				}
+			}
+			return nil
+		}
+
+		if rel, relErr := filepath.Rel(directory, path); relErr == nil && rel != "." && ignore.Match(filepath.ToSlash(rel), info.IsDir()) {
+			slog.Debug("Skipping ignored path", "path", path)
+			index.Ignore(path)
+			if info.IsDir() {
+				skippedDirs = append(skippedDirs, path)
+				skipReasons[path] = skipIgnored
+			} else if filepath.Ext(info.Name()) != ".json" && isMediaFileIncluded(info.Name()) {
+				skippedByReason.Add(skipIgnored, 1)
+			}
+			return nil
 		}
 
 		// check if file is folder and continue
 		if info.IsDir() {
+			// Skip Takeout's Trash and Archive folders unless they are opted into
+			if folder, ok := specialDirFolder(directory, path); ok {
+				if !includeSpecialDir(folder) {
+					slog.Info("Skipping Takeout folder", "dir", path)
+					skippedDirs = append(skippedDirs, path)
+					skipReasons[path] = skipTakeoutFolder
+					return nil
+				}
+				specialDirs[path] = folder
+			}
 			return nil
 		} else {
+			if skipNotNewFile(info) {
+				slog.Debug("Skipping file modified before the last run", "file", path)
+				if filepath.Ext(info.Name()) != ".json" && isMediaFileIncluded(info.Name()) {
+					skippedByReason.Add(skipNotNew, 1)
+				}
+				return nil
+			}
+			// Every other JSON file may be a sidecar, whatever Takeout numbered or
+			// shortened its name to: "IMG.jpg.json", "IMG(1).jpg.json", "IMG.jpg(1).json"
 			if filepath.Ext(info.Name()) == ".json" {
-				if strings.Count(info.Name(), ".") == 3 {
+				if info.Name() == albumMetadataFileName {
+					localAlbumMetadataFileList = append(localAlbumMetadataFileList, path)
+				} else {
 					localJsonFileList = append(localJsonFileList, path)
 				}
-			} else {
+			} else if isMediaFileIncluded(info.Name()) {
 				localMediaFileList = append(localMediaFileList, path)
+			} else {
+				slog.Debug("Skipping excluded file", "file", path)
+				if info.Name() != photoIgnoreFileName {
+					skippedByReason.Add(skipExcludedExt, 1)
+				}
 			}
 		}
 		return nil
 	})
+	if err != nil {
+		slog.Error("Failed to read photos directory", "dir", directory, "error", err)
+		walkErrors++
+	}
 
-	return localJsonFileList, localMediaFileList
+	return localJsonFileList, localMediaFileList, localAlbumMetadataFileList, walkErrors
 }
 
-func parseExtractMetadatJsonFileAndAddToMapImage(jsonFileList []string) {
+// parseExtractMetadatJsonFileAndAddToMapImage returns the number of sidecars that could not be parsed.
+// mediaFileList is used to look for the media file of a sidecar in the folders next to it, and
+// in the same folder of the other photosDirs of a split export.
+func parseExtractMetadatJsonFileAndAddToMapImage(index *MediaIndex, photosDirs, jsonFileList, mediaFileList []string) int {
+	errorCount := 0
+	dirs := newMediaDirs(photosDirs, mediaFileList)
+
 	// parse media metadata json file and get associated media file name and timestamp when it was created and add to map
 	for _, jsonFile := range jsonFileList {
-		parentPath := filepath.Dir(jsonFile)
-
-		// Read and parse the JSON metadata
-		openJsonFile, err := os.Open(jsonFile)
-		if err != nil {
-			log.Printf("Failed to open JSON file %s: %v\n", jsonFile, err)
-			return
+		if err := addMetadataJsonFileToMap(index, dirs, jsonFile); err != nil {
+			slog.Error("Failed to index sidecar", "file", jsonFile, "error", err)
+			errorCount++
 		}
+	}
 
-		byteValue, err := ioutil.ReadAll(openJsonFile)
-		if err != nil {
-			log.Printf("Failed to read JSON file %s: %v\n", jsonFile, err)
-			openJsonFile.Close()
-			return
-		}
-		defer openJsonFile.Close()
-
-		var metadata PhotoMetadata
-		json.Unmarshal(byteValue, &metadata)
+	if len(orphanSidecars) > 0 {
+		slog.Warn("Found no media file for some sidecars, in their folder or the ones next to it", "count", len(orphanSidecars), "files", orphanSidecars)
+	}
+	return errorCount
+}
 
-		fileName := metadata.Title
-		photoTakenTime, _ := extractDateFolder(metadata.PhotoTakenTime.Timestamp)
-		absImageFilePath := filepath.Join(parentPath, fileName)
+// addMetadataJsonFileToMap parses a single JSON sidecar and adds its media file to the map.
+func addMetadataJsonFileToMap(index *MediaIndex, dirs *mediaDirs, jsonFile string) (err error) {
+	defer recoverFilePanic(jsonFile, &err)
+	parentPath := filepath.Dir(jsonFile)
 
-		// Add photo to list
-		myMap[absImageFilePath] = photoTakenTime
+	// Read and parse the JSON metadata
+	byteValue, err := readMediaFile(jsonFile)
+	if err != nil {
+		return fmt.Errorf("failed to read JSON file %s: %v", jsonFile, err)
 	}
-}
 
-func getMediaFilesWithoutMedtadataJsonFiles(mediaFileList []string) []string {
-	var exifMEdiaFileList []string
+	sidecar, err := metadata.DecodeSidecar(byteValue)
+	if err != nil && !isJSONObject(byteValue) {
+		slog.Debug("Skipping JSON file that isn't an object, it is no sidecar", "file", jsonFile)
+		return nil
+	}
+	if err != nil {
+		return addMediaFileWithCorruptSidecar(index, jsonFile, err)
+	}
+	// Takeout's other JSON files, such as print-subscriptions.json, have no title
+	if sidecar.Title == "" {
+		slog.Debug("Skipping JSON file without a title, it is no sidecar", "file", jsonFile)
+		return nil
+	}
 
-	for _, mediaFile := range mediaFileList {
-		_, exists := myMap[mediaFile]
-		if !exists {
-			exifMEdiaFileList = append(exifMEdiaFileList, mediaFile)
-		} else {
-			continue
+	absImageFilePath, found := copyMediaPath(dirs.near(parentPath), jsonFile, sidecar.Title)
+	// The sidecar of a copy must not date the file it is a copy of
+	if _, numbered := sidecarCounter(jsonFile, sidecar.Title); !found && !numbered {
+		absImageFilePath, found = sidecarMediaPath(dirs.near(parentPath), sidecar.Title)
+	}
+	if !found {
+		slog.Debug("Found no media file for sidecar", "file", jsonFile, "title", sidecar.Title)
+		orphanSidecars = append(orphanSidecars, jsonFile)
+		return nil
+	}
+	if index.Ignored(absImageFilePath) {
+		return nil
+	}
+	dateFolder, dateSource := resolveDateFolder(index, absImageFilePath, &sidecar)
+
+	// Add photo to list
+	index.Add(absImageFilePath, dateFolder)
+	index.SetDateSource(absImageFilePath, dateSource)
+	index.SetSidecar(absImageFilePath, jsonFile)
+	for _, person := range sidecar.People {
+		if person.Name != "" {
+			index.AddPeople(absImageFilePath, person.Name)
 		}
 	}
+	return nil
+}
 
-	return exifMEdiaFileList
+// mediaDirs are the folders the walk found media files in, to find the media file of a
+// sidecar in a folder next to the sidecar's, as some Takeout layouts split them. A split
+// export may also put a sidecar in another part than its media file, so the same folder
+// below the other roots is searched too.
+type mediaDirs struct {
+	roots    []string
+	found    map[string]bool
+	children map[string][]string
 }
 
-func parseExtractMediaFilesWithoutMedtadataJsonFileAddToMap(exifMEdiaFileList []string) {
-	for _, photoPath := range exifMEdiaFileList {
-		timeStamp := ""
-		defaultTimestamp := "0001/01"
-		if filepath.Ext(photoPath) == ".DS_Store" {
+func newMediaDirs(roots, mediaFiles []string) *mediaDirs {
+	dirs := &mediaDirs{roots: roots, found: make(map[string]bool), children: make(map[string][]string)}
+	for _, mediaFile := range mediaFiles {
+		dir := filepath.Dir(mediaFile)
+		if dirs.found[dir] {
 			continue
 		}
+		dirs.found[dir] = true
+		parent := filepath.Dir(dir)
+		dirs.children[parent] = append(dirs.children[parent], dir)
+	}
+	for _, children := range dirs.children {
+		sort.Strings(children)
+	}
+	return dirs
+}
 
-		// Open the media file
-		file, err := os.Open(photoPath)
-		if err != nil {
-			fmt.Println("Error opening file:", err)
-			return
-		}
-		defer file.Close()
-
-		// check if file is a directory
-		if info, err := file.Stat(); err == nil && info.IsDir() {
-			fmt.Println("Skipping directory:", info.Name())
+// near returns dir, then its parent and its subfolders if they hold media files, then the
+// same folder below the other roots if it holds media files.
+func (d *mediaDirs) near(dir string) []string {
+	nearby := []string{dir}
+	if parent := filepath.Dir(dir); parent != dir && d.found[parent] {
+		nearby = append(nearby, parent)
+	}
+	nearby = append(nearby, d.children[dir]...)
+	for _, root := range d.roots {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || !filepath.IsLocal(rel) {
 			continue
 		}
-
-		// Parse metadata from the file
-		meta, err := metadata.Parse(file)
-		if err != nil {
-			fmt.Printf("Error parsing file: [%s] with metadata: %v . Will use default value [%s]\n", photoPath, err, defaultTimestamp)
-			timeStamp = defaultTimestamp
+		for _, other := range d.roots {
+			if other == root {
+				continue
+			}
+			if sibling := filepath.Join(other, rel); d.found[sibling] && !slices.Contains(nearby, sibling) {
+				nearby = append(nearby, sibling)
+			}
 		}
+	}
+	return nearby
+}
 
-		// Extract and print creation timestamp
-		if timeStamp == "" {
-			if meta.DateTimeCreated.IsZero() {
-				fmt.Printf("Creation timestamp not found for file: [%s], going with original timestamp in EXIF data \n", photoPath)
-				timeStamp = meta.DateTimeOriginal.Time.Format("2006/01")
-			} else {
-				timeStamp = meta.DateTimeCreated.Time.Format("2006/01")
+// sidecarMediaPath returns the media file a sidecar with the given title belongs to, looking
+// in dirs in order, and false if there is none. The title usually is the media file's name,
+// but some exports drop or change its extension, e.g. "VID_20220101" for VID_20220101.mp4,
+// so if no folder has a file named title the title is tried with each of the default media
+// extensions, in lower and upper case, in place of its own.
+func sidecarMediaPath(dirs []string, title string) (string, bool) {
+	for _, dir := range dirs {
+		mediaPath := filepath.Join(dir, title)
+		if _, err := statMedia(mediaPath); err == nil {
+			if dir != dirs[0] {
+				slog.Debug("Matched sidecar to media file in another folder", "title", title, "file", mediaPath)
 			}
-
+			return mediaPath, true
 		}
+	}
 
-		// Add photo to map
-		_, exists := myMap[photoPath]
-		if !exists {
-			myMap[photoPath] = timeStamp
-		} else {
-			fmt.Println("Error, Media file already exists in map")
+	stems := []string{title}
+	if ext := filepath.Ext(title); ext != "" {
+		stems = append(stems, strings.TrimSuffix(title, ext))
+	}
+	for _, dir := range dirs {
+		for _, stem := range stems {
+			for _, ext := range strings.Split(defaultIncludeExt, ",") {
+				for _, candidate := range []string{stem + "." + ext, stem + "." + strings.ToUpper(ext)} {
+					if _, err := statMedia(filepath.Join(dir, candidate)); err == nil {
+						slog.Debug("Matched sidecar title to media file with another extension", "title", title, "file", filepath.Join(dir, candidate))
+						return filepath.Join(dir, candidate), true
+					}
+				}
+			}
 		}
 	}
+	return "", false
 }
 
-func GetEnvWithDefault(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
+// sidecarCounterPattern matches the counter Takeout adds to the sidecar of the second and
+// later copies of a file with the same name, e.g. "IMG_1234.jpg.supplemental-metadata(1).json".
+// sidecarNameCounterPattern matches the counter of sidecars named after the copy instead,
+// e.g. "IMG_1234(1).jpg.json".
+var (
+	sidecarCounterPattern     = regexp.MustCompile(` ?\((\d+)\)\.json$`)
+	sidecarNameCounterPattern = regexp.MustCompile(`\((\d+)\)\.[^.()]+(\.[^()]*)?\.json$`)
+)
+
+// sidecarCounter returns the counter, such as "(1)", of a sidecar that belongs to a copy of
+// the file named title, and false for the sidecar of the file itself. A counter in front of
+// the extension that title has as well is part of the file's name.
+func sidecarCounter(jsonFile, title string) (string, bool) {
+	name := filepath.Base(jsonFile)
+	if match := sidecarCounterPattern.FindStringSubmatch(name); match != nil {
+		return "(" + match[1] + ")", true
 	}
-	return value
+	if match := sidecarNameCounterPattern.FindStringSubmatch(name); match != nil && !strings.Contains(title, "("+match[1]+")") {
+		return "(" + match[1] + ")", true
+	}
+	return "", false
 }
 
-func processDirectory(photosDir string) {
-	// get media files from given directory
-	jsonFileList, mediaFileList := getMediaFileList(photosDir)
-
-	// parse media metadata json file and get associated media file name and timestamp when it was created and add to map
-	parseExtractMetadatJsonFileAndAddToMapImage(jsonFileList)
+// copyNames returns the names Takeout gives the copy of the media file name that carries
+// counter: the counter before the extension ("IMG_1234(1).jpg") or after it ("IMG_1234.jpg(1)").
+func copyNames(name, counter string) []string {
+	ext := filepath.Ext(name)
+	return []string{strings.TrimSuffix(name, ext) + counter + ext, name + counter}
+}
 
-	// get media files that do not exist in jsonFileList
-	exifMEdiaFileList := getMediaFilesWithoutMedtadataJsonFiles(mediaFileList)
+// copyMediaPath returns the media file of a sidecar with a counter in its name, which
+// belongs to the copy of the file named title with the same counter rather than to the
+// file itself. It returns false for a sidecar without counter or if there is no such copy.
+func copyMediaPath(dirs []string, jsonFile, title string) (string, bool) {
+	counter, numbered := sidecarCounter(jsonFile, title)
+	if !numbered {
+		return "", false
+	}
+	for _, dir := range dirs {
+		for _, name := range copyNames(title, counter) {
+			mediaPath := filepath.Join(dir, name)
+			if _, err := statMedia(mediaPath); err == nil {
+				slog.Debug("Matched numbered sidecar to copy of media file", "sidecar", jsonFile, "file", mediaPath)
+				return mediaPath, true
+			}
+		}
+	}
+	return "", false
+}
 
-	// iterate over photoList and extract exif data and get metadata with timestamp
-	parseExtractMediaFilesWithoutMedtadataJsonFileAddToMap(exifMEdiaFileList)
+// isJSONObject reports whether data may be a JSON object. Invalid JSON counts as one, as
+// it may be a damaged sidecar, while valid JSON such as an array is no sidecar.
+func isJSONObject(data []byte) bool {
+	return !json.Valid(data) || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
 
-	for photoPath, subFolderTimestamp := range myMap {
-		if strings.Contains(subFolderTimestamp, "0001/") {
-			parts := strings.Split(subFolderTimestamp, "/")
-			newSubFolderTimestamp := "2000/" + parts[1]
-			myMap[photoPath] = newSubFolderTimestamp
+// addMediaFileWithCorruptSidecar adds the media file of a sidecar that could not be parsed
+// to the map without using the sidecar's metadata. The media file name is taken from the
+// sidecar's name ("IMG_0001.jpg.supplemental-metadata.json") as its title is unknown, and
+// a numbered sidecar resolves to the copy with the same number.
+func addMediaFileWithCorruptSidecar(index *MediaIndex, jsonFile string, parseErr error) error {
+	mediaPath := strings.TrimSuffix(jsonFile, ".json")
+	numbered := false
+	if match := sidecarCounterPattern.FindStringIndex(jsonFile); match != nil {
+		mediaPath = jsonFile[:match[0]]
+		numbered = true
+	}
+	mediaPath = strings.TrimSuffix(mediaPath, filepath.Ext(mediaPath))
+	if numbered {
+		copyPath, found := copyMediaPath([]string{filepath.Dir(mediaPath)}, jsonFile, filepath.Base(mediaPath))
+		if !found {
+			return fmt.Errorf("failed to parse JSON file %s: %v", jsonFile, parseErr)
 		}
+		mediaPath = copyPath
+	}
+	if _, err := statMedia(mediaPath); err != nil {
+		return fmt.Errorf("failed to parse JSON file %s: %v", jsonFile, parseErr)
 	}
 
-	fmt.Printf("\n\nProcessed %d multimedia files \n\n", len(myMap))
+	slog.Warn("Ignoring unparsable sidecar", "file", jsonFile, "error", parseErr)
+	dateFolder, dateSource := resolveDateFolder(index, mediaPath, nil)
+	index.Add(mediaPath, dateFolder)
+	index.SetDateSource(mediaPath, dateSource)
+	if _, unresolved := index.Unresolved(mediaPath); unresolved {
+		index.SetUnresolved(mediaPath, "sidecar-error")
+	}
+	index.SetSidecar(mediaPath, jsonFile)
+	return nil
 }
 
-// createNestedDirectories ensures all directories in the path exist on Nextcloud.
-func createNestedDirectories(client *http.Client, baseURL, subFolder, username, password string) error {
-	parts := strings.Split(subFolder, "/")
-	currentPath := baseURL
+func getMediaFilesWithoutMedtadataJsonFiles(index *MediaIndex, mediaFileList []string) []string {
+	var exifMEdiaFileList []string
 
-	for _, part := range parts {
-		if part == "" {
+	for _, mediaFile := range mediaFileList {
+		_, exists := index.Get(mediaFile)
+		if !exists {
+			exifMEdiaFileList = append(exifMEdiaFileList, mediaFile)
+		} else {
 			continue
 		}
-		currentPath = fmt.Sprintf("%s/%s", currentPath, part)
-		if err := createDirectoryIfNotExists(client, currentPath, username, password); err != nil {
-			return fmt.Errorf("failed to create directory %s: %v", currentPath, err)
+	}
+
+	return exifMEdiaFileList
+}
+
+// parseExtractMediaFilesWithoutMedtadataJsonFileAddToMap returns the number of media files that could not be read.
+func parseExtractMediaFilesWithoutMedtadataJsonFileAddToMap(index *MediaIndex, exifMEdiaFileList []string) int {
+	errorCount := 0
+
+	for _, photoPath := range exifMEdiaFileList {
+		if err := addMediaFileToMap(index, photoPath); err != nil {
+			slog.Error("Failed to index media file", "file", photoPath, "error", err)
+			errorCount++
 		}
 	}
 
-	return nil
+	return errorCount
 }
 
-// createDirectoryIfNotExists checks if a WebDAV directory exists, and creates it if it doesn't.
-func createDirectoryIfNotExists(client *http.Client, url, username, password string) error {
-	req, err := http.NewRequest("MKCOL", url, nil)
-	if err != nil {
+// addMediaFileToMap resolves the date folder of a single media file without a sidecar
+// and adds it to the map.
+func addMediaFileToMap(index *MediaIndex, photoPath string) (err error) {
+	defer recoverFilePanic(photoPath, &err)
+	if _, err := statMedia(photoPath); err != nil {
 		return err
 	}
-	req.SetBasicAuth(username, password)
-	resp, err := client.Do(req)
+
+	// Add photo to map
+	_, exists := index.Get(photoPath)
+	if !exists {
+		dateFolder, dateSource := resolveDateFolder(index, photoPath, nil)
+		index.Add(photoPath, dateFolder)
+		index.SetDateSource(photoPath, dateSource)
+	} else {
+		slog.Error("Media file already exists in map", "file", photoPath)
+	}
+	return nil
+}
+
+// checkPhotosDir returns an error unless dir is a readable directory.
+func checkPhotosDir(dir string) error {
+	info, err := os.Stat(dir)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusMethodNotAllowed {
-		return nil
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
 	}
 
-	if resp.StatusCode == 204 {
-		log.Printf("Folder %s already exists in Nextcloud\n", url)
-		return nil
+	// Listing an entry is the only reliable check for read permission
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
-
-	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to create directory %s, status: %s", url, resp.Status)
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read %s: %v", dir, err)
 	}
-
-	log.Printf("Successfully created directory: %s\n", url)
 	return nil
 }
 
-// uploadFile uploads a file to Nextcloud with retry on 404 status code.
-func uploadFile(fileLocation, nextcloudURL, username, password, subFolder string) error {
-	fileName := filepath.Base(fileLocation)
-	url := fmt.Sprintf("%s/%s/%s", nextcloudURL, subFolder, fileName)
-	absFileLocation, _ := filepath.Abs(fileLocation)
-
-	retryCount := 3
-	for attempt := 1; attempt <= retryCount; attempt++ {
-		file, err := os.Open(absFileLocation)
-		if err != nil {
-			return err
+// splitPhotosDirs splits a PHOTOS_DIR value listing several Takeout roots, such as
+// "Takeout,Takeout 2", separated by commas or the OS path list separator.
+func splitPhotosDirs(value string) []string {
+	var dirs []string
+	for _, dir := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == os.PathListSeparator }) {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
 		}
-		defer file.Close()
+	}
+	return dirs
+}
 
-		req, err := http.NewRequest("PUT", url, file)
+// listDates writes the LIST_ONLY table of index to path, or to stdout when path is empty.
+func listDates(index *MediaIndex, path string) {
+	w := os.Stdout
+	if path != "" {
+		file, err := os.Create(path)
 		if err != nil {
-			return err
+			fatal("Failed to create LIST_FILE", "error", err)
 		}
-		req.SetBasicAuth(username, password)
+		defer file.Close()
+		w = file
+	}
+	count, err := writeDateListing(index, w)
+	if err != nil {
+		fatal("Failed to write date listing", "error", err)
+	}
+	if err := saveState(statePath); err != nil {
+		slog.Error("Failed to save state file", "error", err)
+	}
+	summaryLogger.Info("Finished listing dates", "files", count)
+}
 
-		transport := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // Disable certificate verification
-		}
-		client := &http.Client{Transport: transport}
-		resp, err := client.Do(req)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
+// processDirectory indexes all photosDirs and returns the index and the number of files that
+// failed to index. The roots are indexed together so that deduplication and albums work
+// across the parts of a split Takeout export.
+func processDirectory(photosDirs []string) (*MediaIndex, int) {
+	index := newMediaIndex()
+
+	// get media files from given directories
+	var jsonFileList, mediaFileList, albumMetadataFileList []string
+	walkErrors := 0
+	for _, photosDir := range photosDirs {
+		jsonFiles, mediaFiles, albumMetadataFiles, dirWalkErrors := getMediaFileList(index, photosDir)
+		jsonFileList = append(jsonFileList, jsonFiles...)
+		mediaFileList = append(mediaFileList, mediaFiles...)
+		albumMetadataFileList = append(albumMetadataFileList, albumMetadataFiles...)
+		walkErrors += dirWalkErrors
+	}
+	if walkErrors > 0 {
+		slog.Warn("Some files or directories could not be read, files in them are missing", "count", walkErrors)
+	}
 
-		if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK {
-			successfullCounter++
-			return nil
+	errorCount := walkErrors
+	cacheKey := indexCacheKey(jsonFileList, mediaFileList)
+	if loadIndexCache(cacheKey, index) {
+		slog.Info("Loaded index from INDEX_CACHE, no files changed since it was written", "files", index.Len(), "file", indexCachePath)
+	} else {
+		// parse media metadata json file and get associated media file name and timestamp when it was created and add to map
+		parseErrors := parseExtractMetadatJsonFileAndAddToMapImage(index, photosDirs, jsonFileList, mediaFileList)
+
+		// get media files that do not exist in jsonFileList
+		exifMEdiaFileList := getMediaFilesWithoutMedtadataJsonFiles(index, mediaFileList)
+
+		// iterate over photoList and extract exif data and get metadata with timestamp
+		parseErrors += parseExtractMediaFilesWithoutMedtadataJsonFileAddToMap(index, exifMEdiaFileList)
+
+		// Files that failed are retried by the next run rather than cached as missing
+		errorCount += parseErrors
+		if parseErrors == 0 {
+			if err := saveIndexCache(cacheKey, index); err != nil {
+				slog.Warn("Failed to write index cache", "error", err)
+			}
 		}
+	}
 
-		if resp.StatusCode == 204 {
-			successfullCounter++
-			return nil
-		}
+	unknownDates, err := skipUnknownDates(index)
+	if err != nil {
+		fatal("Failed to decide about files without a date", "error", err)
+	}
+	if unknownDates > 0 {
+		slog.Info("Skipped files without a date", "count", unknownDates)
+		skippedByReason.Add(skipUnknownDate, unknownDates)
+	}
 
-		// Retry on 404 status code
-		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGatewayTimeout {
-			log.Printf("Attempt %d: Received %d for %s. Retrying...\n", attempt, resp.StatusCode, url)
-			time.Sleep(2 * time.Second) // Wait before retrying
-			continue
+	if unresolvedReportPath != "" {
+		if err := writeUnresolvedReport(unresolvedReportPath, index); err != nil {
+			slog.Error("Failed to write unresolved report", "error", err)
+		} else {
+			slog.Info("Wrote files without a date to unresolved report", "count", len(index.UnresolvedPaths()), "file", unresolvedReportPath)
 		}
-
-		failedCounter++
-		return fmt.Errorf("failed to upload %s due to %s", fileName, resp.Status)
 	}
 
-	failedCounter++
-	return fmt.Errorf("failed to upload %s after %d retries", fileName, retryCount)
-}
-
-type MediaFile struct {
-	Path string
-	Ts   string
-}
-
-func uploadMediaFilesToNextcloud(parallelUploads int, nextcloudURL, username, password string, directories []string) {
-	fmt.Println("Creating Required directories on Nextcloud")
-	client := &http.Client{}
-	dirSize := len(directories)
-
-	numWorkers := runtime.NumCPU()
-	fmt.Printf("Using %d workers (CPU cores)\n", numWorkers)
-
-	// Initialize progress bar
-	dirBar := progressbar.New(dirSize)
+	if dateFilteredCounter = filterByDate(index); dateFilteredCounter > 0 {
+		slog.Info("Skipped files outside DATE_SINCE/DATE_UNTIL", "count", dateFilteredCounter)
+		skippedByReason.Add(skipDateRange, dateFilteredCounter)
+	}
 
-	// Create a channel to control the number of concurrent goroutines
-	dirJobs := make(chan string, dirSize)
-	// Create a wait group to wait for all goroutines to complete
-	var wgDir sync.WaitGroup
-	wgDir.Add(dirSize)
+	if notNew := filterNotNew(index); notNew > 0 {
+		slog.Info("Skipped files dated before the last run", "count", notNew)
+		skippedByReason.Add(skipNotNew, notNew)
+	}
 
-	// Create a fixed number of goroutines to handle the uploads
-	for range parallelUploads {
-		go func() {
-			for directory := range dirJobs {
-				// Ensure nested directories exist
-				if err := createNestedDirectories(client, nextcloudURL, directory, username, password); err != nil {
-					log.Printf("Error ensuring nested directories exist: %v \n", err)
-				}
-				dirBar.Add(1)
-				wgDir.Done()
+	// Album folders are also needed to pick which copy deduplication keeps, and for the
+	// {album} APPLY_TAGS
+	if organizeBy == "album" || dedup || slices.Contains(applyTags, tagAlbums) {
+		for _, albumMetadataFile := range albumMetadataFileList {
+			if err := addAlbumMetadataFile(albumMetadataFile); err != nil {
+				slog.Error("Failed to index album", "file", albumMetadataFile, "error", err)
+				errorCount++
 			}
-		}()
+		}
+		slog.Info("Found albums", "count", len(albumDirs))
 	}
 
-	// Iterate over the map and send each media file to the jobs channel
-	for _, dir := range directories {
-		dirJobs <- dir
+	if dedup {
+		duplicates := deduplicateMedia(index)
+		slog.Info("Removed duplicate copies", "duplicates", duplicates)
+		skippedByReason.Add(skipDuplicate, duplicates)
 	}
 
-	// Close the jobs channel to signal that all jobs have been sent
-	close(dirJobs)
-	// Wait for all goroutines to complete
-	wgDir.Wait()
+	recordMediaSizes(index)
 
-	fmt.Println()
-
-	fmt.Println("Uploading media files to Nextcloud")
-
-	// Initialize progress bar
-	mediaSize := len(myMap)
+	if !uploadEmpty {
+		skipEmptyMedia(index)
+	}
+	if maxFileSize > 0 {
+		skipOversizedMedia(index)
+	}
 
-	mediaProgressBar := progressbar.New(mediaSize)
+	slog.Info("Processed multimedia files", "count", index.Len())
 
-	jobs := make(chan MediaFile, mediaSize)
-	progressChan := make(chan int, parallelUploads)
-	var wgMedia sync.WaitGroup
+	return index, errorCount
+}
 
-	for range parallelUploads {
-		wgMedia.Add(1)
-		go worker(jobs, progressChan, &wgMedia)
+// openUploadBackend returns the BACKEND files are uploaded to, and to the USER_MAP
+// destinations' accounts for their files.
+func openUploadBackend(name string, auth Authenticator, localDir string) UploadBackend {
+	// Everything is uploaded below REMOTE_BASE_PATH, so make sure it exists first
+	backend, err := newUploadBackend(context.Background(), name, nextcloudURL, auth, localDir, remoteBasePath)
+	if err != nil {
+		fatal("Failed to create remote base path", "path", remoteBasePath, "error", err)
 	}
-
-	// Send jobs (keys of the map) to workers
-	go func() {
-		for photoPath, subFolderTimestamp := range myMap {
-			jobs <- MediaFile{photoPath, subFolderTimestamp}
+	if len(userDestinations) > 0 {
+		if backend, err = newUserBackend(context.Background(), name, backend, userDestinations, remoteBasePath); err != nil {
+			fatal("Failed to create remote base path", "path", remoteBasePath, "error", err)
 		}
-		close(jobs) // Close jobs channel after sending all keys
-	}()
-
-	// Close progress channel once all workers are done
-	go func() {
-		wgMedia.Wait()
-		close(progressChan)
-	}()
-
-	finishCounter := 0
-	// Update progress bar in real-time
-	for p := range progressChan {
-		finishCounter += p
-		fmt.Printf("Uploaded %d/%d media files\n", finishCounter, mediaSize)
-		_ = mediaProgressBar.Add(p)
 	}
+	return backend
 }
 
-func worker(jobs chan MediaFile, progressChan chan int, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	for media := range jobs {
-		// Upload the media file
-		if err := uploadFile(media.Path, nextcloudURL, username, password, media.Ts); err != nil {
-			log.Printf("Failed to upload file %s: [%v]\n", media.Path, err)
+// recordMediaSizes stats every file in index once so the upload phase knows the total
+// number of bytes to transfer.
+func recordMediaSizes(index *MediaIndex) {
+	for _, photoPath := range index.Paths() {
+		info, err := statMedia(photoPath)
+		if err != nil {
+			slog.Warn("Failed to determine file size", "file", photoPath, "error", err)
+			index.SetSize(photoPath, -1)
+			continue
 		}
-		progressChan <- 1
+		index.SetSize(photoPath, info.Size())
 	}
 }
 
-func getUniqueDirectoryToBecreatedOnNextCloud() []string {
-	// Helper map to track unique values
-	uniqueValuesMap := make(map[string]bool)
-
-	// Slice to store unique values
-	var uniqueValues []string
-
-	// Iterate over the map and collect unique values
-	for _, value := range myMap {
-		if !uniqueValuesMap[value] {
-			uniqueValuesMap[value] = true
-			uniqueValues = append(uniqueValues, value)
+// skipEmptyMedia removes 0-byte media files from index and records them in emptyMediaFiles.
+// Takeout contains these for photos Google failed to export.
+func skipEmptyMedia(index *MediaIndex) {
+	for _, photoPath := range index.Paths() {
+		if index.Size(photoPath) == 0 {
+			slog.Warn("Skipping empty media file", "file", photoPath)
+			emptyMediaFiles = append(emptyMediaFiles, photoPath)
+			skippedByReason.Add(skipEmpty, 1)
+			index.Delete(photoPath)
 		}
 	}
+}
 
-	return uniqueValues
+// skipOversizedMedia removes media files larger than MAX_FILE_SIZE from index and records
+// them in oversizedMediaFiles, so files the server rejects anyway don't use up retries.
+func skipOversizedMedia(index *MediaIndex) {
+	for _, photoPath := range index.Paths() {
+		if size := index.Size(photoPath); size > maxFileSize {
+			slog.Warn("Skipping media file larger than MAX_FILE_SIZE", "file", photoPath, "size", size)
+			oversizedMediaFiles = append(oversizedMediaFiles, photoPath)
+			skippedByReason.Add(skipTooLarge, 1)
+			index.Delete(photoPath)
+		}
+	}
 }
 
-func main() {
-	nextcloudURL = GetEnvWithDefault("NEXTCLOUD_URL", "")
-	username = GetEnvWithDefault("NEXTCLOUD_USER", "")
-	password = GetEnvWithDefault("NEXTCLOUD_PASSWORD", "")
-	photosDir = GetEnvWithDefault("PHOTOS_DIR", "")
-	parallel = GetEnvWithDefault("PARALLEL_UPLOADS", "1")
+// destinationPath returns the path, relative to the backend's root, that a file named
+// fileName in subFolder is uploaded to. Leading, trailing and repeated slashes are dropped,
+// so an empty subFolder is the root, and ".." can't climb above the root. remoteURL turns it
+// into a URL below the remote base path.
+func destinationPath(subFolder, fileName string) string {
+	return strings.TrimPrefix(path.Join("/", subFolder, fileName), "/")
+}
 
-	if nextcloudURL == "" || username == "" || password == "" || photosDir == "" || parallel == "" {
-		log.Fatal("Missing required environment variables: NEXTCLOUD_URL, NEXTCLOUD_USER, NEXTCLOUD_PASSWORD, PHOTOS_DIR, PARALLEL_UPLOADS")
+// remoteURL appends each slash-separated path to baseURL, escaping every segment with
+// url.PathEscape so names containing spaces, '#', '+' or non-ASCII characters stay intact.
+func remoteURL(baseURL string, paths ...string) string {
+	joined := strings.TrimRight(baseURL, "/")
+	for _, p := range paths {
+		for _, part := range strings.Split(p, "/") {
+			if part == "" {
+				continue
+			}
+			joined = fmt.Sprintf("%s/%s", joined, url.PathEscape(part))
+		}
 	}
+	return joined
+}
 
-	// Convert string to integer
-	parallelUploads, err := strconv.Atoi(parallel)
+// createDirectoryIfNotExists checks if a WebDAV directory exists, and creates it if it doesn't.
+// It reports whether dirURL itself was created. dirURL must already be escaped, see remoteURL.
+//
+// MKCOL answers 201 when the collection was created, 405 when it already exists and 409
+// when its parent is missing, in which case the parent is created first and the MKCOL
+// is repeated.
+func createDirectoryIfNotExists(client *http.Client, dirURL string, auth Authenticator) (bool, error) {
+	statusCode, status, err := mkcol(client, dirURL, auth)
 	if err != nil {
-		fmt.Println("Error converting PARALLEL_UPLOADS string to integer:", err)
-		return
+		return false, err
 	}
 
-	// processDirectory(photosDir)
-	processDirectory(photosDir)
-
-	directoriesToBeCreated := getUniqueDirectoryToBecreatedOnNextCloud()
-
-	uploadMediaFilesToNextcloud(parallelUploads, nextcloudURL, username, password, directoriesToBeCreated)
-
-	fmt.Printf("\n\nSuccessfully uploaded %d media files \n\n", successfullCounter)
-	fmt.Println("Failed to upload", failedCounter, "media files")
+	if statusCode == http.StatusConflict {
+		parentURL, ok := parentCollectionURL(dirURL)
+		if !ok {
+			return false, fmt.Errorf("failed to create directory %s, status: %s", dirURL, status)
+		}
+		slog.Debug("Parent folder missing, creating it first", "url", parentURL)
+		if _, err := createDirectoryIfNotExists(client, parentURL, auth); err != nil {
+			return false, err
+		}
+		if statusCode, status, err = mkcol(client, dirURL, auth); err != nil {
+			return false, err
+		}
+	}
+
+	switch statusCode {
+	case http.StatusCreated, http.StatusOK:
+		slog.Debug("Created directory", "url", dirURL)
+		return true, nil
+	case http.StatusMethodNotAllowed:
+		slog.Debug("Folder already exists in Nextcloud", "url", dirURL)
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to create directory %s, status: %s", dirURL, status)
+	}
+}
+
+// mkcol issues a single MKCOL request for dirURL and returns the response status.
+func mkcol(client *http.Client, dirURL string, auth Authenticator) (int, string, error) {
+	req, err := http.NewRequest("MKCOL", dirURL, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	auth.Authenticate(req)
+	resp, err := doRequest(client, req, webdavRetryPolicy)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode, resp.Status, nil
+}
+
+// parentCollectionURL strips the last path segment from dirURL. It returns false when
+// dirURL is already at the server root.
+func parentCollectionURL(dirURL string) (string, bool) {
+	u, err := url.Parse(dirURL)
+	if err != nil {
+		return "", false
+	}
+	trimmed := strings.TrimRight(u.EscapedPath(), "/")
+	idx := strings.LastIndex(trimmed, "/")
+	if idx <= 0 {
+		return "", false
+	}
+	parentPath := trimmed[:idx]
+	if u.Path, err = url.PathUnescape(parentPath); err != nil {
+		return "", false
+	}
+	u.RawPath = parentPath
+	return u.String(), true
+}
+
+// UploadResult describes how uploadFile uploaded one local file.
+type UploadResult struct {
+	// TargetPath is the remote path, which differs from the local name with ON_CONFLICT=rename.
+	TargetPath string
+	// StatusCode is the HTTP status of the last rejected attempt, 0 if the server rejected none.
+	StatusCode int
+	Bytes      int64
+	Attempts   int
+	Elapsed    time.Duration
+	// Skipped is set when ON_CONFLICT=skip found the target existing and nothing was uploaded.
+	Skipped bool
+}
+
+// uploadFile uploads a file to the backend, retrying as uploadRetryPolicy allows and on timeouts.
+// The result is filled in as far as the upload got, also when it failed. Cancelling ctx
+// aborts the request in flight. index holds what indexing recorded about the file, if any.
+func uploadFile(ctx context.Context, index *MediaIndex, fileLocation string, backend UploadBackend, subFolder string) (UploadResult, error) {
+	start := time.Now()
+	fileName := filepath.Base(fileLocation)
+	absFileLocation, _ := filepath.Abs(fileLocation)
+
+	size := int64(-1)
+	if info, err := statMedia(absFileLocation); err == nil {
+		size = info.Size()
+	}
+	targetPath, err := uploadTargetPath(ctx, backend, subFolder, fileName, size)
+	if errors.Is(err, errRemoteExists) {
+		return UploadResult{TargetPath: destinationPath(subFolder, fileName), Skipped: true, Elapsed: time.Since(start)}, nil
+	}
+	if err != nil {
+		return UploadResult{}, err
+	}
+
+	result := UploadResult{TargetPath: targetPath}
+
+	retryCount := uploadRetryPolicy.Attempts
+	for attempt := 1; attempt <= retryCount; attempt++ {
+		result.Attempts = attempt
+		err := putFile(ctx, index, backend, absFileLocation, targetPath, attempt > 1)
+		if err == nil {
+			if info, err := statMedia(absFileLocation); err == nil {
+				result.Bytes = info.Size()
+			}
+			result.Elapsed = time.Since(start)
+			return result, nil
+		}
+
+		if errors.Is(err, errChecksumMismatch) {
+			slog.Warn("Upload was corrupted, retrying", "attempt", attempt, "path", targetPath)
+			metrics.UploadRetried()
+			continue
+		}
+
+		var statusErr *uploadStatusError
+		if !errors.As(err, &statusErr) {
+			// A request that hit UPLOAD_TIMEOUT is retried, anything else is fatal for this file
+			if !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+				result.Elapsed = time.Since(start)
+				return result, err
+			}
+			slog.Warn("Upload attempt timed out, retrying", "attempt", attempt, "timeout", uploadTimeout, "path", targetPath)
+			metrics.UploadRetried()
+			continue
+		}
+
+		result.StatusCode = statusErr.Code
+
+		if uploadRetryPolicy.Retryable(statusErr.Code) && attempt < retryCount {
+			slog.Warn("Upload attempt failed, retrying", "attempt", attempt, "status", statusErr.Code, "path", targetPath)
+			metrics.UploadRetried()
+			if err := uploadRetryPolicy.Wait(ctx, attempt, ""); err != nil {
+				result.Elapsed = time.Since(start)
+				return result, err
+			}
+			continue
+		}
+
+		result.Elapsed = time.Since(start)
+		return result, fmt.Errorf("failed to upload %s due to %s", fileName, statusErr.Status)
+	}
+
+	result.Elapsed = time.Since(start)
+	return result, fmt.Errorf("failed to upload %s after %d retries", fileName, retryCount)
+}
+
+// putFile makes a single upload attempt of fileLocation to targetPath, bounded by UPLOAD_TIMEOUT.
+// With RESUME_PARTIAL a retry appends to the bytes an earlier attempt left on the server.
+func putFile(ctx context.Context, index *MediaIndex, backend UploadBackend, fileLocation, targetPath string, retry bool) error {
+	if uploadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, uploadTimeout)
+		defer cancel()
+	}
+
+	info, err := statMedia(fileLocation)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	if partial, ok := backend.(partialUploader); ok && retry && resumePartial {
+		offset = partial.PartialSize(ctx, targetPath, info.Size())
+	}
+
+	err = putFileFrom(ctx, index, backend, fileLocation, targetPath, info, offset)
+	var statusErr *uploadStatusError
+	if offset > 0 && errors.As(err, &statusErr) && statusErr.Code >= 400 && statusErr.Code < 500 {
+		slog.Debug("Server rejected partial upload, uploading the whole file", "path", targetPath, "status", statusErr.Code)
+		return putFileFrom(ctx, index, backend, fileLocation, targetPath, info, 0)
+	}
+	if err == nil && offset > 0 {
+		slog.Info("Resumed partial upload", "path", targetPath, "offset", offset, "size", info.Size())
+	}
+	return err
+}
+
+// putFileFrom uploads fileLocation to targetPath, starting offset bytes into the file.
+func putFileFrom(ctx context.Context, index *MediaIndex, backend UploadBackend, fileLocation, targetPath string, info os.FileInfo, offset int64) error {
+	file, err := openMedia(fileLocation)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var body io.Reader = file
+	if offset > 0 {
+		if err := skipBytes(body, offset); err != nil {
+			return err
+		}
+	}
+	if uploadLimiter != nil {
+		body = &throttledReader{ctx: ctx, r: body, limiter: uploadLimiter}
+	}
+	body = metrics.countBytes(body)
+
+	opts := UploadOptions{Size: info.Size(), ModTime: info.ModTime(), Source: fileLocation, Offset: offset}
+	opts.Taken, _ = index.TakenTime(fileLocation)
+	opts.Checksum, _ = index.Checksum(fileLocation)
+	return backend.Upload(ctx, targetPath, body, opts)
+}
+
+type MediaFile struct {
+	Path string
+	Ts   string
+	Size int64 // -1 if unknown
+}
+
+// sortMediaFiles sorts mediaFiles by folder, which for date folders is chronological, and
+// then by path, so every run uploads in the same order and a partial run can be reproduced.
+func sortMediaFiles(mediaFiles []MediaFile) {
+	sort.SliceStable(mediaFiles, func(i, j int) bool {
+		if mediaFiles[i].Ts != mediaFiles[j].Ts {
+			return mediaFiles[i].Ts < mediaFiles[j].Ts
+		}
+		return mediaFiles[i].Path < mediaFiles[j].Path
+	})
+}
+
+// directoryResult is the outcome of creating one directory.
+type directoryResult struct {
+	Dir string
+	Err error
+}
+
+// expandDirectories returns every directory in directories together with all of its
+// parents, each exactly once, sorted shortest-first so parents precede their children.
+func expandDirectories(directories []string) []string {
+	seen := make(map[string]bool)
+	var all []string
+	for _, dir := range directories {
+		parts := strings.Split(strings.Trim(dir, "/"), "/")
+		for i := range parts {
+			if parts[i] == "" {
+				continue
+			}
+			parent := strings.Join(parts[:i+1], "/")
+			if !seen[parent] {
+				seen[parent] = true
+				all = append(all, parent)
+			}
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		di, dj := strings.Count(all[i], "/"), strings.Count(all[j], "/")
+		if di != dj {
+			return di < dj
+		}
+		return all[i] < all[j]
+	})
+	return all
+}
+
+// createDirectoriesOnNextcloud creates directories and all of their parents, issuing a
+// single MKCOL per path. Paths are created one depth level at a time by a bounded pool
+// of workers, so a parent always exists before its children and no two workers ever
+// race on the same path. It returns how many paths could not be created.
+func createDirectoriesOnNextcloud(ctx context.Context, parallel int, backend UploadBackend, directories []string) int {
+	allDirectories := expandDirectories(directories)
+	slog.Info("Creating required directories", "count", len(allDirectories))
+
+	dirBar := progressbar.NewOptions(len(allDirectories),
+		progressbar.OptionSetDescription("Creating folders"),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSetWidth(30),
+		progressbar.OptionSetVisibility(!quiet),
+		progressbar.OptionOnCompletion(func() { fmt.Println() }),
+	)
+
+	failed := 0
+	for start := 0; start < len(allDirectories); {
+		// Collect the next depth level
+		depth := strings.Count(allDirectories[start], "/")
+		end := start
+		for end < len(allDirectories) && strings.Count(allDirectories[end], "/") == depth {
+			end++
+		}
+		level := allDirectories[start:end]
+		start = end
+
+		dirJobs := make(chan string, len(level))
+		results := make(chan directoryResult, parallel)
+		var wgDir sync.WaitGroup
+
+		for range parallel {
+			wgDir.Add(1)
+			go func() {
+				defer wgDir.Done()
+				for directory := range dirJobs {
+					// Drain the remaining directories once the run is cancelled
+					if ctx.Err() != nil {
+						continue
+					}
+					results <- directoryResult{directory, backend.EnsureDir(ctx, directory)}
+				}
+			}()
+		}
+
+		for _, dir := range level {
+			dirJobs <- dir
+		}
+		close(dirJobs)
+
+		// Close the results channel once all workers are done
+		go func() {
+			wgDir.Wait()
+			close(results)
+		}()
+
+		for result := range results {
+			if result.Err != nil {
+				slog.Error("Failed to create directory", "dir", result.Dir, "error", result.Err)
+				failed++
+			} else {
+				events.DirCreated(result.Dir)
+			}
+			_ = dirBar.Add(1)
+		}
+	}
+
+	return failed
+}
+
+// uploadMediaFilesToNextcloud creates the directories and uploads every job that is not
+// already in the resume manifest. When ctx is cancelled the workers stop picking up new
+// files, and the number of jobs that were processed is returned.
+func uploadMediaFilesToNextcloud(ctx context.Context, parallelDirs, parallelUploads int, backend UploadBackend, index *MediaIndex, directories []string, mediaFiles []MediaFile, manifest *resumeManifest, report *runReport) int {
+	if failed := createDirectoriesOnNextcloud(ctx, parallelDirs, backend, directories); failed > 0 {
+		slog.Warn("Some directories could not be created, uploads into them will fail", "count", failed)
+	}
+
+	sortMediaFiles(mediaFiles)
+	index.PlanUploads(mediaFiles)
+	if onConflict != "overwrite" {
+		listRemoteFolders(ctx, parallelDirs, backend, mediaFiles, manifest)
+	}
+	if bulkUpload {
+		uploadBundles(ctx, parallelUploads, backend, mediaFiles, manifest)
+	}
+
+	slog.Info("Uploading media files to Nextcloud", "count", len(mediaFiles), "workers", parallelUploads)
+
+	mediaSize := len(mediaFiles)
+
+	// Initialize progress bar, by bytes with rate and ETA when every size is known
+	totalBytes, unknownSizes := totalMediaBytes(mediaFiles)
+	sizesKnown := unknownSizes == 0
+	progressAmount := func(media MediaFile) int64 { return 1 }
+	mediaProgressBar := progressbar.NewOptions(mediaSize,
+		progressbar.OptionSetDescription("Uploading"),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSetWidth(30),
+		progressbar.OptionSetVisibility(!quiet),
+		progressbar.OptionOnCompletion(func() { fmt.Println() }),
+	)
+	if sizesKnown {
+		progressAmount = func(media MediaFile) int64 { return media.Size }
+		mediaProgressBar = progressbar.NewOptions64(totalBytes,
+			progressbar.OptionSetDescription("Uploading"),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionShowCount(),
+			progressbar.OptionSetPredictTime(true),
+			progressbar.OptionSetWidth(30),
+			progressbar.OptionSetVisibility(!quiet),
+			progressbar.OptionThrottle(100*time.Millisecond),
+			progressbar.OptionOnCompletion(func() { fmt.Println() }),
+		)
+	}
+
+	progress := newUploadProgress(mediaSize, totalBytes)
+	stopStatus := handleStatusSignal(progress)
+	defer stopStatus()
+
+	jobs := make(chan MediaFile, mediaSize)
+	progressChan := make(chan mediaUpload, parallelUploads)
+	var wgMedia sync.WaitGroup
+
+	for range parallelUploads {
+		wgMedia.Add(1)
+		go worker(ctx, jobs, progressChan, &wgMedia, backend, index, manifest, report)
+	}
+
+	// Send jobs (keys of the map) to workers, skipping files a previous run already uploaded
+	finishCounter := 0
+	for _, media := range mediaFiles {
+		if manifest.Done(media) {
+			report.Record(media, statusPreviousRun, nil)
+			skippedByReason.Add(skipPreviousRun, 1)
+			finishCounter++
+			progress.Done(media)
+			_ = mediaProgressBar.Add64(progressAmount(media))
+			continue
+		}
+		jobs <- media
+	}
+	close(jobs) // Close jobs channel after sending all keys
+	if finishCounter > 0 {
+		slog.Info("Skipping files uploaded by a previous run", "count", finishCounter)
+	}
+
+	// Close progress channel once all workers are done
+	go func() {
+		wgMedia.Wait()
+		close(progressChan)
+	}()
+
+	// Update progress bar in real-time
+	for done := range progressChan {
+		finishCounter++
+		slog.Debug("Upload progress", "done", finishCounter, "total", mediaSize, "file", done.Media.Path, "attempts", done.attempts(), "elapsed", done.elapsed())
+		progress.Done(done.Media)
+		_ = mediaProgressBar.Add64(progressAmount(done.Media))
+	}
+
+	return finishCounter
+}
+
+// mediaUpload is the outcome of a media file a worker processed: one result per local file
+// uploaded for it, e.g. a HEIC conversion and its original.
+type mediaUpload struct {
+	Media   MediaFile
+	Uploads []UploadResult
+}
+
+// attempts returns the number of upload attempts made for the media file.
+func (u mediaUpload) attempts() int {
+	total := 0
+	for _, upload := range u.Uploads {
+		total += upload.Attempts
+	}
+	return total
+}
+
+// elapsed returns the time spent uploading the media file.
+func (u mediaUpload) elapsed() time.Duration {
+	var total time.Duration
+	for _, upload := range u.Uploads {
+		total += upload.Elapsed
+	}
+	return total
+}
+
+func worker(ctx context.Context, jobs chan MediaFile, progressChan chan mediaUpload, wg *sync.WaitGroup, backend UploadBackend, index *MediaIndex, manifest *resumeManifest, report *runReport) {
+	defer wg.Done()
+
+	for media := range jobs {
+		// Drain the remaining jobs without uploading once the run is cancelled
+		if ctx.Err() != nil {
+			continue
+		}
+
+		uploads, done := uploadMediaFileRecovering(ctx, media, backend, index, manifest, report)
+		if !done {
+			continue
+		}
+		progressChan <- mediaUpload{media, uploads}
+	}
+}
+
+// uploadMediaFileRecovering is uploadMediaFile, but a panic, e.g. in a library choking on
+// a malformed file, only fails media instead of ending the run.
+func uploadMediaFileRecovering(ctx context.Context, media MediaFile, backend UploadBackend, index *MediaIndex, manifest *resumeManifest, report *runReport) (uploads []UploadResult, done bool) {
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		recordUploadFailure(media, report, statusPanicked, err)
+		breaker.Failure()
+		uploads, done = nil, true
+	}()
+	// Runs first, turning the panic into err for the function above
+	defer recoverFilePanic(media.Path, &err)
+	return uploadMediaFile(ctx, media, backend, index, manifest, report)
+}
+
+// recoverFilePanic turns a panic while handling file into an error stored in err. It has to
+// be deferred directly.
+func recoverFilePanic(file string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	slog.Error("Recovered from a crash while handling file, skipping it", "file", file, "panic", r, "stack", string(debug.Stack()))
+	*err = fmt.Errorf("crashed: %v", r)
+}
+
+// uploadMediaFile uploads media (converting HEIC first if enabled), then verifies it and
+// deletes the local copy as configured. index holds what indexing and planning recorded
+// about media. It returns the result of every local file uploaded for media, and false if
+// ctx interrupted the upload.
+func uploadMediaFile(ctx context.Context, media MediaFile, backend UploadBackend, index *MediaIndex, manifest *resumeManifest, report *runReport) ([]UploadResult, bool) {
+	var uploads []UploadResult
+	events.UploadStarted(media)
+	uploadPaths, cleanup := mediaUploadFiles(media.Path)
+	defer cleanup()
+	if extractMotion {
+		withVideos, motionCleanup := motionUploadFiles(uploadPaths)
+		defer motionCleanup()
+		uploadPaths = withVideos
+	}
+	if stripGeodata {
+		stripped, stripCleanup, err := stripGeodataFiles(uploadPaths)
+		defer stripCleanup()
+		if err != nil {
+			slog.Error("Failed to upload file", "file", media.Path, "error", err)
+			recordUploadFailure(media, report, statusFailed, err)
+			return uploads, true
+		}
+		uploadPaths = stripped
+	}
+
+	// Local files actually uploaded and the remote path each went to; skipped ones are left out
+	uploadedPaths := make(map[string]string)
+	// Remote paths to copy or tag into the file's albums, including skipped existing ones
+	var remotePaths []string
+	for _, uploadPath := range uploadPaths {
+		result, bundled := bulkUploadResult(uploadPath)
+		var err error
+		if !bundled {
+			slog.Debug("Uploading file", "file", uploadPath, "folder", media.Ts)
+			result, err = uploadFile(ctx, index, uploadPath, backend, media.Ts)
+		}
+		uploads = append(uploads, result)
+		if err == nil {
+			breaker.Success()
+		}
+		if result.Skipped {
+			slog.Debug("Remote file exists, skipping", "file", uploadPath, "folder", media.Ts)
+			remotePaths = append(remotePaths, result.TargetPath)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				slog.Debug("Upload interrupted", "file", media.Path)
+				return uploads, false
+			}
+			slog.Error("Failed to upload file", "file", media.Path, "error", err)
+			recordUploadFailure(media, report, statusFailed, err)
+			breaker.Failure()
+			return uploads, true
+		}
+		uploadedPaths[uploadPath] = result.TargetPath
+		remotePaths = append(remotePaths, result.TargetPath)
+		if uploadPath == media.Path {
+			recordUploadTarget(media.Path, result.TargetPath)
+		}
+	}
+
+	for _, remotePath := range remotePaths {
+		if err := placeInAlbums(ctx, backend, index, media, remotePath); err != nil {
+			if ctx.Err() != nil {
+				return uploads, false
+			}
+			slog.Error("Failed to add file to album", "file", media.Path, "error", err)
+			recordUploadFailure(media, report, statusFailed, err)
+			return uploads, true
+		}
+	}
+
+	if len(applyTags) > 0 {
+		for _, uploadPath := range uploadPaths {
+			if targetPath, ok := uploadedPaths[uploadPath]; ok {
+				applyFileTags(ctx, backend, index, media, targetPath)
+			}
+		}
+	}
+
+	if uploadSidecars && len(uploadedPaths) > 0 {
+		uploadSidecar(ctx, backend, index, media, uploadedPaths, uploadPaths)
+	}
+
+	if len(uploadedPaths) == 0 {
+		slog.Debug("Skipped file that already exists remotely", "file", media.Path, "folder", media.Ts)
+		skippedExistingCounter.Add(1)
+		skippedByReason.Add(skipExisting, 1)
+		report.Record(media, statusSkippedExisting, nil)
+		events.UploadDone(media, uploads, statusSkippedExisting)
+	} else {
+		slog.Debug("Uploaded file", "file", media.Path, "folder", media.Ts)
+		successfullCounter.Add(1)
+		report.Record(media, statusUploaded, nil)
+		events.UploadDone(media, uploads, statusUploaded)
+		metrics.FileUploaded()
+	}
+
+	if err := manifest.Record(media); err != nil {
+		slog.Error("Failed to record upload in resume manifest", "file", media.Path, "error", err)
+	}
+
+	if !verifyUploads || len(uploadedPaths) == 0 {
+		return uploads, true
+	}
+
+	for uploadPath, targetPath := range uploadedPaths {
+		if err := verifyUpload(ctx, uploadPath, targetPath, backend); err != nil {
+			slog.Error("Failed to verify upload, keeping local file", "file", media.Path, "error", err)
+			recordUploadFailure(media, report, statusVerifyFailed, err)
+			return uploads, true
+		}
+	}
+	slog.Debug("Verified upload", "file", media.Path)
+
+	if deleteAfterUpload {
+		// Only delete the original once it was uploaded itself, not just a conversion of it,
+		// and every other folder it is planned for, such as its albums, got it too
+		if _, uploaded := uploadedPaths[media.Path]; !uploaded {
+			slog.Info("Keeping local original of converted file", "file", media.Path)
+		} else if index.FinishUpload(media.Path) {
+			deleteLocalMediaFile(index, media.Path)
+		} else {
+			slog.Debug("Keeping local file until its uploads into other folders succeeded", "file", media.Path)
+		}
+	}
+	return uploads, true
+}
+
+// recordUploadFailure counts media as failed, whatever went wrong, and records status in the
+// report, the event stream and the metrics. Every failed media file is counted exactly once,
+// so the summary is right and ONLY_NEW doesn't move its watermark past it.
+func recordUploadFailure(media MediaFile, report *runReport, status string, err error) {
+	failedCounter.Add(1)
+	report.Record(media, status, err)
+	events.UploadFailed(media, status, err)
+	metrics.UploadFailed()
+}
+
+// uploadSidecar uploads the JSON sidecar of media, if it has one, next to the uploaded file
+// as "<name>.json", keeping Google's metadata on the server. The sidecar goes next to the
+// original, or next to its conversion if only that was uploaded. With STRIP_GEODATA a copy
+// without the location is uploaded. A failed sidecar upload is logged but doesn't fail the
+// media file.
+func uploadSidecar(ctx context.Context, backend UploadBackend, index *MediaIndex, media MediaFile, uploadedPaths map[string]string, uploadPaths []string) {
+	sidecar, ok := index.Sidecar(media.Path)
+	if !ok {
+		return
+	}
+	targetPath, ok := uploadedPaths[media.Path]
+	if !ok {
+		for _, uploadPath := range uploadPaths {
+			if targetPath, ok = uploadedPaths[uploadPath]; ok {
+				break
+			}
+		}
+	}
+
+	if stripGeodata {
+		tmpDir, err := os.MkdirTemp("", "media2nextcloud-sidecar-")
+		if err != nil {
+			slog.Warn("Failed to upload sidecar", "file", sidecar, "error", err)
+			return
+		}
+		defer os.RemoveAll(tmpDir)
+		stripped := filepath.Join(tmpDir, filepath.Base(sidecar))
+		if err := stripSidecarGeodata(sidecar, stripped); err != nil {
+			slog.Warn("Failed to remove the location from sidecar, not uploading it", "file", sidecar, "error", err)
+			return
+		}
+		sidecar = stripped
+	}
+
+	if err := putFile(ctx, index, backend, sidecar, targetPath+".json", false); err != nil {
+		if ctx.Err() == nil {
+			slog.Warn("Failed to upload sidecar", "file", sidecar, "error", err)
+		}
+		return
+	}
+	slog.Debug("Uploaded sidecar", "file", sidecar, "path", targetPath+".json")
+}
+
+// deleteLocalMediaFile removes a verified media file (and its sidecar if DELETE_SIDECARS is set)
+// and records the freed space.
+func deleteLocalMediaFile(index *MediaIndex, mediaPath string) {
+	paths := []string{mediaPath}
+	if sidecar, exists := index.Sidecar(mediaPath); exists && deleteSidecars {
+		paths = append(paths, sidecar)
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			slog.Error("Failed to stat file before deletion", "file", path, "error", err)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			slog.Error("Failed to delete local file", "file", path, "error", err)
+			continue
+		}
+		deletedCounter.Add(1)
+		freedBytes.Add(info.Size())
+		slog.Debug("Deleted local file", "file", path)
+	}
+}
+
+// totalMediaBytes sums the sizes recorded during indexing and returns how many files had
+// an unknown size and were left out.
+func totalMediaBytes(mediaFiles []MediaFile) (int64, int) {
+	total, unknown := int64(0), 0
+	for _, media := range mediaFiles {
+		if media.Size < 0 {
+			unknown++
+			continue
+		}
+		total += media.Size
+	}
+	return total, unknown
+}
+
+// formatBytes formats n with a binary unit, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func getUniqueDirectoryToBecreatedOnNextCloud(mediaFiles []MediaFile) []string {
+	// Helper map to track unique values
+	uniqueValuesMap := make(map[string]bool)
+
+	// Slice to store unique values
+	var uniqueValues []string
+
+	// Iterate over the map and collect unique values
+	for _, media := range mediaFiles {
+		value := media.Ts
+		if !uniqueValuesMap[value] {
+			uniqueValuesMap[value] = true
+			uniqueValues = append(uniqueValues, value)
+		}
+	}
+
+	return uniqueValues
+}
+
+func main() {
+	registerFlags(flag.CommandLine)
+	flag.Parse()
+
+	cfg, err := loadConfig(flag.CommandLine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	nextcloudURL = cfg.Get("NEXTCLOUD_URL")
+	username = cfg.Get("NEXTCLOUD_USER")
+	password = cfg.Get("NEXTCLOUD_PASSWORD")
+	photosDir = cfg.Get("PHOTOS_DIR")
+	photosDirs := splitPhotosDirs(photosDir)
+	photosArchive := cfg.Get("PHOTOS_ARCHIVE")
+	retryFrom := cfg.Get("RETRY_FROM")
+	remoteBasePath = strings.Trim(cfg.Get("REMOTE_BASE_PATH"), "/")
+	includePatterns = parsePatterns(cfg.Get("INCLUDE_EXT"))
+	excludePatterns = parsePatterns(cfg.Get("EXCLUDE_EXT"))
+	excludeDirs = parseExcludeDirs(cfg.Get("EXCLUDE_DIR"))
+	parallel = cfg.Get("PARALLEL_UPLOADS")
+
+	verbose, err := cfg.GetBool("VERBOSE")
+	if err == nil {
+		quiet, err = cfg.GetBool("QUIET")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	jsonLogs, err := cfg.GetBool("JSON_LOGS")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// Keep stdout for the event stream: no progress bars and only problems logged
+	if jsonLogs && !verbose {
+		quiet = true
+	}
+	logLevel := cfg.Get("LOG_LEVEL")
+	switch {
+	case quiet && verbose:
+		fmt.Fprintln(os.Stderr, "QUIET and VERBOSE can't both be set")
+		os.Exit(1)
+	case quiet:
+		logLevel = "warn"
+	case verbose:
+		logLevel = "debug"
+	}
+	if err := setupLogger(logLevel, cfg.Get("LOG_FORMAT")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if jsonLogs {
+		if events, err = openEventStream(cfg.Get("JSON_LOGS_FILE")); err != nil {
+			fatal("Failed to open JSON_LOGS_FILE", "error", err)
+		}
+	}
+
+	reportDuplicatesOnly, err := cfg.GetBool("REPORT_DUPLICATES")
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if listOnly, err = cfg.GetBool("LIST_ONLY"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if listOnly && retryFrom != "" {
+		fatal("LIST_ONLY lists the files found by indexing and can't be combined with RETRY_FROM")
+	}
+
+	// Reporting duplicates and listing dates never talk to Nextcloud, so they only need the photos
+	backendName := strings.ToLower(cfg.Get("BACKEND"))
+	usesNextcloud := (backendName == "nextcloud" || backendName == "webdav") && !reportDuplicatesOnly && !listOnly
+	if repairMtime, err = cfg.GetBool("REPAIR_MTIME"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if repairMtime && backendName == "immich" {
+		fatal("REPAIR_MTIME needs BACKEND=nextcloud, webdav or local, Immich dates assets itself")
+	}
+	if (nextcloudURL == "" && usesNextcloud) || (photosDir == "" && photosArchive == "" && retryFrom == "") {
+		fmt.Fprintln(os.Stderr, "Missing required settings: --nextcloud-url (NEXTCLOUD_URL), --photos-dir (PHOTOS_DIR) or --photos-archive (PHOTOS_ARCHIVE)")
+		fmt.Fprintln(os.Stderr)
+		flag.CommandLine.Usage()
+		os.Exit(2)
+	}
+
+	switch backendName {
+	case "nextcloud", "webdav":
+	case "immich":
+		immichURL, immichAPIKey = cfg.Get("IMMICH_URL"), cfg.Get("IMMICH_API_KEY")
+		if immichURL == "" || immichAPIKey == "" {
+			fatal("BACKEND=immich requires IMMICH_URL and IMMICH_API_KEY")
+		}
+	case "local":
+		if cfg.Get("LOCAL_DIR") == "" {
+			fatal("BACKEND=local requires LOCAL_DIR")
+		}
+	default:
+		fatal("Invalid BACKEND, must be nextcloud, webdav, immich or local", "value", backendName)
+	}
+
+	if proxy := cfg.Get("NEXTCLOUD_PROXY"); proxy != "" {
+		if httpProxy, err = parseProxyURL(proxy); err != nil {
+			fatal("Invalid NEXTCLOUD_PROXY", "error", err)
+		}
+	}
+	if disableCompression, err = cfg.GetBool("DISABLE_COMPRESSION"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if insecureSkipVerify, err = cfg.GetBool("INSECURE_SKIP_VERIFY"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if insecureSkipVerify {
+		slog.Warn("INSECURE_SKIP_VERIFY is set, the server's certificate is not verified")
+	}
+
+	passwordStdin, err := cfg.GetBool("NEXTCLOUD_PASSWORD_STDIN")
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if password, err = readPassword(passwordStdin, cfg.Get("NEXTCLOUD_PASSWORD_FILE"), password); err != nil {
+		fatal("Failed to read the Nextcloud password", "error", err)
+	}
+	// Credentials in the URL would end up in every logged URL
+	if cleanURL, user := stripURLCredentials(nextcloudURL); user != nil {
+		slog.Warn("NEXTCLOUD_URL contains credentials, use NEXTCLOUD_USER with NEXTCLOUD_PASSWORD_FILE instead")
+		nextcloudURL = cleanURL
+		if username == "" {
+			username = user.Username()
+		}
+		if userPassword, ok := user.Password(); ok && password == "" {
+			password = userPassword
+		}
+	}
+
+	webdavPath := cfg.Get("WEBDAV_PATH")
+	if backendName == "nextcloud" && nextcloudURL != "" {
+		if nextcloudURL, err = nextcloudEndpoint(nextcloudURL, webdavPath, username); err != nil {
+			fatal("Invalid NEXTCLOUD_URL", "error", err)
+		}
+	}
+
+	var auth Authenticator
+	if usesNextcloud {
+		if auth, err = newAuthenticator(cfg.Get("NEXTCLOUD_AUTH_MODE"), username, password, cfg.Get("NEXTCLOUD_TOKEN")); err != nil {
+			fatal("Invalid authentication configuration", "error", err)
+		}
+	}
+	if userMap := cfg.Get("USER_MAP"); userMap != "" {
+		// The local and Immich backends have no per user accounts to map folders to
+		if backendName != "nextcloud" && backendName != "webdav" {
+			fatal("USER_MAP needs BACKEND=nextcloud or webdav", "backend", backendName)
+		}
+		if userDestinations, err = loadUserMap(userMap); err != nil {
+			fatal("Invalid USER_MAP", "error", err)
+		}
+		for _, d := range userDestinations {
+			if backendName == "nextcloud" {
+				if d.URL, err = nextcloudEndpoint(d.URL, webdavPath, d.User); err != nil {
+					fatal("Invalid USER_MAP", "user", d.User, "error", err)
+				}
+			}
+		}
+	}
+
+	if verifyUploads, err = cfg.GetBool("VERIFY_UPLOADS"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if deleteAfterUpload, err = cfg.GetBool("DELETE_AFTER_UPLOAD"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if deleteSidecars, err = cfg.GetBool("DELETE_SIDECARS"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if uploadSidecars, err = cfg.GetBool("UPLOAD_SIDECARS"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if uploadSidecars && backendName == "immich" {
+		slog.Warn("Ignoring UPLOAD_SIDECARS, Immich would store the sidecars as assets")
+		uploadSidecars = false
+	}
+
+	onConflict = strings.ToLower(cfg.Get("ON_CONFLICT"))
+	if onConflict != "overwrite" && onConflict != "skip" && onConflict != "rename" {
+		fatal("Invalid ON_CONFLICT, must be overwrite, skip or rename", "value", onConflict)
+	}
+
+	if uploadEmpty, err = cfg.GetBool("UPLOAD_EMPTY"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if maxFileSize, err = strconv.ParseInt(cfg.Get("MAX_FILE_SIZE"), 10, 64); err != nil || maxFileSize < 0 {
+		fatal("Invalid MAX_FILE_SIZE, must be a number of bytes", "value", cfg.Get("MAX_FILE_SIZE"))
+	}
+	if ignoreQuota, err = cfg.GetBool("IGNORE_QUOTA"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if resumePartial, err = cfg.GetBool("RESUME_PARTIAL"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if maxConsecutiveFailures, err = strconv.Atoi(cfg.Get("MAX_CONSECUTIVE_FAILURES")); err != nil || maxConsecutiveFailures < 0 {
+		fatal("Invalid MAX_CONSECUTIVE_FAILURES, must be a number", "value", cfg.Get("MAX_CONSECUTIVE_FAILURES"))
+	}
+	if assumeYes, err = cfg.GetBool("ASSUME_YES"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if pruneEmpty, err = cfg.GetBool("PRUNE_EMPTY"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if stripGeodata, err = cfg.GetBool("STRIP_GEODATA"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if allowUnstripped, err = cfg.GetBool("ALLOW_UNSTRIPPED"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	// Deleting local files is only safe once the remote copy has been checked
+	if deleteAfterUpload && !verifyUploads {
+		fatal("DELETE_AFTER_UPLOAD requires VERIFY_UPLOADS=true")
+	}
+
+	organizeBy = strings.ToLower(cfg.Get("ORGANIZE_BY"))
+	if organizeBy != "date" && organizeBy != "album" && organizeBy != "none" {
+		fatal("Invalid ORGANIZE_BY, must be date, album or none", "value", organizeBy)
+	}
+	flatFolder = strings.Trim(cfg.Get("FLAT_FOLDER"), "/")
+	albumDuplicates = strings.ToLower(cfg.Get("ALBUM_DUPLICATES"))
+	if albumDuplicates != "copy" && albumDuplicates != "first" {
+		fatal("Invalid ALBUM_DUPLICATES, must be copy or first", "value", albumDuplicates)
+	}
+	if albumAlsoByDate, err = cfg.GetBool("ALBUM_ALSO_BY_DATE"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	albumStrategy = strings.ToLower(cfg.Get("ALBUM_STRATEGY"))
+	switch albumStrategy {
+	case "upload-both", "copy-remote":
+	case "tag-only":
+		if davRoot, _ := nextcloudDAVRoot(nextcloudURL); backendName != "nextcloud" || davRoot == "" {
+			fatal("ALBUM_STRATEGY=tag-only needs BACKEND=nextcloud and a NEXTCLOUD_URL ending in /remote.php/dav/files/<username>")
+		}
+	default:
+		fatal("Invalid ALBUM_STRATEGY, must be upload-both, copy-remote or tag-only", "value", albumStrategy)
+	}
+	applyTags = parseApplyTags(cfg.Get("APPLY_TAGS"))
+	if len(applyTags) > 0 {
+		if davRoot, _ := nextcloudDAVRoot(nextcloudURL); backendName != "nextcloud" || davRoot == "" {
+			fatal("APPLY_TAGS needs BACKEND=nextcloud and a NEXTCLOUD_URL ending in /remote.php/dav/files/<username>")
+		}
+	}
+	if dedup, err = cfg.GetBool("DEDUP"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if includeTrash, err = cfg.GetBool("INCLUDE_TRASH"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if includeArchive, err = cfg.GetBool("INCLUDE_ARCHIVE"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	if dateSources, err = parseDateSources(cfg.Get("DATE_SOURCE")); err != nil {
+		fatal("Invalid DATE_SOURCE", "error", err)
+	}
+	unresolvedReportPath = cfg.Get("UNRESOLVED_REPORT")
+	if fallbackDateFolder, err = parseFallbackYear(cfg.Get("FALLBACK_YEAR")); err != nil {
+		fatal("Invalid FALLBACK_YEAR", "error", err)
+	}
+	if folderTemplate, err = parseFolderTemplate(cfg.Get("FOLDER_TEMPLATE")); err != nil {
+		fatal("Invalid FOLDER_TEMPLATE", "error", err)
+	}
+	if routeRules, err = parseRouteRules(cfg.Get("ROUTE_RULES")); err != nil {
+		fatal("Invalid ROUTE_RULES", "error", err)
+	}
+	onUnknownDate = strings.ToLower(cfg.Get("ON_UNKNOWN_DATE"))
+	if followSymlinks, err = cfg.GetBool("FOLLOW_SYMLINKS"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if onUnknownDate != "fallback" && onUnknownDate != "skip" && onUnknownDate != "prompt" {
+		fatal("Invalid ON_UNKNOWN_DATE, must be fallback, skip or prompt", "value", onUnknownDate)
+	}
+	if dateDiscrepancyDays, err = strconv.Atoi(cfg.Get("DATE_DISCREPANCY_DAYS")); err != nil || dateDiscrepancyDays < 0 {
+		fatal("Invalid DATE_DISCREPANCY_DAYS, must be a number of days", "value", cfg.Get("DATE_DISCREPANCY_DAYS"))
+	}
+	if dateLocation, err = parseTimezone(cfg.Get("TIMEZONE")); err != nil {
+		fatal("Invalid TIMEZONE", "error", err)
+	}
+	if dateSince, err = parseDateBound(cfg.Get("DATE_SINCE")); err != nil {
+		fatal("Invalid DATE_SINCE", "error", err)
+	}
+	if dateUntil, err = parseDateBound(cfg.Get("DATE_UNTIL")); err != nil {
+		fatal("Invalid DATE_UNTIL", "error", err)
+	}
+	if dateSince.set() && dateUntil.set() && dateUntil.compare(dateSince.folder, dateSince.at, !dateSince.at.IsZero()) < 0 {
+		fatal("DATE_SINCE must not be after DATE_UNTIL", "since", dateSince, "until", dateUntil)
+	}
+	if timestampLayouts, err = parseTimestampLayouts(cfg.Get("TIMESTAMP_LAYOUTS")); err != nil {
+		fatal("Invalid TIMESTAMP_LAYOUTS", "error", err)
+	}
+	if filenameDatePatterns, err = parseFilenameDatePatterns(cfg.Get("FILENAME_DATE_PATTERNS")); err != nil {
+		fatal("Invalid FILENAME_DATE_PATTERNS", "error", err)
+	}
+
+	if contentHasher, err = newContentHasher(cfg.Get("HASH_ALGORITHM")); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	indexCachePath = cfg.Get("INDEX_CACHE")
+	statePath = cfg.Get("STATE_FILE")
+	if err := loadState(statePath); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if onlyNew, err = cfg.GetBool("ONLY_NEW"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if onlyNewBy, err = parseOnlyNewBy(cfg.Get("ONLY_NEW_BY")); err != nil {
+		fatal("Invalid ONLY_NEW_BY", "error", err)
+	}
+	if onlyNew && statePath == "" {
+		fatal("ONLY_NEW needs STATE_FILE to record when the last run completed")
+	}
+	if watermark, ok := lastRunWatermark(); ok {
+		slog.Info("Only uploading files newer than the last completed run", "since", watermark.Format(time.RFC3339), "by", onlyNewBy)
+	} else if onlyNew {
+		slog.Info("No completed run recorded in STATE_FILE yet, uploading all files")
+	}
+
+	maxUploadBytesPerSec, err := strconv.ParseInt(cfg.Get("MAX_UPLOAD_BYTES_PER_SEC"), 10, 64)
+	if err != nil {
+		fatal("Invalid MAX_UPLOAD_BYTES_PER_SEC", "error", err)
+	}
+	uploadLimiter = newBandwidthLimiter(maxUploadBytesPerSec)
+
+	if extractMotion, err = cfg.GetBool("EXTRACT_MOTION"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if convertHEIC, err = cfg.GetBool("CONVERT_HEIC"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if heicKeepOriginal, err = cfg.GetBool("HEIC_KEEP_ORIGINAL"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if convertHEIC {
+		if heicConverter = findHEICConverter(); heicConverter == nil {
+			slog.Warn("CONVERT_HEIC is set but no converter (heif-convert or ImageMagick) was found, HEIC files will be uploaded unconverted")
+		}
+	}
+
+	if chunkSize, err = strconv.ParseInt(cfg.Get("CHUNK_SIZE"), 10, 64); err != nil || chunkSize < 0 {
+		fatal("Invalid CHUNK_SIZE, must be a number of bytes", "value", cfg.Get("CHUNK_SIZE"))
+	}
+	if chunkSessionMaxAge, err = time.ParseDuration(cfg.Get("CHUNK_SESSION_MAX_AGE")); err != nil || chunkSessionMaxAge <= 0 {
+		fatal("Invalid CHUNK_SESSION_MAX_AGE, must be a positive duration such as 24h", "value", cfg.Get("CHUNK_SESSION_MAX_AGE"))
+	}
+	if bulkUpload, err = cfg.GetBool("BULK_UPLOAD"); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if bulkUpload {
+		if davRoot, _ := nextcloudDAVRoot(nextcloudURL); backendName != "nextcloud" || davRoot == "" {
+			fatal("BULK_UPLOAD needs BACKEND=nextcloud and a NEXTCLOUD_URL ending in /remote.php/dav/files/<username>")
+		}
+	}
+	if bulkUploadMaxSize, err = strconv.ParseInt(cfg.Get("BULK_UPLOAD_MAX_SIZE"), 10, 64); err != nil || bulkUploadMaxSize <= 0 {
+		fatal("Invalid BULK_UPLOAD_MAX_SIZE, must be a positive number of bytes", "value", cfg.Get("BULK_UPLOAD_MAX_SIZE"))
+	}
+	if uploadTimeout, err = time.ParseDuration(cfg.Get("UPLOAD_TIMEOUT")); err != nil {
+		fatal("Invalid UPLOAD_TIMEOUT", "error", err)
+	}
+
+	// Convert string to integer
+	// Uploads wait on the network rather than the CPU, so default to more workers than cores
+	parallelUploads := min(2*runtime.NumCPU(), maxDefaultParallelUploads)
+	if parallel != "" {
+		if parallelUploads, err = strconv.Atoi(parallel); err != nil || parallelUploads < 1 {
+			fatal("Invalid PARALLEL_UPLOADS, must be a positive number", "value", parallel)
+		}
+	}
+	parallelDirs, err := strconv.Atoi(cfg.Get("PARALLEL_DIRS"))
+	if err != nil || parallelDirs < 1 {
+		fatal("Invalid PARALLEL_DIRS, must be a positive number", "value", cfg.Get("PARALLEL_DIRS"))
+	}
+
+	// Fail fast on a wrong URL or bad credentials before spending time on indexing
+	if usesNextcloud {
+		if nextcloudURL, err = preflightCheck(nextcloudURL, auth); err != nil {
+			fatal("Preflight check failed", "error", err)
+		}
+		for _, d := range userDestinations {
+			if d.URL, err = preflightCheck(d.URL, d.auth); err != nil {
+				fatal("Preflight check failed", "user", d.User, "error", err)
+			}
+		}
+	}
+	if backendName == "immich" && !reportDuplicatesOnly && !listOnly {
+		if err := immichPing(immichURL, immichAPIKey); err != nil {
+			fatal("Preflight check failed", "error", err)
+		}
+	}
+
+	// Archives are indexed as a virtual directory below the archive path
+	if photosArchive != "" {
+		if photosDir != "" {
+			fatal("Set either PHOTOS_DIR or PHOTOS_ARCHIVE, not both")
+		}
+		if deleteAfterUpload {
+			fatal("DELETE_AFTER_UPLOAD can't delete files inside PHOTOS_ARCHIVE")
+		}
+		root, closeArchives, err := openArchives(photosArchive)
+		if err != nil {
+			fatal("Failed to open PHOTOS_ARCHIVE", "error", err)
+		}
+		defer closeArchives()
+		photosDirs = []string{root}
+	} else if retryFrom == "" {
+		for _, dir := range photosDirs {
+			if err := checkPhotosDir(dir); err != nil {
+				fatal("Invalid PHOTOS_DIR", "error", err)
+			}
+		}
+	}
+
+	// A retry rewrites the report it read unless RUN_REPORT names another file
+	verifyAllPath := cfg.Get("VERIFY_ALL")
+	reportPath := cfg.Get("RUN_REPORT")
+	if reportPath == "" {
+		reportPath = retryFrom
+	}
+	report := newRunReport(reportPath)
+
+	// reportFiles are all files listed in the run report, mediaFiles the ones uploaded now
+	var mediaFiles, reportFiles []MediaFile
+	var index *MediaIndex
+	indexErrors := 0
+	if retryFrom != "" {
+		index = newMediaIndex()
+		if reportFiles, mediaFiles, err = loadRetryJobs(retryFrom, index, report); err != nil {
+			fatal("Invalid RETRY_FROM", "error", err)
+		}
+		slog.Info("Retrying uploads from previous run", "report", retryFrom, "count", len(mediaFiles))
+	} else {
+		events.IndexingStarted(photosDirs)
+		index, indexErrors = processDirectory(photosDirs)
+		if indexErrors > 0 {
+			slog.Warn("Some files could not be indexed and will not be uploaded", "count", indexErrors)
+		}
+
+		if reportDuplicatesOnly {
+			groups := reportDuplicates(index, os.Stdout)
+			if err := saveState(statePath); err != nil {
+				slog.Error("Failed to save state file", "error", err)
+			}
+			summaryLogger.Info("Finished reporting duplicates", "groups", groups)
+			os.Exit(0)
+		}
+		if listOnly {
+			listDates(index, cfg.Get("LIST_FILE"))
+			os.Exit(0)
+		}
+		if index.Len() == 0 && indexErrors == 0 && skippedByReason.Count(skipNotNew) > 0 {
+			recordRunWatermark()
+			summaryLogger.Info("No media files added since the last completed run", "skipped", skippedByReason.Count(skipNotNew))
+			events.RunFinished("finished")
+			os.Exit(0)
+		}
+		if index.Len() == 0 {
+			fatal("No media files could be indexed", "dirs", photosDirs)
+		}
+
+		if err := saveState(statePath); err != nil {
+			slog.Error("Failed to save state file", "error", err)
+		}
+
+		mediaFiles = planUploads(index)
+		assignUsers(index, mediaFiles, photosDirs)
+		reportFiles = mediaFiles
+		checkCollisions(mediaFiles)
+	}
+
+	if repairMtime {
+		setter, ok := openUploadBackend(backendName, auth, cfg.Get("LOCAL_DIR")).(modTimeSetter)
+		if !ok {
+			fatal("REPAIR_MTIME is not supported by this backend")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		counts := repairRemoteMtimes(ctx, parallelUploads, setter, index, mediaFiles)
+		stop()
+		summaryLogger.Info("Finished repairing modification times", "corrected", counts.corrected.Load(), "alreadyCorrect", counts.correct.Load(), "missingRemotely", counts.missing.Load(), "failed", counts.failed.Load())
+		if ctx.Err() != nil || counts.failed.Load() > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	directoriesToBeCreated := getUniqueDirectoryToBecreatedOnNextCloud(mediaFiles)
+	directoriesToBeCreated = append(directoriesToBeCreated, index.AlbumCopyFolders()...)
+
+	totalBytes, unknownSizes := totalMediaBytes(mediaFiles)
+	slog.Info("About to upload media files", "files", len(mediaFiles), "size", formatBytes(totalBytes), "folders", len(directoriesToBeCreated), "unknownSizes", unknownSizes)
+	if len(mediaFiles) > 0 {
+		if err := confirmUpload(len(mediaFiles), len(expandDirectories(directoriesToBeCreated)), totalBytes); errors.Is(err, errNotConfirmed) {
+			summaryLogger.Info("Upload cancelled, nothing was uploaded")
+			os.Exit(0)
+		} else if err != nil {
+			fatal("Failed to confirm upload", "error", err)
+		}
+	}
+
+	if addr := cfg.Get("METRICS_ADDR"); addr != "" {
+		if metrics, err = startMetricsServer(addr); err != nil {
+			fatal("Failed to start metrics server", "addr", addr, "error", err)
+		}
+		metrics.SetPlanned(len(mediaFiles), totalBytes)
+	}
+
+	if usesNextcloud && len(mediaFiles) > 0 {
+		checkQuota(nextcloudURL, auth, totalBytes)
+	}
+
+	backend := openUploadBackend(backendName, auth, cfg.Get("LOCAL_DIR"))
+
+	manifest, err := openResumeManifest(cfg.Get("RESUME_MANIFEST"))
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	// Ctrl-C or SIGTERM cancel in-flight uploads and stop the workers from starting new ones
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	// and so does MAX_CONSECUTIVE_FAILURES
+	ctx, abort := context.WithCancelCause(ctx)
+	breaker = newFailureBreaker(maxConsecutiveFailures, abort)
+	processed := uploadMediaFilesToNextcloud(ctx, parallelDirs, parallelUploads, backend, index, directoriesToBeCreated, mediaFiles, manifest, report)
+	interrupted := ctx.Err() != nil
+	serverDown := errors.Is(context.Cause(ctx), errServerDown)
+	abort(nil)
+	stop()
+
+	if err := manifest.Close(); err != nil {
+		slog.Error("Failed to flush resume manifest", "error", err)
+	}
+	if err := report.Write(reportPath, index, reportFiles); err != nil {
+		slog.Error("Failed to write run report", "error", err)
+	}
+	if pruneEmpty {
+		pruneEmptyDirs(backend)
+	}
+
+	if len(emptyMediaFiles) > 0 {
+		slog.Warn("Skipped empty media files, set UPLOAD_EMPTY=true to upload them", "count", len(emptyMediaFiles), "files", emptyMediaFiles)
+	}
+	if len(oversizedMediaFiles) > 0 {
+		slog.Warn("Skipped media files larger than MAX_FILE_SIZE, upload them with CHUNK_SIZE set below the server's limit", "count", len(oversizedMediaFiles), "maxFileSize", maxFileSize, "files", oversizedMediaFiles)
+	}
+
+	if serverDown {
+		slog.Error("Stopped because the server appears down, rerun to continue once it is back", "uploaded", successfullCounter.Load(), "failed", failedCounter.Load(), "remaining", len(mediaFiles)-processed, "skippedExisting", skippedExistingCounter.Load(), "skippedByDate", dateFilteredCounter)
+		skippedByReason.LogSummary(summaryLogger)
+		if deleteAfterUpload {
+			summaryLogger.Info("Deleted local files", "deleted", deletedCounter.Load(), "freedBytes", freedBytes.Load())
+		}
+		events.RunFinished("server-down")
+		os.Exit(1)
+	}
+	if interrupted {
+		slog.Warn("Interrupted, stopped before all files were uploaded", "uploaded", successfullCounter.Load(), "failed", failedCounter.Load(), "remaining", len(mediaFiles)-processed, "skippedExisting", skippedExistingCounter.Load(), "skippedByDate", dateFilteredCounter)
+		skippedByReason.LogSummary(summaryLogger)
+		if deleteAfterUpload {
+			summaryLogger.Info("Deleted local files", "deleted", deletedCounter.Load(), "freedBytes", freedBytes.Load())
+		}
+		events.RunFinished("interrupted")
+		os.Exit(130)
+	}
+	if verifyAllPath != "" {
+		discrepancies, err := sweepRemoteCopies(context.Background(), parallelUploads, backend, index, reportFiles, verifyAllPath)
+		if err != nil {
+			slog.Error("Failed to write verification report", "error", err)
+		}
+		summaryLogger.Info("Checked remote copies", "files", len(reportFiles), "discrepancies", discrepancies, "report", verifyAllPath)
+	}
+	// A retry only uploads some files, and files that failed must not end up before the
+	// watermark
+	if retryFrom == "" && indexErrors == 0 && failedCounter.Load() == 0 {
+		recordRunWatermark()
+	}
+	summaryLogger.Info("Finished uploading media files", "uploaded", successfullCounter.Load(), "failed", failedCounter.Load(), "skippedExisting", skippedExistingCounter.Load(), "skippedByDate", dateFilteredCounter)
+	if extractMotion {
+		summaryLogger.Info("Extracted motion photo videos", "count", motionVideosExtracted.Load())
+	}
+	skippedByReason.LogSummary(summaryLogger)
+	if deleteAfterUpload {
+		summaryLogger.Info("Deleted local files", "deleted", deletedCounter.Load(), "freedBytes", freedBytes.Load())
+	}
+	events.RunFinished("finished")
 	os.Exit(0)
 }
@@ -0,0 +1,1030 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMain keeps the warnings the code under test logs out of the test output.
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	// No progress bars
+	quiet = true
+	os.Exit(m.Run())
+}
+
+// writeFile creates path with content, creating its parent directories.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// davServer is a mock WebDAV server for the subset of WebDAV the uploader uses: MKCOL, PUT,
+// PROPFIND with depth 0 or 1, HEAD and DELETE. It keeps files and collections in memory. handle, when set, sees
+// every request first and answers it itself by returning true, e.g. to fail it.
+type davServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	files    map[string][]byte
+	dirs     map[string]bool
+	requests []string
+	handle   func(w http.ResponseWriter, r *http.Request) bool
+}
+
+func newDAVServer(t *testing.T) *davServer {
+	t.Helper()
+	s := &davServer{files: make(map[string][]byte), dirs: map[string]bool{"/": true}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *davServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	handle := s.handle
+	s.mu.Unlock()
+	if handle != nil && handle(w, r) {
+		return
+	}
+
+	p := path.Clean(r.URL.Path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case "MKCOL":
+		switch {
+		case s.dirs[p] || s.files[p] != nil:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case !s.dirs[path.Dir(p)]:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			s.dirs[p] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "PUT":
+		if !s.dirs[path.Dir(p)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.files[p] = body
+		w.WriteHeader(http.StatusCreated)
+	case "PROPFIND":
+		content, isFile := s.files[p]
+		if !isFile && !s.dirs[p] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">`)
+		writeResponse := func(href string, size int) {
+			fmt.Fprintf(w, `<d:response><d:href>%s</d:href><d:propstat><d:prop><d:getcontentlength>%d</d:getcontentlength></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`, href, size)
+		}
+		writeResponse(r.URL.EscapedPath(), len(content))
+		if !isFile && r.Header.Get("Depth") == "1" {
+			for child, content := range s.files {
+				if path.Dir(child) == p {
+					writeResponse((&url.URL{Path: child}).EscapedPath(), len(content))
+				}
+			}
+		}
+		fmt.Fprint(w, `</d:multistatus>`)
+	case "HEAD":
+		content, isFile := s.files[p]
+		if !isFile {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	case "DELETE":
+		delete(s.files, p)
+		delete(s.dirs, p)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// file returns the content stored at the unescaped path p and whether there is a file.
+func (s *davServer) file(p string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, ok := s.files[p]
+	return content, ok
+}
+
+// hasDir reports whether the collection at the unescaped path p exists.
+func (s *davServer) hasDir(p string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dirs[p]
+}
+
+// requestCount returns how many requests with method were made.
+func (s *davServer) requestCount(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, req := range s.requests {
+		if strings.HasPrefix(req, method+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+// fastRetries makes retries wait a millisecond instead of seconds for the rest of the test.
+func fastRetries(t *testing.T) {
+	t.Helper()
+	webdav, upload := webdavRetryPolicy, uploadRetryPolicy
+	webdavRetryPolicy.Delay, webdavRetryPolicy.MaxDelay = time.Millisecond, time.Millisecond
+	uploadRetryPolicy.Delay, uploadRetryPolicy.MaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { webdavRetryPolicy, uploadRetryPolicy = webdav, upload })
+}
+
+// skipCertificateVerification sets INSECURE_SKIP_VERIFY for the rest of the test, so the
+// self-signed certificates of httptest.NewTLSServer are accepted.
+func skipCertificateVerification(t *testing.T) {
+	t.Helper()
+	old := insecureSkipVerify
+	insecureSkipVerify = true
+	t.Cleanup(func() { insecureSkipVerify = old })
+}
+
+// newTestWebDAVBackend returns a plain WebDAV backend for the root of server.
+func newTestWebDAVBackend(server *davServer) *webdavBackend {
+	return newWebDAVBackend(server.URL, basicAuth{username: "alice", password: "secret"}, false)
+}
+
+func TestUploadFile(t *testing.T) {
+	fastRetries(t)
+	oldTimeout := uploadTimeout
+	uploadTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { uploadTimeout = oldTimeout })
+
+	// failFirst answers the first PUT with status, or stalls it past UPLOAD_TIMEOUT for 0
+	failFirst := func(status int) func(http.ResponseWriter, *http.Request) bool {
+		var failed atomic.Bool
+		return func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method != "PUT" || failed.Swap(true) {
+				return false
+			}
+			if status == 0 {
+				// Reading the body lets the server notice the client giving up
+				_, _ = io.Copy(io.Discard, r.Body)
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+				return true
+			}
+			w.WriteHeader(status)
+			return true
+		}
+	}
+	alwaysFail := func(status int) func(http.ResponseWriter, *http.Request) bool {
+		return func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method != "PUT" {
+				return false
+			}
+			w.WriteHeader(status)
+			return true
+		}
+	}
+
+	tests := []struct {
+		name         string
+		handle       func(http.ResponseWriter, *http.Request) bool
+		wantErr      bool
+		wantAttempts int
+		wantStatus   int
+	}{
+		{name: "success", wantAttempts: 1},
+		{name: "404 then success", handle: failFirst(http.StatusNotFound), wantAttempts: 2, wantStatus: http.StatusNotFound},
+		{name: "hard 403", handle: alwaysFail(http.StatusForbidden), wantErr: true, wantAttempts: 1, wantStatus: http.StatusForbidden},
+		{name: "404 every time", handle: alwaysFail(http.StatusNotFound), wantErr: true, wantAttempts: uploadRetryPolicy.Attempts, wantStatus: http.StatusNotFound},
+		{name: "timeout then success", handle: failFirst(0), wantAttempts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newDAVServer(t)
+			server.handle = tt.handle
+			server.dirs["/2022"], server.dirs["/2022/03"] = true, true
+			local := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+			writeFile(t, local, "jpeg data")
+
+			result, err := uploadFile(context.Background(), newMediaIndex(), local, newTestWebDAVBackend(server), "2022/03")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("uploadFile() error = %v, want error %t", err, tt.wantErr)
+			}
+			if result.Attempts != tt.wantAttempts {
+				t.Errorf("Attempts = %d, want %d", result.Attempts, tt.wantAttempts)
+			}
+			if result.StatusCode != tt.wantStatus {
+				t.Errorf("StatusCode = %d, want %d", result.StatusCode, tt.wantStatus)
+			}
+			content, stored := server.file("/2022/03/IMG_0001.jpg")
+			if stored == tt.wantErr {
+				t.Errorf("file stored = %t, want %t", stored, !tt.wantErr)
+			}
+			if stored && string(content) != "jpeg data" {
+				t.Errorf("stored content = %q, want %q", content, "jpeg data")
+			}
+			if !tt.wantErr && result.TargetPath != "2022/03/IMG_0001.jpg" {
+				t.Errorf("TargetPath = %q, want 2022/03/IMG_0001.jpg", result.TargetPath)
+			}
+		})
+	}
+}
+
+func TestCreateDirectoryIfNotExists(t *testing.T) {
+	fastRetries(t)
+	auth := basicAuth{username: "alice", password: "secret"}
+
+	tests := []struct {
+		name        string
+		existing    []string
+		dir         string
+		wantCreated bool
+		wantMKCOL   int
+	}{
+		{name: "201 created", existing: []string{"/2022"}, dir: "/2022/03", wantCreated: true, wantMKCOL: 1},
+		{name: "405 exists", existing: []string{"/2022", "/2022/03"}, dir: "/2022/03", wantCreated: false, wantMKCOL: 1},
+		{name: "409 missing parent", dir: "/2022/03", wantCreated: true, wantMKCOL: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newDAVServer(t)
+			for _, dir := range tt.existing {
+				server.dirs[dir] = true
+			}
+
+			created, err := createDirectoryIfNotExists(server.Client(), server.URL+tt.dir, auth)
+			if err != nil {
+				t.Fatalf("createDirectoryIfNotExists() error = %v", err)
+			}
+			if created != tt.wantCreated {
+				t.Errorf("created = %t, want %t", created, tt.wantCreated)
+			}
+			if !server.hasDir("/2022") || !server.hasDir("/2022/03") {
+				t.Errorf("collections after MKCOL: /2022 %t, /2022/03 %t", server.hasDir("/2022"), server.hasDir("/2022/03"))
+			}
+			if n := server.requestCount("MKCOL"); n != tt.wantMKCOL {
+				t.Errorf("sent %d MKCOL requests, want %d", n, tt.wantMKCOL)
+			}
+		})
+	}
+
+	t.Run("409 for several levels", func(t *testing.T) {
+		server := newDAVServer(t)
+		created, err := createDirectoryIfNotExists(server.Client(), server.URL+"/Photos/2022/03/Albums", auth)
+		if err != nil || !created {
+			t.Fatalf("createDirectoryIfNotExists() = %t, %v, want created", created, err)
+		}
+		for _, dir := range []string{"/Photos", "/Photos/2022", "/Photos/2022/03", "/Photos/2022/03/Albums"} {
+			if !server.hasDir(dir) {
+				t.Errorf("%s wasn't created", dir)
+			}
+		}
+		// Three 409s on the way up, then one MKCOL per level on the way down
+		if n := server.requestCount("MKCOL"); n != 7 {
+			t.Errorf("sent %d MKCOL requests, want 7", n)
+		}
+	})
+
+	for _, status := range []int{http.StatusForbidden, http.StatusNoContent, http.StatusMultiStatus} {
+		t.Run(fmt.Sprintf("status %d", status), func(t *testing.T) {
+			server := newDAVServer(t)
+			server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				w.WriteHeader(status)
+				return true
+			}
+			if _, err := createDirectoryIfNotExists(server.Client(), server.URL+"/2022", auth); err == nil {
+				t.Fatalf("createDirectoryIfNotExists() succeeded on a %d", status)
+			}
+		})
+	}
+
+	t.Run("409 up to the root", func(t *testing.T) {
+		server := newDAVServer(t)
+		server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+			w.WriteHeader(http.StatusConflict)
+			return true
+		}
+		if _, err := createDirectoryIfNotExists(server.Client(), server.URL+"/2022/03", auth); err == nil {
+			t.Fatal("createDirectoryIfNotExists() succeeded although every MKCOL conflicted")
+		}
+		if n := server.requestCount("MKCOL"); n > 3 {
+			t.Errorf("sent %d MKCOL requests, want the parents tried once each", n)
+		}
+	})
+}
+
+func TestExtractDateFolder(t *testing.T) {
+	oldLocation := dateLocation
+	t.Cleanup(func() { dateLocation = oldLocation })
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		timestamp string
+		location  *time.Location
+		want      string
+		wantErr   bool
+	}{
+		{name: "ISO UTC", timestamp: "2020-02-06T10:40:00Z", want: "2020/02"},
+		{name: "ISO offset", timestamp: "2022-03-14T10:30:00+05:30", want: "2022/03"},
+		{name: "ISO offset crossing the month", timestamp: "2022-03-01T01:00:00+05:30", want: "2022/02"},
+		{name: "ISO without zone", timestamp: "2022-03-14T10:30:00", want: "2022/03"},
+		{name: "space separated", timestamp: "2022-03-14 10:30:00", want: "2022/03"},
+		{name: "space separated offset", timestamp: "2022-03-14 10:30:00-08:00", want: "2022/03"},
+		{name: "EXIF", timestamp: "2022:03:14 10:30:00", want: "2022/03"},
+		{name: "epoch seconds", timestamp: "1580985600", want: "2020/02"},
+		{name: "fractional epoch", timestamp: "1580985600.5", want: "2020/02"},
+		{name: "epoch milliseconds", timestamp: "1580985600000", want: "2020/02"},
+		{name: "negative epoch", timestamp: "-86400", want: "1969/12"},
+		{name: "epoch at month end in UTC", timestamp: "1640995199", want: "2021/12"},
+		{name: "epoch at month end in TIMEZONE", timestamp: "1640995199", location: berlin, want: "2022/01"},
+		{name: "milliseconds in TIMEZONE", timestamp: "1640995199000", location: berlin, want: "2022/01"},
+		{name: "year one", timestamp: "0001-01-01T00:00:00Z", want: "0001/01"},
+		{name: "empty", timestamp: "", wantErr: true},
+		{name: "garbage", timestamp: "yesterday", wantErr: true},
+		{name: "NaN", timestamp: "NaN", wantErr: true},
+		{name: "infinite", timestamp: "Inf", wantErr: true},
+		{name: "date only", timestamp: "2022-03-14", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dateLocation = time.UTC
+			if tt.location != nil {
+				dateLocation = tt.location
+			}
+			got, err := extractDateFolder(tt.timestamp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractDateFolder(%q) error = %v, want error %t", tt.timestamp, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("extractDateFolder(%q) = %q, want %q", tt.timestamp, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSidecarTimestampEpochs(t *testing.T) {
+	oldLocation := dateLocation
+	dateLocation = time.UTC
+	t.Cleanup(func() { dateLocation = oldLocation })
+
+	newYear := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		timestamp string
+		want      time.Time
+	}{
+		{"1577836800", newYear},
+		{"1577836800000", newYear},
+		{"1577836800.25", newYear.Add(250 * time.Millisecond)},
+		{"1577836800250", newYear.Add(250 * time.Millisecond)},
+		{"1577836800000.5", newYear.Add(500 * time.Microsecond)},
+		{"1.5778368e9", newYear},
+		{"1.5778368e12", newYear},
+		{"0", time.Unix(0, 0)},
+		{"-1577836800000", time.Date(1920, 1, 2, 0, 0, 0, 0, time.UTC)},
+		// The last second before 1e12 is still read as seconds
+		{"999999999999", time.Unix(999999999999, 0)},
+	}
+	for _, tt := range tests {
+		got, err := parseSidecarTimestamp(tt.timestamp)
+		if err != nil {
+			t.Errorf("parseSidecarTimestamp(%q) error = %v", tt.timestamp, err)
+			continue
+		}
+		// Float seconds carry less than microsecond precision
+		if diff := got.Sub(tt.want).Abs(); diff > time.Microsecond {
+			t.Errorf("parseSidecarTimestamp(%q) = %v, want %v", tt.timestamp, got, tt.want)
+		}
+	}
+}
+
+// TestIndexingCorruptSidecar indexes media files whose sidecars aren't valid JSON. They must
+// not be dated from an empty sidecar, but get the fallback folder and show up as unresolved.
+func TestIndexingCorruptSidecar(t *testing.T) {
+	dir := t.TempDir()
+	photo, copied, orphan := filepath.Join(dir, "IMG_0001.jpg"), filepath.Join(dir, "IMG_0001(1).jpg"), filepath.Join(dir, "IMG_0002.jpg")
+	writeFile(t, photo, "no EXIF")
+	writeFile(t, copied, "no EXIF either")
+	sidecars := []string{
+		photo + ".supplemental-metadata.json",
+		photo + ".supplemental-metadata(1).json",
+		orphan + ".supplemental-metadata.json",
+	}
+	writeFile(t, sidecars[0], `{"title": "IMG_0001.jpg", "photoTakenTime": {"timest`)
+	writeFile(t, sidecars[1], `not JSON at all`)
+	// The media file of this one doesn't exist
+	writeFile(t, sidecars[2], `{"title": `)
+
+	index := newMediaIndex()
+	if errs := parseExtractMetadatJsonFileAndAddToMapImage(index, nil, sidecars, []string{photo, copied}); errs != 1 {
+		t.Errorf("indexing failed for %d sidecars, want 1 without a media file", errs)
+	}
+	for _, path := range []string{photo, copied} {
+		folder, ok := index.Get(path)
+		if !ok || folder != fallbackDateFolder {
+			t.Errorf("folder of %s = %q, %t, want %q", filepath.Base(path), folder, ok, fallbackDateFolder)
+		}
+		if reason, _ := index.Unresolved(path); reason != "sidecar-error" {
+			t.Errorf("unresolved reason of %s = %q, want sidecar-error", filepath.Base(path), reason)
+		}
+	}
+	if _, ok := index.Get(orphan); ok {
+		t.Errorf("%s indexed without existing", filepath.Base(orphan))
+	}
+}
+
+func TestSidecarMediaPath(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"IMG_0001.jpg", "VID_20220101.mp4", "VID_20220102.MOV", "IMG_0003.heic"} {
+		writeFile(t, filepath.Join(dir, name), "media")
+	}
+
+	tests := []struct {
+		title, want string
+	}{
+		{"IMG_0001.jpg", "IMG_0001.jpg"},
+		// Titles without or with another extension than the file on disk
+		{"VID_20220101", "VID_20220101.mp4"},
+		{"VID_20220102", "VID_20220102.MOV"},
+		{"VID_20220101.MOV", "VID_20220101.mp4"},
+		{"IMG_0003.jpg", "IMG_0003.heic"},
+	}
+	for _, tt := range tests {
+		if got, ok := sidecarMediaPath([]string{dir}, tt.title); !ok || got != filepath.Join(dir, tt.want) {
+			t.Errorf("sidecarMediaPath(%q) = %q, %t, want %q", tt.title, filepath.Base(got), ok, tt.want)
+		}
+	}
+
+	for _, title := range []string{"IMG_0004.jpg", "VID_20220103"} {
+		if got, ok := sidecarMediaPath([]string{dir}, title); ok {
+			t.Errorf("sidecarMediaPath(%q) = %q, want no match", title, got)
+		}
+	}
+}
+
+// TestIndexingSidecarTitleExtension indexes a video whose sidecar title lacks its extension,
+// which must be dated from the sidecar rather than left without one.
+func TestIndexingSidecarTitleExtension(t *testing.T) {
+	dir := t.TempDir()
+	video := filepath.Join(dir, "VID_20220101.mp4")
+	sidecar := video + ".supplemental-metadata.json"
+	writeFile(t, video, "no metadata")
+	writeFile(t, sidecar, `{"title": "VID_20220101", "photoTakenTime": {"timestamp": "1648780200"}}`)
+
+	index := newMediaIndex()
+	if errs := parseExtractMetadatJsonFileAndAddToMapImage(index, nil, []string{sidecar}, []string{video}); errs != 0 {
+		t.Errorf("indexing failed for %d sidecars, want 0", errs)
+	}
+	if folder, ok := index.Get(video); !ok || folder != "2022/04" {
+		t.Errorf("folder of %s = %q, %t, want 2022/04", filepath.Base(video), folder, ok)
+	}
+	if _, ok := index.Get(filepath.Join(dir, "VID_20220101")); ok {
+		t.Error("sidecar title indexed instead of the video")
+	}
+}
+
+// TestIndexingNumberedSidecars indexes a photo and its copy from a second album with the
+// same name, each with its own sidecar. The copy's sidecar, however Takeout numbered it,
+// must date the copy and never the original, whichever sidecar is read first. Each case is
+// also indexed by processDirectory, which has to find the sidecars by walking the folder.
+func TestIndexingNumberedSidecars(t *testing.T) {
+	const (
+		originalSidecar = `{"title": "IMG.jpg", "photoTakenTime": {"timestamp": "1584000000"}}`
+		copySidecar     = `{"title": "IMG.jpg", "photoTakenTime": {"timestamp": "1648780200"}}`
+	)
+	tests := []struct {
+		name        string
+		copySidecar string
+		// withCopy is false when the copy itself is missing
+		withCopy   bool
+		wantCopy   string
+		wantOrphan bool
+	}{
+		{"counter before the extension", "IMG(1).jpg.json", true, "2022/04", false},
+		{"counter before the extension, supplemental", "IMG(1).jpg.supplemental-metadata.json", true, "2022/04", false},
+		{"counter after the extension", "IMG.jpg(1).json", true, "2022/04", false},
+		{"counter after supplemental", "IMG.jpg.supplemental-metadata(1).json", true, "2022/04", false},
+		{"copy missing, counter before the extension", "IMG(1).jpg.json", false, "", true},
+		{"copy missing, counter after the extension", "IMG.jpg(1).json", false, "", true},
+	}
+	for _, tt := range tests {
+		for _, order := range []string{"listed", "reversed", "walked"} {
+			dir := t.TempDir()
+			original, copied := filepath.Join(dir, "IMG.jpg"), filepath.Join(dir, "IMG(1).jpg")
+			media := []string{original}
+			writeFile(t, original, "no metadata")
+			if tt.withCopy {
+				writeFile(t, copied, "no metadata")
+				media = append(media, copied)
+			}
+			sidecars := []string{filepath.Join(dir, "IMG.jpg.json"), filepath.Join(dir, tt.copySidecar)}
+			writeFile(t, sidecars[0], originalSidecar)
+			writeFile(t, sidecars[1], copySidecar)
+			if order == "reversed" {
+				sidecars[0], sidecars[1] = sidecars[1], sidecars[0]
+			}
+			// Takeout's JSON files that aren't sidecars
+			writeFile(t, filepath.Join(dir, "print-subscriptions.json"), `{"printSubscriptions": []}`)
+			writeFile(t, filepath.Join(dir, "shared_album_comments.json"), `[]`)
+			orphanSidecars = nil
+
+			index := newMediaIndex()
+			errs := 0
+			if order == "walked" {
+				index, errs = processDirectory([]string{dir})
+			} else {
+				errs = parseExtractMetadatJsonFileAndAddToMapImage(index, nil, sidecars, media)
+			}
+			if errs != 0 {
+				t.Errorf("%s, %s: indexing failed for %d files", tt.name, order, errs)
+			}
+			if folder, _ := index.Get(original); folder != "2020/03" {
+				t.Errorf("%s, %s: folder of the original = %q, want 2020/03", tt.name, order, folder)
+			}
+			if sidecar, _ := index.Sidecar(original); sidecar != filepath.Join(dir, "IMG.jpg.json") {
+				t.Errorf("%s, %s: sidecar of the original = %q", tt.name, order, sidecar)
+			}
+			if folder, _ := index.Get(copied); folder != tt.wantCopy {
+				t.Errorf("%s, %s: folder of the copy = %q, want %q", tt.name, order, folder, tt.wantCopy)
+			}
+			if orphaned := len(orphanSidecars) == 1; orphaned != tt.wantOrphan {
+				t.Errorf("%s, %s: orphan sidecars = %q, want orphaned %t", tt.name, order, orphanSidecars, tt.wantOrphan)
+			}
+		}
+	}
+	orphanSidecars = nil
+}
+
+func TestSidecarCounter(t *testing.T) {
+	tests := []struct {
+		sidecar, title string
+		want           string
+		numbered       bool
+	}{
+		{"IMG.jpg.json", "IMG.jpg", "", false},
+		{"IMG.jpg.supplemental-metadata.json", "IMG.jpg", "", false},
+		{"IMG(1).jpg.json", "IMG.jpg", "(1)", true},
+		{"IMG.jpg(1).json", "IMG.jpg", "(1)", true},
+		{"IMG.jpg.supplemental-metadata(2).json", "IMG.jpg", "(2)", true},
+		{"IMG(12).jpg.supplemental-metadata.json", "IMG.jpg", "(12)", true},
+		// The counter is part of the file's name
+		{"Party(2).jpg.json", "Party(2).jpg", "", false},
+	}
+	for _, tt := range tests {
+		if got, numbered := sidecarCounter(tt.sidecar, tt.title); got != tt.want || numbered != tt.numbered {
+			t.Errorf("sidecarCounter(%q, %q) = %q, %t, want %q, %t", tt.sidecar, tt.title, got, numbered, tt.want, tt.numbered)
+		}
+	}
+}
+
+func TestDestinationPath(t *testing.T) {
+	tests := []struct {
+		subFolder, fileName, want string
+	}{
+		{"2022/03", "IMG_0001.jpg", "2022/03/IMG_0001.jpg"},
+		{"", "IMG_0001.jpg", "IMG_0001.jpg"},
+		{"/2022/03", "IMG_0001.jpg", "2022/03/IMG_0001.jpg"},
+		{"2022/03/", "IMG_0001.jpg", "2022/03/IMG_0001.jpg"},
+		{"//2022//03//", "IMG_0001.jpg", "2022/03/IMG_0001.jpg"},
+		{"/", "IMG_0001.jpg", "IMG_0001.jpg"},
+		{"Photos/Summer 2022", "IMG #1.jpg", "Photos/Summer 2022/IMG #1.jpg"},
+		// ".." can't climb above the backend's root
+		{"..", "IMG_0001.jpg", "IMG_0001.jpg"},
+		{"../../etc", "passwd", "etc/passwd"},
+		{"2022/../../03", "IMG_0001.jpg", "03/IMG_0001.jpg"},
+		{"2022/03", "../../../IMG_0001.jpg", "IMG_0001.jpg"},
+	}
+	for _, tt := range tests {
+		if got := destinationPath(tt.subFolder, tt.fileName); got != tt.want {
+			t.Errorf("destinationPath(%q, %q) = %q, want %q", tt.subFolder, tt.fileName, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteURL(t *testing.T) {
+	const base = "https://cloud.example.com/remote.php/dav/files/alice"
+	tests := []struct {
+		name    string
+		baseURL string
+		paths   []string
+		want    string
+	}{
+		{"plain", base, []string{"2022/03", "IMG_0001.jpg"}, base + "/2022/03/IMG_0001.jpg"},
+		{"trailing slash URL", base + "/", []string{"2022/03/IMG_0001.jpg"}, base + "/2022/03/IMG_0001.jpg"},
+		{"trailing slashes URL", base + "//", []string{"2022"}, base + "/2022"},
+		{"empty subfolder", base, []string{"", "IMG_0001.jpg"}, base + "/IMG_0001.jpg"},
+		{"leading slash", base, []string{"/2022/03", "/IMG_0001.jpg"}, base + "/2022/03/IMG_0001.jpg"},
+		{"trailing slash", base + "/", []string{"2022/03/", "IMG_0001.jpg"}, base + "/2022/03/IMG_0001.jpg"},
+		{"empty segments", base, []string{"2022//03", "//"}, base + "/2022/03"},
+		{"no paths", base + "/", nil, base},
+		{"escaped", base, []string{"Summer 2022", "IMG #1+ä.jpg"}, base + "/Summer%202022/IMG%20%231+%C3%A4.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remoteURL(tt.baseURL, tt.paths...); got != tt.want {
+				t.Errorf("remoteURL(%q, %q) = %q, want %q", tt.baseURL, tt.paths, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestUploadFileSlashTolerant uploads through a base URL with a trailing slash into empty
+// and slash-padded subfolders, which must not produce empty path segments.
+func TestUploadFileSlashTolerant(t *testing.T) {
+	fastRetries(t)
+	for subFolder, want := range map[string]string{
+		"":           "/IMG_0001.jpg",
+		"/2022/03":   "/2022/03/IMG_0001.jpg",
+		"2022/03/":   "/2022/03/IMG_0001.jpg",
+		"/2022//03/": "/2022/03/IMG_0001.jpg",
+	} {
+		server := newDAVServer(t)
+		server.dirs["/2022"], server.dirs["/2022/03"] = true, true
+		local := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+		writeFile(t, local, "jpeg data")
+
+		backend := newWebDAVBackend(server.URL+"/", basicAuth{username: "alice", password: "secret"}, false)
+		if _, err := uploadFile(context.Background(), newMediaIndex(), local, backend, subFolder); err != nil {
+			t.Fatalf("uploadFile() into %q error = %v", subFolder, err)
+		}
+		if _, stored := server.file(want); !stored {
+			t.Errorf("uploadFile() into %q didn't store %s, requests %v", subFolder, want, server.requests)
+		}
+		for _, request := range server.requests {
+			if strings.Contains(request, "//") {
+				t.Errorf("uploadFile() into %q sent %q", subFolder, request)
+			}
+		}
+	}
+}
+
+// TestUploadFileEscapesNames uploads files whose folder and file names need escaping into a
+// WebDAV server, which must store them under their unescaped names.
+func TestUploadFileEscapesNames(t *testing.T) {
+	fastRetries(t)
+	for _, tt := range []struct{ folder, name string }{
+		{"2022/03", "Beach day #1.jpg"},
+		{"Albums/Summer 2022", "IMG+1 (copy).jpg"},
+		{"Albums/Été à Zürich", "100% café?.jpg"},
+		{"Albums/🏖️ Trip", "😀.heic"},
+	} {
+		server := newDAVServer(t)
+		backend := newTestWebDAVBackend(server)
+		local := filepath.Join(t.TempDir(), tt.name)
+		writeFile(t, local, "photo")
+
+		if err := backend.EnsureDir(context.Background(), tt.folder); err != nil {
+			t.Fatalf("EnsureDir(%q) error = %v", tt.folder, err)
+		}
+		if !server.hasDir("/" + tt.folder) {
+			t.Errorf("EnsureDir(%q) created %v", tt.folder, server.dirs)
+		}
+		if _, err := uploadFile(context.Background(), newMediaIndex(), local, backend, tt.folder); err != nil {
+			t.Fatalf("uploadFile(%q) error = %v", tt.name, err)
+		}
+		if content, ok := server.file("/" + tt.folder + "/" + tt.name); !ok || string(content) != "photo" {
+			t.Errorf("%s/%s not stored, files %v", tt.folder, tt.name, server.files)
+		}
+	}
+}
+
+func TestSortMediaFiles(t *testing.T) {
+	mediaFiles := []MediaFile{
+		{Path: "/takeout/b/IMG_0003.jpg", Ts: "2024/03"},
+		{Path: "/takeout/a/IMG_0009.jpg", Ts: "2024/03"},
+		{Path: "/takeout/a/IMG_0001.jpg", Ts: "2024/11"},
+		{Path: "/takeout/a/IMG_0002.jpg", Ts: "2023/12"},
+		{Path: "/takeout/a/IMG_0004.jpg", Ts: "Albums/Trip"},
+		{Path: "/takeout/a/IMG_0004.jpg", Ts: "2024/03"},
+	}
+	sortMediaFiles(mediaFiles)
+
+	var got []string
+	for _, media := range mediaFiles {
+		got = append(got, media.Ts+" "+filepath.Base(media.Path))
+	}
+	want := []string{
+		"2023/12 IMG_0002.jpg",
+		"2024/03 IMG_0004.jpg",
+		"2024/03 IMG_0009.jpg",
+		"2024/03 IMG_0003.jpg",
+		"2024/11 IMG_0001.jpg",
+		"Albums/Trip IMG_0004.jpg",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("sorted media files = %q, want %q", got, want)
+	}
+}
+
+// TestUploadOrder uploads media files with a single worker, which must send them to the
+// backend in folder and path order whatever order they were planned in.
+func TestUploadOrder(t *testing.T) {
+	oldConflict := onConflict
+	t.Cleanup(func() { onConflict = oldConflict })
+	onConflict = "overwrite"
+
+	dir := t.TempDir()
+	var mediaFiles []MediaFile
+	for _, f := range []struct{ name, folder string }{
+		{"IMG_0003.jpg", "2024/03"},
+		{"IMG_0001.jpg", "2024/11"},
+		{"IMG_0002.jpg", "2023/12"},
+		{"IMG_0000.jpg", "2024/03"},
+	} {
+		local := filepath.Join(dir, f.name)
+		writeFile(t, local, f.name)
+		mediaFiles = append(mediaFiles, MediaFile{local, f.folder, int64(len(f.name))})
+	}
+
+	var uploaded []string
+	backend := stubBackend{upload: func(path string, r io.Reader) error {
+		uploaded = append(uploaded, path)
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}}
+	report := newRunReport(filepath.Join(t.TempDir(), "report.csv"))
+	if processed := uploadMediaFilesToNextcloud(context.Background(), 1, 1, backend, newMediaIndex(), nil, mediaFiles, nil, report); processed != len(mediaFiles) {
+		t.Errorf("uploadMediaFilesToNextcloud() processed %d files, want %d", processed, len(mediaFiles))
+	}
+	want := []string{"2023/12/IMG_0002.jpg", "2024/03/IMG_0000.jpg", "2024/03/IMG_0003.jpg", "2024/11/IMG_0001.jpg"}
+	if !slices.Equal(uploaded, want) {
+		t.Errorf("upload order = %q, want %q", uploaded, want)
+	}
+}
+
+// TestUploadRecoversFromPanic uploads two files through a backend that crashes on one of
+// them. The crash must only fail that file, which is reported as panicked.
+func TestUploadRecoversFromPanic(t *testing.T) {
+	fastRetries(t)
+	oldConflict := onConflict
+	t.Cleanup(func() { onConflict = oldConflict })
+	onConflict = "overwrite"
+
+	dir := t.TempDir()
+	crashing, fine := filepath.Join(dir, "IMG_0001.jpg"), filepath.Join(dir, "IMG_0002.jpg")
+	writeFile(t, crashing, "malformed")
+	writeFile(t, fine, "photo")
+	mediaFiles := []MediaFile{{crashing, "2024/03", 9}, {fine, "2024/03", 5}}
+
+	var mu sync.Mutex
+	var uploaded []string
+	backend := stubBackend{upload: func(path string, r io.Reader) error {
+		if strings.HasSuffix(path, "IMG_0001.jpg") {
+			var m map[string]int
+			m["crash"]++
+		}
+		mu.Lock()
+		uploaded = append(uploaded, path)
+		mu.Unlock()
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}}
+
+	failedBefore := failedCounter.Load()
+	report := newRunReport(filepath.Join(t.TempDir(), "report.csv"))
+	if processed := uploadMediaFilesToNextcloud(context.Background(), 1, 2, backend, newMediaIndex(), nil, mediaFiles, nil, report); processed != 2 {
+		t.Errorf("uploadMediaFilesToNextcloud() processed %d files, want 2", processed)
+	}
+	if !slices.Equal(uploaded, []string{"2024/03/IMG_0002.jpg"}) {
+		t.Errorf("uploaded = %q, want only IMG_0002.jpg", uploaded)
+	}
+	if failed := failedCounter.Load() - failedBefore; failed != 1 {
+		t.Errorf("%d failed uploads counted, want 1", failed)
+	}
+	result := report.results[manifestKey(mediaFiles[0])]
+	if result.Status != statusPanicked || !strings.Contains(result.Error, "crashed") {
+		t.Errorf("report of the crashing file = %+v, want status %s", result, statusPanicked)
+	}
+	if result := report.results[manifestKey(mediaFiles[1])]; result.Status == statusPanicked {
+		t.Errorf("report of the other file = %+v, want it not to have crashed", result)
+	}
+}
+
+// TestIndexingRecoversFromPanic indexes a media file into a nil index, which crashes. The
+// crash must be returned as an error of that file.
+func TestIndexingRecoversFromPanic(t *testing.T) {
+	photo := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+	writeFile(t, photo, "no EXIF")
+	sidecar := photo + ".supplemental-metadata.json"
+	writeFile(t, sidecar, `{"title": "IMG_0001.jpg", "photoTakenTime": {"timestamp": "1648780200"}}`)
+
+	if err := addMediaFileToMap(nil, photo); err == nil || !strings.Contains(err.Error(), "crashed") {
+		t.Errorf("addMediaFileToMap() error = %v, want the crash", err)
+	}
+	if errs := parseExtractMetadatJsonFileAndAddToMapImage(nil, nil, []string{sidecar}, []string{photo}); errs != 1 {
+		t.Errorf("indexing failed for %d sidecars, want the crashing one", errs)
+	}
+}
+
+// stubBackend is an UploadBackend whose uploads all end with err, or call upload if set.
+type stubBackend struct {
+	err    error
+	upload func(path string, r io.Reader) error
+}
+
+func (b stubBackend) EnsureDir(ctx context.Context, dir string) error { return nil }
+
+func (b stubBackend) Upload(ctx context.Context, path string, r io.Reader, opts UploadOptions) error {
+	if b.upload != nil {
+		return b.upload(path, r)
+	}
+	_, _ = io.Copy(io.Discard, r)
+	return b.err
+}
+
+func (b stubBackend) Exists(ctx context.Context, path string) (bool, error) { return false, nil }
+
+func (b stubBackend) Size(ctx context.Context, path string) (int64, error) { return 0, nil }
+
+func TestUploadTimeout(t *testing.T) {
+	fastRetries(t)
+	oldTimeout := uploadTimeout
+	t.Cleanup(func() { uploadTimeout = oldTimeout })
+	local := filepath.Join(t.TempDir(), "VID_0001.mp4")
+	writeFile(t, local, "video")
+
+	// The backend stalls until the request is cancelled, recording whether it had a deadline
+	var deadlines []bool
+	backend := ctxBackend{upload: func(ctx context.Context) error {
+		_, hasDeadline := ctx.Deadline()
+		deadlines = append(deadlines, hasDeadline)
+		if !hasDeadline {
+			return nil
+		}
+		<-ctx.Done()
+		return fmt.Errorf("put: %w", ctx.Err())
+	}}
+
+	t.Run("retried until given up", func(t *testing.T) {
+		uploadTimeout, deadlines = 10*time.Millisecond, nil
+		result, err := uploadFile(context.Background(), newMediaIndex(), local, backend, "2022/03")
+		if err == nil {
+			t.Fatal("uploadFile() succeeded although every attempt timed out")
+		}
+		if result.Attempts != uploadRetryPolicy.Attempts {
+			t.Errorf("Attempts = %d, want %d", result.Attempts, uploadRetryPolicy.Attempts)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		uploadTimeout, deadlines = 0, nil
+		if _, err := uploadFile(context.Background(), newMediaIndex(), local, backend, "2022/03"); err != nil {
+			t.Fatalf("uploadFile() error = %v", err)
+		}
+		if len(deadlines) != 1 || deadlines[0] {
+			t.Errorf("requests had deadlines %v, want one without", deadlines)
+		}
+	})
+	t.Run("cancelled run not retried", func(t *testing.T) {
+		uploadTimeout, deadlines = time.Minute, nil
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		result, err := uploadFile(ctx, newMediaIndex(), local, backend, "2022/03")
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("uploadFile() error = %v, want context.Canceled", err)
+		}
+		if result.Attempts != 1 {
+			t.Errorf("Attempts = %d, want 1", result.Attempts)
+		}
+	})
+}
+
+// ctxBackend is a stubBackend whose uploads call upload with the request's context.
+type ctxBackend struct {
+	stubBackend
+	upload func(ctx context.Context) error
+}
+
+func (b ctxBackend) Upload(ctx context.Context, path string, r io.Reader, opts UploadOptions) error {
+	_, _ = io.Copy(io.Discard, r)
+	return b.upload(ctx)
+}
+
+// TestUploadMediaFileCountsEveryFailure checks that every failed media file is counted once,
+// whatever the error, as ONLY_NEW only records its watermark when no file failed.
+func TestUploadMediaFileCountsEveryFailure(t *testing.T) {
+	fastRetries(t)
+
+	tests := []struct {
+		name         string
+		err          error
+		wantUploaded int64
+		wantFailed   int64
+		wantStatus   string
+	}{
+		{name: "uploaded", wantUploaded: 1, wantStatus: statusUploaded},
+		{name: "connection error", err: errors.New("dial tcp: connection refused"), wantFailed: 1, wantStatus: statusFailed},
+		{name: "timeout", err: fmt.Errorf("put: %w", context.DeadlineExceeded), wantFailed: 1, wantStatus: statusFailed},
+		{name: "rejected", err: &uploadStatusError{Code: http.StatusForbidden, Status: "403 Forbidden"}, wantFailed: 1, wantStatus: statusFailed},
+		{name: "retried until given up", err: &uploadStatusError{Code: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}, wantFailed: 1, wantStatus: statusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+			writeFile(t, local, "jpeg data")
+			media := MediaFile{Path: local, Ts: "2022/03", Size: 9}
+			report := newRunReport("report.csv")
+
+			uploadedBefore, before := successfullCounter.Load(), failedCounter.Load()
+			_, done := uploadMediaFile(context.Background(), media, stubBackend{err: tt.err}, newMediaIndex(), nil, report)
+			if !done {
+				t.Fatal("uploadMediaFile() reported an interrupted upload")
+			}
+			if uploaded := successfullCounter.Load() - uploadedBefore; uploaded != tt.wantUploaded {
+				t.Errorf("uploaded counter grew by %d, want %d", uploaded, tt.wantUploaded)
+			}
+			if failed := failedCounter.Load() - before; failed != tt.wantFailed {
+				t.Errorf("failed counter grew by %d, want %d", failed, tt.wantFailed)
+			}
+			if status := report.results[manifestKey(media)].Status; status != tt.wantStatus {
+				t.Errorf("report status = %q, want %q", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// TestUploadMediaFileCountsMotionPhotoOnce checks a motion photo uploaded with its extracted
+// video counts as one uploaded file, and as only a failed one when the video fails.
+func TestUploadMediaFileCountsMotionPhotoOnce(t *testing.T) {
+	fastRetries(t)
+	old := extractMotion
+	extractMotion = true
+	t.Cleanup(func() { extractMotion = old })
+
+	tests := []struct {
+		name         string
+		failVideo    bool
+		wantUploaded int64
+		wantFailed   int64
+	}{
+		{name: "photo and video uploaded", wantUploaded: 1},
+		{name: "video failed", failVideo: true, wantFailed: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := filepath.Join(t.TempDir(), "PXL_0001.MP.jpg")
+			if err := os.WriteFile(local, fixtureMotionPhoto(t), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			media := MediaFile{Path: local, Ts: "2022/03", Size: 1}
+			var uploads []string
+			backend := stubBackend{upload: func(path string, r io.Reader) error {
+				uploads = append(uploads, path)
+				_, _ = io.Copy(io.Discard, r)
+				if tt.failVideo && strings.HasSuffix(path, ".mp4") {
+					return &uploadStatusError{Code: http.StatusForbidden, Status: "403 Forbidden"}
+				}
+				return nil
+			}}
+
+			uploadedBefore, failedBefore := successfullCounter.Load(), failedCounter.Load()
+			if _, done := uploadMediaFile(context.Background(), media, backend, newMediaIndex(), nil, newRunReport("report.csv")); !done {
+				t.Fatal("uploadMediaFile() reported an interrupted upload")
+			}
+			if len(uploads) != 2 {
+				t.Fatalf("uploaded %q, want the photo and its video", uploads)
+			}
+			if uploaded := successfullCounter.Load() - uploadedBefore; uploaded != tt.wantUploaded {
+				t.Errorf("uploaded counter grew by %d, want %d", uploaded, tt.wantUploaded)
+			}
+			if failed := failedCounter.Load() - failedBefore; failed != tt.wantFailed {
+				t.Errorf("failed counter grew by %d, want %d", failed, tt.wantFailed)
+			}
+		})
+	}
+}
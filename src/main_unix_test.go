@@ -0,0 +1,64 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestIndexingClosesFilesPromptly indexes more sidecars and media files than the lowered
+// open file limit allows at once, which fails if files stay open until the loop ends.
+func TestIndexingClosesFilesPromptly(t *testing.T) {
+	const limit, files = 64, 300
+
+	var old syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &old); err != nil {
+		t.Skipf("getrlimit: %v", err)
+	}
+	lowered := old
+	lowered.Cur = limit
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Skipf("setrlimit: %v", err)
+	}
+	t.Cleanup(func() { _ = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &old) })
+
+	dir := t.TempDir()
+	var jsonFiles, mediaFiles []string
+	for i := range files {
+		name := fmt.Sprintf("IMG_%04d.jpg", i)
+		mediaPath := filepath.Join(dir, name)
+		jsonPath := mediaPath + ".supplemental-metadata.json"
+		writeFile(t, mediaPath, "photo")
+		writeFile(t, jsonPath, fmt.Sprintf(`{"title": %q, "photoTakenTime": {"timestamp": "1647253800"}}`, name))
+		jsonFiles = append(jsonFiles, jsonPath)
+		mediaFiles = append(mediaFiles, mediaPath)
+	}
+	// Half of the media files are indexed without their sidecar
+	jsonFiles = jsonFiles[:files/2]
+
+	index := newMediaIndex()
+	if errs := parseExtractMetadatJsonFileAndAddToMapImage(index, nil, jsonFiles, mediaFiles); errs != 0 {
+		t.Fatalf("indexing sidecars failed for %d files", errs)
+	}
+	rest := getMediaFilesWithoutMedtadataJsonFiles(index, mediaFiles)
+	if errs := parseExtractMediaFilesWithoutMedtadataJsonFileAddToMap(index, rest); errs != 0 {
+		t.Fatalf("indexing media files failed for %d files", errs)
+	}
+	if index.Len() != files {
+		t.Fatalf("indexed %d files, want %d", index.Len(), files)
+	}
+	if folder, _ := index.Get(mediaFiles[0]); folder != "2022/03" {
+		t.Errorf("folder of %s = %q, want 2022/03", mediaFiles[0], folder)
+	}
+
+	// Opening one more file works only if nothing leaked
+	f, err := os.Open(mediaFiles[0])
+	if err != nil {
+		t.Fatalf("open after indexing: %v", err)
+	}
+	f.Close()
+}
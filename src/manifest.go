@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// resumeManifest records every finished upload as a "path<TAB>folder" line, so that an
+// interrupted run can be restarted and skip what was already uploaded. A nil
+// *resumeManifest is valid and records nothing.
+type resumeManifest struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	done   map[string]bool
+}
+
+// openResumeManifest loads the entries of an existing manifest at path and opens it for
+// appending. It returns nil when path is empty.
+func openResumeManifest(path string) (*resumeManifest, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	m := &resumeManifest{done: make(map[string]bool)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read resume manifest %s: %v", path, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			m.done[line] = true
+		}
+	}
+
+	m.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open resume manifest %s: %v", path, err)
+	}
+	m.writer = bufio.NewWriter(m.file)
+
+	return m, nil
+}
+
+// manifestKey is the manifest line for media. A photo uploaded to several folders has a
+// line per folder.
+func manifestKey(media MediaFile) string {
+	return media.Path + "\t" + media.Ts
+}
+
+// Done reports whether media was uploaded by a previous run.
+func (m *resumeManifest) Done(media MediaFile) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.done[manifestKey(media)]
+}
+
+// Record marks media as uploaded.
+func (m *resumeManifest) Record(media MediaFile) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.done[manifestKey(media)] = true
+	_, err := fmt.Fprintln(m.writer, manifestKey(media))
+	return err
+}
+
+// Close flushes pending entries to disk and closes the manifest.
+func (m *resumeManifest) Close() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.writer.Flush(); err != nil {
+		m.file.Close()
+		return err
+	}
+	return m.file.Close()
+}
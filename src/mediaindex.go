@@ -0,0 +1,350 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MediaIndex maps the path of every indexed media file to its "YYYY/MM" date folder, along
+// with what indexing and planning learned about each file. It is safe for concurrent use.
+//
+// Only the date folders are removed by Delete, the rest stays so that reports still
+// describe files that were filtered out.
+type MediaIndex struct {
+	mu      sync.RWMutex
+	folders map[string]string
+
+	// dateSources records the source each media file got its date folder from.
+	dateSources map[string]string
+	// takenTimes holds the sidecar timestamp each media file dated by its sidecar got its
+	// date folder from, for backends that store the date rather than a folder.
+	takenTimes map[string]time.Time
+	// unresolved records why each media file that got fallbackDateFolder had no date.
+	unresolved map[string]string
+	// discrepancies describes the disagreeing sidecar and EXIF dates of each media file
+	// found by DATE_DISCREPANCY_DAYS.
+	discrepancies map[string]string
+	// sidecars maps a media file to its JSON sidecar.
+	sidecars map[string]string
+	// people maps a media file to the names of the people its sidecar lists.
+	people map[string][]string
+	// sizes are the sizes of the media files, -1 for ones that couldn't be read.
+	sizes map[string]int64
+	// checksums are the hex SHA-256 of the media files hashed while indexing.
+	checksums map[string]string
+	// ignored are the files and directories skipped by an ignore pattern, so the sidecar
+	// of an ignored media file doesn't add it back.
+	ignored map[string]bool
+	// albums records, for a photo kept by deduplication, the albums its removed copies
+	// were found in.
+	albums map[string][]string
+	// albumCopies and albumTags hold the album folders to copy each media file into and
+	// the album tags to give it once it was uploaded, for the copy-remote and tag-only
+	// strategies.
+	albumCopies map[string][]string
+	albumTags   map[string][]string
+	// pendingUploads counts the planned upload jobs of each media file that haven't
+	// succeeded yet, as album and date folders each get a job for the same local file.
+	pendingUploads map[string]int
+}
+
+func newMediaIndex() *MediaIndex {
+	return &MediaIndex{
+		folders:        make(map[string]string),
+		dateSources:    make(map[string]string),
+		takenTimes:     make(map[string]time.Time),
+		unresolved:     make(map[string]string),
+		discrepancies:  make(map[string]string),
+		sidecars:       make(map[string]string),
+		people:         make(map[string][]string),
+		sizes:          make(map[string]int64),
+		checksums:      make(map[string]string),
+		ignored:        make(map[string]bool),
+		albums:         make(map[string][]string),
+		albumCopies:    make(map[string][]string),
+		albumTags:      make(map[string][]string),
+		pendingUploads: make(map[string]int),
+	}
+}
+
+// Add sets the date folder of the media file at path.
+func (idx *MediaIndex) Add(path, folder string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, exists := idx.folders[path]; !exists {
+		events.FileIndexed(path, folder)
+	}
+	idx.folders[path] = folder
+}
+
+// Get returns the date folder of the media file at path and whether it is indexed.
+func (idx *MediaIndex) Get(path string) (string, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	folder, ok := idx.folders[path]
+	return folder, ok
+}
+
+// Delete removes the media file at path from the index.
+func (idx *MediaIndex) Delete(path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.folders, path)
+}
+
+// Len returns the number of indexed media files.
+func (idx *MediaIndex) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.folders)
+}
+
+// Range calls fn for every indexed media file in path order until fn returns false. It
+// iterates over a snapshot, so fn may modify the index.
+func (idx *MediaIndex) Range(fn func(path, folder string) bool) {
+	idx.mu.RLock()
+	paths := make([]string, 0, len(idx.folders))
+	folders := make(map[string]string, len(idx.folders))
+	for path, folder := range idx.folders {
+		paths = append(paths, path)
+		folders[path] = folder
+	}
+	idx.mu.RUnlock()
+
+	sort.Strings(paths)
+	for _, path := range paths {
+		if !fn(path, folders[path]) {
+			return
+		}
+	}
+}
+
+// Paths returns the paths of all indexed media files, sorted.
+func (idx *MediaIndex) Paths() []string {
+	var paths []string
+	idx.Range(func(path, _ string) bool {
+		paths = append(paths, path)
+		return true
+	})
+	return paths
+}
+
+// SetDateSource records the source the media file at path got its date folder from.
+func (idx *MediaIndex) SetDateSource(path, source string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.dateSources[path] = source
+}
+
+// DateSource returns the source the media file at path got its date folder from.
+func (idx *MediaIndex) DateSource(path string) string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.dateSources[path]
+}
+
+// SetTakenTime records the sidecar timestamp the media file at path was dated by.
+func (idx *MediaIndex) SetTakenTime(path string, taken time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.takenTimes[path] = taken
+}
+
+// TakenTime returns the sidecar timestamp the media file at path was dated by, if it was.
+func (idx *MediaIndex) TakenTime(path string) (time.Time, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	taken, ok := idx.takenTimes[path]
+	return taken, ok
+}
+
+// SetUnresolved records why the media file at path has no date.
+func (idx *MediaIndex) SetUnresolved(path, reason string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.unresolved[path] = reason
+}
+
+// Unresolved returns why the media file at path has no date, and whether it has none.
+func (idx *MediaIndex) Unresolved(path string) (string, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	reason, ok := idx.unresolved[path]
+	return reason, ok
+}
+
+// UnresolvedPaths returns the sorted paths of the media files without a date.
+func (idx *MediaIndex) UnresolvedPaths() []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	paths := make([]string, 0, len(idx.unresolved))
+	for path := range idx.unresolved {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// SetDiscrepancy records how the sidecar and EXIF dates of the media file at path disagree.
+func (idx *MediaIndex) SetDiscrepancy(path, discrepancy string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.discrepancies[path] = discrepancy
+}
+
+// Discrepancy returns how the dates of the media file at path disagree, "" if they don't.
+func (idx *MediaIndex) Discrepancy(path string) string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.discrepancies[path]
+}
+
+// SetSidecar records the JSON sidecar of the media file at path.
+func (idx *MediaIndex) SetSidecar(path, sidecar string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.sidecars[path] = sidecar
+}
+
+// Sidecar returns the JSON sidecar of the media file at path, if it has one.
+func (idx *MediaIndex) Sidecar(path string) (string, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	sidecar, ok := idx.sidecars[path]
+	return sidecar, ok
+}
+
+// AddPeople records the names of people the sidecar of the media file at path lists.
+func (idx *MediaIndex) AddPeople(path string, names ...string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.people[path] = append(idx.people[path], names...)
+}
+
+// People returns the names of the people the sidecar of the media file at path lists.
+func (idx *MediaIndex) People(path string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return slices.Clone(idx.people[path])
+}
+
+// SetSize records the size of the media file at path, -1 if it couldn't be read.
+func (idx *MediaIndex) SetSize(path string, size int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.sizes[path] = size
+}
+
+// Size returns the size recorded for the media file at path, or -1 if unknown.
+func (idx *MediaIndex) Size(path string) int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if size, ok := idx.sizes[path]; ok {
+		return size
+	}
+	return -1
+}
+
+// SetChecksum records the hex SHA-256 of the media file at path.
+func (idx *MediaIndex) SetChecksum(path, sum string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.checksums[path] = sum
+}
+
+// Checksum returns the hex SHA-256 of the media file at path, if it was hashed while indexing.
+func (idx *MediaIndex) Checksum(path string) (string, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	sum, ok := idx.checksums[path]
+	return sum, ok
+}
+
+// Ignore records that path was skipped by an ignore pattern.
+func (idx *MediaIndex) Ignore(path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.ignored[path] = true
+}
+
+// Ignored reports whether path was skipped by an ignore pattern.
+func (idx *MediaIndex) Ignored(path string) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.ignored[path]
+}
+
+// AddAlbum records that a removed copy of the media file at path was in the album title.
+func (idx *MediaIndex) AddAlbum(path, title string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.albums[path] = append(idx.albums[path], title)
+}
+
+// Albums returns the albums the removed copies of the media file at path were in.
+func (idx *MediaIndex) Albums(path string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return slices.Clone(idx.albums[path])
+}
+
+// SetAlbumCopies sets the album folders the media file at path is copied into.
+func (idx *MediaIndex) SetAlbumCopies(path string, folders []string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.albumCopies[path] = folders
+}
+
+// AlbumCopies returns the album folders the media file at path is copied into.
+func (idx *MediaIndex) AlbumCopies(path string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return slices.Clone(idx.albumCopies[path])
+}
+
+// AlbumCopyFolders returns every album folder media files are copied into, sorted.
+func (idx *MediaIndex) AlbumCopyFolders() []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var folders []string
+	for _, mediaFolders := range idx.albumCopies {
+		folders = append(folders, mediaFolders...)
+	}
+	sort.Strings(folders)
+	return slices.Compact(folders)
+}
+
+// SetAlbumTags sets the album tags the media file at path gets once it was uploaded.
+func (idx *MediaIndex) SetAlbumTags(path string, titles []string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.albumTags[path] = titles
+}
+
+// AlbumTags returns the album tags the media file at path gets once it was uploaded.
+func (idx *MediaIndex) AlbumTags(path string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return slices.Clone(idx.albumTags[path])
+}
+
+// PlanUploads counts the upload jobs of every media file in jobs.
+func (idx *MediaIndex) PlanUploads(jobs []MediaFile) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, job := range jobs {
+		idx.pendingUploads[job.Path]++
+	}
+}
+
+// FinishUpload records that an upload job of the media file at path succeeded and reports
+// whether it was the last planned one. A job that failed is never finished, so the local
+// file is kept.
+func (idx *MediaIndex) FinishUpload(path string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.pendingUploads[path]--
+	return idx.pendingUploads[path] <= 0
+}
@@ -0,0 +1,76 @@
+// Package metadata holds the types of the JSON sidecars Google Takeout writes next to
+// every photo and video, and reads them.
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// PhotoMetadata represents the structure of the JSON metadata file accompanying each photo.
+type PhotoMetadata struct {
+	Title                 string   `json:"title"`
+	Description           string   `json:"description"`
+	ImageViews            string   `json:"imageViews"`
+	CreationTime          TimeData `json:"creationTime"`
+	PhotoTakenTime        TimeData `json:"photoTakenTime"`
+	PhotoLastModifiedTime TimeData `json:"photoLastModifiedTime"`
+	GeoData               GeoData  `json:"geoData"`
+	People                []Person `json:"people"`
+	URL                   string   `json:"url"`
+	Origin                Origin   `json:"googlePhotosOrigin"`
+}
+
+type TimeData struct {
+	Timestamp string `json:"timestamp"`
+	Formatted string `json:"formatted"`
+}
+
+type GeoData struct {
+	Latitude      float64 `json:"latitude"`
+	Longitude     float64 `json:"longitude"`
+	Altitude      float64 `json:"altitude"`
+	LatitudeSpan  float64 `json:"latitudeSpan"`
+	LongitudeSpan float64 `json:"longitudeSpan"`
+}
+
+type Person struct {
+	Name string `json:"name"`
+}
+
+type Origin struct {
+	MobileUpload MobileUpload `json:"mobileUpload"`
+}
+
+type MobileUpload struct {
+	DeviceFolder DeviceFolder `json:"deviceFolder"`
+	DeviceType   string       `json:"deviceType"`
+}
+
+type DeviceFolder struct {
+	LocalFolderName string `json:"localFolderName"`
+}
+
+// ParseSidecar reads and parses the JSON sidecar at path.
+func ParseSidecar(path string) (PhotoMetadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PhotoMetadata{}, fmt.Errorf("failed to read JSON file %s: %v", path, err)
+	}
+	sidecar, err := DecodeSidecar(data)
+	if err != nil {
+		return PhotoMetadata{}, fmt.Errorf("failed to parse JSON file %s: %v", path, err)
+	}
+	return sidecar, nil
+}
+
+// DecodeSidecar parses the content of a JSON sidecar, for sidecars that aren't plain files
+// such as the ones inside a Takeout zip.
+func DecodeSidecar(data []byte) (PhotoMetadata, error) {
+	var sidecar PhotoMetadata
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return PhotoMetadata{}, err
+	}
+	return sidecar, nil
+}
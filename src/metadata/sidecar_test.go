@@ -0,0 +1,71 @@
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const takeoutSidecar = `{
+  "title": "IMG_0001.jpg",
+  "description": "",
+  "imageViews": "3",
+  "creationTime": {"timestamp": "1656633600", "formatted": "Jul 1, 2022, 12:00:00 AM UTC"},
+  "photoTakenTime": {"timestamp": "1648780200", "formatted": "Apr 1, 2022, 2:30:00 AM UTC"},
+  "photoLastModifiedTime": {"timestamp": "1669852800", "formatted": "Dec 1, 2022, 12:00:00 AM UTC"},
+  "geoData": {"latitude": 48.8584, "longitude": 2.2945, "altitude": 35.0, "latitudeSpan": 0.0, "longitudeSpan": 0.0},
+  "people": [{"name": "Alice"}],
+  "url": "https://photos.google.com/photo/abc",
+  "googlePhotosOrigin": {"mobileUpload": {"deviceFolder": {"localFolderName": "Camera"}, "deviceType": "ANDROID_PHONE"}}
+}`
+
+func TestDecodeSidecar(t *testing.T) {
+	sidecar, err := DecodeSidecar([]byte(takeoutSidecar))
+	if err != nil {
+		t.Fatalf("DecodeSidecar() error = %v", err)
+	}
+	for name, got := range map[string]string{
+		"title":                 sidecar.Title,
+		"creationTime":          sidecar.CreationTime.Timestamp,
+		"photoTakenTime":        sidecar.PhotoTakenTime.Timestamp,
+		"photoLastModifiedTime": sidecar.PhotoLastModifiedTime.Timestamp,
+	} {
+		want := map[string]string{
+			"title":                 "IMG_0001.jpg",
+			"creationTime":          "1656633600",
+			"photoTakenTime":        "1648780200",
+			"photoLastModifiedTime": "1669852800",
+		}[name]
+		if got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if sidecar.GeoData.Latitude != 48.8584 || len(sidecar.People) != 1 || sidecar.People[0].Name != "Alice" {
+		t.Errorf("DecodeSidecar() = %+v", sidecar)
+	}
+
+	// Sidecars written by other tools lack most fields
+	sidecar, err = DecodeSidecar([]byte(`{"title": "IMG_0002.jpg"}`))
+	if err != nil || sidecar.Title != "IMG_0002.jpg" || sidecar.PhotoLastModifiedTime.Timestamp != "" {
+		t.Errorf("DecodeSidecar() of a minimal sidecar = %+v, %v", sidecar, err)
+	}
+
+	for _, data := range []string{"", "{", `{"title": 1}`, "[]"} {
+		if _, err := DecodeSidecar([]byte(data)); err == nil {
+			t.Errorf("DecodeSidecar(%q) succeeded", data)
+		}
+	}
+}
+
+func TestParseSidecar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "IMG_0001.jpg.supplemental-metadata.json")
+	if err := os.WriteFile(path, []byte(takeoutSidecar), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if sidecar, err := ParseSidecar(path); err != nil || sidecar.PhotoTakenTime.Timestamp != "1648780200" {
+		t.Errorf("ParseSidecar() = %+v, %v", sidecar, err)
+	}
+	if _, err := ParseSidecar(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("ParseSidecar() of a missing file succeeded")
+	}
+}
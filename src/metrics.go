@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// metricsRateInterval is how often the upload rate gauge is updated.
+const metricsRateInterval = 10 * time.Second
+
+// uploadMetrics are the counters served on METRICS_ADDR. A nil *uploadMetrics is valid and
+// counts nothing, so there is no overhead without METRICS_ADDR.
+type uploadMetrics struct {
+	plannedFiles  atomic.Int64
+	plannedBytes  atomic.Int64
+	uploadedFiles atomic.Int64
+	uploadedBytes atomic.Int64
+	failures      atomic.Int64
+	retries       atomic.Int64
+	// bytesPerSecond is the upload rate over the last metricsRateInterval, as float64 bits.
+	bytesPerSecond atomic.Uint64
+}
+
+var metrics *uploadMetrics
+
+// startMetricsServer serves the metrics in the Prometheus text format on addr under /metrics.
+func startMetricsServer(addr string) (*uploadMetrics, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &uploadMetrics{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Error("Metrics server stopped", "error", err)
+		}
+	}()
+	go m.measureRate()
+
+	slog.Info("Serving metrics", "url", fmt.Sprintf("http://%s/metrics", listener.Addr()))
+	return m, nil
+}
+
+// measureRate updates the rate gauge from the uploaded bytes every metricsRateInterval.
+func (m *uploadMetrics) measureRate() {
+	ticker := time.NewTicker(metricsRateInterval)
+	defer ticker.Stop()
+	last, lastTime := m.uploadedBytes.Load(), time.Now()
+	for now := range ticker.C {
+		current := m.uploadedBytes.Load()
+		rate := float64(current-last) / now.Sub(lastTime).Seconds()
+		m.bytesPerSecond.Store(math.Float64bits(rate))
+		last, lastTime = current, now
+	}
+}
+
+func (m *uploadMetrics) write(w io.Writer) {
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+	}
+
+	gauge("media2nextcloud_planned_files", "Number of files planned for upload in this run.", float64(m.plannedFiles.Load()))
+	gauge("media2nextcloud_planned_bytes", "Total size of the files planned for upload in this run.", float64(m.plannedBytes.Load()))
+	counter("media2nextcloud_uploaded_files_total", "Number of files uploaded.", m.uploadedFiles.Load())
+	counter("media2nextcloud_uploaded_bytes_total", "Number of bytes sent in upload requests, including retried ones.", m.uploadedBytes.Load())
+	counter("media2nextcloud_upload_failures_total", "Number of files whose upload failed.", m.failures.Load())
+	counter("media2nextcloud_upload_retries_total", "Number of upload attempts that were retried.", m.retries.Load())
+	gauge("media2nextcloud_upload_bytes_per_second", "Upload rate over the last 10 seconds.", math.Float64frombits(m.bytesPerSecond.Load()))
+}
+
+// SetPlanned records the number and total size of the files about to be uploaded.
+func (m *uploadMetrics) SetPlanned(files int, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.plannedFiles.Store(int64(files))
+	m.plannedBytes.Store(bytes)
+}
+
+// FileUploaded counts a successful upload.
+func (m *uploadMetrics) FileUploaded() {
+	if m != nil {
+		m.uploadedFiles.Add(1)
+	}
+}
+
+// UploadFailed counts a failed upload.
+func (m *uploadMetrics) UploadFailed() {
+	if m != nil {
+		m.failures.Add(1)
+	}
+}
+
+// UploadRetried counts an upload attempt that is retried.
+func (m *uploadMetrics) UploadRetried() {
+	if m != nil {
+		m.retries.Add(1)
+	}
+}
+
+// countBytes returns r counting the bytes read from it as uploaded, or r itself without
+// metrics.
+func (m *uploadMetrics) countBytes(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &countingReader{r: r, n: &m.uploadedBytes}
+}
+
+// countingReader adds the number of bytes read from r to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	// extractMotion is EXTRACT_MOTION: also upload the video embedded in a motion photo as
+	// an .mp4 next to it.
+	extractMotion bool
+	// motionVideosExtracted counts the videos EXTRACT_MOTION extracted.
+	motionVideosExtracted atomic.Int64
+)
+
+var (
+	// microVideoOffsetPattern finds the XMP of Google's older motion photos, MVIMG_*.jpg,
+	// which gives the video's offset from the end of the file.
+	microVideoOffsetPattern = regexp.MustCompile(`MicroVideoOffset(?:="|>)(\d+)`)
+	// motionPhotoItemPattern finds the container item of Google's newer motion photos, whose
+	// Item:Length is the size of the video at the end of the file.
+	motionPhotoItemPattern = regexp.MustCompile(`<Container:Item\b[^>]*Item:Semantic="MotionPhoto"[^>]*>`)
+	itemLengthPattern      = regexp.MustCompile(`Item:Length="(\d+)"`)
+)
+
+// samsungMotionMarker precedes the video Samsung appends to its motion photos.
+var samsungMotionMarker = []byte("MotionPhoto_Data")
+
+// errNoMotionVideo is returned by motionVideo for photos without an embedded video.
+var errNoMotionVideo = errors.New("no embedded video")
+
+// isMotionPhotoCandidate reports whether path is in a format motion photos are stored in:
+// JPEG, including Pixel's .MP.jpg and older .MP files, or HEIC.
+func isMotionPhotoCandidate(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".mp", ".heic", ".heif":
+		return true
+	}
+	return false
+}
+
+// motionVideo returns the MP4 embedded in the motion photo data, located by the XMP offset
+// Google's cameras write, the trailer marker of Samsung's, or the "mpvd" box of HEIC motion
+// photos.
+func motionVideo(data []byte) ([]byte, error) {
+	var starts []int
+	if start := mpvdPayload(data); start >= 0 {
+		starts = append(starts, start)
+	}
+	if match := motionPhotoItemPattern.Find(data); match != nil {
+		if length := itemLengthPattern.FindSubmatch(match); length != nil {
+			if n, err := strconv.Atoi(string(length[1])); err == nil && n > 0 && n < len(data) {
+				starts = append(starts, len(data)-n)
+			}
+		}
+	}
+	if match := microVideoOffsetPattern.FindSubmatch(data); match != nil {
+		if n, err := strconv.Atoi(string(match[1])); err == nil && n > 0 && n < len(data) {
+			starts = append(starts, len(data)-n)
+		}
+	}
+	if i := bytes.LastIndex(data, samsungMotionMarker); i >= 0 {
+		starts = append(starts, i+len(samsungMotionMarker))
+	}
+
+	for _, start := range starts {
+		if length := mp4Length(data[start:]); length > 0 {
+			return data[start : start+length], nil
+		}
+	}
+	return nil, errNoMotionVideo
+}
+
+// mp4Length walks the top level boxes of the MP4 at the start of data and returns its
+// length, or 0 if data doesn't start with an MP4 holding a movie. Whatever follows the last
+// box, such as Samsung's metadata trailer, is left out.
+func mp4Length(data []byte) int {
+	offset, hasMovie := 0, false
+	for offset+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		boxType := string(data[offset+4 : offset+8])
+		if offset == 0 && boxType != "ftyp" {
+			return 0
+		}
+		switch size {
+		case 0:
+			// The box extends to the end of the data
+			size = len(data) - offset
+		case 1:
+			if offset+16 > len(data) {
+				return 0
+			}
+			size64 := binary.BigEndian.Uint64(data[offset+8:])
+			if size64 > uint64(len(data)-offset) {
+				return 0
+			}
+			size = int(size64)
+		}
+		if size < 8 || offset+size > len(data) || !isBoxType(boxType) {
+			break
+		}
+		hasMovie = hasMovie || boxType == "moov"
+		offset += size
+	}
+	if !hasMovie {
+		return 0
+	}
+	return offset
+}
+
+// mpvdPayload returns the offset of the payload of the top level "mpvd" box a HEIF motion
+// photo keeps its video in, or -1 if data isn't HEIF or has no such box.
+func mpvdPayload(data []byte) int {
+	if len(data) < 8 || string(data[4:8]) != "ftyp" {
+		return -1
+	}
+	for offset := 0; offset+8 <= len(data); {
+		size, header := int(binary.BigEndian.Uint32(data[offset:])), 8
+		switch size {
+		case 0:
+			size = len(data) - offset
+		case 1:
+			if offset+16 > len(data) {
+				return -1
+			}
+			size64 := binary.BigEndian.Uint64(data[offset+8:])
+			if size64 > uint64(len(data)-offset) {
+				return -1
+			}
+			size, header = int(size64), 16
+		}
+		if size < header || offset+size > len(data) {
+			return -1
+		}
+		if string(data[offset+4:offset+8]) == "mpvd" {
+			return offset + header
+		}
+		offset += size
+	}
+	return -1
+}
+
+// isBoxType reports whether name is a plausible MP4 box type, four printable characters.
+func isBoxType(name string) bool {
+	for i := range len(name) {
+		if name[i] < 0x20 || name[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// motionUploadFiles adds the video embedded in each motion photo in uploadPaths, extracted
+// into a temporary directory as "<name>.mp4", after its photo. The photos themselves are
+// uploaded unchanged. A photo whose video can't be extracted is uploaded on its own. The
+// returned cleanup removes the videos.
+func motionUploadFiles(uploadPaths []string) ([]string, func()) {
+	cleanup := func() {}
+	var tmpDir string
+	files := make([]string, 0, len(uploadPaths))
+	for _, uploadPath := range uploadPaths {
+		files = append(files, uploadPath)
+		if !isMotionPhotoCandidate(uploadPath) {
+			continue
+		}
+
+		data, err := readMediaFile(uploadPath)
+		if err != nil {
+			slog.Warn("Failed to read photo, uploading it without its motion video", "file", uploadPath, "error", err)
+			continue
+		}
+		video, err := motionVideo(data)
+		if err != nil {
+			continue
+		}
+
+		if tmpDir == "" {
+			if tmpDir, err = os.MkdirTemp("", "media2nextcloud-motion-"); err != nil {
+				slog.Warn("Failed to create temporary directory, uploading photo without its motion video", "file", uploadPath, "error", err)
+				continue
+			}
+			cleanup = func() { os.RemoveAll(tmpDir) }
+		}
+		name := strings.TrimSuffix(filepath.Base(uploadPath), filepath.Ext(uploadPath)) + ".mp4"
+		videoPath := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(videoPath, video, 0o600); err != nil {
+			slog.Warn("Failed to extract motion video", "file", uploadPath, "error", err)
+			continue
+		}
+		// Uploaded with the photo's modification time
+		if info, err := statMedia(uploadPath); err == nil {
+			os.Chtimes(videoPath, info.ModTime(), info.ModTime())
+		}
+		slog.Debug("Extracted motion video", "file", uploadPath, "size", len(video))
+		motionVideosExtracted.Add(1)
+		files = append(files, videoPath)
+	}
+	return files, cleanup
+}
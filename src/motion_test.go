@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMotionUploadFilesWithStripGeodata(t *testing.T) {
+	old := allowUnstripped
+	allowUnstripped = false
+	t.Cleanup(func() { allowUnstripped = old })
+
+	dir := t.TempDir()
+	photo, still := filepath.Join(dir, "PXL_0001.MP.jpg"), filepath.Join(dir, "IMG_0002.jpg")
+	if err := os.WriteFile(photo, fixtureMotionPhoto(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(still, fixtureJPEG(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	files, cleanupMotion := motionUploadFiles([]string{photo, still})
+	defer cleanupMotion()
+	if len(files) != 3 || files[0] != photo || filepath.Base(files[1]) != "PXL_0001.MP.mp4" || files[2] != still {
+		t.Fatalf("motionUploadFiles() = %v, want the photo, its video and the still photo", files)
+	}
+	video, err := os.ReadFile(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(video, fixtureMP4()) {
+		t.Errorf("extracted video differs from the embedded one")
+	}
+
+	// The extracted video is stripped like any other
+	stripped, cleanupStrip, err := stripGeodataFiles(files)
+	if err != nil {
+		t.Fatalf("stripGeodataFiles() error = %v", err)
+	}
+	defer cleanupStrip()
+	for _, path := range stripped {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertNoLocation(t, data)
+	}
+	data, _ := os.ReadFile(stripped[1])
+	if mp4Length(data) != len(video) {
+		t.Errorf("stripped video is no longer a complete MP4")
+	}
+}
+
+func TestMotionVideo(t *testing.T) {
+	mp4 := fixtureMP4()
+	samsung := append(append(fixtureJPEG(t), samsungMotionMarker...), mp4...)
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"pixel", fixtureMotionPhoto(t), mp4},
+		{"samsung", samsung, mp4},
+		{"samsung with trailer", append(bytes.Clone(samsung), "SEFT trailer"...), mp4},
+		{"heic", append(fixtureHEIC(), box("mpvd", mp4)...), mp4},
+		{"still heic", fixtureHEIC(), nil},
+		{"still photo", fixtureJPEG(t), nil},
+	}
+	for _, tt := range tests {
+		got, err := motionVideo(tt.data)
+		if tt.want == nil {
+			if err != errNoMotionVideo {
+				t.Errorf("%s: motionVideo() error = %v, want errNoMotionVideo", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: motionVideo() = %d bytes, %v, want the %d byte video", tt.name, len(got), err, len(tt.want))
+		}
+	}
+}
+
+func TestIsMotionPhotoCandidate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"IMG_0001.jpg", true},
+		{"MVIMG_0001.JPEG", true},
+		{"PXL_20220101_120000000.MP.jpg", true},
+		{"PXL_20220101_120000000.MP", true},
+		{"IMG_0001.HEIC", true},
+		{"IMG_0001.heif", true},
+		{"IMG_0001.png", false},
+		{"VID_0001.mp4", false},
+	} {
+		if got := isMotionPhotoCandidate(tt.name); got != tt.want {
+			t.Errorf("isMotionPhotoCandidate(%q) = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestPixelMotionFilesIncluded checks the .MP files of older Pixel phones are uploaded by
+// default.
+func TestPixelMotionFilesIncluded(t *testing.T) {
+	old := includePatterns
+	t.Cleanup(func() { includePatterns = old })
+	includePatterns = parsePatterns(defaultIncludeExt)
+
+	for _, name := range []string{"PXL_20220101_120000000.MP", "PXL_20220101_120000000.MP.jpg"} {
+		if !isMediaFileIncluded(name) {
+			t.Errorf("isMediaFileIncluded(%q) = false, want true", name)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// remoteNameReplacer maps the characters Nextcloud doesn't allow in file and folder names
+// to an underscore, like a slash in an album title.
+var remoteNameReplacer = strings.NewReplacer(
+	`\`, "_",
+	"<", "_",
+	">", "_",
+	":", "_",
+	`"`, "_",
+	"|", "_",
+	"?", "_",
+	"*", "_",
+	"/", "_",
+)
+
+// remoteFolderName turns an album title into a single remote folder name: normalized to
+// NFC, so decomposed titles as macOS and some Takeout exports store them give the same
+// folder, and with the characters Nextcloud rejects replaced by "_", everything else,
+// emoji included, kept as is. remoteURL takes care of escaping it.
+func remoteFolderName(title string) string {
+	name := remoteNameReplacer.Replace(norm.NFC.String(title))
+	// "." and ".." aren't names of their own
+	if strings.Trim(name, ".") == "" {
+		name = strings.ReplaceAll(name, ".", "_")
+	}
+	return name
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoteFolderName(t *testing.T) {
+	tests := []struct {
+		name, title, want string
+	}{
+		{"plain", "Summer 2022", "Summer 2022"},
+		{"emoji", "🏖️ Summer 2022", "🏖️ Summer 2022"},
+		{"emoji sequence", "👨‍👩‍👧 Family", "👨‍👩‍👧 Family"},
+		{"NFD accents", "Cafe\u0301 in Zu\u0308rich", "Caf\u00e9 in Z\u00fcrich"},
+		{"NFD Vietnamese", "Ha\u0323 Long", "H\u1ea1 Long"},
+		{"NFD Hangul", "\u1112\u1161\u11ab\u1100\u1173\u11af", "\ud55c\uae00"},
+		{"already NFC", "Caf\u00e9", "Caf\u00e9"},
+		{"reserved characters", `a\b<c>d:e"f|g?h*i/j`, "a_b_c_d_e_f_g_h_i_j"},
+		{"reserved next to emoji", "Trip: 🇯🇵 / 🇰🇷?", "Trip_ 🇯🇵 _ 🇰🇷_"},
+		{"dot", ".", "_"},
+		{"dot dot", "..", "__"},
+		{"dots in a name", "v1.2...", "v1.2..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remoteFolderName(tt.title); got != tt.want {
+				t.Errorf("remoteFolderName(%q) = %q, want %q", tt.title, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAlbumFoldersNormalized checks that an album whose title is stored decomposed ends up
+// in the same escaped remote folder as its precomposed spelling.
+func TestAlbumFoldersNormalized(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Café 🏖️")
+	metadataFile := filepath.Join(dir, albumMetadataFileName)
+	writeFile(t, metadataFile, "{\"title\": \"Cafe\u0301 🏖️ Trip: day 1?\"}")
+	t.Cleanup(func() { delete(albumDirs, dir) })
+
+	if err := addAlbumMetadataFile(metadataFile); err != nil {
+		t.Fatalf("addAlbumMetadataFile() error = %v", err)
+	}
+	folders := albumFolders(newMediaIndex(), filepath.Join(dir, "IMG_0001.jpg"))
+	want := "Albums/Caf\u00e9 🏖️ Trip_ day 1_"
+	if len(folders) != 1 || folders[0] != want {
+		t.Fatalf("albumFolders() = %q, want [%q]", folders, want)
+	}
+
+	const wantURL = "https://cloud.example.com/dav/Albums/Caf%C3%A9%20%F0%9F%8F%96%EF%B8%8F%20Trip_%20day%201_/IMG_0001.jpg"
+	if got := remoteURL("https://cloud.example.com/dav/", folders[0], "IMG_0001.jpg"); got != wantURL {
+		t.Errorf("remoteURL() = %q, want %q", got, wantURL)
+	}
+}
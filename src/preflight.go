@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const propfindQuotaBody = `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:quota-available-bytes/>
+  </d:prop>
+</d:propfind>`
+
+// ignoreQuota lets the upload start even when the files don't fit into the free space.
+var ignoreQuota bool
+
+// maxPreflightRedirects bounds how many redirects preflightCheck follows.
+const maxPreflightRedirects = 5
+
+// preflightCheck issues a Depth 0 PROPFIND on nextcloudURL so that a wrong URL or bad
+// credentials are reported before the (potentially long) indexing pass starts. It returns
+// the URL to upload to: a redirect to the same path on the same host, typically from http://
+// to https://, is followed and its target returned with a warning, as Go drops the
+// credentials on a redirect to another scheme and every later request would fail with 401.
+// Any other redirect, in particular to another host, is an error naming its target, so the
+// credentials are never sent to a server NEXTCLOUD_URL doesn't name.
+func preflightCheck(nextcloudURL string, auth Authenticator) (string, error) {
+	client := &http.Client{
+		Transport: newHTTPTransport(),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for range maxPreflightRedirects {
+		req, err := http.NewRequest("PROPFIND", nextcloudURL, strings.NewReader(propfindContentLengthBody))
+		if err != nil {
+			return "", fmt.Errorf("invalid NEXTCLOUD_URL %s: %v", nextcloudURL, err)
+		}
+		auth.Authenticate(req)
+		req.Header.Set("Depth", "0")
+		req.Header.Set("Content-Type", "application/xml")
+
+		resp, err := doRequest(client, req, webdavRetryPolicy)
+		if err != nil {
+			return "", describeConnectionError(nextcloudURL, err)
+		}
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusMultiStatus, http.StatusOK:
+			return nextcloudURL, nil
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			location, err := resp.Location()
+			if err != nil {
+				return "", fmt.Errorf("%s redirects (%s) without a valid Location", nextcloudURL, resp.Status)
+			}
+			if !sameEndpoint(req.URL, location) {
+				return "", fmt.Errorf("%s redirects to %s, set NEXTCLOUD_URL to the WebDAV endpoint on that server instead", nextcloudURL, location.Redacted())
+			}
+			slog.Warn("NEXTCLOUD_URL redirects, uploading to the redirect's target instead. Set NEXTCLOUD_URL to it to skip the redirect", "url", nextcloudURL, "target", location.Redacted())
+			nextcloudURL = location.String()
+		case http.StatusUnauthorized:
+			return "", fmt.Errorf("Nextcloud rejected the credentials (401), check NEXTCLOUD_USER/NEXTCLOUD_PASSWORD or NEXTCLOUD_TOKEN")
+		case http.StatusNotFound, http.StatusMethodNotAllowed:
+			return "", fmt.Errorf("%s does not look like a WebDAV endpoint (%s), it should end in /remote.php/dav/files/<username>", nextcloudURL, resp.Status)
+		default:
+			return "", fmt.Errorf("unexpected response from %s: %s", nextcloudURL, resp.Status)
+		}
+	}
+	return "", fmt.Errorf("%s redirects more than %d times", nextcloudURL, maxPreflightRedirects)
+}
+
+// sameEndpoint reports whether the redirect from to location stays on the WebDAV endpoint:
+// the same path, ignoring a trailing slash, on the same host, either with the same scheme
+// and port or upgraded from http to https.
+func sameEndpoint(from, location *url.URL) bool {
+	if strings.TrimRight(location.Path, "/") != strings.TrimRight(from.Path, "/") || location.RawQuery != "" {
+		return false
+	}
+	switch {
+	case location.Scheme == from.Scheme:
+		return location.Host == from.Host
+	case from.Scheme == "http" && location.Scheme == "https":
+		return location.Hostname() == from.Hostname()
+	default:
+		return false
+	}
+}
+
+// describeConnectionError turns a transport-level error into an actionable message.
+func describeConnectionError(nextcloudURL string, err error) error {
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("connection to %s was refused, check NEXTCLOUD_URL: %v", nextcloudURL, err)
+	case errors.As(err, &dnsErr):
+		return fmt.Errorf("could not resolve host of %s, check NEXTCLOUD_URL: %v", nextcloudURL, err)
+	case errors.As(err, &recordErr), errors.Is(err, http.ErrSchemeMismatch):
+		return fmt.Errorf("TLS handshake with %s failed, check the URL scheme: %v", nextcloudURL, err)
+	case isCertificateError(err):
+		return fmt.Errorf("certificate of %s could not be verified, set INSECURE_SKIP_VERIFY=true if it is self-signed: %v", nextcloudURL, err)
+	default:
+		return fmt.Errorf("could not reach %s: %v", nextcloudURL, err)
+	}
+}
+
+// remoteQuotaAvailable returns the free space in bytes reported for url. known is false when
+// the server doesn't report it or the quota is unlimited, which Nextcloud reports as a
+// negative number.
+func remoteQuotaAvailable(client *http.Client, url string, auth Authenticator) (available int64, known bool, err error) {
+	req, err := http.NewRequest("PROPFIND", url, strings.NewReader(propfindQuotaBody))
+	if err != nil {
+		return 0, false, err
+	}
+	auth.Authenticate(req)
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := doRequest(client, req, webdavRetryPolicy)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return 0, false, fmt.Errorf("PROPFIND %s returned %s", url, resp.Status)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return 0, false, fmt.Errorf("failed to decode PROPFIND response for %s: %v", url, err)
+	}
+
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.QuotaAvailable == "" {
+				continue
+			}
+			available, err := strconv.ParseInt(ps.Prop.QuotaAvailable, 10, 64)
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid quota %q reported for %s", ps.Prop.QuotaAvailable, url)
+			}
+			return available, available >= 0, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// checkQuota compares the free space on the server with the bytes about to be uploaded, so
+// a run doesn't fail halfway through because the quota ran out. Unless IGNORE_QUOTA is set
+// the run stops when they don't fit.
+func checkQuota(nextcloudURL string, auth Authenticator, totalBytes int64) {
+	client := &http.Client{Transport: newHTTPTransport()}
+	available, known, err := remoteQuotaAvailable(client, nextcloudURL, auth)
+	if err != nil {
+		slog.Warn("Could not read the free space on the server, uploading anyway", "error", err)
+		return
+	}
+	if !known {
+		slog.Warn("The server reports no quota or an unlimited one, uploading without checking the free space")
+		return
+	}
+
+	slog.Info("Free space on the server", "available", formatBytes(available), "needed", formatBytes(totalBytes))
+	if totalBytes <= available {
+		return
+	}
+	if ignoreQuota {
+		slog.Warn("Not enough free space on the server, uploading anyway since IGNORE_QUOTA is set", "available", formatBytes(available), "needed", formatBytes(totalBytes))
+		return
+	}
+	fatal("Not enough free space on the server, free up space or set IGNORE_QUOTA=true", "available", formatBytes(available), "needed", formatBytes(totalBytes))
+}
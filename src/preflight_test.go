@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const preflightPath = "/remote.php/dav/files/alice"
+
+// preflightTarget answers the preflight PROPFIND when it carries alice's credentials and
+// rejects it otherwise.
+func preflightTarget(w http.ResponseWriter, r *http.Request) {
+	if user, password, ok := r.BasicAuth(); !ok || user != "alice" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "PROPFIND" || strings.TrimRight(r.URL.Path, "/") != preflightPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusMultiStatus)
+}
+
+// newPreflightTarget starts a WebDAV endpoint with start, httptest.NewServer or
+// httptest.NewTLSServer, that answers like preflightTarget.
+func newPreflightTarget(t *testing.T, start func(http.Handler) *httptest.Server) *httptest.Server {
+	server := start(http.HandlerFunc(preflightTarget))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newRedirectServer starts a server redirecting every request to target with status.
+func newRedirectServer(t *testing.T, status int, target func(r *http.Request) string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", target(r))
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPreflightCheck(t *testing.T) {
+	auth := basicAuth{username: "alice", password: "secret"}
+	target := newPreflightTarget(t, httptest.NewServer)
+
+	got, err := preflightCheck(target.URL+preflightPath, auth)
+	if err != nil || got != target.URL+preflightPath {
+		t.Errorf("preflightCheck() = %q, %v, want the URL itself", got, err)
+	}
+
+	if _, err := preflightCheck(target.URL+preflightPath, basicAuth{username: "alice", password: "wrong"}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("preflightCheck() with a wrong password error = %v, want the credentials rejected", err)
+	}
+	if _, err := preflightCheck(target.URL+"/remote.php/webdav", auth); err == nil || !strings.Contains(err.Error(), "WebDAV endpoint") {
+		t.Errorf("preflightCheck() of another path error = %v, want not a WebDAV endpoint", err)
+	}
+}
+
+// TestPreflightCheckRedirects checks that a redirect to the same endpoint on https is
+// followed with the credentials and its target returned, and that others are reported.
+func TestPreflightCheckRedirects(t *testing.T) {
+	skipCertificateVerification(t)
+	auth := basicAuth{username: "alice", password: "secret"}
+	secure := newPreflightTarget(t, httptest.NewTLSServer)
+
+	for _, status := range []int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect} {
+		moved := newRedirectServer(t, status, func(r *http.Request) string { return secure.URL + r.URL.Path })
+		got, err := preflightCheck(moved.URL+preflightPath, auth)
+		if err != nil || got != secure.URL+preflightPath {
+			t.Errorf("preflightCheck() redirected with %d = %q, %v, want %q", status, got, err, secure.URL+preflightPath)
+		}
+	}
+
+	// A trailing slash doesn't make it another endpoint
+	slashed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		preflightTarget(w, r)
+	}))
+	t.Cleanup(slashed.Close)
+	if got, err := preflightCheck(slashed.URL+preflightPath, auth); err != nil || got != slashed.URL+preflightPath+"/" {
+		t.Errorf("preflightCheck() redirected with a trailing slash = %q, %v, want %q", got, err, slashed.URL+preflightPath+"/")
+	}
+
+	// A login page or another path can't be uploaded to
+	target := newPreflightTarget(t, httptest.NewServer)
+	for _, location := range []string{target.URL + "/login", target.URL + preflightPath + "?redirect_url=1"} {
+		elsewhere := newRedirectServer(t, http.StatusFound, func(*http.Request) string { return location })
+		if _, err := preflightCheck(elsewhere.URL+preflightPath, auth); err == nil || !strings.Contains(err.Error(), location) {
+			t.Errorf("preflightCheck() redirected to %s error = %v, want one naming the target", location, err)
+		}
+	}
+
+	var loop *httptest.Server
+	loop = newRedirectServer(t, http.StatusFound, func(r *http.Request) string { return loop.URL + r.URL.Path })
+	if _, err := preflightCheck(loop.URL+preflightPath, auth); err == nil || !strings.Contains(err.Error(), "redirects more than") {
+		t.Errorf("preflightCheck() of a redirect loop error = %v, want too many redirects", err)
+	}
+
+	missing := newRedirectServer(t, http.StatusFound, func(*http.Request) string { return "" })
+	if _, err := preflightCheck(missing.URL+preflightPath, auth); err == nil || !strings.Contains(err.Error(), "without a valid Location") {
+		t.Errorf("preflightCheck() of a redirect without Location error = %v, want one", err)
+	}
+}
+
+// TestPreflightCheckRedirectToAnotherHost checks that a redirect to the same path on another
+// host, port or a downgrade to http is reported without sending the credentials there.
+func TestPreflightCheckRedirectToAnotherHost(t *testing.T) {
+	skipCertificateVerification(t)
+	auth := basicAuth{username: "alice", password: "secret"}
+	var credentialsSent atomic.Bool
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			credentialsSent.Store(true)
+		}
+		preflightTarget(w, r)
+	}))
+	t.Cleanup(other.Close)
+	otherURL, err := url.Parse(other.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, location := range map[string]string{
+		"another host":          "http://localhost:" + otherURL.Port() + preflightPath,
+		"another port":          other.URL + preflightPath,
+		"another host on https": "https://localhost:" + otherURL.Port() + preflightPath,
+	} {
+		moved := newRedirectServer(t, http.StatusMovedPermanently, func(*http.Request) string { return location })
+		_, err := preflightCheck(moved.URL+preflightPath, auth)
+		if err == nil || !strings.Contains(err.Error(), "set NEXTCLOUD_URL to") || !strings.Contains(err.Error(), location) {
+			t.Errorf("preflightCheck() redirected to %s error = %v, want NEXTCLOUD_URL to be set to it", name, err)
+		}
+	}
+
+	var downgrade *httptest.Server
+	downgrade = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://"+downgrade.Listener.Addr().String()+r.URL.Path, http.StatusMovedPermanently)
+	}))
+	t.Cleanup(downgrade.Close)
+	if _, err := preflightCheck(downgrade.URL+preflightPath, auth); err == nil || !strings.Contains(err.Error(), "set NEXTCLOUD_URL to") {
+		t.Errorf("preflightCheck() redirected from https to http error = %v, want NEXTCLOUD_URL to be set", err)
+	}
+
+	if credentialsSent.Load() {
+		t.Error("preflightCheck() sent the credentials to the host it was redirected to")
+	}
+}
+
+// TestPreflightCheckCertificate checks that the server's certificate is verified unless
+// INSECURE_SKIP_VERIFY is set, and that https to a plain http server is reported.
+func TestPreflightCheckCertificate(t *testing.T) {
+	fastRetries(t)
+	auth := basicAuth{username: "alice", password: "secret"}
+	secure := newPreflightTarget(t, httptest.NewTLSServer)
+
+	if _, err := preflightCheck(secure.URL+preflightPath, auth); err == nil || !strings.Contains(err.Error(), "INSECURE_SKIP_VERIFY") {
+		t.Errorf("preflightCheck() of a self-signed server error = %v, want INSECURE_SKIP_VERIFY suggested", err)
+	}
+
+	plain := newPreflightTarget(t, httptest.NewServer)
+	plainURL := "https://" + plain.Listener.Addr().String() + preflightPath
+	if _, err := preflightCheck(plainURL, auth); err == nil || !strings.Contains(err.Error(), "check the URL scheme") {
+		t.Errorf("preflightCheck() of https on a plain http server error = %v, want the scheme to be checked", err)
+	}
+
+	skipCertificateVerification(t)
+	if got, err := preflightCheck(secure.URL+preflightPath, auth); err != nil || got != secure.URL+preflightPath {
+		t.Errorf("preflightCheck() with INSECURE_SKIP_VERIFY = %q, %v, want the URL itself", got, err)
+	}
+}
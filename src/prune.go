@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// pruneEmpty is PRUNE_EMPTY: delete the directories created by this run that are still
+// empty once it ends, e.g. because it was interrupted before their files were uploaded.
+var pruneEmpty bool
+
+// pruneEmptyDirs runs the PRUNE_EMPTY cleanup on backend, if it supports it.
+func pruneEmptyDirs(backend UploadBackend) {
+	pruner, ok := backend.(dirPruner)
+	if !ok {
+		slog.Warn("PRUNE_EMPTY is not supported by this backend, keeping empty folders")
+		return
+	}
+	// The run's context may already be cancelled by an interrupt
+	deleted, err := pruner.PruneEmptyDirs(context.Background())
+	if err != nil {
+		slog.Error("Failed to prune empty folders", "error", err)
+	}
+	if deleted > 0 {
+		summaryLogger.Info("Deleted empty folders created by this run", "count", deleted)
+	}
+}
+
+func (b *webdavBackend) PruneEmptyDirs(ctx context.Context) (int, error) {
+	b.dirsMu.Lock()
+	dirs := append([]string(nil), b.createdDirs...)
+	b.dirsMu.Unlock()
+
+	// Children first, so a parent holding nothing but pruned folders is empty by its turn
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], "/") > strings.Count(dirs[j], "/")
+	})
+
+	deleted := 0
+	for _, dir := range dirs {
+		dirURL := remoteURL(b.baseURL, dir)
+		empty, err := b.isEmptyDir(ctx, dirURL)
+		if err != nil {
+			return deleted, err
+		}
+		if !empty {
+			continue
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "DELETE", dirURL, nil)
+		if err != nil {
+			return deleted, err
+		}
+		b.auth.Authenticate(req)
+		if err := b.do(req, http.StatusNoContent, http.StatusOK); err != nil {
+			return deleted, fmt.Errorf("failed to delete empty folder %s: %w", dir, err)
+		}
+		slog.Debug("Deleted empty folder", "dir", dir)
+		b.dirsMu.Lock()
+		delete(b.knownDirs, dir)
+		b.dirsMu.Unlock()
+		deleted++
+	}
+	return deleted, nil
+}
+
+// isEmptyDir reports whether the collection at dirURL has no members.
+func (b *webdavBackend) isEmptyDir(ctx context.Context, dirURL string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", dirURL, strings.NewReader(propfindLastModifiedBody))
+	if err != nil {
+		return false, err
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return false, fmt.Errorf("PROPFIND %s returned %s", dirURL, resp.Status)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return false, fmt.Errorf("failed to decode PROPFIND response for %s: %v", dirURL, err)
+	}
+	// The collection itself is always the first response
+	return len(ms.Responses) <= 1, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proppatchLastModifiedBody sets a file's modification time to a Unix timestamp, which
+// Nextcloud accepts as the writable {DAV:}lastmodified property.
+const proppatchLastModifiedBody = `<?xml version="1.0" encoding="UTF-8"?>
+<d:propertyupdate xmlns:d="DAV:">
+  <d:set>
+    <d:prop>
+      <d:lastmodified>%d</d:lastmodified>
+    </d:prop>
+  </d:set>
+</d:propertyupdate>`
+
+// repairMtime is REPAIR_MTIME: instead of uploading, set the modification time of the files
+// uploaded by earlier runs to that of their local file, as an upload sends in X-OC-Mtime.
+var repairMtime bool
+
+func (b *webdavBackend) ModTime(ctx context.Context, p string) (time.Time, bool, error) {
+	fileURL := remoteURL(b.baseURL, p)
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", fileURL, strings.NewReader(propfindLastModifiedBody))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return time.Time{}, false, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return time.Time{}, false, fmt.Errorf("PROPFIND %s returned %s", fileURL, resp.Status)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to decode PROPFIND response for %s: %v", fileURL, err)
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.LastModified == "" {
+				continue
+			}
+			modTime, err := http.ParseTime(ps.Prop.LastModified)
+			if err != nil {
+				return time.Time{}, false, fmt.Errorf("invalid modification time %q reported for %s", ps.Prop.LastModified, fileURL)
+			}
+			return modTime, true, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("PROPFIND %s did not report a modification time", fileURL)
+}
+
+func (b *webdavBackend) SetModTime(ctx context.Context, p string, modTime time.Time) error {
+	fileURL := remoteURL(b.baseURL, p)
+	body := fmt.Sprintf(proppatchLastModifiedBody, modTime.Unix())
+	req, err := http.NewRequestWithContext(ctx, "PROPPATCH", fileURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return fmt.Errorf("PROPPATCH %s returned %s", fileURL, resp.Status)
+	}
+
+	// The request succeeds as a whole even when the property was refused
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return fmt.Errorf("failed to decode PROPPATCH response for %s: %v", fileURL, err)
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if fields := strings.Fields(ps.Status); len(fields) >= 2 && fields[1] != strconv.Itoa(http.StatusOK) {
+				return fmt.Errorf("server refused to change the modification time of %s: %s", p, ps.Status)
+			}
+		}
+	}
+	return nil
+}
+
+func (b localBackend) ModTime(ctx context.Context, p string) (time.Time, bool, error) {
+	info, err := os.Stat(b.localPath(p))
+	if os.IsNotExist(err) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return info.ModTime(), true, nil
+}
+
+func (b localBackend) SetModTime(ctx context.Context, p string, modTime time.Time) error {
+	return os.Chtimes(b.localPath(p), modTime, modTime)
+}
+
+// repairCounts are the outcome of REPAIR_MTIME.
+type repairCounts struct {
+	corrected, correct, missing, failed atomic.Int64
+}
+
+// repairRemoteMtimes sets the modification time of the remote copy of every planned upload,
+// and of the album copies index records for it, to the local file's. Remote files that don't exist are
+// skipped, ones already showing the right time are left alone.
+func repairRemoteMtimes(ctx context.Context, parallel int, setter modTimeSetter, index *MediaIndex, mediaFiles []MediaFile) *repairCounts {
+	counts := &repairCounts{}
+	slog.Info("Repairing the modification times of uploaded files", "files", len(mediaFiles))
+	jobs := make(chan MediaFile)
+	var wg sync.WaitGroup
+	for range parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for media := range jobs {
+				repairMediaMtime(ctx, setter, index, media, counts)
+			}
+		}()
+	}
+	for _, media := range mediaFiles {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- media
+	}
+	close(jobs)
+	wg.Wait()
+	return counts
+}
+
+// repairMediaMtime repairs the remote copies of a single media file.
+func repairMediaMtime(ctx context.Context, setter modTimeSetter, index *MediaIndex, media MediaFile, counts *repairCounts) {
+	info, err := statMedia(media.Path)
+	if err != nil {
+		slog.Error("Failed to read local file", "file", media.Path, "error", err)
+		counts.failed.Add(1)
+		return
+	}
+
+	targetPath, _ := expectedRemotePath(media)
+	targets := []string{targetPath}
+	for _, folder := range index.AlbumCopies(media.Path) {
+		targets = append(targets, destinationPath(folder, path.Base(targetPath)))
+	}
+
+	for _, target := range targets {
+		modTime, exists, err := setter.ModTime(ctx, target)
+		switch {
+		case err != nil:
+			slog.Error("Failed to read remote modification time", "path", target, "error", err)
+			counts.failed.Add(1)
+		case !exists:
+			slog.Debug("Skipping file missing remotely", "path", target)
+			counts.missing.Add(1)
+		case modTime.Unix() == info.ModTime().Unix():
+			counts.correct.Add(1)
+		default:
+			if err := setter.SetModTime(ctx, target, info.ModTime()); err != nil {
+				slog.Error("Failed to repair modification time", "path", target, "error", err)
+				counts.failed.Add(1)
+				continue
+			}
+			slog.Debug("Repaired modification time", "path", target, "was", modTime, "now", info.ModTime())
+			counts.corrected.Add(1)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+)
+
+// listOnly is LIST_ONLY: index the photos, list the date of every media file and exit
+// without uploading.
+var listOnly bool
+
+// Upload statuses written to the run report.
+const (
+	statusUploaded        = "uploaded"
+	statusFailed          = "failed"
+	statusVerifyFailed    = "verify-failed"
+	statusSkippedExisting = "skipped-existing"
+	statusPreviousRun     = "uploaded-previously"
+	statusNotUploaded     = "not-uploaded"
+	statusMissingRemotely = "missing-remotely"
+	statusSizeMismatch    = "size-mismatch"
+	// statusPanicked marks files whose upload crashed, which are worth reporting as a bug.
+	statusPanicked = "panicked"
+)
+
+// reportHeader is the first row of a run report.
+var reportHeader = []string{"path", "folder", "date_source", "status", "error", "date_discrepancy"}
+
+// legacyReportHeaderLen is the number of columns of reports written before the
+// date_discrepancy column was added, which RETRY_FROM still reads.
+const legacyReportHeaderLen = 5
+
+// retryStatuses are the statuses RETRY_FROM uploads again.
+var retryStatuses = []string{statusFailed, statusVerifyFailed, statusNotUploaded, statusMissingRemotely, statusSizeMismatch, statusPanicked}
+
+// uploadResult is the outcome of a single upload job.
+type uploadResult struct {
+	Status string
+	Error  string
+}
+
+// runReport collects the outcome of every upload job so it can be written as a CSV once
+// the run ends. A nil *runReport is valid and records nothing.
+type runReport struct {
+	mu      sync.Mutex
+	results map[string]uploadResult
+}
+
+// newRunReport returns a report, or nil when path is empty.
+func newRunReport(path string) *runReport {
+	if path == "" {
+		return nil
+	}
+	return &runReport{results: make(map[string]uploadResult)}
+}
+
+// Record stores the outcome of media. err may be nil.
+func (r *runReport) Record(media MediaFile, status string, err error) {
+	if r == nil {
+		return
+	}
+	result := uploadResult{Status: status}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results[manifestKey(media)] = result
+}
+
+// loadRetryJobs reads the run report at path and returns every upload listed in it and the
+// ones that didn't succeed and should be retried. The date sources and discrepancies it
+// lists are recorded in index and the outcome of the others is copied into report, so the
+// report written at the end of the retry still lists every file.
+func loadRetryJobs(path string, index *MediaIndex, report *runReport) ([]MediaFile, []MediaFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open run report %s: %v", path, err)
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read run report %s: %v", path, err)
+	}
+	if len(rows) == 0 || !slices.Equal(rows[0], reportHeader) && !slices.Equal(rows[0], reportHeader[:legacyReportHeaderLen]) {
+		return nil, nil, fmt.Errorf("%s is not a run report written by RUN_REPORT", path)
+	}
+
+	var all, retry []MediaFile
+	for _, row := range rows[1:] {
+		media := MediaFile{row[0], row[1], -1}
+		index.SetDateSource(media.Path, row[2])
+		if len(row) > legacyReportHeaderLen && row[5] != "" {
+			index.SetDiscrepancy(media.Path, row[5])
+		}
+		all = append(all, media)
+
+		if !slices.Contains(retryStatuses, row[3]) {
+			if report != nil {
+				report.mu.Lock()
+				report.results[manifestKey(media)] = uploadResult{Status: row[3], Error: row[4]}
+				report.mu.Unlock()
+			}
+			continue
+		}
+
+		if info, err := statMedia(media.Path); err == nil {
+			media.Size = info.Size()
+		}
+		retry = append(retry, media)
+	}
+	return all, retry, nil
+}
+
+// Write writes one row per planned upload to path: the local file, the remote folder, the
+// source its date came from, the upload status and the error if it failed. Jobs that never
+// ran, e.g. because the run was interrupted, are reported as not uploaded. The date sources
+// and discrepancies come from index.
+func (r *runReport) Write(path string, index *MediaIndex, mediaFiles []MediaFile) error {
+	if r == nil {
+		return nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create run report %s: %v", path, err)
+	}
+	defer file.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	w := csv.NewWriter(file)
+	_ = w.Write(reportHeader)
+	for _, media := range mediaFiles {
+		result, exists := r.results[manifestKey(media)]
+		if !exists {
+			result.Status = statusNotUploaded
+		}
+		_ = w.Write([]string{media.Path, media.Ts, index.DateSource(media.Path), result.Status, result.Error, index.Discrepancy(media.Path)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write run report %s: %v", path, err)
+	}
+	return file.Close()
+}
+
+// writeUnresolvedReport writes every media file whose date could not be determined to path,
+// with the reason and the folder it was put in instead.
+func writeUnresolvedReport(path string, index *MediaIndex) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create unresolved report %s: %v", path, err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	_ = w.Write([]string{"path", "reason", "folder"})
+	for _, mediaPath := range index.UnresolvedPaths() {
+		folder, _ := index.Get(mediaPath)
+		reason, _ := index.Unresolved(mediaPath)
+		_ = w.Write([]string{mediaPath, reason, folder})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write unresolved report %s: %v", path, err)
+	}
+	return file.Close()
+}
+
+// writeDateListing writes a table of every media file in index to w with the date folder
+// it resolved to and the source the date came from: taken, creation, modified, exif,
+// filename or fallback. It returns the number of files listed.
+func writeDateListing(index *MediaIndex, w io.Writer) (int, error) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tDATE\tSOURCE")
+	count := 0
+	index.Range(func(mediaPath, folder string) bool {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", mediaPath, folder, index.DateSource(mediaPath))
+		count++
+		return true
+	})
+	return count, tw.Flush()
+}
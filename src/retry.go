@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides how often and when a failed request is sent again.
+type RetryPolicy struct {
+	// Attempts is the number of times a request is sent at most.
+	Attempts int
+	// Delay is the wait before the second attempt, doubled for each further one up to
+	// MaxDelay. A Retry-After header of the response takes precedence.
+	Delay, MaxDelay time.Duration
+	// Statuses are the response codes worth another attempt. Errors without a response,
+	// such as a reset connection, are always retried, unless the server's certificate
+	// failed verification.
+	Statuses []int
+}
+
+var (
+	// webdavRetryPolicy retries the WebDAV requests around uploads when the server is
+	// briefly overloaded or restarting.
+	webdavRetryPolicy = RetryPolicy{
+		Attempts: 3,
+		Delay:    2 * time.Second,
+		MaxDelay: 30 * time.Second,
+		Statuses: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	}
+	// uploadRetryPolicy also retries a 404, which Nextcloud answers for a PUT into a folder
+	// it hasn't finished creating.
+	uploadRetryPolicy = RetryPolicy{
+		Attempts: 3,
+		Delay:    2 * time.Second,
+		MaxDelay: 30 * time.Second,
+		Statuses: []int{http.StatusNotFound, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	}
+)
+
+// Retryable reports whether a response with status code is worth another attempt.
+func (p RetryPolicy) Retryable(code int) bool {
+	return slices.Contains(p.Statuses, code)
+}
+
+// Wait sleeps before the attempt after attempt, or returns ctx's error if ctx is done first.
+// retryAfter is the response's Retry-After header, if any.
+func (p RetryPolicy) Wait(ctx context.Context, attempt int, retryAfter string) error {
+	delay := p.Delay << (attempt - 1)
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		delay = min(time.Duration(seconds)*time.Second, p.MaxDelay)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// doWithRetry calls send until it returns a response policy doesn't retry or the attempts
+// are used up, and returns that response. Cancelling ctx stops waiting for the next attempt.
+func doWithRetry(ctx context.Context, send func() (*http.Response, error), policy RetryPolicy) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := send()
+		if ctx.Err() != nil || attempt >= policy.Attempts {
+			return resp, err
+		}
+
+		retryAfter := ""
+		switch {
+		case err != nil && isCertificateError(err):
+			return resp, err
+		case err != nil:
+			slog.Debug("Request failed, retrying", "attempt", attempt, "error", err)
+		case policy.Retryable(resp.StatusCode):
+			slog.Debug("Request failed, retrying", "attempt", attempt, "method", resp.Request.Method, "url", resp.Request.URL, "status", resp.Status)
+			retryAfter = resp.Header.Get("Retry-After")
+			// Let the connection be reused
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+
+		if err := policy.Wait(ctx, attempt, retryAfter); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isCertificateError reports whether err is the server's certificate failing verification,
+// which another attempt doesn't change.
+func isCertificateError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	return errors.As(err, &certErr) || errors.As(err, &unknownAuthErr)
+}
+
+// doRequest sends req with client, retrying as policy allows. A request whose body can't
+// be read again, such as a streamed upload, is only sent once.
+func doRequest(client *http.Client, req *http.Request, policy RetryPolicy) (*http.Response, error) {
+	if req.Body != nil && req.GetBody == nil {
+		return client.Do(req)
+	}
+
+	first := true
+	return doWithRetry(req.Context(), func() (*http.Response, error) {
+		if first {
+			first = false
+			return client.Do(req)
+		}
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, errors.Join(errors.New("failed to rewind request body"), err)
+			}
+			retry.Body = body
+		}
+		return client.Do(retry)
+	}, policy)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRetryPolicy retries 429s and 503s without waiting noticeably.
+var testRetryPolicy = RetryPolicy{
+	Attempts: 3,
+	Delay:    time.Millisecond,
+	MaxDelay: time.Millisecond,
+	Statuses: []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+}
+
+// newRetryServer answers each request with the next of statuses, and the last one after
+// them, and records the bodies it received.
+func newRetryServer(t *testing.T, statuses ...int) (*httptest.Server, *[]string) {
+	t.Helper()
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		status := statuses[min(len(bodies), len(statuses))-1]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &bodies
+}
+
+func TestDoRequestRetriesServerErrors(t *testing.T) {
+	server, bodies := newRetryServer(t, http.StatusServiceUnavailable, http.StatusOK)
+	req, err := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("photo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := doRequest(server.Client(), req, testRetryPolicy)
+	if err != nil {
+		t.Fatalf("doRequest() failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("doRequest() status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	// The body must be sent again with the second attempt
+	if len(*bodies) != 2 || (*bodies)[1] != "photo" {
+		t.Errorf("server received %q, want the body twice", *bodies)
+	}
+}
+
+// TestDoRequestRetryAfter checks a 429's Retry-After header takes precedence over the
+// policy's shorter delay.
+func TestDoRequestRetryAfter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for Retry-After")
+	}
+	server, bodies := newRetryServer(t, http.StatusTooManyRequests, http.StatusOK)
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := testRetryPolicy
+	policy.MaxDelay = 5 * time.Second
+
+	start := time.Now()
+	resp, err := doRequest(server.Client(), req, policy)
+	if err != nil {
+		t.Fatalf("doRequest() failed: %v", err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("doRequest() retried after %v, want the Retry-After of 1s", elapsed)
+	}
+	if resp.StatusCode != http.StatusOK || len(*bodies) != 2 {
+		t.Errorf("doRequest() = %d after %d attempts, want %d after 2", resp.StatusCode, len(*bodies), http.StatusOK)
+	}
+}
+
+func TestDoRequestGivesUp(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantAttempts int
+	}{
+		{"not retryable", http.StatusForbidden, 1},
+		{"attempts used up", http.StatusServiceUnavailable, 3},
+	}
+	for _, tt := range tests {
+		server, bodies := newRetryServer(t, tt.status)
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := doRequest(server.Client(), req, testRetryPolicy)
+		if err != nil {
+			t.Fatalf("%s: doRequest() failed: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: doRequest() status = %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		if len(*bodies) != tt.wantAttempts {
+			t.Errorf("%s: server received %d attempts, want %d", tt.name, len(*bodies), tt.wantAttempts)
+		}
+	}
+}
+
+// TestDoRequestStreamedBody checks a body that can't be read again is only sent once.
+func TestDoRequestStreamedBody(t *testing.T) {
+	server, bodies := newRetryServer(t, http.StatusServiceUnavailable)
+	req, err := http.NewRequest(http.MethodPut, server.URL, io.NopCloser(strings.NewReader("photo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := doRequest(server.Client(), req, testRetryPolicy)
+	if err != nil {
+		t.Fatalf("doRequest() failed: %v", err)
+	}
+	resp.Body.Close()
+	if len(*bodies) != 1 {
+		t.Errorf("server received %d attempts, want 1", len(*bodies))
+	}
+}
+
+func TestDoWithRetryRetriesErrors(t *testing.T) {
+	attempts := 0
+	resp, err := doWithRetry(context.Background(), func() (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, errors.New("connection reset by peer")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}, testRetryPolicy)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("doWithRetry() = %v, %v, want 200", resp, err)
+	}
+	if attempts != 2 {
+		t.Errorf("doWithRetry() made %d attempts, want 2", attempts)
+	}
+}
+
+// TestDoWithRetryCancelledWhileWaiting cancels the context while waiting for the second
+// attempt, which must return at once with the context's error.
+func TestDoWithRetryCancelledWhileWaiting(t *testing.T) {
+	server, bodies := newRetryServer(t, http.StatusServiceUnavailable)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := testRetryPolicy
+	policy.Delay, policy.MaxDelay = time.Hour, time.Hour
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	resp, err := doRequest(server.Client(), req, policy)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("doRequest() = %v, %v, want %v", resp, err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("doRequest() returned after %v, want right after cancelling", elapsed)
+	}
+	if len(*bodies) != 1 {
+		t.Errorf("server received %d attempts, want 1", len(*bodies))
+	}
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	policy := RetryPolicy{Delay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := policy.Wait(ctx, 1, ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+
+	// A Retry-After of 0 asks for no delay
+	done := make(chan error, 1)
+	go func() { done <- policy.Wait(context.Background(), 1, "0") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wait() = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Wait() with Retry-After: 0 didn't return")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Extensions of the built-in ROUTE_RULES groups. Files matching neither are "other".
+const (
+	routeVideoExt = "mp4,mov,m4v,avi,mkv,3gp,mts,mpg,wmv"
+	routeImageExt = "jpg,jpeg,mp,png,heic,heif,gif,webp,bmp,tif,tiff,dng"
+)
+
+// routeRule sends the media files matching patterns, or every file for the "other" group,
+// into a folder below prefix.
+type routeRule struct {
+	patterns []string
+	other    bool
+	prefix   string
+}
+
+// routeRules are the ROUTE_RULES, extension rules first, then the groups.
+var routeRules []routeRule
+
+// parseRouteRules parses a comma-separated ROUTE_RULES value of match=prefix rules, such as
+// "videos=Videos,images=Photos". match is one of the groups videos, images and other, or
+// extensions joined by "+" such as "heic+heif", which take precedence over the groups.
+func parseRouteRules(value string) ([]routeRule, error) {
+	var extRules, groupRules []routeRule
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		match, prefix, ok := strings.Cut(item, "=")
+		prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+		if !ok || prefix == "" || strings.Contains(prefix, `\`) || path.Clean(prefix) != prefix || strings.HasPrefix(prefix, "..") {
+			return nil, fmt.Errorf("invalid rule %q, must be group=folder", item)
+		}
+
+		switch match = strings.ToLower(strings.TrimSpace(match)); match {
+		case "videos":
+			groupRules = append(groupRules, routeRule{patterns: parsePatterns(routeVideoExt), prefix: prefix})
+		case "images":
+			groupRules = append(groupRules, routeRule{patterns: parsePatterns(routeImageExt), prefix: prefix})
+		case "other":
+			groupRules = append(groupRules, routeRule{other: true, prefix: prefix})
+		default:
+			patterns := parsePatterns(strings.ReplaceAll(match, "+", ","))
+			if len(patterns) == 0 {
+				return nil, fmt.Errorf("invalid rule %q, must be group=folder", item)
+			}
+			extRules = append(extRules, routeRule{patterns: patterns, prefix: prefix})
+		}
+	}
+
+	// "other" only gets what no other rule took
+	var otherRules []routeRule
+	rules := extRules
+	for _, rule := range groupRules {
+		if rule.other {
+			otherRules = append(otherRules, rule)
+		} else {
+			rules = append(rules, rule)
+		}
+	}
+	return append(rules, otherRules...), nil
+}
+
+// routeFolder puts folder below the ROUTE_RULES prefix of mediaPath, if a rule matches it.
+func routeFolder(mediaPath, folder string) string {
+	name := filepath.Base(mediaPath)
+	for _, rule := range routeRules {
+		if rule.other || matchesAny(name, rule.patterns) {
+			return strings.TrimSuffix(rule.prefix+"/"+folder, "/")
+		}
+	}
+	return folder
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseRouteRules(t *testing.T) {
+	rules, err := parseRouteRules(" other=Misc, videos=Videos/ ,HEIC+heif=Photos/HEIC,images=/Photos,")
+	if err != nil {
+		t.Fatalf("parseRouteRules() error = %v", err)
+	}
+	// Extension rules first, then the groups, with other last
+	var prefixes []string
+	for _, rule := range rules {
+		prefixes = append(prefixes, rule.prefix)
+	}
+	if want := []string{"Photos/HEIC", "Videos", "Photos", "Misc"}; !slices.Equal(prefixes, want) {
+		t.Errorf("rule prefixes = %q, want %q", prefixes, want)
+	}
+	if !slices.Equal(rules[0].patterns, []string{"*.heic", "*.heif"}) {
+		t.Errorf("extension rule patterns = %q, want *.heic and *.heif", rules[0].patterns)
+	}
+	if !rules[3].other {
+		t.Error("the other rule doesn't match every file")
+	}
+
+	if rules, err := parseRouteRules(""); err != nil || len(rules) != 0 {
+		t.Errorf("parseRouteRules(\"\") = %v, %v, want no rules", rules, err)
+	}
+
+	for _, value := range []string{
+		"videos",
+		"videos=",
+		"videos=/",
+		"=Videos",
+		"+=Videos",
+		"videos=../Videos",
+		"videos=Videos/../..",
+		`videos=Videos\Clips`,
+		"videos=Videos//Clips",
+	} {
+		if _, err := parseRouteRules(value); err == nil {
+			t.Errorf("parseRouteRules(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestRouteFolder(t *testing.T) {
+	oldRules := routeRules
+	t.Cleanup(func() { routeRules = oldRules })
+
+	var err error
+	if routeRules, err = parseRouteRules("videos=Videos,images=Photos,heic=Photos/HEIC"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mediaPath, folder, want string
+	}{
+		{"/takeout/IMG_0001.jpg", "2024/03", "Photos/2024/03"},
+		{"/takeout/IMG_0002.HEIC", "2024/03", "Photos/HEIC/2024/03"},
+		{"/takeout/VID_0001.MP4", "2024/03", "Videos/2024/03"},
+		// No rule takes these without an other rule
+		{"/takeout/notes.txt", "2024/03", "2024/03"},
+		// The flat folder of ORGANIZE_BY=none may be the root
+		{"/takeout/VID_0001.mp4", "", "Videos"},
+	}
+	for _, tt := range tests {
+		if got := routeFolder(tt.mediaPath, tt.folder); got != tt.want {
+			t.Errorf("routeFolder(%q, %q) = %q, want %q", tt.mediaPath, tt.folder, got, tt.want)
+		}
+	}
+
+	if routeRules, err = parseRouteRules("videos=Videos,other=Other"); err != nil {
+		t.Fatal(err)
+	}
+	if got := routeFolder("/takeout/IMG_0001.jpg", "2024/03"); got != "Other/2024/03" {
+		t.Errorf("routeFolder() of a photo = %q, want Other/2024/03", got)
+	}
+}
+
+// TestPlanUploadsRoutes checks that the date and flat folders of planned uploads are put
+// below the ROUTE_RULES prefix of each file.
+func TestPlanUploadsRoutes(t *testing.T) {
+	oldRules, oldOrganizeBy, oldFlatFolder := routeRules, organizeBy, flatFolder
+	t.Cleanup(func() { routeRules, organizeBy, flatFolder = oldRules, oldOrganizeBy, oldFlatFolder })
+
+	var err error
+	if routeRules, err = parseRouteRules("videos=Videos,images=Photos"); err != nil {
+		t.Fatal(err)
+	}
+	index := newMediaIndex()
+	index.Add("/takeout/IMG_0001.jpg", "2024/03")
+	index.Add("/takeout/VID_0001.mp4", "2024/04")
+
+	tests := []struct {
+		organizeBy, flatFolder string
+		want                   []string
+	}{
+		{"date", "", []string{"Photos/2024/03", "Videos/2024/04"}},
+		{"none", "", []string{"Photos", "Videos"}},
+		{"none", "Takeout", []string{"Photos/Takeout", "Videos/Takeout"}},
+	}
+	for _, tt := range tests {
+		organizeBy, flatFolder = tt.organizeBy, tt.flatFolder
+		var folders []string
+		for _, job := range planUploads(index) {
+			folders = append(folders, job.Ts)
+		}
+		if !slices.Equal(folders, tt.want) {
+			t.Errorf("ORGANIZE_BY=%s FLAT_FOLDER=%q folders = %q, want %q", tt.organizeBy, tt.flatFolder, folders, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// Reasons files are skipped, as broken down in the final summary.
+const (
+	skipExisting      = "already-exists"
+	skipPreviousRun   = "previous-run"
+	skipDateRange     = "outside-date-range"
+	skipUnknownDate   = "unknown-date"
+	skipExcludedExt   = "excluded-extension"
+	skipIgnored       = "ignored"
+	skipTakeoutFolder = "trash-or-archive"
+	skipDuplicate     = "duplicate"
+	skipEmpty         = "empty"
+	skipTooLarge      = "too-large"
+	skipNotNew        = "before-last-run"
+)
+
+// skipCounter counts skipped files by reason. It is safe for concurrent use.
+type skipCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var skippedByReason = &skipCounter{counts: make(map[string]int)}
+
+// Add counts n files skipped for reason.
+func (s *skipCounter) Add(reason string, n int) {
+	if n == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[reason] += n
+}
+
+// Count returns the number of files skipped for reason.
+func (s *skipCounter) Count(reason string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[reason]
+}
+
+// Total returns the number of skipped files.
+func (s *skipCounter) Total() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int64
+	for _, n := range s.counts {
+		total += int64(n)
+	}
+	return total
+}
+
+// LogSummary logs the number of skipped files for every reason that occurred, so a gap
+// between the files in the export and the uploaded ones can be accounted for.
+func (s *skipCounter) LogSummary(logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.counts) == 0 {
+		return
+	}
+
+	reasons := make([]string, 0, len(s.counts))
+	for reason := range s.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	total := 0
+	args := make([]any, 0, 2*len(reasons)+2)
+	for _, reason := range reasons {
+		args = append(args, reason, s.counts[reason])
+		total += s.counts[reason]
+	}
+	logger.Info("Skipped files", append([]any{"total", total}, args...)...)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// runState is persisted in STATE_FILE between runs so expensive work such as content
+// hashing doesn't have to be repeated.
+type runState struct {
+	mu             sync.Mutex
+	Hashes         map[string]hashCacheEntry `json:"hashes"`
+	UploadSessions map[string]uploadSession  `json:"uploadSessions,omitempty"`
+	// LastRun is when the last run that indexed and uploaded every file started.
+	LastRun time.Time `json:"lastRun,omitzero"`
+}
+
+// hashCacheEntry is a content hash of a file, valid as long as size and mtime still match.
+type hashCacheEntry struct {
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	Algorithm string    `json:"algorithm"`
+	Hash      string    `json:"hash"`
+}
+
+var (
+	statePath string
+	state     = &runState{Hashes: make(map[string]hashCacheEntry), UploadSessions: make(map[string]uploadSession)}
+	// stateFileMu serializes saveState, which upload workers call for chunked uploads.
+	stateFileMu sync.Mutex
+)
+
+// loadState reads STATE_FILE if it exists.
+func loadState(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return fmt.Errorf("failed to parse state file %s: %v", path, err)
+	}
+	if state.Hashes == nil {
+		state.Hashes = make(map[string]hashCacheEntry)
+	}
+	if state.UploadSessions == nil {
+		state.UploadSessions = make(map[string]uploadSession)
+	}
+	return nil
+}
+
+// saveState writes the state to STATE_FILE, replacing it atomically.
+func saveState(path string) error {
+	if path == "" {
+		return nil
+	}
+	stateFileMu.Lock()
+	defer stateFileMu.Unlock()
+
+	state.mu.Lock()
+	data, err := json.MarshalIndent(state, "", "  ")
+	state.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write state file %s: %v", path, err)
+	}
+	return os.Rename(tmpPath, path)
+}
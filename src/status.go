@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+)
+
+// uploadProgress tracks the upload phase for the status printed on SIGUSR1.
+type uploadProgress struct {
+	start      time.Time
+	totalFiles int64
+	totalBytes int64
+	doneFiles  atomic.Int64
+	doneBytes  atomic.Int64
+}
+
+func newUploadProgress(files int, bytes int64) *uploadProgress {
+	return &uploadProgress{start: time.Now(), totalFiles: int64(files), totalBytes: bytes}
+}
+
+// Done counts media as processed, whatever the outcome.
+func (p *uploadProgress) Done(media MediaFile) {
+	p.doneFiles.Add(1)
+	if media.Size > 0 {
+		p.doneBytes.Add(media.Size)
+	}
+}
+
+// logStatus logs a snapshot of the progress. The rate is averaged over the upload so far,
+// which is also what the ETA assumes.
+func (p *uploadProgress) logStatus() {
+	doneFiles, doneBytes := p.doneFiles.Load(), p.doneBytes.Load()
+	elapsed := time.Since(p.start)
+	rate := float64(doneBytes) / elapsed.Seconds()
+
+	eta := "unknown"
+	if remaining := p.totalBytes - doneBytes; rate > 0 {
+		eta = (time.Duration(float64(remaining)/rate) * time.Second).Round(time.Second).String()
+	}
+	summaryLogger.Info("Upload status",
+		"doneFiles", doneFiles, "remainingFiles", p.totalFiles-doneFiles,
+		"doneBytes", formatBytes(doneBytes), "remainingBytes", formatBytes(p.totalBytes-doneBytes),
+		"rate", formatBytes(int64(rate))+"/s", "elapsed", elapsed.Round(time.Second), "eta", eta,
+		"failed", failedCounter.Load())
+}
+
+// handleStatusSignal logs the status of p whenever the process receives statusSignals, until
+// the returned stop is called. It does nothing on platforms without such a signal.
+func handleStatusSignal(p *uploadProgress) func() {
+	if len(statusSignals) == 0 {
+		return func() {}
+	}
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, statusSignals...)
+	go func() {
+		for {
+			select {
+			case <-signals:
+				p.logStatus()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
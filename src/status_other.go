@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// statusSignals is empty since this platform has no SIGUSR1.
+var statusSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals print the upload status, see handleStatusSignal.
+var statusSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// followSymlinks is FOLLOW_SYMLINKS: walk into symlinked directories of PHOTOS_DIR.
+var followSymlinks bool
+
+// walkFollowingSymlinks walks root like filepath.Walk, but follows symlinks to directories.
+// Paths keep the name of the link, not of its target. Every directory is walked once: a
+// link back to one of its own parents is a cycle, which is reported and not followed, and
+// a directory reached again through another link is skipped.
+func walkFollowingSymlinks(root string, fn filepath.WalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	w := &symlinkWalker{fn: fn, visited: make(map[string]bool), ancestors: make(map[string]bool)}
+	err = w.walk(root, info)
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+type symlinkWalker struct {
+	fn filepath.WalkFunc
+	// visited are the real paths of every directory walked, ancestors those of the
+	// directories the walk is currently inside of.
+	visited, ancestors map[string]bool
+}
+
+func (w *symlinkWalker) walk(path string, info fs.FileInfo) error {
+	if !info.IsDir() {
+		return w.fn(path, info, nil)
+	}
+
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return w.fn(path, info, err)
+	}
+	if w.ancestors[realPath] {
+		slog.Warn("Symlink cycle detected, not following the link", "path", path, "target", realPath)
+		return nil
+	}
+	if w.visited[realPath] {
+		slog.Info("Directory was already walked through another path, skipping", "path", path, "target", realPath)
+		return nil
+	}
+	w.visited[realPath] = true
+
+	if err := w.fn(path, info, nil); err != nil {
+		if errors.Is(err, filepath.SkipDir) {
+			return nil
+		}
+		return err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return w.fn(path, info, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	w.ancestors[realPath] = true
+	defer delete(w.ancestors, realPath)
+	for _, name := range names {
+		childPath := filepath.Join(path, name)
+		// Stat follows the link, so a symlinked directory is walked like a real one
+		childInfo, err := os.Stat(childPath)
+		if err != nil {
+			if err := w.fn(childPath, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.walk(childPath, childInfo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
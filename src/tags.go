@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Placeholders in APPLY_TAGS for the names of a file's albums and of the people in it.
+const (
+	tagAlbums = "{album}"
+	tagPeople = "{people}"
+)
+
+// applyTags are the APPLY_TAGS attached to every uploaded file.
+var applyTags []string
+
+// parseApplyTags splits a comma-separated APPLY_TAGS value such as
+// "imported-from-google,{album},{people}".
+func parseApplyTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return slices.Compact(tags)
+}
+
+// fileTags returns the APPLY_TAGS of the media file at mediaPath with the placeholders
+// replaced by its albums and people as recorded in index. A placeholder the file has no
+// names for is dropped.
+func fileTags(index *MediaIndex, mediaPath string) []string {
+	var tags []string
+	for _, tag := range applyTags {
+		switch tag {
+		case tagAlbums:
+			tags = append(tags, albumTitles(index, mediaPath)...)
+		case tagPeople:
+			tags = append(tags, index.People(mediaPath)...)
+		default:
+			tags = append(tags, tag)
+		}
+	}
+	slices.Sort(tags)
+	return slices.Compact(tags)
+}
+
+// applyFileTags attaches the APPLY_TAGS of media to the file uploaded to remotePath. The
+// tags are an extra, so failing to attach one is logged but doesn't fail the upload.
+func applyFileTags(ctx context.Context, backend UploadBackend, index *MediaIndex, media MediaFile, remotePath string) {
+	tagger, ok := backend.(fileTagger)
+	if !ok {
+		return
+	}
+	for _, tag := range fileTags(index, media.Path) {
+		if err := tagger.Tag(ctx, remotePath, tag); err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("Failed to tag file", "file", remotePath, "tag", tag, "error", err)
+			}
+			continue
+		}
+		slog.Debug("Tagged file", "file", remotePath, "tag", tag)
+	}
+}
+
+const propfindTagsBody = `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop>
+    <oc:id/>
+    <oc:display-name/>
+  </d:prop>
+</d:propfind>`
+
+const propfindFileIDBody = `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop>
+    <oc:fileid/>
+  </d:prop>
+</d:propfind>`
+
+// tagCache maps the names of Nextcloud's collaborative tags to their ids. The server's tags
+// are listed once and tags created by this run are added. fileIDs holds the ids of the
+// files uploaded in this run, as returned by the server, so tagging them needs no PROPFIND.
+type tagCache struct {
+	mu      sync.Mutex
+	ids     map[string]string
+	loaded  bool
+	fileIDs sync.Map
+}
+
+// Tag attaches the collaborative tag named tag to the file at path, creating the tag if
+// it doesn't exist yet. It needs a NEXTCLOUD_URL of the form ".../remote.php/dav/files/<user>".
+func (b *webdavBackend) Tag(ctx context.Context, path, tag string) error {
+	if b.davRoot == "" {
+		return errors.New("tagging needs BACKEND=nextcloud and a NEXTCLOUD_URL ending in /remote.php/dav/files/<username>")
+	}
+
+	tagID, err := b.tagID(ctx, tag)
+	if err != nil {
+		return err
+	}
+	fileID, err := b.fileID(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", remoteURL(b.davRoot, "systemtags-relations/files", fileID, tagID), nil)
+	if err != nil {
+		return err
+	}
+	b.auth.Authenticate(req)
+	// Conflict means the file already has the tag
+	return b.do(req, http.StatusCreated, http.StatusConflict)
+}
+
+// tagID returns the id of the tag named name, creating the tag if needed.
+func (b *webdavBackend) tagID(ctx context.Context, name string) (string, error) {
+	b.tags.mu.Lock()
+	defer b.tags.mu.Unlock()
+
+	if !b.tags.loaded {
+		if err := b.loadTags(ctx); err != nil {
+			return "", err
+		}
+	}
+	if id, ok := b.tags.ids[name]; ok {
+		return id, nil
+	}
+
+	body, err := json.Marshal(map[string]any{"name": name, "userVisible": true, "userAssignable": true})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", remoteURL(b.davRoot, "systemtags"), strings.NewReader(string(body)))
+	if err != nil {
+		return "", err
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		// The new tag's URL ends in its id
+		id := path.Base(resp.Header.Get("Content-Location"))
+		if id == "." || id == "/" {
+			return "", fmt.Errorf("server did not return the id of the new tag %q", name)
+		}
+		b.tags.ids[name] = id
+		return id, nil
+	case http.StatusConflict:
+		// Created by someone else since the tags were listed
+		if err := b.loadTags(ctx); err != nil {
+			return "", err
+		}
+		if id, ok := b.tags.ids[name]; ok {
+			return id, nil
+		}
+		return "", fmt.Errorf("tag %q exists but is not visible to this user", name)
+	default:
+		return "", fmt.Errorf("failed to create tag %q: server returned %s", name, resp.Status)
+	}
+}
+
+// loadTags lists the server's collaborative tags into the cache. b.tags.mu must be held.
+func (b *webdavBackend) loadTags(ctx context.Context) error {
+	url := remoteURL(b.davRoot, "systemtags")
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", url, strings.NewReader(propfindTagsBody))
+	if err != nil {
+		return err
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return fmt.Errorf("PROPFIND %s returned %s", url, resp.Status)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return fmt.Errorf("failed to decode PROPFIND response for %s: %v", url, err)
+	}
+
+	b.tags.ids = make(map[string]string)
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.TagID != "" && ps.Prop.DisplayName != "" {
+				b.tags.ids[ps.Prop.DisplayName] = ps.Prop.TagID
+			}
+		}
+	}
+	b.tags.loaded = true
+	return nil
+}
+
+// recordFileID remembers the file id of an upload to path from the response's OC-FileId
+// header, which Nextcloud formats as the zero-padded id followed by its instance id.
+func (b *webdavBackend) recordFileID(path, header string) {
+	end := strings.IndexFunc(header, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(header)
+	}
+	id, err := strconv.ParseUint(header[:end], 10, 64)
+	if err != nil {
+		return
+	}
+	b.tags.fileIDs.Store(path, strconv.FormatUint(id, 10))
+}
+
+// fileID returns Nextcloud's id of the file at path, which tags are attached to.
+func (b *webdavBackend) fileID(ctx context.Context, path string) (string, error) {
+	if id, ok := b.tags.fileIDs.Load(path); ok {
+		return id.(string), nil
+	}
+
+	url := remoteURL(b.baseURL, path)
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", url, strings.NewReader(propfindFileIDBody))
+	if err != nil {
+		return "", err
+	}
+	b.auth.Authenticate(req)
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := doRequest(b.client, req, webdavRetryPolicy)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return "", fmt.Errorf("PROPFIND %s returned %s", url, resp.Status)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return "", fmt.Errorf("failed to decode PROPFIND response for %s: %v", url, err)
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.FileID != "" {
+				return ps.Prop.FileID, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("PROPFIND %s did not report a file id", url)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// bandwidthLimiter is a token bucket shared by all upload workers, so that
+// MAX_UPLOAD_BYTES_PER_SEC caps the combined upload rate rather than the rate per worker.
+type bandwidthLimiter struct {
+	mu       sync.Mutex
+	rate     float64 // bytes per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+var uploadLimiter *bandwidthLimiter
+
+// newBandwidthLimiter returns a limiter allowing bytesPerSec, or nil if bytesPerSec <= 0.
+// The bucket holds one second worth of bytes.
+func newBandwidthLimiter(bytesPerSec int64) *bandwidthLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{
+		rate:     float64(bytesPerSec),
+		capacity: float64(bytesPerSec),
+		tokens:   float64(bytesPerSec),
+		last:     time.Now(),
+	}
+}
+
+// wait blocks until n bytes may be sent, or ctx is done.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.capacity {
+		l.tokens = l.capacity
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledReader paces reads from r through a shared bandwidthLimiter.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Never ask for more than the bucket can ever hold, or a read could wait forever
+	if max := int(t.limiter.capacity); len(p) > max {
+		p = p[:max]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if waitErr := t.limiter.wait(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
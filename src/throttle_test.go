@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewBandwidthLimiterDisabled(t *testing.T) {
+	for _, rate := range []int64{0, -1} {
+		if l := newBandwidthLimiter(rate); l != nil {
+			t.Errorf("newBandwidthLimiter(%d) = %+v, want nil", rate, l)
+		}
+	}
+}
+
+// TestThrottledReaderShapesThroughput reads a known payload through the limiter, alone and
+// split across workers sharing it, and checks the time it takes. The bucket starts full, so
+// the first second worth of bytes passes at once.
+func TestThrottledReaderShapesThroughput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures elapsed time")
+	}
+	const rate, payload = 200_000, 300_000
+	// (payload - rate) / rate
+	const want = 500 * time.Millisecond
+
+	for _, workers := range []int{1, 3} {
+		limiter := newBandwidthLimiter(rate)
+		start := time.Now()
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := &throttledReader{ctx: context.Background(), r: bytes.NewReader(make([]byte, payload/workers)), limiter: limiter}
+				n, err := io.Copy(io.Discard, r)
+				if err == nil && n != int64(payload/workers) {
+					err = io.ErrShortWrite
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("%d workers: read error = %v", workers, err)
+			}
+		}
+
+		elapsed := time.Since(start)
+		if elapsed < want-50*time.Millisecond || elapsed > want+400*time.Millisecond {
+			t.Errorf("%d workers: reading %d bytes at %d bytes/s took %v, want about %v", workers, payload, rate, elapsed, want)
+		}
+	}
+}
+
+func TestThrottledReaderCancelled(t *testing.T) {
+	limiter := newBandwidthLimiter(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := &throttledReader{ctx: ctx, r: bytes.NewReader(make([]byte, 5000)), limiter: limiter}
+
+	start := time.Now()
+	_, err := io.Copy(io.Discard, r)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("read error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled read took %v", elapsed)
+	}
+}
+
+// TestThrottledReaderCapsReads checks that a read never asks for more than the bucket holds,
+// which would wait forever for tokens it can't collect.
+func TestThrottledReaderCapsReads(t *testing.T) {
+	limiter := newBandwidthLimiter(100)
+	r := &throttledReader{ctx: context.Background(), r: bytes.NewReader(make([]byte, 1000)), limiter: limiter}
+	n, err := r.Read(make([]byte, 1000))
+	if err != nil || n != 100 {
+		t.Errorf("Read() = %d, %v, want 100 bytes", n, err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// userPrefix starts the first folder of the jobs planned for a USER_MAP destination, e.g.
+// "@alice/2020/01". userBackend strips it again and uploads into alice's account.
+const userPrefix = "@"
+
+// userDestination is a USER_MAP entry: the media files below Source, a folder below
+// PHOTOS_DIR, are uploaded into another Nextcloud account than NEXTCLOUD_URL's.
+type userDestination struct {
+	Source       string `yaml:"source"`
+	URL          string `yaml:"url"`
+	User         string `yaml:"user"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	AuthMode     string `yaml:"auth_mode"`
+	Token        string `yaml:"token"`
+
+	auth Authenticator
+}
+
+// userDestinations are the USER_MAP entries, in the order of the file.
+var userDestinations []*userDestination
+
+// loadUserMap reads the USER_MAP file, a YAML list of destinations with the keys of
+// userDestination's tags, and sets up their credentials.
+func loadUserMap(file string) ([]*userDestination, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var destinations []*userDestination
+	if err := yaml.Unmarshal(data, &destinations); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+
+	urls := make(map[string]string)
+	for i, d := range destinations {
+		d.Source = strings.Trim(filepath.ToSlash(d.Source), "/")
+		if d.Source == "" || d.URL == "" || d.User == "" {
+			return nil, fmt.Errorf("entry %d needs source, url and user", i+1)
+		}
+		if strings.ContainsAny(d.User, "/\\") {
+			return nil, fmt.Errorf("invalid user %q", d.User)
+		}
+		if url, ok := urls[d.User]; ok && url != d.URL {
+			return nil, fmt.Errorf("user %q is mapped to two URLs", d.User)
+		}
+		urls[d.User] = d.URL
+
+		if _, user := stripURLCredentials(d.URL); user != nil {
+			return nil, fmt.Errorf("url of user %q contains credentials, use password_file instead", d.User)
+		}
+		password, err := readPassword(false, d.PasswordFile, d.Password)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %v", d.User, err)
+		}
+		if d.auth, err = newAuthenticator(d.AuthMode, d.User, password, d.Token); err != nil {
+			return nil, fmt.Errorf("user %q: %v", d.User, err)
+		}
+	}
+	return destinations, nil
+}
+
+// assignUsers moves the jobs of media files below a USER_MAP source, and the album folders
+// they are copied into as recorded in index, below the prefix of its user. photosDirs are
+// the roots sources are relative to. Nested sources are matched most specific first.
+func assignUsers(index *MediaIndex, jobs []MediaFile, photosDirs []string) {
+	if len(userDestinations) == 0 {
+		return
+	}
+
+	userOf := func(mediaPath string) string {
+		user, longest := "", 0
+		for _, d := range userDestinations {
+			for _, dir := range photosDirs {
+				source := filepath.Join(dir, filepath.FromSlash(d.Source))
+				if isBelowAny(mediaPath, []string{source}) && len(source) > longest {
+					user, longest = d.User, len(source)
+				}
+			}
+		}
+		return user
+	}
+
+	prefixed := make(map[string]bool)
+	for i, job := range jobs {
+		user := userOf(job.Path)
+		if user == "" {
+			continue
+		}
+		jobs[i].Ts = path.Join(userPrefix+user, job.Ts)
+		if prefixed[job.Path] {
+			continue
+		}
+		prefixed[job.Path] = true
+		folders := index.AlbumCopies(job.Path)
+		for j, folder := range folders {
+			folders[j] = path.Join(userPrefix+user, folder)
+		}
+		index.SetAlbumCopies(job.Path, folders)
+	}
+}
+
+// userBackend uploads paths starting with a user prefix to that user's backend, and all
+// other paths to the default backend of NEXTCLOUD_URL.
+type userBackend struct {
+	fallback UploadBackend
+	users    map[string]UploadBackend
+}
+
+// newUserBackend wraps fallback with a backend for every destination, rooted at basePath
+// in the destination's account like fallback is in NEXTCLOUD_URL's.
+func newUserBackend(ctx context.Context, name string, fallback UploadBackend, destinations []*userDestination, basePath string) (*userBackend, error) {
+	b := &userBackend{fallback: fallback, users: make(map[string]UploadBackend)}
+	for _, d := range destinations {
+		if _, ok := b.users[d.User]; ok {
+			continue
+		}
+		backend, err := newUploadBackend(ctx, name, d.URL, d.auth, "", basePath)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", d.User, err)
+		}
+		b.users[d.User] = backend
+	}
+	return b, nil
+}
+
+// route returns the backend p belongs to and p relative to that backend's root.
+func (b *userBackend) route(p string) (UploadBackend, string) {
+	first, rest, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	if user, ok := strings.CutPrefix(first, userPrefix); ok {
+		if backend, ok := b.users[user]; ok {
+			return backend, rest
+		}
+	}
+	return b.fallback, p
+}
+
+func (b *userBackend) EnsureDir(ctx context.Context, dir string) error {
+	backend, dir := b.route(dir)
+	if strings.Trim(dir, "/") == "" {
+		// The user's root, which the backend already created
+		return nil
+	}
+	return backend.EnsureDir(ctx, dir)
+}
+
+func (b *userBackend) Upload(ctx context.Context, p string, r io.Reader, opts UploadOptions) error {
+	backend, p := b.route(p)
+	return backend.Upload(ctx, p, r, opts)
+}
+
+func (b *userBackend) Exists(ctx context.Context, p string) (bool, error) {
+	backend, p := b.route(p)
+	return backend.Exists(ctx, p)
+}
+
+func (b *userBackend) Size(ctx context.Context, p string) (int64, error) {
+	backend, p := b.route(p)
+	return backend.Size(ctx, p)
+}
+
+func (b *userBackend) Copy(ctx context.Context, src, dst string) error {
+	srcBackend, src := b.route(src)
+	dstBackend, dst := b.route(dst)
+	copier, ok := srcBackend.(remoteCopier)
+	if !ok {
+		return errors.New("the upload backend can't copy files")
+	}
+	if srcBackend != dstBackend {
+		return errors.New("can't copy files between the accounts of two users")
+	}
+	return copier.Copy(ctx, src, dst)
+}
+
+func (b *userBackend) PartialSize(ctx context.Context, p string, size int64) int64 {
+	backend, p := b.route(p)
+	if partial, ok := backend.(partialUploader); ok {
+		return partial.PartialSize(ctx, p, size)
+	}
+	return 0
+}
+
+func (b *userBackend) ListDir(ctx context.Context, dir string) (map[string]int64, error) {
+	backend, dir := b.route(dir)
+	lister, ok := backend.(dirLister)
+	if !ok {
+		return nil, errors.New("the upload backend can't list folders")
+	}
+	return lister.ListDir(ctx, dir)
+}
+
+func (b *userBackend) Tag(ctx context.Context, p, tag string) error {
+	backend, p := b.route(p)
+	tagger, ok := backend.(fileTagger)
+	if !ok {
+		return errors.New("the upload backend can't tag files")
+	}
+	return tagger.Tag(ctx, p, tag)
+}
+
+func (b *userBackend) ModTime(ctx context.Context, p string) (time.Time, bool, error) {
+	backend, p := b.route(p)
+	setter, ok := backend.(modTimeSetter)
+	if !ok {
+		return time.Time{}, false, errors.New("the upload backend can't change modification times")
+	}
+	return setter.ModTime(ctx, p)
+}
+
+func (b *userBackend) SetModTime(ctx context.Context, p string, modTime time.Time) error {
+	backend, p := b.route(p)
+	setter, ok := backend.(modTimeSetter)
+	if !ok {
+		return errors.New("the upload backend can't change modification times")
+	}
+	return setter.SetModTime(ctx, p, modTime)
+}
+
+func (b *userBackend) PruneEmptyDirs(ctx context.Context) (int, error) {
+	total := 0
+	var errs []error
+	for _, backend := range append([]UploadBackend{b.fallback}, slices.Collect(maps.Values(b.users))...) {
+		if pruner, ok := backend.(dirPruner); ok {
+			n, err := pruner.PruneEmptyDirs(ctx)
+			total += n
+			errs = append(errs, err)
+		}
+	}
+	return total, errors.Join(errs...)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const propfindContentLengthBody = `<?xml version="1.0" encoding="UTF-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:getcontentlength/>
+  </d:prop>
+</d:propfind>`
+
+// davMultistatus is the subset of a WebDAV PROPFIND multistatus response we read.
+type davMultistatus struct {
+	Responses []davResponse `xml:"response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"href"`
+	Propstat []davPropstat `xml:"propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"prop"`
+	Status string  `xml:"status"`
+}
+
+type davProp struct {
+	ContentLength  string `xml:"getcontentlength"`
+	LastModified   string `xml:"getlastmodified"`
+	QuotaAvailable string `xml:"quota-available-bytes"`
+	FileID         string `xml:"http://owncloud.org/ns fileid"`
+	TagID          string `xml:"http://owncloud.org/ns id"`
+	DisplayName    string `xml:"http://owncloud.org/ns display-name"`
+}
+
+// remoteFileSize asks Nextcloud for the size of the file at url using a Depth 0 PROPFIND.
+func remoteFileSize(client *http.Client, url string, auth Authenticator) (int64, error) {
+	req, err := http.NewRequest("PROPFIND", url, strings.NewReader(propfindContentLengthBody))
+	if err != nil {
+		return 0, err
+	}
+	auth.Authenticate(req)
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := doRequest(client, req, webdavRetryPolicy)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return 0, fmt.Errorf("PROPFIND %s returned %s", url, resp.Status)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return 0, fmt.Errorf("failed to decode PROPFIND response for %s: %v", url, err)
+	}
+
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.ContentLength != "" {
+				return strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("PROPFIND %s did not report a content length", url)
+}
+
+// verifyUpload checks that the copy of fileLocation uploaded to targetPath exists with the same size.
+func verifyUpload(ctx context.Context, fileLocation, targetPath string, backend UploadBackend) error {
+	info, err := statMedia(fileLocation)
+	if err != nil {
+		return err
+	}
+
+	size, err := backend.Size(ctx, targetPath)
+	if err != nil {
+		return err
+	}
+
+	if size != info.Size() {
+		return fmt.Errorf("remote size %d does not match local size %d for %s", size, info.Size(), fileLocation)
+	}
+
+	return nil
+}
+
+// uploadTargets records the remote path each media file uploaded by this run went to, which
+// differs from its default path when ON_CONFLICT=rename picked a new name.
+var (
+	uploadTargets   = make(map[string]string)
+	uploadTargetsMu sync.Mutex
+)
+
+// recordUploadTarget remembers that the media file at localPath was uploaded to targetPath.
+func recordUploadTarget(localPath, targetPath string) {
+	uploadTargetsMu.Lock()
+	defer uploadTargetsMu.Unlock()
+	uploadTargets[localPath] = targetPath
+}
+
+// expectedRemotePath returns where media should be found remotely and whether its remote
+// size should match the local one, which isn't the case for HEIC files uploaded as JPEG or
+// files uploaded without their GPS metadata.
+func expectedRemotePath(media MediaFile) (string, bool) {
+	uploadTargetsMu.Lock()
+	targetPath, uploaded := uploadTargets[media.Path]
+	uploadTargetsMu.Unlock()
+	if uploaded {
+		return targetPath, true
+	}
+
+	name := filepath.Base(media.Path)
+	if convertHEIC && heicConverter != nil && isHEIC(media.Path) && !isArchiveEntry(media.Path) && !heicKeepOriginal {
+		return destinationPath(media.Ts, strings.TrimSuffix(name, filepath.Ext(name))+".jpg"), false
+	}
+	return destinationPath(media.Ts, name), !stripGeodata
+}
+
+// sweepResult is the outcome of checking one media file in the VERIFY_ALL sweep. A zero
+// status means the file was found as expected.
+type sweepResult struct {
+	Media  MediaFile
+	Status string
+	Err    error
+}
+
+// checkRemoteCopy reports whether media is present remotely with the local size.
+func checkRemoteCopy(ctx context.Context, backend UploadBackend, media MediaFile) sweepResult {
+	targetPath, compareSize := expectedRemotePath(media)
+	exists, err := backend.Exists(ctx, targetPath)
+	if err != nil {
+		return sweepResult{media, statusMissingRemotely, err}
+	}
+	if !exists {
+		return sweepResult{media, statusMissingRemotely, fmt.Errorf("%s not found remotely", targetPath)}
+	}
+
+	// Files deleted by DELETE_AFTER_UPLOAD can only be checked for existence
+	info, err := statMedia(media.Path)
+	if !compareSize || err != nil {
+		return sweepResult{Media: media}
+	}
+	size, err := backend.Size(ctx, targetPath)
+	if err != nil {
+		return sweepResult{media, statusSizeMismatch, err}
+	}
+	if size != info.Size() {
+		return sweepResult{media, statusSizeMismatch, fmt.Errorf("remote size %d does not match local size %d", size, info.Size())}
+	}
+	return sweepResult{Media: media}
+}
+
+// sweepRemoteCopies checks every planned upload against the remote side once the run ended,
+// which catches files that were skipped or lost without an upload error. Discrepancies are
+// written to reportPath in the run report format, so RETRY_FROM can upload just those. It returns
+// the number of discrepancies.
+func sweepRemoteCopies(ctx context.Context, parallel int, backend UploadBackend, index *MediaIndex, mediaFiles []MediaFile, reportPath string) (int, error) {
+	slog.Info("Checking that every file is present remotely", "files", len(mediaFiles))
+
+	jobs := make(chan MediaFile, len(mediaFiles))
+	results := make(chan sweepResult, parallel)
+	var wg sync.WaitGroup
+	for range parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for media := range jobs {
+				results <- checkRemoteCopy(ctx, backend, media)
+			}
+		}()
+	}
+	for _, media := range mediaFiles {
+		jobs <- media
+	}
+	close(jobs)
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	discrepancies := make(map[string]sweepResult)
+	for result := range results {
+		if result.Status == "" {
+			continue
+		}
+		slog.Warn("Local file is not present remotely as expected", "file", result.Media.Path, "status", result.Status, "error", result.Err)
+		discrepancies[result.Media.Path] = result
+	}
+
+	file, err := os.Create(reportPath)
+	if err != nil {
+		return len(discrepancies), fmt.Errorf("failed to create verification report %s: %v", reportPath, err)
+	}
+	defer file.Close()
+
+	// Keep the order of mediaFiles so the report is stable between runs
+	w := csv.NewWriter(file)
+	_ = w.Write(reportHeader)
+	for _, media := range mediaFiles {
+		result, found := discrepancies[media.Path]
+		if !found {
+			continue
+		}
+		_ = w.Write([]string{media.Path, media.Ts, index.DateSource(media.Path), result.Status, result.Err.Error(), index.Discrepancy(media.Path)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return len(discrepancies), fmt.Errorf("failed to write verification report %s: %v", reportPath, err)
+	}
+	return len(discrepancies), file.Close()
+}
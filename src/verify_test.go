@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExpectedRemotePath(t *testing.T) {
+	oldStrip := stripGeodata
+	t.Cleanup(func() { stripGeodata = oldStrip })
+	stripGeodata = false
+
+	tests := []struct {
+		name     string
+		media    MediaFile
+		want     string
+		sameSize bool
+	}{
+		{"date folder", MediaFile{Path: "/takeout/IMG_0001.jpg", Ts: "2024/03"}, "2024/03/IMG_0001.jpg", true},
+		{"padded folder", MediaFile{Path: "/takeout/IMG_0002.jpg", Ts: "/2024//03/"}, "2024/03/IMG_0002.jpg", true},
+		{"root", MediaFile{Path: "/takeout/IMG_0003.jpg", Ts: ""}, "IMG_0003.jpg", true},
+		{"climbing folder", MediaFile{Path: "/takeout/IMG_0004.jpg", Ts: "../../2024"}, "2024/IMG_0004.jpg", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, sameSize := expectedRemotePath(tt.media)
+			if got != tt.want || sameSize != tt.sameSize {
+				t.Errorf("expectedRemotePath(%v) = %q, %v, want %q, %v", tt.media, got, sameSize, tt.want, tt.sameSize)
+			}
+		})
+	}
+
+	// A file renamed by ON_CONFLICT=rename is expected where it was uploaded to
+	renamed := MediaFile{Path: "/takeout/Trip/image.jpg", Ts: "2024/03"}
+	recordUploadTarget(renamed.Path, "2024/03/image (1).jpg")
+	t.Cleanup(func() {
+		uploadTargetsMu.Lock()
+		delete(uploadTargets, renamed.Path)
+		uploadTargetsMu.Unlock()
+	})
+	if got, _ := expectedRemotePath(renamed); got != "2024/03/image (1).jpg" {
+		t.Errorf("expectedRemotePath(%v) = %q, want the recorded upload target", renamed, got)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Sources ONLY_NEW_BY compares with the watermark of the last run.
+const (
+	onlyNewByMtime = "mtime"
+	onlyNewByDate  = "date"
+)
+
+var (
+	// onlyNew is ONLY_NEW: media files from before the last completed run recorded in
+	// STATE_FILE are skipped.
+	onlyNew bool
+	// onlyNewBy is ONLY_NEW_BY, whether a file's modification time or its resolved photo date
+	// is compared with the watermark.
+	onlyNewBy = onlyNewByMtime
+	// runStartedAt becomes the watermark once the run completed, so files added while it
+	// was running are picked up by the next one.
+	runStartedAt = time.Now()
+)
+
+// parseOnlyNewBy validates an ONLY_NEW_BY value.
+func parseOnlyNewBy(value string) (string, error) {
+	switch value {
+	case onlyNewByMtime, onlyNewByDate:
+		return value, nil
+	}
+	return "", fmt.Errorf("%q must be %s or %s", value, onlyNewByMtime, onlyNewByDate)
+}
+
+// lastRunWatermark returns the time the last completed run started, and false when ONLY_NEW
+// is off or no run completed yet.
+func lastRunWatermark() (time.Time, bool) {
+	if !onlyNew || state.LastRun.IsZero() {
+		return time.Time{}, false
+	}
+	return state.LastRun, true
+}
+
+// skipNotNewFile reports whether the walk skips a file for ONLY_NEW=true with ONLY_NEW_BY=mtime
+// as it was last modified before the last completed run. Sidecars are compared too, since
+// the media file they belong to is skipped along with them, album metadata is always kept.
+func skipNotNewFile(info os.FileInfo) bool {
+	watermark, ok := lastRunWatermark()
+	return ok && onlyNewBy == onlyNewByMtime && info.Name() != albumMetadataFileName && info.ModTime().Before(watermark)
+}
+
+// filterNotNew removes the media files dated before the last completed run from index for
+// ONLY_NEW=true with ONLY_NEW_BY=date, and returns how many were removed. Files dated by
+// their sidecar are compared by the sidecar's timestamp, others by their date folder's
+// month. Files without a known date are kept.
+func filterNotNew(index *MediaIndex) int {
+	watermark, ok := lastRunWatermark()
+	if !ok || onlyNewBy != onlyNewByDate {
+		return 0
+	}
+	watermarkFolder := watermark.In(dateLocation).Format("2006/01")
+
+	skipped := 0
+	index.Range(func(mediaPath, dateFolder string) bool {
+		if index.DateSource(mediaPath) == fallbackDateSource {
+			return true
+		}
+		old := dateFolder < watermarkFolder
+		if taken, ok := index.TakenTime(mediaPath); ok {
+			old = taken.Before(watermark)
+		}
+		if old {
+			slog.Debug("Skipping file dated before the last run", "file", mediaPath, "folder", dateFolder)
+			index.Delete(mediaPath)
+			skipped++
+		}
+		return true
+	})
+	return skipped
+}
+
+// recordRunWatermark stores the time this run started in STATE_FILE as the watermark for
+// ONLY_NEW. It is only called once every file was indexed and uploaded.
+func recordRunWatermark() {
+	if statePath == "" {
+		return
+	}
+	state.mu.Lock()
+	state.LastRun = runStartedAt
+	state.mu.Unlock()
+	if err := saveState(statePath); err != nil {
+		slog.Error("Failed to save state file", "error", err)
+	}
+}